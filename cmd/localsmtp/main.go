@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,10 +17,23 @@ import (
 
 	"github.io/razzkumar/localsmtp/internal/api"
 	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/blobstore"
+	"github.io/razzkumar/localsmtp/internal/certs"
 	"github.io/razzkumar/localsmtp/internal/config"
+	"github.io/razzkumar/localsmtp/internal/credentials"
+	"github.io/razzkumar/localsmtp/internal/extract"
+	"github.io/razzkumar/localsmtp/internal/faults"
+	"github.io/razzkumar/localsmtp/internal/imapserver"
+	"github.io/razzkumar/localsmtp/internal/ingest"
+	"github.io/razzkumar/localsmtp/internal/magic"
+	"github.io/razzkumar/localsmtp/internal/metrics"
+	"github.io/razzkumar/localsmtp/internal/pop3server"
+	"github.io/razzkumar/localsmtp/internal/retention"
+	"github.io/razzkumar/localsmtp/internal/routing"
 	"github.io/razzkumar/localsmtp/internal/smtpserver"
 	"github.io/razzkumar/localsmtp/internal/sse"
 	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/webhook"
 )
 
 func main() {
@@ -27,17 +42,56 @@ func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
 
 	ctx := context.Background()
-	db, err := store.Open(ctx, cfg.DBPath)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db, err := store.Open(ctx, cfg.DBPath, cfg.DBReadConns)
+		if err != nil {
+			logger.Error("open database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		if err := runMigrate(ctx, db, os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if strings.TrimSpace(cfg.DBPath) == "" {
+			fmt.Fprintln(os.Stderr, "token commands need DB_PATH; with an in-memory database use the /api/tokens endpoints")
+			os.Exit(1)
+		}
+		db, err := store.Open(ctx, cfg.DBPath, cfg.DBReadConns)
+		if err != nil {
+			logger.Error("open database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		if err := db.CheckSchema(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v; run \"localsmtp migrate up\"\n", err)
+			os.Exit(1)
+		}
+		if err := runToken(ctx, db, os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	blobDir, removeBlobDir, err := blobStoreDir(cfg)
 	if err != nil {
-		logger.Error("open database", "error", err)
+		logger.Error("blob store", "error", err)
 		os.Exit(1)
 	}
-	defer db.Close()
+	defer removeBlobDir()
+	cfg.BlobStoreDir = blobDir
 
-	if err := db.EnsureSchema(ctx); err != nil {
-		logger.Error("ensure schema", "error", err)
+	storage, db, err := openStorage(ctx, cfg, logger)
+	if err != nil {
+		logger.Error("open storage", "error", err)
 		os.Exit(1)
 	}
+	defer storage.Close()
 
 	authManager, err := auth.New(cfg.AuthSecret, 30*24*time.Hour)
 	if err != nil {
@@ -48,22 +102,151 @@ func main() {
 		logger.Warn("AUTH_SECRET not set; sessions reset on restart")
 	}
 
+	faultsCfg, err := faults.LoadFile(cfg.FaultsFile)
+	if err != nil {
+		logger.Error("load faults", "error", err)
+		os.Exit(1)
+	}
+	injector, err := faults.New(faultsCfg)
+	if err != nil {
+		logger.Error("init faults", "error", err)
+		os.Exit(1)
+	}
+	if faultsCfg.Enabled {
+		logger.Warn("smtp fault injection enabled", "rules", len(faultsCfg.Rules))
+	}
+
+	var responder *magic.Responder
+	if cfg.MagicEnabled {
+		rules, err := magic.LoadFile(cfg.MagicFile)
+		if err != nil {
+			logger.Error("load magic addresses", "error", err)
+			os.Exit(1)
+		}
+		if responder, err = magic.New(rules); err != nil {
+			logger.Error("init magic addresses", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	aliases, err := routing.LoadFile(cfg.AliasesFile)
+	if err != nil {
+		logger.Error("load aliases", "error", err)
+		os.Exit(1)
+	}
+	router, err := routing.New(cfg.Subaddressing, aliases)
+	if err != nil {
+		logger.Error("init aliases", "error", err)
+		os.Exit(1)
+	}
+	if router.Enabled() {
+		logger.Info("recipient routing enabled", "subaddressing", cfg.Subaddressing, "aliases", len(aliases))
+	}
+
+	// Patterns are separated by whitespace, which URLs cannot contain.
+	extractor, err := extract.New(strings.Fields(cfg.MagicLinkPatterns))
+	if err != nil {
+		logger.Error("init link extraction", "error", err)
+		os.Exit(1)
+	}
+
 	hub := sse.NewHub()
-	apiServer := api.NewServer(cfg, db, authManager, hub, logger)
+	collector := metrics.New()
+
+	hooks, err := webhook.LoadFile(cfg.WebhooksFile)
+	if err != nil {
+		logger.Error("load webhooks", "error", err)
+		os.Exit(1)
+	}
+	var webhooks *webhook.Dispatcher
+	if len(hooks) > 0 {
+		if db == nil {
+			logger.Warn("webhooks ignored; the delivery queue needs the sqlite backend")
+		} else if webhooks, err = webhook.New(db, hooks, webhook.Config{
+			MaxAttempts:  cfg.WebhookMaxAttempts,
+			Timeout:      cfg.WebhookTimeout,
+			LogRetention: cfg.WebhookLogRetention,
+		}, collector, logger); err != nil {
+			logger.Error("init webhooks", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	smtpCredentials, err := loadSMTPCredentials(cfg, storage)
+	if err != nil {
+		logger.Error("load smtp credentials", "error", err)
+		os.Exit(1)
+	}
+
+	apiServer := api.NewServer(cfg, storage, authManager, hub, injector, webhooks, extractor, smtpCredentials, collector, logger)
 
 	smtpAuthCfg := smtpserver.AuthConfig{
-		Enabled:  cfg.SMTPAuthEnabled,
-		Username: cfg.SMTPUsername,
-		Password: cfg.SMTPPassword,
+		Enabled:     cfg.SMTPAuthEnabled,
+		Credentials: smtpCredentials,
 	}
 	if smtpAuthCfg.Enabled {
-		logger.Info("smtp auth enabled", "username", smtpAuthCfg.Username, "password", smtpAuthCfg.Password)
+		usernames := make([]string, 0, len(smtpCredentials.Static()))
+		for _, credential := range smtpCredentials.Static() {
+			usernames = append(usernames, credential.Username)
+		}
+		logger.Info("smtp auth enabled", "usernames", usernames)
 	} else {
 		logger.Warn("smtp auth disabled; server accepts unauthenticated connections")
 	}
 
+	smtpTLSCfg := smtpserver.TLSConfig{}
+	if cfg.SMTPTLSEnabled || cfg.SMTPSPort > 0 {
+		tlsConfig, err := certs.Load(cfg.TLSCertFile, cfg.TLSKeyFile, tlsCacheDir(cfg))
+		if err != nil {
+			logger.Error("load tls certificate", "error", err)
+			os.Exit(1)
+		}
+		smtpTLSCfg.Config = tlsConfig
+		if cfg.SMTPSPort > 0 {
+			smtpTLSCfg.ImplicitAddr = fmt.Sprintf(":%d", cfg.SMTPSPort)
+		}
+	}
+
 	smtpAddr := fmt.Sprintf(":%d", cfg.SMTPPort)
-	smtpSrv := smtpserver.New(db, hub, logger, smtpAddr, smtpAuthCfg)
+	smtpSpoolCfg := smtpserver.SpoolConfig{
+		Threshold: int64(cfg.SMTPSpoolKB) << 10,
+		Dir:       cfg.SMTPSpoolDir,
+	}
+	switch ingest.Backpressure(cfg.IngestBackpressure) {
+	case ingest.BackpressureBlock, ingest.BackpressureReject:
+	default:
+		logger.Error("unknown INGEST_BACKPRESSURE; use block or reject", "value", cfg.IngestBackpressure)
+		os.Exit(1)
+	}
+	queue := ingest.New(storage, ingest.Config{
+		QueueSize:    cfg.IngestQueueSize,
+		MaxBatch:     cfg.IngestMaxBatch,
+		BatchWait:    cfg.IngestBatchWait,
+		Backpressure: ingest.Backpressure(cfg.IngestBackpressure),
+		BlockTimeout: cfg.IngestBlockTimeout,
+	}, collector, logger)
+	smtpSrv := smtpserver.New(storage, queue, hub, logger, smtpAddr, smtpAuthCfg, smtpTLSCfg, smtpSpoolCfg, injector, responder, router, webhooks, collector)
+	apiServer.AddReadinessCheck("smtp", func(context.Context) error {
+		return smtpSrv.Ready()
+	})
+
+	var imapSrv *imapserver.Server
+	if cfg.IMAPPort > 0 {
+		imapAuthCfg := imapserver.AuthConfig{
+			Enabled:     cfg.IMAPAuthEnabled,
+			Credentials: smtpCredentials,
+		}
+		imapSrv = imapserver.New(storage, logger, fmt.Sprintf(":%d", cfg.IMAPPort), imapAuthCfg, smtpTLSCfg.Config, webhooks)
+	}
+
+	var pop3Srv *pop3server.Server
+	if cfg.POP3Port > 0 {
+		pop3AuthCfg := pop3server.AuthConfig{
+			Enabled:     cfg.POP3AuthEnabled,
+			Credentials: smtpCredentials,
+		}
+		pop3Srv = pop3server.New(storage, logger, fmt.Sprintf(":%d", cfg.POP3Port), pop3AuthCfg, smtpTLSCfg.Config, webhooks)
+	}
 
 	httpAddr := fmt.Sprintf(":%d", cfg.HTTPPort)
 	httpSrv := &http.Server{
@@ -77,6 +260,28 @@ func main() {
 		}
 	}()
 
+	go func() {
+		if err := smtpSrv.ListenAndServeTLS(); err != nil {
+			logger.Error("smtps server stopped", "error", err)
+		}
+	}()
+
+	if imapSrv != nil {
+		go func() {
+			if err := imapSrv.ListenAndServe(); err != nil {
+				logger.Error("imap server stopped", "error", err)
+			}
+		}()
+	}
+
+	if pop3Srv != nil {
+		go func() {
+			if err := pop3Srv.ListenAndServe(); err != nil {
+				logger.Error("pop3 server stopped", "error", err)
+			}
+		}()
+	}
+
 	go func() {
 		logger.Info("http server listening", "addr", httpAddr)
 		if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -84,9 +289,39 @@ func main() {
 		}
 	}()
 
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	policy := retention.Policy{
+		MaxAge:        cfg.RetentionMaxAge,
+		MaxMessages:   cfg.RetentionMaxMessages,
+		MaxPerMailbox: cfg.RetentionMaxPerMailbox,
+		MaxDBBytes:    int64(cfg.RetentionMaxDBSizeMB) << 20,
+		Interval:      cfg.RetentionInterval,
+		BatchSize:     cfg.RetentionBatchSize,
+		CollectBlobs:  db != nil && cfg.BlobStoreDir != "",
+	}
+	if policy.Enabled() {
+		if db != nil {
+			if incremental, err := db.IncrementalVacuumEnabled(ctx); err == nil && !incremental {
+				logger.Warn("retention cannot shrink the database file until \"localsmtp migrate vacuum\" is run")
+			}
+			go retention.New(db, hub, webhooks, policy, collector, logger).Run(janitorCtx)
+		} else {
+			logger.Warn("retention limits ignored; the memory backend is bounded by MEMORY_MAX_MESSAGES")
+		}
+	}
+
+	webhookCtx, stopWebhooks := context.WithCancel(context.Background())
+	defer stopWebhooks()
+	if webhooks != nil {
+		go webhooks.Run(webhookCtx)
+	}
+
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 	<-shutdown
+	stopJanitor()
+	stopWebhooks()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -97,4 +332,114 @@ func main() {
 	if err := smtpSrv.Close(); err != nil {
 		logger.Error("shutdown smtp", "error", err)
 	}
+	queue.Close()
+	if imapSrv != nil {
+		if err := imapSrv.Close(); err != nil {
+			logger.Error("shutdown imap", "error", err)
+		}
+	}
+	if pop3Srv != nil {
+		if err := pop3Srv.Close(); err != nil {
+			logger.Error("shutdown pop3", "error", err)
+		}
+	}
+}
+
+// openStorage returns the configured backend. db is only set for SQLite,
+// which also owns migrations and retention.
+func openStorage(ctx context.Context, cfg config.Config, logger *slog.Logger) (storage store.Storage, db *store.Store, err error) {
+	switch cfg.StorageBackend {
+	case "memory":
+		logger.Info("using in-memory storage; mail is lost on restart", "maxMessages", cfg.MemoryMaxMessages)
+		return store.NewMemory(cfg.MemoryMaxMessages), nil, nil
+	case "sqlite":
+	default:
+		return nil, nil, fmt.Errorf("unknown STORAGE_BACKEND %q", cfg.StorageBackend)
+	}
+
+	db, err = store.Open(ctx, cfg.DBPath, cfg.DBReadConns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.MigrateOnStart {
+		applied, err := db.Migrate(ctx)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		if applied > 0 {
+			logger.Info("database migrated", "applied", applied, "version", store.LatestSchemaVersion())
+		}
+	} else if err := db.CheckSchema(ctx); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("%w; run \"localsmtp migrate up\"", err)
+	}
+	if cfg.BlobStoreDir != "" {
+		blobs, err := blobstore.Open(cfg.BlobStoreDir, blobstore.Compression(cfg.BlobCompression))
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		db.SetBlobStore(blobs)
+		logger.Info("storing message data in blob store", "dir", cfg.BlobStoreDir, "compression", cfg.BlobCompression)
+	}
+	return db, db, nil
+}
+
+// loadSMTPCredentials reads SMTP_CREDENTIALS_FILE. Without one, the single
+// SMTP_USERNAME and SMTP_PASSWORD pair is the configured credential.
+func loadSMTPCredentials(cfg config.Config, storage store.Storage) (*credentials.Set, error) {
+	static, err := credentials.LoadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CredentialsFile == "" {
+		hash, err := credentials.Hash(cfg.SMTPPassword)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_PASSWORD: %w", err)
+		}
+		static = []store.SMTPCredential{{Username: cfg.SMTPUsername, PasswordHash: hash}}
+	}
+	return credentials.NewSet(storage, static)
+}
+
+// tlsCacheDir keeps generated certificates next to a file-backed database so
+// they survive restarts; in-memory setups get a fresh certificate each run.
+func tlsCacheDir(cfg config.Config) string {
+	if cfg.TLSCacheDir != "" {
+		return cfg.TLSCacheDir
+	}
+	return databaseDir(cfg)
+}
+
+// blobStoreDir resolves BLOB_STORE_DIR for SQLite. By default blobs live next
+// to a file-backed database, or in a temporary directory removed on exit for
+// an in-memory one, so no message is ever held in memory whole; "none" keeps
+// raw messages and attachments in SQLite.
+func blobStoreDir(cfg config.Config) (dir string, cleanup func(), err error) {
+	cleanup = func() {}
+	switch {
+	case cfg.StorageBackend != "sqlite" || strings.EqualFold(cfg.BlobStoreDir, "none"):
+		return "", cleanup, nil
+	case cfg.BlobStoreDir != "":
+		return cfg.BlobStoreDir, cleanup, nil
+	}
+	if dir := databaseDir(cfg); dir != "" {
+		return filepath.Join(dir, "blobs"), cleanup, nil
+	}
+	dir, err = os.MkdirTemp(cfg.SMTPSpoolDir, "localsmtp-blobs-*")
+	if err != nil {
+		return "", cleanup, fmt.Errorf("create blob directory: %w", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }, nil
+}
+
+// databaseDir is the directory of a file-backed database, or empty for an
+// in-memory one.
+func databaseDir(cfg config.Config) string {
+	dbPath := strings.TrimSpace(cfg.DBPath)
+	if dbPath == "" || strings.HasPrefix(dbPath, "file:") || strings.Contains(dbPath, ":memory:") {
+		return ""
+	}
+	return filepath.Dir(dbPath)
 }
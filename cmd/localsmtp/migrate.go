@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+const migrateUsage = "usage: localsmtp migrate [status|up|vacuum]"
+
+// runMigrate implements "localsmtp migrate": "status" lists migrations, "up"
+// applies the pending ones and "vacuum" converts a database created before
+// incremental vacuum so retention can shrink the file.
+func runMigrate(ctx context.Context, db *store.Store, args []string, out io.Writer) error {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "status":
+		return printMigrationStatus(ctx, db, out)
+	case "up":
+		applied, err := db.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "applied %d migrations, schema is at version %d\n", applied, store.LatestSchemaVersion())
+		return nil
+	case "vacuum":
+		if err := db.EnableIncrementalVacuum(ctx); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "incremental vacuum enabled")
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q; %s", command, migrateUsage)
+	}
+}
+
+func printMigrationStatus(ctx context.Context, db *store.Store, out io.Writer) error {
+	current, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	incremental, err := db.IncrementalVacuumEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "schema version %d of %d\n", current, store.LatestSchemaVersion())
+	if !incremental {
+		fmt.Fprintln(out, "incremental vacuum is off; run \"localsmtp migrate vacuum\" so retention can shrink the file")
+	}
+	fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, migration := range status {
+		applied := "pending"
+		if migration.Applied() {
+			applied = migration.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", migration.Version, migration.Name, applied)
+	}
+	return w.Flush()
+}
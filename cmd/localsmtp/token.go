@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+const tokenUsage = `usage: localsmtp token list
+       localsmtp token create <name> [-admin] [-mailbox <email>]...
+       localsmtp token revoke <name>`
+
+// runToken implements "localsmtp token", which manages API tokens in the
+// SQLite database directly, for instance to create the first admin token.
+func runToken(ctx context.Context, db *store.Store, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(tokenUsage)
+	}
+	switch args[0] {
+	case "list":
+		return printTokens(ctx, db, out)
+	case "create":
+		return createToken(ctx, db, args[1:], out)
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(tokenUsage)
+		}
+		deleted, err := db.DeleteAPIToken(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("no token named %q", args[1])
+		}
+		fmt.Fprintf(out, "revoked token %s\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown token command %q\n%s", args[0], tokenUsage)
+	}
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func createToken(ctx context.Context, db *store.Store, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("token create", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	admin := flags.Bool("admin", false, "allow access to every mailbox")
+	var mailboxes stringList
+	flags.Var(&mailboxes, "mailbox", "mailbox the token may read; repeatable")
+	// Accept the name before or after the flags.
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w\n%s", err, tokenUsage)
+	}
+	if name == "" && flags.NArg() == 1 {
+		name = flags.Arg(0)
+	} else if flags.NArg() > 0 {
+		return errors.New(tokenUsage)
+	}
+	if name == "" {
+		return errors.New(tokenUsage)
+	}
+	if err := auth.ValidateTokenName(name); err != nil {
+		return err
+	}
+	if !*admin && len(mailboxes) == 0 {
+		return errors.New("a token needs -admin or at least one -mailbox")
+	}
+
+	token := store.APIToken{Name: name, Admin: *admin, CreatedAt: time.Now()}
+	for _, mailbox := range mailboxes {
+		normalized, err := auth.NormalizeEmail(mailbox)
+		if err != nil {
+			return fmt.Errorf("mailbox %q: %w", mailbox, err)
+		}
+		token.Mailboxes = append(token.Mailboxes, normalized)
+	}
+	secret, err := auth.GenerateToken()
+	if err != nil {
+		return err
+	}
+	token.Hash = auth.HashToken(secret)
+	token.Prefix = auth.DisplayPrefix(secret)
+	if _, err := db.CreateAPIToken(ctx, token); err != nil {
+		if errors.Is(err, store.ErrTokenExists) {
+			return fmt.Errorf("a token named %q exists", name)
+		}
+		return err
+	}
+	// The secret is not stored, so this is the only chance to copy it.
+	fmt.Fprintln(out, secret)
+	return nil
+}
+
+func printTokens(ctx context.Context, db *store.Store, out io.Writer) error {
+	tokens, err := db.ListAPITokens(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPREFIX\tACCESS\tCREATED\tLAST USED")
+	for _, token := range tokens {
+		access := strings.Join(token.Mailboxes, ",")
+		if token.Admin {
+			access = "admin"
+		}
+		lastUsed := "never"
+		if !token.LastUsedAt.IsZero() {
+			lastUsed = token.LastUsedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s…\t%s\t%s\t%s\n", token.Name, token.Prefix, access, token.CreatedAt.Format(time.RFC3339), lastUsed)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/sse"
+)
+
+// parseAdmins splits ADMIN_EMAILS. "*" lets any mailbox log in as an admin
+// with ADMIN_SECRET.
+func parseAdmins(value string) []string {
+	var admins []string
+	for _, email := range strings.Split(value, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			admins = append(admins, email)
+		}
+	}
+	return admins
+}
+
+// isAdmin reports whether a login for emails that presented secret gets an
+// admin session. ADMIN_EMAILS alone grants nothing, since logins have no
+// password: without ADMIN_SECRET only admin API tokens are admins.
+func (s *Server) isAdmin(emails []string, secret string) bool {
+	if s.adminSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.adminSecret)) != 1 {
+		return false
+	}
+	for _, admin := range s.admins {
+		if admin == "*" || slices.Contains(emails, admin) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin authenticates r as an admin, answering 401 or 403 otherwise.
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	caller, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return principal{}, false
+	}
+	if !caller.admin {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return principal{}, false
+	}
+	return caller, true
+}
+
+// ownsMailbox reports whether email is one of the caller's own mailboxes
+// rather than one an admin is looking into.
+func (s *Server) ownsMailbox(r *http.Request, email string) bool {
+	caller, err := s.authenticate(r)
+	return err == nil && slices.Contains(caller.emails, email)
+}
+
+type mailboxSummary struct {
+	Email         string `json:"email"`
+	Messages      int32  `json:"messages"`
+	Unread        int32  `json:"unread"`
+	LastMessageAt string `json:"lastMessageAt,omitempty"`
+	LastLoginAt   string `json:"lastLoginAt,omitempty"`
+}
+
+// handleAdminMailboxes lists every mailbox that logged in or received mail.
+func (s *Server) handleAdminMailboxes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	mailboxes, err := s.store.ListMailboxes(r.Context())
+	if err != nil {
+		http.Error(w, "unable to list mailboxes", http.StatusInternalServerError)
+		return
+	}
+	summaries := make([]mailboxSummary, 0, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		summary := mailboxSummary{Email: mailbox.Email, Messages: mailbox.Messages, Unread: mailbox.Unread}
+		if !mailbox.LastMessageAt.IsZero() {
+			summary.LastMessageAt = mailbox.LastMessageAt.UTC().Format(time.RFC3339)
+		}
+		if !mailbox.LastLogin.IsZero() {
+			summary.LastLoginAt = mailbox.LastLogin.UTC().Format(time.RFC3339)
+		}
+		summaries = append(summaries, summary)
+	}
+	s.respondJSON(w, http.StatusOK, map[string]any{"mailboxes": summaries})
+}
+
+// handleAdminMessages purges every message, or with the mailbox parameter
+// every message that mailbox sent or received. The global list is
+// /api/messages?box=all.
+func (s *Server) handleAdminMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	mailbox := strings.TrimSpace(r.URL.Query().Get("mailbox"))
+	if mailbox != "" {
+		normalized, err := auth.NormalizeEmail(mailbox)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mailbox = normalized
+	}
+	events := s.webhooks.LookupPurge(r.Context(), mailbox)
+	removed, err := s.store.PurgeMessages(r.Context(), mailbox)
+	if removed > 0 {
+		s.hub.BroadcastAll(sse.PurgeEvent(mailbox, removed))
+	}
+	if err != nil {
+		s.logger.Error("purge messages", "mailbox", mailbox, "removed", removed, "error", err)
+		http.Error(w, "unable to purge messages", http.StatusInternalServerError)
+		return
+	}
+	for _, event := range events {
+		s.webhooks.Publish(r.Context(), event)
+	}
+	s.logger.Info("purged messages", "mailbox", mailbox, "removed", removed)
+	s.respondJSON(w, http.StatusOK, map[string]any{"deleted": removed})
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/credentials"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+type credentialSummary struct {
+	Username       string   `json:"username"`
+	AllowedSenders []string `json:"allowedSenders"`
+	RatePerHour    int      `json:"ratePerHour"`
+	Project        string   `json:"project,omitempty"`
+	// Source is "config" for credentials from the environment or
+	// SMTP_CREDENTIALS_FILE, which the API cannot change, and "api" otherwise.
+	Source    string `json:"source"`
+	CreatedAt string `json:"createdAt,omitempty"`
+}
+
+func toCredentialSummary(credential store.SMTPCredential, source string) credentialSummary {
+	summary := credentialSummary{
+		Username:       credential.Username,
+		AllowedSenders: credential.AllowedSenders,
+		RatePerHour:    credential.RatePerHour,
+		Project:        credential.Project,
+		Source:         source,
+	}
+	if summary.AllowedSenders == nil {
+		summary.AllowedSenders = []string{}
+	}
+	if !credential.CreatedAt.IsZero() {
+		summary.CreatedAt = credential.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	return summary
+}
+
+// handleSMTPCredentials lists SMTP credentials on GET and creates one on
+// POST. Password hashes are never returned.
+func (s *Server) handleSMTPCredentials(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		stored, err := s.store.ListSMTPCredentials(r.Context())
+		if err != nil {
+			http.Error(w, "unable to load credentials", http.StatusInternalServerError)
+			return
+		}
+		summaries := make([]credentialSummary, 0, len(stored)+1)
+		for _, credential := range s.credentials.Static() {
+			summaries = append(summaries, toCredentialSummary(credential, "config"))
+		}
+		for _, credential := range stored {
+			if !s.credentials.IsStatic(credential.Username) {
+				summaries = append(summaries, toCredentialSummary(credential, "api"))
+			}
+		}
+		s.respondJSON(w, http.StatusOK, map[string]any{"credentials": summaries})
+	case http.MethodPost:
+		s.handleCreateSMTPCredential(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleCreateSMTPCredential(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Username       string   `json:"username"`
+		Password       string   `json:"password"`
+		AllowedSenders []string `json:"allowedSenders"`
+		RatePerHour    int      `json:"ratePerHour"`
+		Project        string   `json:"project"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	hash, err := credentials.Hash(payload.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	credential, err := credentials.Validate(store.SMTPCredential{
+		Username:       strings.TrimSpace(payload.Username),
+		PasswordHash:   hash,
+		AllowedSenders: payload.AllowedSenders,
+		RatePerHour:    payload.RatePerHour,
+		Project:        payload.Project,
+		CreatedAt:      time.Now(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.credentials.IsStatic(credential.Username) {
+		http.Error(w, "a credential with that username exists", http.StatusConflict)
+		return
+	}
+	credential, err = s.store.CreateSMTPCredential(r.Context(), credential)
+	if errors.Is(err, store.ErrCredentialExists) {
+		http.Error(w, "a credential with that username exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "unable to create credential", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("smtp credential created", "username", credential.Username, "project", credential.Project)
+	s.respondJSON(w, http.StatusCreated, toCredentialSummary(credential, "api"))
+}
+
+// handleSMTPCredential deletes the API-managed credential named in the path.
+func (s *Server) handleSMTPCredential(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	username := strings.TrimPrefix(r.URL.Path, "/api/admin/smtp-credentials/")
+	if s.credentials.IsStatic(username) {
+		http.Error(w, "configured credentials cannot be deleted", http.StatusConflict)
+		return
+	}
+	deleted, err := s.store.DeleteSMTPCredential(r.Context(), username)
+	if err != nil {
+		http.Error(w, "unable to delete credential", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Info("smtp credential deleted", "username", username)
+	w.WriteHeader(http.StatusNoContent)
+}
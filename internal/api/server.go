@@ -3,7 +3,6 @@ package api
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,45 +12,77 @@ import (
 	"net/http"
 	"net/smtp"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.io/razzkumar/localsmtp/internal/auth"
 	"github.io/razzkumar/localsmtp/internal/config"
+	"github.io/razzkumar/localsmtp/internal/credentials"
+	"github.io/razzkumar/localsmtp/internal/extract"
+	"github.io/razzkumar/localsmtp/internal/faults"
+	"github.io/razzkumar/localsmtp/internal/metrics"
 	"github.io/razzkumar/localsmtp/internal/pagination"
+	"github.io/razzkumar/localsmtp/internal/routing"
+	"github.io/razzkumar/localsmtp/internal/search"
 	"github.io/razzkumar/localsmtp/internal/sse"
 	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/webhook"
 	webassets "github.io/razzkumar/localsmtp/web"
 )
 
 type Server struct {
 	cfg      config.Config
-	store    *store.Store
+	store    store.Storage
 	auth     *auth.Manager
 	hub      *sse.Hub
-	logger   *slog.Logger
-	smtpAddr string
-	mux      *http.ServeMux
-	staticFS fs.FS
-	staticOK bool
+	faults   *faults.Injector
+	webhooks *webhook.Dispatcher
+	extract  *extract.Extractor
+	// credentials are the SMTP logins, for the credential endpoints.
+	credentials *credentials.Set
+	admins      []string
+	adminSecret string
+	metrics     *metrics.Metrics
+	logger      *slog.Logger
+	smtpAddr    string
+	mux         *http.ServeMux
+	staticFS    fs.FS
+	staticOK    bool
+	checks      []readinessCheck
 }
 
-func NewServer(cfg config.Config, store *store.Store, authManager *auth.Manager, hub *sse.Hub, logger *slog.Logger) *Server {
+type readinessCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+func NewServer(cfg config.Config, store store.Storage, authManager *auth.Manager, hub *sse.Hub, injector *faults.Injector, webhooks *webhook.Dispatcher, extractor *extract.Extractor, smtpCredentials *credentials.Set, m *metrics.Metrics, logger *slog.Logger) *Server {
 	staticFS, err := webassets.Dist()
 	staticOK := err == nil
 	if err != nil {
 		logger.Warn("ui assets not embedded", "error", err)
 	}
+	if cfg.AdminEmails != "" && cfg.AdminSecret == "" {
+		logger.Warn("ADMIN_EMAILS has no effect without ADMIN_SECRET")
+	}
 	server := &Server{
-		cfg:      cfg,
-		store:    store,
-		auth:     authManager,
-		hub:      hub,
-		logger:   logger,
-		smtpAddr: fmt.Sprintf("127.0.0.1:%d", cfg.SMTPPort),
-		staticFS: staticFS,
-		staticOK: staticOK,
+		cfg:         cfg,
+		store:       store,
+		auth:        authManager,
+		hub:         hub,
+		faults:      injector,
+		webhooks:    webhooks,
+		extract:     extractor,
+		credentials: smtpCredentials,
+		admins:      parseAdmins(cfg.AdminEmails),
+		adminSecret: cfg.AdminSecret,
+		metrics:     m,
+		logger:      logger,
+		smtpAddr:    fmt.Sprintf("127.0.0.1:%d", cfg.SMTPPort),
+		staticFS:    staticFS,
+		staticOK:    staticOK,
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/login", server.handleLogin)
@@ -60,22 +91,37 @@ func NewServer(cfg config.Config, store *store.Store, authManager *auth.Manager,
 	mux.HandleFunc("/api/accounts", server.handleAccounts)
 	mux.HandleFunc("/api/messages", server.handleMessages)
 	mux.HandleFunc("/api/messages/", server.handleMessage)
+	mux.HandleFunc("/api/messages/wait", server.handleWaitMessage)
 	mux.HandleFunc("/api/stream", server.handleStream)
 	mux.HandleFunc("/api/send", server.handleSend)
+	mux.HandleFunc("/api/admin/faults", server.handleFaults)
+	mux.HandleFunc("/api/webhooks", server.handleWebhooks)
+	mux.HandleFunc("/api/webhooks/deliveries", server.handleWebhookDeliveries)
+	mux.HandleFunc("/api/admin/mailboxes", server.handleAdminMailboxes)
+	mux.HandleFunc("/api/admin/messages", server.handleAdminMessages)
+	mux.HandleFunc("/api/admin/smtp-credentials", server.handleSMTPCredentials)
+	mux.HandleFunc("/api/admin/smtp-credentials/", server.handleSMTPCredential)
+	mux.HandleFunc("/api/tokens", server.handleTokens)
+	mux.HandleFunc("/api/tokens/", server.handleToken)
 	server.mux = mux
 	return server
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.route(recorder, r)
+	route := s.routeLabel(r)
+	s.metrics.HTTPRequests.Inc(route, r.Method, strconv.Itoa(recorder.status))
+	s.metrics.HTTPRequestDuration.Observe(time.Since(start), route)
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	if strings.HasPrefix(path, "/api/") {
 		s.mux.ServeHTTP(w, r)
 		return
 	}
-	if strings.HasPrefix(path, "/webhooks") {
-		http.NotFound(w, r)
-		return
-	}
 	if path == "/health" {
 		s.handleHealth(w, r)
 		return
@@ -92,6 +138,52 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.serveStatic(w, r)
 }
 
+// routeLabel keeps the metrics label set small: API requests use the mux
+// pattern and everything that falls through to the UI counts as "static".
+func (s *Server) routeLabel(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/api/"):
+		if _, pattern := s.mux.Handler(r); pattern != "" {
+			return pattern
+		}
+		return "/api/"
+	case path == "/health", path == "/ready", path == "/metrics":
+		return path
+	default:
+		return "static"
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func (s *Server) serveStatic(w http.ResponseWriter, r *http.Request) {
 	if !s.staticOK {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -159,6 +251,9 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	var payload struct {
 		Email string `json:"email"`
+		// AdminSecret makes the session an admin when it matches
+		// ADMIN_SECRET and the mailbox is one of ADMIN_EMAILS.
+		AdminSecret string `json:"adminSecret"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
@@ -171,23 +266,31 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	now := time.Now()
 	current := []string{}
+	admin := false
 	if cookie, err := r.Cookie(s.auth.CookieName()); err == nil {
-		if emails, err := s.auth.Parse(cookie.Value, now); err == nil {
-			current = emails
+		if emails, currentAdmin, err := s.auth.Parse(cookie.Value, now); err == nil {
+			current, admin = emails, currentAdmin
 		}
 	}
+	sessionEmails := uniqueEmails(append([]string{email}, current...))
+	if payload.AdminSecret != "" {
+		if !s.isAdmin(sessionEmails, payload.AdminSecret) {
+			http.Error(w, "invalid admin secret", http.StatusForbidden)
+			return
+		}
+		admin = true
+	}
 	if err := s.store.UpsertUser(r.Context(), email, now); err != nil {
 		http.Error(w, "unable to save user", http.StatusInternalServerError)
 		return
 	}
-	sessionEmails := uniqueEmails(append([]string{email}, current...))
-	token, err := s.auth.IssueEmails(sessionEmails, now)
+	token, err := s.auth.IssueEmails(sessionEmails, admin, now)
 	if err != nil {
 		http.Error(w, "unable to create session", http.StatusInternalServerError)
 		return
 	}
 	s.setSessionCookie(w, token, now)
-	s.respondJSON(w, http.StatusOK, map[string]any{"email": email, "emails": sessionEmails})
+	s.respondJSON(w, http.StatusOK, map[string]any{"email": email, "emails": sessionEmails, "admin": admin})
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
@@ -211,12 +314,24 @@ func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	emails, err := s.sessionEmails(r)
+	caller, err := s.authenticate(r)
 	if err != nil {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	s.respondJSON(w, http.StatusOK, map[string]any{"email": emails[0], "emails": emails})
+	emails, err := s.sessionEmails(r)
+	if err != nil && !caller.admin {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if emails == nil {
+		emails = []string{}
+	}
+	email := ""
+	if len(emails) > 0 {
+		email = emails[0]
+	}
+	s.respondJSON(w, http.StatusOK, map[string]any{"email": email, "emails": emails, "admin": caller.admin})
 }
 
 func (s *Server) handleAccounts(w http.ResponseWriter, r *http.Request) {
@@ -237,8 +352,9 @@ func (s *Server) handleAccounts(w http.ResponseWriter, r *http.Request) {
 	accounts := make([]map[string]any, 0, len(emails))
 	for _, email := range emails {
 		accounts = append(accounts, map[string]any{
-			"email":  email,
-			"unread": counts[email],
+			"email":     email,
+			"unread":    counts[email].Total,
+			"unreadBcc": counts[email].Bcc,
 		})
 	}
 	s.respondJSON(w, http.StatusOK, map[string]any{"accounts": accounts})
@@ -249,58 +365,89 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	email, err := s.sessionEmailForRequest(r)
-	if err != nil {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
 	box := r.URL.Query().Get("box")
 	if box == "" {
 		box = "inbox"
 	}
-	if box != "inbox" && box != "sent" {
+	var email string
+	switch box {
+	case "inbox", "sent":
+		var err error
+		if email, err = s.sessionEmailForRequest(r); err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	case "all":
+		if _, ok := s.requireAdmin(w, r); !ok {
+			return
+		}
+	default:
 		http.Error(w, "invalid box", http.StatusBadRequest)
 		return
 	}
-	search := strings.TrimSpace(r.URL.Query().Get("search"))
+	query := search.Parse(r.URL.Query().Get("search"))
 	params := pagination.GetPaginationParams(r.URL.Query())
-	messages, total, err := s.store.ListMessages(
-		r.Context(),
-		email,
-		box,
-		search,
-		params.Sort,
-		params.Offset,
-		params.Limit,
-	)
+	page := store.Page{
+		Sort:   params.Sort,
+		Offset: params.Offset,
+		Limit:  params.Limit,
+		Count:  params.Count,
+	}
+	if params.Cursor != "" {
+		cursor, err := store.ParseCursor(params.Cursor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page.Cursor = &cursor
+	}
+	messages, info, err := s.store.ListMessages(r.Context(), email, box, query, page)
 	if err != nil {
 		http.Error(w, "unable to list messages", http.StatusInternalServerError)
 		return
 	}
 
-	hasMore := pagination.GetHasNext(params.Offset, params.Limit, total)
+	hasMore := info.Next != nil
 	nextPage := int32(0)
-	if hasMore {
+	if hasMore && page.Cursor == nil {
 		nextPage = params.Page + 1
 	}
 
 	response := struct {
-		Messages []messageSummary `json:"messages"`
-		Page     int32            `json:"page"`
-		Limit    int32            `json:"limit"`
-		Total    int32            `json:"total"`
-		HasMore  bool             `json:"hasMore"`
-		NextPage int32            `json:"nextPage"`
+		Messages   []messageSummary `json:"messages"`
+		Page       int32            `json:"page"`
+		Limit      int32            `json:"limit"`
+		Total      *int32           `json:"total,omitempty"`
+		HasMore    bool             `json:"hasMore"`
+		NextPage   int32            `json:"nextPage"`
+		NextCursor string           `json:"nextCursor,omitempty"`
+		PrevCursor string           `json:"prevCursor,omitempty"`
 	}{
 		Messages: make([]messageSummary, 0, len(messages)),
 		Page:     params.Page,
 		Limit:    params.Limit,
-		Total:    total,
 		HasMore:  hasMore,
 		NextPage: nextPage,
 	}
+	if params.Count {
+		response.Total = &info.Total
+	}
+	if info.Next != nil {
+		response.NextCursor = info.Next.String()
+	}
+	if info.Prev != nil {
+		response.PrevCursor = info.Prev.String()
+	}
 	for _, msg := range messages {
-		response.Messages = append(response.Messages, toSummary(msg))
+		summary := toSummary(msg)
+		switch box {
+		case "inbox":
+			summary.DeliveredAs = deliveredAs(msg.RecipientGroups, email)
+			summary.Tag = subaddressTag(msg.RecipientGroups, email)
+		case "all":
+			summary.Mailbox = openAs(msg)
+		}
+		response.Messages = append(response.Messages, summary)
 	}
 	s.respondJSON(w, http.StatusOK, response)
 }
@@ -341,6 +488,15 @@ func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(parts) == 2 && (parts[1] == "links" || parts[1] == "codes") {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleMessageExtract(w, r, email, id, parts[1])
+		return
+	}
+
 	if len(parts) == 3 && parts[1] == "attachments" {
 		if r.Method != http.MethodGet {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -364,86 +520,114 @@ func (s *Server) handleMessageDetail(w http.ResponseWriter, r *http.Request, ema
 		if errors.Is(err, context.Canceled) {
 			return
 		}
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, store.ErrNotFound) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
 		http.Error(w, "unable to load message", http.StatusInternalServerError)
 		return
 	}
-	if recipientIncludes(recipients, email) {
-		if err := s.store.MarkMessageRead(r.Context(), email, id, time.Now()); err != nil {
+	// An admin browsing another mailbox should not mark its mail read.
+	if recipientIncludes(recipients, email) && s.ownsMailbox(r, email) {
+		if changed, err := s.store.MarkMessageRead(r.Context(), email, id, time.Now()); err != nil {
 			s.logger.Warn("mark message read", "error", err)
+		} else if changed {
+			s.webhooks.Publish(r.Context(), webhook.Event{Type: webhook.MessageRead, Mailbox: email, Message: message, Recipients: recipients})
 		}
 	}
 
-	detail := messageDetail{
-		ID:          message.ID,
-		From:        message.From,
-		Subject:     message.Subject,
-		Text:        message.TextBody,
-		HTML:        message.HTMLBody,
-		CreatedAt:   message.CreatedAt.UTC().Format(time.RFC3339),
-		RawSize:     message.RawSize,
-		To:          []string{},
-		Cc:          []string{},
-		Bcc:         []string{},
-		Attachments: []attachmentSummary{},
+	s.respondJSON(w, http.StatusOK, toMessageDetail(message, recipients, attachments, email))
+}
+
+type linksResponse struct {
+	Links []extract.Link `json:"links"`
+	// MagicLinks are the targets of links that match a magic link pattern.
+	MagicLinks []string `json:"magicLinks"`
+}
+
+type codesResponse struct {
+	Codes []extract.Code `json:"codes"`
+	// Code is the best candidate, if any.
+	Code string `json:"code,omitempty"`
+}
+
+// handleMessageExtract serves the links or codes found in a message. Unlike
+// the detail view it does not mark the message read.
+func (s *Server) handleMessageExtract(w http.ResponseWriter, r *http.Request, email, id, kind string) {
+	message, _, _, err := s.store.GetMessage(r.Context(), email, id)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "unable to load message", http.StatusInternalServerError)
+		return
 	}
-	for _, recipient := range recipients {
-		switch recipient.Type {
-		case "cc":
-			detail.Cc = append(detail.Cc, recipient.Email)
-		case "bcc":
-			detail.Bcc = append(detail.Bcc, recipient.Email)
-		default:
-			detail.To = append(detail.To, recipient.Email)
+
+	if kind == "codes" {
+		response := codesResponse{Codes: extract.Codes(message)}
+		if response.Codes == nil {
+			response.Codes = []extract.Code{}
+		} else {
+			response.Code = response.Codes[0].Value
 		}
+		s.respondJSON(w, http.StatusOK, response)
+		return
 	}
-	for _, attachment := range attachments {
-		detail.Attachments = append(detail.Attachments, attachmentSummary{
-			ID:          attachment.ID,
-			Filename:    attachment.Filename,
-			ContentType: attachment.ContentType,
-			Size:        attachment.Size,
-		})
+	response := linksResponse{Links: s.extract.Links(message), MagicLinks: []string{}}
+	if response.Links == nil {
+		response.Links = []extract.Link{}
 	}
-	s.respondJSON(w, http.StatusOK, detail)
+	for _, link := range response.Links {
+		// A tracked link and a plain copy often lead to the same place.
+		if link.Magic && !slices.Contains(response.MagicLinks, link.Target()) {
+			response.MagicLinks = append(response.MagicLinks, link.Target())
+		}
+	}
+	s.respondJSON(w, http.StatusOK, response)
 }
 
 func (s *Server) handleMessageRaw(w http.ResponseWriter, r *http.Request, email, id string) {
-	message, _, _, err := s.store.GetMessage(r.Context(), email, id)
+	content, _, err := s.store.OpenRaw(r.Context(), email, id)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, store.ErrNotFound) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		s.logger.Error("open raw message", "error", err)
 		http.Error(w, "unable to load message", http.StatusInternalServerError)
 		return
 	}
+	defer content.Close()
 	w.Header().Set("Content-Type", "message/rfc822")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=message-%s.eml", message.ID))
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(message.Raw)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=message-%s.eml", id))
+	http.ServeContent(w, r, "", time.Time{}, content)
 }
 
+// handleAttachment streams the attachment, so Range requests resume large
+// downloads without loading them into memory.
 func (s *Server) handleAttachment(w http.ResponseWriter, r *http.Request, email string, attachmentID int64) {
-	attachment, err := s.store.GetAttachment(r.Context(), email, attachmentID)
+	attachment, content, err := s.store.OpenAttachment(r.Context(), email, attachmentID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, store.ErrNotFound) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		s.logger.Error("open attachment", "error", err)
 		http.Error(w, "unable to load attachment", http.StatusInternalServerError)
 		return
 	}
+	defer content.Close()
 	w.Header().Set("Content-Type", attachment.ContentType)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachment.Filename))
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(attachment.Data)
+	http.ServeContent(w, r, "", time.Time{}, content)
 }
 
 func (s *Server) handleMessageDelete(w http.ResponseWriter, r *http.Request, email, id string) {
+	event, notify := s.webhooks.Lookup(r.Context(), webhook.MessageDeleted, email, id)
 	deleted, err := s.store.DeleteMessage(r.Context(), email, id)
 	if err != nil {
 		http.Error(w, "unable to delete", http.StatusInternalServerError)
@@ -453,6 +637,9 @@ func (s *Server) handleMessageDelete(w http.ResponseWriter, r *http.Request, ema
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
+	if notify {
+		s.webhooks.Publish(r.Context(), event)
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -553,7 +740,7 @@ func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
 	}
 
 	raw := buildOutboundMessage(email, recipients, subject, textBody, htmlBody)
-	if err := smtp.SendMail(s.smtpAddr, nil, email, recipients, raw); err != nil {
+	if err := sendLocalMail(s.smtpAddr, email, recipients, raw); err != nil {
 		s.logger.Error("send mail", "error", err)
 		http.Error(w, "unable to send mail", http.StatusBadRequest)
 		return
@@ -561,15 +748,160 @@ func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *Server) sessionEmails(r *http.Request) ([]string, error) {
-	cookie, err := r.Cookie(s.auth.CookieName())
+// sendLocalMail delivers to the embedded SMTP listener over loopback. It skips
+// STARTTLS, which smtp.SendMail would attempt against the self-signed
+// certificate and fail to verify.
+func sendLocalMail(addr, from string, to []string, msg []byte) error {
+	client, err := smtp.Dial(addr)
 	if err != nil {
-		return nil, errors.New("missing session")
+		return err
 	}
-	emails, err := s.auth.Parse(cookie.Value, time.Now())
+	defer client.Close()
+
+	if err := client.Hello("localhost"); err != nil {
+		return err
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(msg); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// handleFaults reads and replaces the fault-injection rules. The rules apply
+// to every SMTP client, so only admins may see or change them.
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var payload faults.Config
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := s.faults.SetConfig(payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Info("fault injection updated", "enabled", payload.Enabled, "rules", len(payload.Rules))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := s.faults.Config()
+	if cfg.Rules == nil {
+		cfg.Rules = []faults.Rule{}
+	}
+	s.respondJSON(w, http.StatusOK, cfg)
+}
+
+// handleWebhooks lists the configured hooks without their secrets. Only
+// admins see them, since hooks receive mail for every mailbox.
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	hooks := s.webhooks.Hooks()
+	if hooks == nil {
+		hooks = []webhook.Hook{}
+	}
+	s.respondJSON(w, http.StatusOK, map[string]any{"webhooks": hooks})
+}
+
+// handleWebhookDeliveries serves the delivery log, optionally filtered by
+// webhook name and status.
+func (s *Server) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	q := r.URL.Query()
+	filter := store.DeliveryFilter{Webhook: q.Get("webhook"), Status: q.Get("status")}
+	switch filter.Status {
+	case "", store.DeliveryPending, store.DeliveryDelivered, store.DeliveryFailed:
+	default:
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit > 0 {
+		filter.Limit = min(limit, 500)
+	}
+	deliveries, err := s.webhooks.Deliveries(r.Context(), filter)
+	if err != nil {
+		s.logger.Error("list webhook deliveries", "error", err)
+		http.Error(w, "unable to list deliveries", http.StatusInternalServerError)
+		return
+	}
+	response := make([]deliverySummary, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		summary := deliverySummary{
+			ID:           delivery.ID,
+			Webhook:      delivery.Webhook,
+			Event:        delivery.Event,
+			MessageID:    delivery.MessageID,
+			URL:          delivery.URL,
+			Status:       delivery.Status,
+			Attempts:     delivery.Attempts,
+			ResponseCode: delivery.ResponseCode,
+			LastError:    delivery.LastError,
+			CreatedAt:    delivery.CreatedAt.UTC().Format(time.RFC3339),
+		}
+		if !delivery.LastAttemptAt.IsZero() {
+			summary.LastAttemptAt = delivery.LastAttemptAt.UTC().Format(time.RFC3339)
+		}
+		if delivery.Status == store.DeliveryPending {
+			summary.NextAttemptAt = delivery.NextAttemptAt.UTC().Format(time.RFC3339)
+		}
+		response = append(response, summary)
+	}
+	s.respondJSON(w, http.StatusOK, map[string]any{"deliveries": response})
+}
+
+// sessionEmails returns the mailboxes the request may act as. Admin tokens
+// may act as any mailbox, so the one named by the email parameter is added
+// in front.
+func (s *Server) sessionEmails(r *http.Request) ([]string, error) {
+	caller, err := s.authenticate(r)
 	if err != nil {
 		return nil, err
 	}
+	emails := caller.emails
+	if caller.admin {
+		if requested := strings.TrimSpace(r.URL.Query().Get("email")); requested != "" {
+			normalized, err := auth.NormalizeEmail(requested)
+			if err != nil {
+				return nil, err
+			}
+			emails = uniqueEmails(append([]string{normalized}, emails...))
+		}
+	}
+	if len(emails) == 0 {
+		return nil, errors.New("email parameter required")
+	}
 	return emails, nil
 }
 
@@ -609,22 +941,90 @@ func (s *Server) respondJSON(w http.ResponseWriter, status int, payload any) {
 	_ = json.NewEncoder(w).Encode(payload)
 }
 
-func (s *Server) handleHealth(w http.ResponseWriter, _ *http.Request) {
-	s.respondText(w, http.StatusOK, "ok")
+// AddReadinessCheck adds a component check to /ready, such as a listener
+// that must be accepting connections.
+func (s *Server) AddReadinessCheck(name string, check func(context.Context) error) {
+	s.checks = append(s.checks, readinessCheck{name: name, check: check})
 }
 
-func (s *Server) handleReady(w http.ResponseWriter, _ *http.Request) {
-	s.respondText(w, http.StatusOK, "ready")
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
 
-func (s *Server) handleMetrics(w http.ResponseWriter, _ *http.Request) {
-	s.respondText(w, http.StatusOK, "metrics")
+// versionedStore is implemented by backends with a migrated schema.
+type versionedStore interface {
+	SchemaVersion(ctx context.Context) (int, error)
+	CheckSchema(ctx context.Context) error
 }
 
-func (s *Server) respondText(w http.ResponseWriter, status int, payload string) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(status)
-	_, _ = w.Write([]byte(payload))
+type readinessReport struct {
+	Status        string                 `json:"status"`
+	SchemaVersion int                    `json:"schemaVersion,omitempty"`
+	Checks        map[string]checkResult `json:"checks"`
+}
+
+// handleHealth is a liveness probe: the process is up and its database handle
+// still answers.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := s.store.Ping(ctx); err != nil {
+		s.respondJSON(w, http.StatusServiceUnavailable, checkResult{Status: "fail", Error: err.Error()})
+		return
+	}
+	s.respondJSON(w, http.StatusOK, checkResult{Status: "ok"})
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	report := readinessReport{Status: "ready", Checks: map[string]checkResult{}}
+	record := func(name string, err error) {
+		if err != nil {
+			report.Status = "unavailable"
+			report.Checks[name] = checkResult{Status: "fail", Error: err.Error()}
+			return
+		}
+		report.Checks[name] = checkResult{Status: "ok"}
+	}
+
+	record("database", s.store.Ping(ctx))
+	if versioned, ok := s.store.(versionedStore); ok {
+		report.SchemaVersion, _ = versioned.SchemaVersion(ctx)
+		record("schema", versioned.CheckSchema(ctx))
+	}
+	for _, check := range s.checks {
+		record(check.name, check.check(ctx))
+	}
+
+	status := http.StatusOK
+	if report.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	s.respondJSON(w, status, report)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.store.Stats(r.Context())
+	if err != nil {
+		s.logger.Error("metrics store stats", "error", err)
+		http.Error(w, "failed to collect metrics", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	s.metrics.Write(&buf)
+	metrics.WriteGauge(&buf, "localsmtp_store_messages", "Messages currently stored.", float64(stats.Messages))
+	metrics.WriteGauge(&buf, "localsmtp_store_message_bytes", "Total raw size of stored messages.", float64(stats.MessageBytes))
+	metrics.WriteGauge(&buf, "localsmtp_store_attachments", "Attachments currently stored.", float64(stats.Attachments))
+	metrics.WriteGauge(&buf, "localsmtp_store_attachment_bytes", "Total size of stored attachments.", float64(stats.AttachmentBytes))
+	metrics.WriteGauge(&buf, "localsmtp_sse_subscribers", "Open SSE subscriptions on the event hub.", float64(s.hub.Subscribers()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
 }
 
 type messageSummary struct {
@@ -634,22 +1034,57 @@ type messageSummary struct {
 	Subject        string   `json:"subject"`
 	CreatedAt      string   `json:"createdAt"`
 	HasAttachments bool     `json:"hasAttachments"`
+	DeliveredAs    string   `json:"deliveredAs,omitempty"`
+	// Tag is the "+tag" the mailbox received the message under, for
+	// instance "signup" for qa+signup@example.com.
+	Tag string `json:"tag,omitempty"`
+	// Mailbox is an address the message can be opened as, set when listing
+	// every mailbox.
+	Mailbox string `json:"mailbox,omitempty"`
 }
 
 type messageDetail struct {
-	ID          string              `json:"id"`
-	From        string              `json:"from"`
-	To          []string            `json:"to"`
-	Cc          []string            `json:"cc"`
-	Bcc         []string            `json:"bcc"`
+	ID   string   `json:"id"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	Cc   []string `json:"cc"`
+	Bcc  []string `json:"bcc"`
+	// Routed lists mailboxes that sub-addressing or an alias added.
+	Routed      []string            `json:"routed"`
+	DeliveredAs string              `json:"deliveredAs,omitempty"`
 	Subject     string              `json:"subject"`
 	Text        string              `json:"text"`
 	HTML        string              `json:"html"`
 	CreatedAt   string              `json:"createdAt"`
 	RawSize     int64               `json:"rawSize"`
+	TLS         tlsSummary          `json:"tls"`
+	Envelope    *envelopeSummary    `json:"envelope,omitempty"`
 	Attachments []attachmentSummary `json:"attachments"`
 }
 
+type envelopeSummary struct {
+	MailFrom     string                     `json:"mailFrom"`
+	MailParams   map[string]string          `json:"mailParams"`
+	Recipients   []envelopeRecipientSummary `json:"rcptTo"`
+	Helo         string                     `json:"helo"`
+	RemoteAddr   string                     `json:"remoteAddr"`
+	AuthUsername string                     `json:"authUsername,omitempty"`
+	AuthProject  string                     `json:"authProject,omitempty"`
+	TLS          tlsSummary                 `json:"tls"`
+	ReceivedAt   string                     `json:"receivedAt"`
+}
+
+type envelopeRecipientSummary struct {
+	Address string            `json:"address"`
+	Params  map[string]string `json:"params"`
+}
+
+type tlsSummary struct {
+	Enabled bool   `json:"enabled"`
+	Version string `json:"version,omitempty"`
+	Cipher  string `json:"cipher,omitempty"`
+}
+
 type attachmentSummary struct {
 	ID          int64  `json:"id"`
 	Filename    string `json:"filename"`
@@ -657,6 +1092,21 @@ type attachmentSummary struct {
 	Size        int64  `json:"size"`
 }
 
+type deliverySummary struct {
+	ID            int64  `json:"id"`
+	Webhook       string `json:"webhook"`
+	Event         string `json:"event"`
+	MessageID     string `json:"messageId"`
+	URL           string `json:"url"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	ResponseCode  int    `json:"responseCode,omitempty"`
+	LastError     string `json:"lastError,omitempty"`
+	CreatedAt     string `json:"createdAt"`
+	LastAttemptAt string `json:"lastAttemptAt,omitempty"`
+	NextAttemptAt string `json:"nextAttemptAt,omitempty"`
+}
+
 type sendRequest struct {
 	To      []string `json:"to"`
 	Subject string   `json:"subject"`
@@ -679,6 +1129,82 @@ func toSummary(msg store.MessageSummary) messageSummary {
 	}
 }
 
+// toMessageDetail describes message as seen from email's mailbox.
+func toMessageDetail(message store.Message, recipients []store.Recipient, attachments []store.Attachment, email string) messageDetail {
+	detail := messageDetail{
+		ID:        message.ID,
+		From:      message.From,
+		Subject:   message.Subject,
+		Text:      message.TextBody,
+		HTML:      message.HTMLBody,
+		CreatedAt: message.CreatedAt.UTC().Format(time.RFC3339),
+		RawSize:   message.RawSize,
+		TLS: tlsSummary{
+			Enabled: message.TLS,
+			Version: message.TLSVersion,
+			Cipher:  message.TLSCipher,
+		},
+		To:          []string{},
+		Cc:          []string{},
+		Bcc:         []string{},
+		Routed:      []string{},
+		Attachments: []attachmentSummary{},
+	}
+	groups := map[string][]string{}
+	for _, recipient := range recipients {
+		switch recipient.Type {
+		case "cc":
+			detail.Cc = append(detail.Cc, recipient.Email)
+		case "bcc":
+			detail.Bcc = append(detail.Bcc, recipient.Email)
+		case "routed":
+			detail.Routed = append(detail.Routed, recipient.Email)
+		default:
+			detail.To = append(detail.To, recipient.Email)
+		}
+		groups[recipient.Type] = append(groups[recipient.Type], recipient.Email)
+	}
+	detail.DeliveredAs = deliveredAs(groups, email)
+	if message.Envelope != nil {
+		detail.Envelope = toEnvelopeSummary(message)
+	}
+	for _, attachment := range attachments {
+		detail.Attachments = append(detail.Attachments, attachmentSummary{
+			ID:          attachment.ID,
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+		})
+	}
+	return detail
+}
+
+func toEnvelopeSummary(message store.Message) *envelopeSummary {
+	envelope := message.Envelope
+	summary := &envelopeSummary{
+		MailFrom:     envelope.MailFrom,
+		MailParams:   envelope.MailParams,
+		Recipients:   make([]envelopeRecipientSummary, 0, len(envelope.Recipients)),
+		Helo:         envelope.Helo,
+		RemoteAddr:   envelope.RemoteAddr,
+		AuthUsername: envelope.AuthUsername,
+		AuthProject:  envelope.AuthProject,
+		TLS: tlsSummary{
+			Enabled: message.TLS,
+			Version: message.TLSVersion,
+			Cipher:  message.TLSCipher,
+		},
+		ReceivedAt: envelope.ReceivedAt.UTC().Format(time.RFC3339Nano),
+	}
+	for _, recipient := range envelope.Recipients {
+		summary.Recipients = append(summary.Recipients, envelopeRecipientSummary{
+			Address: recipient.Address,
+			Params:  recipient.Params,
+		})
+	}
+	return summary
+}
+
 func normalizeRecipients(recipients []string) []string {
 	seen := map[string]struct{}{}
 	result := []string{}
@@ -746,9 +1272,50 @@ func sanitizeHeader(value string) string {
 	return strings.TrimSpace(cleaned)
 }
 
+// recipientTypes orders recipient types from most to least visible.
+var recipientTypes = []string{"to", "cc", "bcc", "routed"}
+
+// deliveredAs reports how email, which may be a wildcard mailbox, received a
+// message: "to", "cc", "bcc", or "routed" when sub-addressing or an alias
+// added it. A visible To/Cc entry wins over the others.
+func deliveredAs(groups map[string][]string, email string) string {
+	for _, rtype := range recipientTypes {
+		for _, recipient := range groups[rtype] {
+			if auth.MatchEmail(email, recipient) {
+				return rtype
+			}
+		}
+	}
+	return ""
+}
+
+// subaddressTag returns the tag of the first "+tag" recipient that email,
+// or its base address, covers.
+func subaddressTag(groups map[string][]string, email string) string {
+	for _, rtype := range recipientTypes {
+		for _, recipient := range groups[rtype] {
+			tag := routing.Tag(recipient)
+			if tag != "" && (auth.MatchEmail(email, recipient) || auth.MatchEmail(email, routing.Base(recipient))) {
+				return tag
+			}
+		}
+	}
+	return ""
+}
+
+// openAs picks a mailbox that can see msg, preferring its first recipient.
+func openAs(msg store.MessageSummary) string {
+	for _, rtype := range recipientTypes {
+		if recipients := msg.RecipientGroups[rtype]; len(recipients) > 0 {
+			return recipients[0]
+		}
+	}
+	return msg.From
+}
+
 func recipientIncludes(recipients []store.Recipient, email string) bool {
 	for _, recipient := range recipients {
-		if recipient.Email == email {
+		if auth.MatchEmail(email, recipient.Email) {
 			return true
 		}
 	}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// tokenTouchInterval limits how often a token's last use is written, so busy
+// CI jobs don't queue a write per request.
+const tokenTouchInterval = time.Minute
+
+// principal is who a request acts for: a session cookie or an API token.
+type principal struct {
+	emails []string
+	// admin may act as any mailbox: admin API tokens, and sessions logged
+	// in as one of ADMIN_EMAILS with ADMIN_SECRET.
+	admin bool
+	// token is the API token name, empty for sessions.
+	token string
+}
+
+// authenticate accepts an "Authorization: Bearer" API token, falling back
+// to the session cookie.
+func (s *Server) authenticate(r *http.Request) (principal, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		cookie, err := r.Cookie(s.auth.CookieName())
+		if err != nil {
+			return principal{}, errors.New("missing session")
+		}
+		emails, admin, err := s.auth.Parse(cookie.Value, time.Now())
+		if err != nil {
+			return principal{}, err
+		}
+		return principal{emails: emails, admin: admin}, nil
+	}
+
+	scheme, secret, _ := strings.Cut(header, " ")
+	secret = strings.TrimSpace(secret)
+	if !strings.EqualFold(scheme, "Bearer") || secret == "" {
+		return principal{}, errors.New("unsupported authorization")
+	}
+	token, err := s.store.APITokenByHash(r.Context(), auth.HashToken(secret))
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) && !errors.Is(err, context.Canceled) {
+			s.logger.Warn("look up api token", "error", err)
+		}
+		return principal{}, errors.New("invalid api token")
+	}
+	if now := time.Now(); now.Sub(token.LastUsedAt) > tokenTouchInterval {
+		if err := s.store.TouchAPIToken(r.Context(), token.ID, now); err != nil {
+			s.logger.Warn("record api token use", "token", token.Name, "error", err)
+		}
+	}
+	return principal{emails: token.Mailboxes, admin: token.Admin, token: token.Name}, nil
+}
+
+// canManage reports whether p may see and revoke token: admins manage every
+// token, other sessions manage non-admin tokens for their own mailboxes.
+func (p principal) canManage(token store.APIToken) bool {
+	if p.admin {
+		return true
+	}
+	if p.token != "" || token.Admin {
+		return false
+	}
+	for _, mailbox := range token.Mailboxes {
+		if !slices.Contains(p.emails, mailbox) {
+			return false
+		}
+	}
+	return true
+}
+
+type tokenSummary struct {
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Mailboxes  []string `json:"mailboxes"`
+	Admin      bool     `json:"admin"`
+	CreatedAt  string   `json:"createdAt"`
+	LastUsedAt string   `json:"lastUsedAt,omitempty"`
+	// Token is the secret, returned only when the token is created.
+	Token string `json:"token,omitempty"`
+}
+
+func toTokenSummary(token store.APIToken) tokenSummary {
+	summary := tokenSummary{
+		Name:      token.Name,
+		Prefix:    token.Prefix,
+		Mailboxes: token.Mailboxes,
+		Admin:     token.Admin,
+		CreatedAt: token.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if summary.Mailboxes == nil {
+		summary.Mailboxes = []string{}
+	}
+	if !token.LastUsedAt.IsZero() {
+		summary.LastUsedAt = token.LastUsedAt.UTC().Format(time.RFC3339)
+	}
+	return summary
+}
+
+// handleTokens lists API tokens on GET and creates one on POST. Non-admin
+// API tokens cannot manage tokens at all.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	caller, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if caller.token != "" && !caller.admin {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := s.store.ListAPITokens(r.Context())
+		if err != nil {
+			http.Error(w, "unable to load tokens", http.StatusInternalServerError)
+			return
+		}
+		summaries := make([]tokenSummary, 0, len(tokens))
+		for _, token := range tokens {
+			if caller.canManage(token) {
+				summaries = append(summaries, toTokenSummary(token))
+			}
+		}
+		s.respondJSON(w, http.StatusOK, map[string]any{"tokens": summaries})
+	case http.MethodPost:
+		s.handleCreateToken(w, r, caller)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request, caller principal) {
+	var payload struct {
+		Name      string   `json:"name"`
+		Mailboxes []string `json:"mailboxes"`
+		Admin     bool     `json:"admin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := auth.ValidateTokenName(payload.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var mailboxes []string
+	for _, mailbox := range payload.Mailboxes {
+		normalized, err := auth.NormalizeEmail(mailbox)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mailboxes = append(mailboxes, normalized)
+	}
+	mailboxes = uniqueEmails(mailboxes)
+	if !payload.Admin && len(mailboxes) == 0 {
+		// A session's token covers the mailboxes it is logged in to.
+		mailboxes = caller.emails
+	}
+	token := store.APIToken{Name: payload.Name, Mailboxes: mailboxes, Admin: payload.Admin}
+	if !caller.canManage(token) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !token.Admin && len(token.Mailboxes) == 0 {
+		http.Error(w, "mailboxes are required", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := auth.GenerateToken()
+	if err != nil {
+		http.Error(w, "unable to create token", http.StatusInternalServerError)
+		return
+	}
+	token.Hash = auth.HashToken(secret)
+	token.Prefix = auth.DisplayPrefix(secret)
+	token.CreatedAt = time.Now()
+	token, err = s.store.CreateAPIToken(r.Context(), token)
+	if errors.Is(err, store.ErrTokenExists) {
+		http.Error(w, "a token with that name exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "unable to create token", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("api token created", "name", token.Name, "admin", token.Admin, "mailboxes", len(token.Mailboxes))
+	summary := toTokenSummary(token)
+	summary.Token = secret
+	s.respondJSON(w, http.StatusCreated, summary)
+}
+
+// handleToken revokes the token named in the path.
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/tokens/")
+	tokens, err := s.store.ListAPITokens(r.Context())
+	if err != nil {
+		http.Error(w, "unable to load tokens", http.StatusInternalServerError)
+		return
+	}
+	index := slices.IndexFunc(tokens, func(token store.APIToken) bool { return token.Name == name })
+	if index < 0 || !caller.canManage(tokens[index]) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	deleted, err := s.store.DeleteAPIToken(r.Context(), name)
+	if err != nil {
+		http.Error(w, "unable to revoke token", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Info("api token revoked", "name", name)
+	w.WriteHeader(http.StatusNoContent)
+}
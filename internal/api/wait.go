@@ -0,0 +1,345 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/search"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+	// waitScanLimit caps how many existing messages the first scan checks
+	// when no "after" bound is given.
+	waitScanLimit = 500
+	// commitSlack covers messages stamped before a scan but committed after
+	// it, which can sit in the ingest queue for a while.
+	commitSlack = 2 * time.Minute
+)
+
+// waitCriteria selects the message a waiting client is interested in. Every
+// set field must match.
+type waitCriteria struct {
+	// To and From are glob patterns such as "*@example.com". To matches
+	// any recipient, including Cc and Bcc.
+	To           string
+	From         string
+	Subject      string
+	SubjectRegex *regexp.Regexp
+	Headers      []headerMatch
+	After        time.Time
+}
+
+type headerMatch struct {
+	Name  string
+	Value string
+}
+
+func parseWaitCriteria(q map[string][]string) (waitCriteria, time.Duration, error) {
+	get := func(key string) string {
+		if values := q[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+	criteria := waitCriteria{
+		To:      strings.ToLower(get("to")),
+		From:    strings.ToLower(get("from")),
+		Subject: strings.ToLower(get("subject")),
+	}
+	for _, pattern := range []string{criteria.To, criteria.From} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return waitCriteria{}, 0, fmt.Errorf("invalid address pattern %q", pattern)
+		}
+	}
+	if expr := get("subjectRegex"); expr != "" {
+		compiled, err := regexp.Compile(expr)
+		if err != nil {
+			return waitCriteria{}, 0, fmt.Errorf("invalid subjectRegex: %w", err)
+		}
+		criteria.SubjectRegex = compiled
+	}
+	for _, header := range q["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return waitCriteria{}, 0, errors.New("header must be \"Name: value\"")
+		}
+		criteria.Headers = append(criteria.Headers, headerMatch{Name: name, Value: strings.TrimSpace(value)})
+	}
+	if after := get("after"); after != "" {
+		parsed, err := parseTimestamp(after)
+		if err != nil {
+			return waitCriteria{}, 0, errors.New("after must be an RFC 3339 timestamp or Unix seconds")
+		}
+		criteria.After = parsed
+	}
+
+	timeout := defaultWaitTimeout
+	if value := get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			seconds, atoiErr := strconv.Atoi(value)
+			if atoiErr != nil {
+				return waitCriteria{}, 0, errors.New("timeout must be a duration such as \"30s\"")
+			}
+			parsed = time.Duration(seconds) * time.Second
+		}
+		timeout = min(max(parsed, 0), maxWaitTimeout)
+	}
+	return criteria, timeout, nil
+}
+
+func parseTimestamp(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// matchesSummary checks everything a listing row carries, so most candidates
+// are rejected without loading the message.
+func (c waitCriteria) matchesSummary(summary store.MessageSummary) bool {
+	// created_at has second resolution, so "after" is compared in seconds.
+	if !c.After.IsZero() && summary.CreatedAt.Unix() < c.After.Unix() {
+		return false
+	}
+	if c.From != "" && !matchAddress(c.From, summary.From) {
+		return false
+	}
+	if c.Subject != "" && !strings.Contains(strings.ToLower(summary.Subject), c.Subject) {
+		return false
+	}
+	if c.SubjectRegex != nil && !c.SubjectRegex.MatchString(summary.Subject) {
+		return false
+	}
+	if c.To == "" {
+		return true
+	}
+	for _, group := range summary.RecipientGroups {
+		for _, recipient := range group {
+			if matchAddress(c.To, recipient) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesHeaders compares header values case-insensitively after decoding
+// RFC 2047 encoded words.
+func (c waitCriteria) matchesHeaders(raw []byte) bool {
+	if len(c.Headers) == 0 {
+		return true
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return false
+	}
+	decoder := new(mime.WordDecoder)
+	for _, want := range c.Headers {
+		found := false
+		for _, value := range msg.Header[textproto.CanonicalMIMEHeaderKey(want.Name)] {
+			if decoded, err := decoder.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			if strings.EqualFold(strings.TrimSpace(value), want.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAddress(pattern, address string) bool {
+	matched, err := path.Match(pattern, strings.ToLower(address))
+	return err == nil && matched
+}
+
+// messageWaiter scans a mailbox for the first message matching criteria.
+// checked remembers rejected messages so rescans only load new ones.
+type messageWaiter struct {
+	store    store.Storage
+	email    string
+	criteria waitCriteria
+	checked  map[string]struct{}
+	// floor is the oldest creation time the next scan has to look at.
+	floor   time.Time
+	scanned bool
+}
+
+func (w *messageWaiter) scan(ctx context.Context) (*messageDetail, error) {
+	started := time.Now()
+	var cursor *store.Cursor
+	for seen := 0; ; {
+		messages, info, err := w.store.ListMessages(ctx, w.email, "inbox", search.Query{}, store.Page{Limit: 50, Cursor: cursor})
+		if err != nil {
+			return nil, err
+		}
+		for _, summary := range messages {
+			if !w.floor.IsZero() && summary.CreatedAt.Before(w.floor) {
+				w.done(started)
+				return nil, nil
+			}
+			seen++
+			if _, ok := w.checked[summary.ID]; ok {
+				continue
+			}
+			w.checked[summary.ID] = struct{}{}
+			if !w.criteria.matchesSummary(summary) {
+				continue
+			}
+			message, recipients, attachments, err := w.store.GetMessage(ctx, w.email, summary.ID)
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !w.criteria.matchesHeaders(message.Raw) {
+				continue
+			}
+			detail := toMessageDetail(message, recipients, attachments, w.email)
+			return &detail, nil
+		}
+		if info.Next == nil || (!w.scanned && w.floor.IsZero() && seen >= waitScanLimit) {
+			w.done(started)
+			return nil, nil
+		}
+		cursor = info.Next
+	}
+}
+
+// done moves the floor up after a complete scan: later scans only need
+// messages created since, give or take commitSlack.
+func (w *messageWaiter) done(started time.Time) {
+	w.scanned = true
+	floor := started.Add(-commitSlack).Truncate(time.Second)
+	if floor.After(w.floor) {
+		w.floor = floor
+	}
+}
+
+// handleWaitMessage blocks until a message in the session mailbox matches
+// the query criteria or the timeout expires. Clients that accept
+// text/event-stream get keepalives while waiting and the match as an event.
+func (s *Server) handleWaitMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email, err := s.sessionEmailForRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	criteria, timeout, err := parseWaitCriteria(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream") || r.URL.Query().Get("stream") == "true"
+	flusher, _ := w.(http.Flusher)
+	if stream && flusher == nil {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// Subscribe before the first scan so a message arriving in between
+	// still wakes us up.
+	notifications, unsubscribe := s.hub.Subscribe(email)
+	defer unsubscribe()
+	waiter := &messageWaiter{store: s.store, email: email, criteria: criteria, checked: map[string]struct{}{}}
+	if !criteria.After.IsZero() {
+		waiter.floor = criteria.After.Truncate(time.Second)
+	}
+
+	if stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		_, _ = w.Write([]byte("event: ready\ndata: {}\n\n"))
+		flusher.Flush()
+	}
+
+	ticker := time.NewTicker(20 * time.Second)
+	defer ticker.Stop()
+	for {
+		detail, err := waiter.scan(ctx)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			// Timed out or the client went away mid-scan.
+		case err != nil:
+			s.logger.Error("wait for message", "error", err)
+			if stream {
+				writeEvent(w, flusher, "error", map[string]string{"error": "unable to search messages"})
+			} else {
+				http.Error(w, "unable to search messages", http.StatusInternalServerError)
+			}
+			return
+		case detail != nil:
+			if stream {
+				writeEvent(w, flusher, "message", detail)
+			} else {
+				s.respondJSON(w, http.StatusOK, detail)
+			}
+			return
+		}
+		if !s.awaitNotification(ctx, w, flusher, notifications, ticker.C, stream) {
+			if r.Context().Err() != nil {
+				return
+			}
+			if stream {
+				writeEvent(w, flusher, "timeout", map[string]string{"error": "no matching message"})
+			} else {
+				s.respondJSON(w, http.StatusNotFound, map[string]string{"error": "no matching message"})
+			}
+			return
+		}
+	}
+}
+
+// awaitNotification blocks until the mailbox gets new mail, keeping an event
+// stream alive meanwhile. It returns false once ctx is done.
+func (s *Server) awaitNotification(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, notifications <-chan []byte, keepalive <-chan time.Time, stream bool) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-notifications:
+			return true
+		case <-keepalive:
+			if stream {
+				_, _ = w.Write([]byte(": ping\n\n"))
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, payload any) {
+	data, _ := json.Marshal(payload)
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	flusher.Flush()
+}
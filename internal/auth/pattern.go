@@ -0,0 +1,32 @@
+package auth
+
+import "strings"
+
+// IsEmailPattern reports whether email is a wildcard mailbox such as
+// "*@test.example.com" or "qa+*@example.com", where * matches any run of
+// characters in the local part.
+func IsEmailPattern(email string) bool {
+	return strings.Contains(email, "*")
+}
+
+// MatchEmail reports whether address belongs to the mailbox pattern. A
+// pattern without wildcards only matches itself. Both are expected to be
+// normalized.
+func MatchEmail(pattern, address string) bool {
+	if !IsEmailPattern(pattern) {
+		return pattern == address
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(address, parts[0]) {
+		return false
+	}
+	rest := address[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(rest, part)
+		if index < 0 {
+			return false
+		}
+		rest = rest[index+len(part):]
+	}
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
@@ -15,6 +15,9 @@ import (
 
 const (
 	cookieName = "localsmtp_session"
+	// adminMark follows the timestamp in sessions that proved the admin
+	// secret at login.
+	adminMark = "admin"
 )
 
 type Manager struct {
@@ -42,52 +45,62 @@ func (m *Manager) MaxAge() time.Duration {
 }
 
 func (m *Manager) Issue(email string, now time.Time) (string, error) {
-	return m.IssueEmails([]string{email}, now)
+	return m.IssueEmails([]string{email}, false, now)
 }
 
-func (m *Manager) IssueEmails(emails []string, now time.Time) (string, error) {
+// IssueEmails signs a session for emails. admin marks a session that may act
+// as any mailbox.
+func (m *Manager) IssueEmails(emails []string, admin bool, now time.Time) (string, error) {
 	normalized, err := normalizeEmailList(emails)
 	if err != nil {
 		return "", err
 	}
 	timestamp := strconv.FormatInt(now.Unix(), 10)
 	payload := strings.Join(normalized, ",") + "|" + timestamp
+	if admin {
+		payload += "|" + adminMark
+	}
 	sig := m.sign(payload)
 	token := payload + "|" + sig
 	return base64.RawURLEncoding.EncodeToString([]byte(token)), nil
 }
 
-func (m *Manager) Parse(token string, now time.Time) ([]string, error) {
+// Parse verifies a session token and returns its emails and whether it is an
+// admin session.
+func (m *Manager) Parse(token string, now time.Time) ([]string, bool, error) {
 	if token == "" {
-		return nil, errors.New("missing session token")
+		return nil, false, errors.New("missing session token")
 	}
 	raw, err := base64.RawURLEncoding.DecodeString(token)
 	if err != nil {
-		return nil, errors.New("invalid session token")
+		return nil, false, errors.New("invalid session token")
 	}
 	parts := strings.Split(string(raw), "|")
-	if len(parts) != 3 {
-		return nil, errors.New("invalid session token")
+	admin := len(parts) == 4 && parts[2] == adminMark
+	if len(parts) != 3 && !admin {
+		return nil, false, errors.New("invalid session token")
 	}
-	payload := parts[0] + "|" + parts[1]
-	if !m.verify(payload, parts[2]) {
-		return nil, errors.New("invalid session token")
+	payload := strings.Join(parts[:len(parts)-1], "|")
+	if !m.verify(payload, parts[len(parts)-1]) {
+		return nil, false, errors.New("invalid session token")
 	}
 	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
 	if err != nil {
-		return nil, errors.New("invalid session token")
+		return nil, false, errors.New("invalid session token")
 	}
 	issuedAt := time.Unix(timestamp, 0)
 	if now.Sub(issuedAt) > m.maxAge {
-		return nil, errors.New("session expired")
+		return nil, false, errors.New("session expired")
 	}
 	emails, err := normalizeEmailList(strings.Split(parts[0], ","))
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	return emails, nil
+	return emails, admin, nil
 }
 
+// NormalizeEmail lowercases and validates an address. Wildcard mailboxes
+// like "*@test.example.com" are accepted as long as the domain is literal.
 func NormalizeEmail(email string) (string, error) {
 	trimmed := strings.TrimSpace(strings.ToLower(email))
 	if trimmed == "" {
@@ -97,7 +110,11 @@ func NormalizeEmail(email string) (string, error) {
 	if err != nil {
 		return "", errors.New("email must be valid")
 	}
-	return strings.ToLower(addr.Address), nil
+	normalized := strings.ToLower(addr.Address)
+	if at := strings.LastIndex(normalized, "@"); strings.Contains(normalized[at+1:], "*") {
+		return "", errors.New("wildcards are only allowed before the @")
+	}
+	return normalized, nil
 }
 
 func normalizeEmailList(emails []string) ([]string, error) {
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// TokenPrefix starts every API token, so leaked tokens are easy to spot.
+const TokenPrefix = "lsmtp_"
+
+var tokenNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ValidateTokenName checks that name can appear in a URL path unescaped.
+func ValidateTokenName(name string) error {
+	if !tokenNamePattern.MatchString(name) {
+		return errors.New("token name must be 1-64 letters, digits, dots, dashes or underscores")
+	}
+	return nil
+}
+
+// GenerateToken returns a new random API token.
+func GenerateToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("generate api token: %w", err)
+	}
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HashToken is how tokens are stored. They are random enough that a plain
+// SHA-256 is as good as a password hash, and cheap to check per request.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// DisplayPrefix is the part of a token shown when listing tokens.
+func DisplayPrefix(token string) string {
+	return token[:min(len(token), len(TokenPrefix)+4)]
+}
@@ -0,0 +1,202 @@
+// Package blobstore keeps large message data on the filesystem, addressed by
+// the SHA-256 of its uncompressed content so identical blobs are stored once.
+package blobstore
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// extensions maps each codec to the file suffix that records it, so blobs
+// written under a different setting stay readable.
+var extensions = map[Compression]string{
+	CompressionNone: "",
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+var ErrNotFound = errors.New("blob not found")
+
+type Store struct {
+	root        string
+	compression Compression
+}
+
+func Open(root string, compression Compression) (*Store, error) {
+	if _, ok := extensions[compression]; !ok {
+		return nil, fmt.Errorf("unknown blob compression %q", compression)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "tmp"), 0o755); err != nil {
+		return nil, fmt.Errorf("create blob store: %w", err)
+	}
+	return &Store{root: root, compression: compression}, nil
+}
+
+// Put stores the content of r and returns its key and uncompressed size. If
+// the content is already stored, the new copy is discarded and the existing
+// blob's modification time is refreshed so garbage collection running at the
+// same time does not remove it.
+func (s *Store) Put(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "blob-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("put blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	compressor, err := s.compressor(tmp)
+	if err != nil {
+		return "", 0, fmt.Errorf("put blob: %w", err)
+	}
+	size, err := io.Copy(io.MultiWriter(hash, compressor), r)
+	if err != nil {
+		return "", 0, fmt.Errorf("put blob: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return "", 0, fmt.Errorf("put blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, fmt.Errorf("put blob: %w", err)
+	}
+
+	key := hex.EncodeToString(hash.Sum(nil))
+	if path, _, err := s.find(key); err == nil {
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			return "", 0, fmt.Errorf("put blob: %w", err)
+		}
+		return key, size, nil
+	}
+	path := s.path(key, s.compression)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", 0, fmt.Errorf("put blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, fmt.Errorf("put blob: %w", err)
+	}
+	return key, size, nil
+}
+
+// Open returns the uncompressed content of key. size is the uncompressed
+// length, which callers already know, so seeking from the end needs no read.
+func (s *Store) Open(key string, size int64) (io.ReadSeekCloser, error) {
+	path, compression, err := s.find(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open blob: %w", err)
+	}
+	return &reader{path: path, compression: compression, size: size, file: file}, nil
+}
+
+// ReadAll returns the whole content of key.
+func (s *Store) ReadAll(key string, size int64) ([]byte, error) {
+	r, err := s.Open(key, size)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read blob: %w", err)
+	}
+	return data, nil
+}
+
+func (s *Store) Remove(key string) error {
+	path, _, err := s.find(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove blob: %w", err)
+	}
+	return nil
+}
+
+// Walk calls fn for every stored blob with its last modification time.
+func (s *Store) Walk(fn func(key string, modTime time.Time) error) error {
+	return filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path == filepath.Join(s.root, "tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		key, _, ok := strings.Cut(entry.Name(), ".")
+		if !ok {
+			key = entry.Name()
+		}
+		if len(key) != sha256.Size*2 {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(key, info.ModTime())
+	})
+}
+
+func (s *Store) path(key string, compression Compression) string {
+	return filepath.Join(s.root, key[0:2], key[2:4], key+extensions[compression])
+}
+
+func (s *Store) find(key string) (string, Compression, error) {
+	if len(key) != sha256.Size*2 {
+		return "", "", fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, compression := range []Compression{s.compression, CompressionZstd, CompressionGzip, CompressionNone} {
+		path := s.path(key, compression)
+		if _, err := os.Stat(path); err == nil {
+			return path, compression, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: %s", ErrNotFound, key)
+}
+
+func (s *Store) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch s.compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true), zstd.WithWindowSize(1<<20))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package blobstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// content is large enough to span several compressed blocks, so seeks have
+// to decompress and discard.
+var content = []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 40000))
+
+func TestRoundTrip(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			s := open(t, compression)
+			key, size, err := s.Put(bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if size != int64(len(content)) {
+				t.Errorf("size = %d, want %d", size, len(content))
+			}
+			if _, err := os.Stat(s.path(key, compression)); err != nil {
+				t.Errorf("blob not stored with %s suffix: %v", compression, err)
+			}
+			got, err := s.ReadAll(key, size)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("ReadAll returned %d bytes that differ from the %d stored", len(got), len(content))
+			}
+		})
+	}
+}
+
+func TestReadOtherCompression(t *testing.T) {
+	root := t.TempDir()
+	gzipped, err := Open(root, CompressionGzip)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	key, size, err := gzipped.Put(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	zstd, err := Open(root, CompressionZstd)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, err := zstd.ReadAll(key, size)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("gzip blob read with zstd configured: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestPutDeduplicates(t *testing.T) {
+	s := open(t, CompressionZstd)
+	first, _, err := s.Put(strings.NewReader("same logo"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	path, _, err := s.find(first)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	second, _, err := s.Put(strings.NewReader("same logo"))
+	if err != nil {
+		t.Fatalf("Put again: %v", err)
+	}
+	if second != first {
+		t.Errorf("keys differ for the same content: %s, %s", first, second)
+	}
+	other, _, err := s.Put(strings.NewReader("another logo"))
+	if err != nil {
+		t.Fatalf("Put other: %v", err)
+	}
+	if other == first {
+		t.Error("different content got the same key")
+	}
+
+	var keys []string
+	err = s.Walk(func(key string, modTime time.Time) error {
+		keys = append(keys, key)
+		if key == first && modTime.Before(time.Now().Add(-time.Hour)) {
+			t.Error("storing a duplicate did not refresh the blob's modification time")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("Walk found %d blobs, want 2", len(keys))
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.root, "tmp")); len(entries) != 0 {
+		t.Errorf("%d temporary files left behind", len(entries))
+	}
+}
+
+func TestSeek(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int64
+		whence int
+		want   int64
+	}{
+		{name: "start", offset: 0, whence: io.SeekStart, want: 0},
+		{name: "forward", offset: 1000003, whence: io.SeekStart, want: 1000003},
+		{name: "current", offset: 45, whence: io.SeekCurrent, want: 1000148},
+		{name: "backward", offset: 17, whence: io.SeekStart, want: 17},
+		{name: "from end", offset: -500, whence: io.SeekEnd, want: int64(len(content)) - 500},
+	}
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			s := open(t, compression)
+			key, size, err := s.Put(bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			r, err := s.Open(key, size)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer r.Close()
+			// The cases run in order on one reader, like a client
+			// fetching several ranges.
+			for _, tc := range tests {
+				pos, err := r.Seek(tc.offset, tc.whence)
+				if err != nil || pos != tc.want {
+					t.Fatalf("%s: Seek = %d, %v; want %d", tc.name, pos, err, tc.want)
+				}
+				got := make([]byte, 100)
+				n, err := io.ReadFull(r, got)
+				if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("%s: read: %v", tc.name, err)
+				}
+				end := min(tc.want+100, int64(len(content)))
+				if !bytes.Equal(got[:n], content[tc.want:end]) {
+					t.Errorf("%s: read %q, want %q", tc.name, got[:n], content[tc.want:end])
+				}
+				// Leave the position where the range ended, as the next
+				// case expects.
+				if _, err := r.Seek(tc.want+int64(n), io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := r.Seek(0, io.SeekEnd); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("read at end = %d, %v; want EOF", n, err)
+			}
+		})
+	}
+}
+
+func TestMissingBlob(t *testing.T) {
+	s := open(t, CompressionZstd)
+	key := strings.Repeat("ab", 32)
+	if _, err := s.Open(key, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open missing = %v, want ErrNotFound", err)
+	}
+	if err := s.Remove(key); err != nil {
+		t.Errorf("Remove missing = %v", err)
+	}
+	if _, err := s.Open("not-a-key", 1); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Open invalid key = %v, want an invalid key error", err)
+	}
+}
+
+func open(t *testing.T, compression Compression) *Store {
+	t.Helper()
+	s, err := Open(t.TempDir(), compression)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return s
+}
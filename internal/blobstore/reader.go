@@ -0,0 +1,122 @@
+package blobstore
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// reader decompresses a blob on demand. Seek only records the position; the
+// next Read skips forward by decompressing and discarding, or restarts from
+// the beginning when seeking backwards. That is enough for HTTP Range
+// requests without holding the blob in memory.
+type reader struct {
+	path        string
+	compression Compression
+	size        int64
+	file        *os.File
+	decoder     io.Reader
+	closeDecode func()
+	pos         int64
+	decoded     int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if err := r.position(); err != nil {
+		return 0, err
+	}
+	n, err := r.decoder.Read(p)
+	r.pos += int64(n)
+	r.decoded += int64(n)
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("seek blob: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek blob: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *reader) Close() error {
+	r.closeDecoder()
+	return r.file.Close()
+}
+
+// position moves the decoder to r.pos.
+func (r *reader) position() error {
+	if r.compression == CompressionNone {
+		if r.decoder == nil || r.decoded != r.pos {
+			if _, err := r.file.Seek(r.pos, io.SeekStart); err != nil {
+				return fmt.Errorf("seek blob: %w", err)
+			}
+			r.decoder = r.file
+			r.decoded = r.pos
+		}
+		return nil
+	}
+
+	if r.decoder == nil || r.pos < r.decoded {
+		if err := r.restart(); err != nil {
+			return err
+		}
+	}
+	if skip := r.pos - r.decoded; skip > 0 {
+		n, err := io.CopyN(io.Discard, r.decoder, skip)
+		r.decoded += n
+		if err != nil {
+			return fmt.Errorf("seek blob: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *reader) restart() error {
+	r.closeDecoder()
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek blob: %w", err)
+	}
+	switch r.compression {
+	case CompressionGzip:
+		decoder, err := gzip.NewReader(r.file)
+		if err != nil {
+			return fmt.Errorf("open blob %s: %w", r.path, err)
+		}
+		r.decoder = decoder
+		r.closeDecode = func() { decoder.Close() }
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r.file, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return fmt.Errorf("open blob %s: %w", r.path, err)
+		}
+		r.decoder = decoder
+		r.closeDecode = decoder.Close
+	}
+	r.decoded = 0
+	return nil
+}
+
+func (r *reader) closeDecoder() {
+	if r.closeDecode != nil {
+		r.closeDecode()
+		r.closeDecode = nil
+	}
+	r.decoder = nil
+}
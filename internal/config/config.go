@@ -4,27 +4,114 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	HTTPPort        int
-	SMTPPort        int
-	DBPath          string
-	AuthSecret      string
-	SMTPAuthEnabled bool
-	SMTPUsername    string
-	SMTPPassword    string
+	HTTPPort           int
+	SMTPPort           int
+	DBPath             string
+	DBReadConns        int
+	MigrateOnStart     bool
+	StorageBackend     string
+	MemoryMaxMessages  int
+	BlobStoreDir       string
+	BlobCompression    string
+	AuthSecret         string
+	AdminEmails        string
+	AdminSecret        string
+	SMTPAuthEnabled    bool
+	SMTPUsername       string
+	SMTPPassword       string
+	CredentialsFile    string
+	SMTPTLSEnabled     bool
+	SMTPSPort          int
+	SMTPSpoolKB        int
+	SMTPSpoolDir       string
+	IngestQueueSize    int
+	IngestMaxBatch     int
+	IngestBatchWait    time.Duration
+	IngestBackpressure string
+	IngestBlockTimeout time.Duration
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSCacheDir        string
+	FaultsFile         string
+	MagicEnabled       bool
+	MagicFile          string
+	MagicLinkPatterns  string
+	Subaddressing      bool
+	AliasesFile        string
+	IMAPPort           int
+	IMAPAuthEnabled    bool
+	POP3Port           int
+	POP3AuthEnabled    bool
+
+	WebhooksFile        string
+	WebhookMaxAttempts  int
+	WebhookTimeout      time.Duration
+	WebhookLogRetention time.Duration
+
+	RetentionMaxAge        time.Duration
+	RetentionMaxMessages   int
+	RetentionMaxPerMailbox int
+	RetentionMaxDBSizeMB   int
+	RetentionInterval      time.Duration
+	RetentionBatchSize     int
 }
 
 func Load() Config {
 	return Config{
-		HTTPPort:        getEnvInt("HTTP_PORT", 3025),
-		SMTPPort:        getEnvInt("SMTP_PORT", 2025),
-		DBPath:          getEnvString("DB_PATH", ""),
-		AuthSecret:      getEnvString("AUTH_SECRET", ""),
-		SMTPAuthEnabled: getEnvBool("SMTP_AUTH_ENABLED", true),
-		SMTPUsername:    getEnvString("SMTP_USERNAME", "localsmtp"),
-		SMTPPassword:    getEnvString("SMTP_PASSWORD", "localsmtp"),
+		HTTPPort:           getEnvInt("HTTP_PORT", 3025),
+		SMTPPort:           getEnvInt("SMTP_PORT", 2025),
+		DBPath:             getEnvString("DB_PATH", ""),
+		DBReadConns:        getEnvInt("DB_READ_CONNECTIONS", 4),
+		MigrateOnStart:     getEnvBool("MIGRATE_ON_START", true),
+		StorageBackend:     strings.ToLower(getEnvString("STORAGE_BACKEND", "sqlite")),
+		MemoryMaxMessages:  getEnvInt("MEMORY_MAX_MESSAGES", 1000),
+		BlobStoreDir:       getEnvString("BLOB_STORE_DIR", ""),
+		BlobCompression:    strings.ToLower(getEnvString("BLOB_COMPRESSION", "zstd")),
+		AuthSecret:         getEnvString("AUTH_SECRET", ""),
+		AdminEmails:        strings.ToLower(getEnvString("ADMIN_EMAILS", "")),
+		AdminSecret:        getEnvString("ADMIN_SECRET", ""),
+		SMTPAuthEnabled:    getEnvBool("SMTP_AUTH_ENABLED", true),
+		SMTPUsername:       getEnvString("SMTP_USERNAME", "localsmtp"),
+		SMTPPassword:       getEnvString("SMTP_PASSWORD", "localsmtp"),
+		CredentialsFile:    getEnvString("SMTP_CREDENTIALS_FILE", ""),
+		SMTPTLSEnabled:     getEnvBool("SMTP_TLS_ENABLED", false),
+		SMTPSPort:          getEnvInt("SMTPS_PORT", 0),
+		SMTPSpoolKB:        getEnvInt("SMTP_SPOOL_THRESHOLD_KB", 1024),
+		SMTPSpoolDir:       getEnvString("SMTP_SPOOL_DIR", ""),
+		IngestQueueSize:    getEnvInt("INGEST_QUEUE_SIZE", 1000),
+		IngestMaxBatch:     getEnvInt("INGEST_MAX_BATCH", 100),
+		IngestBatchWait:    getEnvDuration("INGEST_BATCH_WAIT", 0),
+		IngestBackpressure: strings.ToLower(getEnvString("INGEST_BACKPRESSURE", "block")),
+		IngestBlockTimeout: getEnvDuration("INGEST_BLOCK_TIMEOUT", 30*time.Second),
+		TLSCertFile:        getEnvString("TLS_CERT_FILE", ""),
+		TLSKeyFile:         getEnvString("TLS_KEY_FILE", ""),
+		TLSCacheDir:        getEnvString("TLS_CACHE_DIR", ""),
+		FaultsFile:         getEnvString("FAULTS_FILE", ""),
+		MagicEnabled:       getEnvBool("MAGIC_ADDRESSES_ENABLED", false),
+		MagicFile:          getEnvString("MAGIC_ADDRESSES_FILE", ""),
+		MagicLinkPatterns:  getEnvString("MAGIC_LINK_PATTERNS", ""),
+		Subaddressing:      getEnvBool("SUBADDRESSING", false),
+		AliasesFile:        getEnvString("ALIASES_FILE", ""),
+		IMAPPort:           getEnvInt("IMAP_PORT", 0),
+		IMAPAuthEnabled:    getEnvBool("IMAP_AUTH_ENABLED", false),
+		POP3Port:           getEnvInt("POP3_PORT", 0),
+		POP3AuthEnabled:    getEnvBool("POP3_AUTH_ENABLED", false),
+
+		WebhooksFile:        getEnvString("WEBHOOKS_FILE", ""),
+		WebhookMaxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookTimeout:      getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookLogRetention: getEnvDuration("WEBHOOK_LOG_RETENTION", 7*24*time.Hour),
+
+		RetentionMaxAge:        getEnvDuration("RETENTION_MAX_AGE", 0),
+		RetentionMaxMessages:   getEnvInt("RETENTION_MAX_MESSAGES", 0),
+		RetentionMaxPerMailbox: getEnvInt("RETENTION_MAX_MESSAGES_PER_MAILBOX", 0),
+		RetentionMaxDBSizeMB:   getEnvInt("RETENTION_MAX_DB_SIZE_MB", 0),
+		RetentionInterval:      getEnvDuration("RETENTION_INTERVAL", 5*time.Minute),
+		RetentionBatchSize:     getEnvInt("RETENTION_BATCH_SIZE", 500),
 	}
 }
 
@@ -48,6 +135,23 @@ func getEnvInt(key string, fallback int) int {
 	return fallback
 }
 
+// getEnvDuration accepts Go durations such as "72h" or "30m", plus a "d" suffix
+// for days.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		trimmed := strings.TrimSpace(value)
+		if days, found := strings.CutSuffix(trimmed, "d"); found {
+			if parsed, err := strconv.Atoi(days); err == nil {
+				return time.Duration(parsed) * 24 * time.Hour
+			}
+		}
+		if parsed, err := time.ParseDuration(trimmed); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
 func getEnvBool(key string, fallback bool) bool {
 	if value, ok := os.LookupEnv(key); ok {
 		parsed, err := strconv.ParseBool(strings.TrimSpace(value))
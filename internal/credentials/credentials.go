@@ -0,0 +1,246 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// ErrInvalid is returned for an unknown username or a wrong password.
+var ErrInvalid = errors.New("invalid credentials")
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@+-]{1,64}$`)
+
+// fileCredential is one entry of SMTP_CREDENTIALS_FILE.
+type fileCredential struct {
+	Username       string   `json:"username"`
+	PasswordHash   string   `json:"passwordHash"`
+	AllowedSenders []string `json:"allowedSenders"`
+	RatePerHour    int      `json:"ratePerHour"`
+	Project        string   `json:"project"`
+}
+
+// LoadFile reads a JSON array of credentials with bcrypt password hashes.
+// An empty path yields none.
+func LoadFile(name string) ([]store.SMTPCredential, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read smtp credentials file: %w", err)
+	}
+	var entries []fileCredential
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse smtp credentials file: %w", err)
+	}
+	credentials := make([]store.SMTPCredential, 0, len(entries))
+	for _, entry := range entries {
+		credentials = append(credentials, store.SMTPCredential{
+			Username:       entry.Username,
+			PasswordHash:   entry.PasswordHash,
+			AllowedSenders: entry.AllowedSenders,
+			RatePerHour:    entry.RatePerHour,
+			Project:        entry.Project,
+		})
+	}
+	return credentials, nil
+}
+
+// Hash returns the bcrypt hash stored for password.
+func Hash(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("password is required")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// Validate checks credential and normalizes its allowed senders.
+func Validate(credential store.SMTPCredential) (store.SMTPCredential, error) {
+	if !usernamePattern.MatchString(credential.Username) {
+		return credential, errors.New("username must be 1-64 letters, digits or ._@+- characters")
+	}
+	if _, err := bcrypt.Cost([]byte(credential.PasswordHash)); err != nil {
+		return credential, fmt.Errorf("%s: password hash is not a bcrypt hash", credential.Username)
+	}
+	if credential.RatePerHour < 0 {
+		return credential, fmt.Errorf("%s: rate per hour cannot be negative", credential.Username)
+	}
+	senders := credential.AllowedSenders
+	credential.AllowedSenders = nil
+	for _, sender := range senders {
+		normalized, err := auth.NormalizeEmail(sender)
+		if err != nil {
+			return credential, fmt.Errorf("%s: allowed sender %q: %w", credential.Username, sender, err)
+		}
+		credential.AllowedSenders = append(credential.AllowedSenders, normalized)
+	}
+	credential.Project = strings.TrimSpace(credential.Project)
+	return credential, nil
+}
+
+// AllowsSender reports whether credential may use from, a normalized
+// address, as MAIL FROM.
+func AllowsSender(credential store.SMTPCredential, from string) bool {
+	if len(credential.AllowedSenders) == 0 {
+		return true
+	}
+	for _, sender := range credential.AllowedSenders {
+		if auth.MatchEmail(sender, from) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set checks SMTP logins against the credentials from configuration, which
+// are fixed, and those managed through the API, which live in the store. It
+// also tracks each credential's hourly quota in memory.
+type Set struct {
+	store  store.Storage
+	static map[string]store.SMTPCredential
+	order  []string
+
+	mu    sync.Mutex
+	usage map[string]*window
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+// NewSet validates the static credentials.
+func NewSet(storage store.Storage, static []store.SMTPCredential) (*Set, error) {
+	set := &Set{store: storage, static: map[string]store.SMTPCredential{}, usage: map[string]*window{}}
+	for idx, credential := range static {
+		credential, err := Validate(credential)
+		if err != nil {
+			return nil, fmt.Errorf("credential %d: %w", idx, err)
+		}
+		if _, ok := set.static[credential.Username]; ok {
+			return nil, fmt.Errorf("credential %d: duplicate username %s", idx, credential.Username)
+		}
+		set.static[credential.Username] = credential
+		set.order = append(set.order, credential.Username)
+	}
+	return set, nil
+}
+
+// Static returns the credentials from configuration in their given order.
+func (s *Set) Static() []store.SMTPCredential {
+	credentials := make([]store.SMTPCredential, 0, len(s.order))
+	for _, username := range s.order {
+		credentials = append(credentials, s.static[username])
+	}
+	return credentials
+}
+
+// IsStatic reports whether username comes from configuration, and so
+// cannot be created or deleted through the API.
+func (s *Set) IsStatic(username string) bool {
+	_, ok := s.static[username]
+	return ok
+}
+
+// Authenticate returns the credential for username if password matches.
+func (s *Set) Authenticate(ctx context.Context, username, password string) (store.SMTPCredential, error) {
+	credential, ok := s.static[username]
+	if !ok {
+		var err error
+		credential, err = s.store.SMTPCredentialByUsername(ctx, username)
+		if errors.Is(err, store.ErrNotFound) {
+			return store.SMTPCredential{}, ErrInvalid
+		}
+		if err != nil {
+			return store.SMTPCredential{}, err
+		}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), []byte(password)) != nil {
+		return store.SMTPCredential{}, ErrInvalid
+	}
+	return credential, nil
+}
+
+// AuthenticateMailbox checks an IMAP or POP3 login, where the username is the
+// mailbox to open. password must belong to a credential that may send as
+// email, so a credential limited to some senders only reads their mail.
+func (s *Set) AuthenticateMailbox(ctx context.Context, email, password string) (store.SMTPCredential, error) {
+	candidates := s.Static()
+	stored, err := s.store.ListSMTPCredentials(ctx)
+	if err != nil {
+		return store.SMTPCredential{}, err
+	}
+	for _, credential := range stored {
+		if !s.IsStatic(credential.Username) {
+			candidates = append(candidates, credential)
+		}
+	}
+	for _, credential := range candidates {
+		if !AllowsSender(credential, email) {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), []byte(password)) == nil {
+			return credential, nil
+		}
+	}
+	return store.SMTPCredential{}, ErrInvalid
+}
+
+// Reserve takes one message from credential's quota for this hour, and
+// reports false when none is left. Sessions reserve at MAIL so concurrent
+// transactions cannot overrun the quota, and Release the slot if no message
+// is accepted.
+func (s *Set) Reserve(credential store.SMTPCredential, now time.Time) bool {
+	if credential.RatePerHour <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.current(credential.Username, now)
+	if usage.count >= credential.RatePerHour {
+		return false
+	}
+	usage.count++
+	return true
+}
+
+// Release gives back a slot Reserve took at reservedAt. Slots from a window
+// that has since ended are already gone.
+func (s *Set) Release(credential store.SMTPCredential, reservedAt time.Time) {
+	if credential.RatePerHour <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage, ok := s.usage[credential.Username]
+	if ok && !reservedAt.Before(usage.start) && usage.count > 0 {
+		usage.count--
+	}
+}
+
+// current returns the quota window for username at now, starting a new one
+// every hour. Callers hold mu.
+func (s *Set) current(username string, now time.Time) *window {
+	usage, ok := s.usage[username]
+	if !ok || now.Sub(usage.start) >= time.Hour {
+		usage = &window{start: now}
+		s.usage[username] = usage
+	}
+	return usage
+}
@@ -0,0 +1,161 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+func hash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestAllowsSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		from    string
+		want    bool
+	}{
+		{name: "unrestricted", from: "anyone@example.org", want: true},
+		{name: "exact", allowed: []string{"billing@example.com"}, from: "billing@example.com", want: true},
+		{name: "other address", allowed: []string{"billing@example.com"}, from: "support@example.com", want: false},
+		{name: "wildcard domain", allowed: []string{"*@example.com"}, from: "support@example.com", want: true},
+		{name: "wildcard other domain", allowed: []string{"*@example.com"}, from: "support@example.org", want: false},
+		{name: "any of several", allowed: []string{"a@example.com", "*@example.org"}, from: "b@example.org", want: true},
+		{name: "null sender", allowed: []string{"*@example.com"}, from: "", want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			credential := store.SMTPCredential{AllowedSenders: tc.allowed}
+			if got := AllowsSender(credential, tc.from); got != tc.want {
+				t.Errorf("AllowsSender(%q) = %v, want %v", tc.from, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := hash(t, "secret")
+	tests := []struct {
+		name       string
+		credential store.SMTPCredential
+		wantErr    bool
+	}{
+		{name: "valid", credential: store.SMTPCredential{Username: "ci-bot", PasswordHash: valid, AllowedSenders: []string{"*@example.com"}, RatePerHour: 10}},
+		{name: "email username", credential: store.SMTPCredential{Username: "ci+bot@example.com", PasswordHash: valid}},
+		{name: "empty username", credential: store.SMTPCredential{PasswordHash: valid}, wantErr: true},
+		{name: "username with space", credential: store.SMTPCredential{Username: "ci bot", PasswordHash: valid}, wantErr: true},
+		{name: "plain password", credential: store.SMTPCredential{Username: "ci", PasswordHash: "secret"}, wantErr: true},
+		{name: "negative rate", credential: store.SMTPCredential{Username: "ci", PasswordHash: valid, RatePerHour: -1}, wantErr: true},
+		{name: "bad sender", credential: store.SMTPCredential{Username: "ci", PasswordHash: valid, AllowedSenders: []string{"billing"}}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Validate(tc.credential); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuota(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	limited := store.SMTPCredential{Username: "limited", RatePerHour: 2}
+	unlimited := store.SMTPCredential{Username: "unlimited"}
+	set, err := NewSet(store.NewMemory(10), nil)
+	if err != nil {
+		t.Fatalf("NewSet: %v", err)
+	}
+	// Steps run in order against the same set.
+	steps := []struct {
+		name       string
+		credential store.SMTPCredential
+		release    bool
+		at         time.Duration
+		reservedAt time.Duration
+		want       bool
+	}{
+		{name: "first", credential: limited, at: 0, want: true},
+		{name: "second", credential: limited, at: time.Minute, want: true},
+		{name: "over quota", credential: limited, at: 2 * time.Minute, want: false},
+		{name: "unlimited is not counted", credential: unlimited, at: 2 * time.Minute, want: true},
+		{name: "release", credential: limited, release: true, reservedAt: time.Minute},
+		{name: "released slot", credential: limited, at: 3 * time.Minute, want: true},
+		{name: "over quota again", credential: limited, at: 4 * time.Minute, want: false},
+		{name: "window expired", credential: limited, at: time.Hour, want: true},
+		{name: "release from the old window is ignored", credential: limited, release: true, reservedAt: 3 * time.Minute},
+		{name: "new window", credential: limited, at: time.Hour + time.Minute, want: true},
+		{name: "new window full", credential: limited, at: time.Hour + 2*time.Minute, want: false},
+	}
+	for _, step := range steps {
+		if step.release {
+			set.Release(step.credential, start.Add(step.reservedAt))
+			continue
+		}
+		if got := set.Reserve(step.credential, start.Add(step.at)); got != step.want {
+			t.Errorf("%s: Reserve() = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	memory := store.NewMemory(10)
+	if _, err := memory.CreateSMTPCredential(ctx, store.SMTPCredential{Username: "api", PasswordHash: hash(t, "api-pass"), AllowedSenders: []string{"*@api.example.com"}}); err != nil {
+		t.Fatalf("create credential: %v", err)
+	}
+	set, err := NewSet(memory, []store.SMTPCredential{
+		{Username: "static", PasswordHash: hash(t, "static-pass")},
+		{Username: "billing", PasswordHash: hash(t, "billing-pass"), AllowedSenders: []string{"billing@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("NewSet: %v", err)
+	}
+	tests := []struct {
+		name     string
+		mailbox  bool
+		username string
+		password string
+		want     string
+	}{
+		{name: "static", username: "static", password: "static-pass", want: "static"},
+		{name: "stored", username: "api", password: "api-pass", want: "api"},
+		{name: "wrong password", username: "static", password: "api-pass"},
+		{name: "unknown user", username: "nobody", password: "static-pass"},
+		{name: "mailbox of an unrestricted credential", mailbox: true, username: "anyone@example.org", password: "static-pass", want: "static"},
+		{name: "mailbox the credential may send as", mailbox: true, username: "billing@example.com", password: "billing-pass", want: "billing"},
+		{name: "mailbox of a stored credential", mailbox: true, username: "ops@api.example.com", password: "api-pass", want: "api"},
+		{name: "mailbox the credential may not send as", mailbox: true, username: "ceo@example.com", password: "billing-pass"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var credential store.SMTPCredential
+			var err error
+			if tc.mailbox {
+				credential, err = set.AuthenticateMailbox(ctx, tc.username, tc.password)
+			} else {
+				credential, err = set.Authenticate(ctx, tc.username, tc.password)
+			}
+			if tc.want == "" {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("err = %v, want ErrInvalid", err)
+				}
+				return
+			}
+			if err != nil || credential.Username != tc.want {
+				t.Errorf("got %q, %v; want %q", credential.Username, err, tc.want)
+			}
+		})
+	}
+}
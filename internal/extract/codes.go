@@ -0,0 +1,144 @@
+package extract
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// Code is a candidate one-time code.
+type Code struct {
+	// Value is the code with any grouping separator removed, so "123 456"
+	// becomes "123456".
+	Value string `json:"value"`
+	// Source is where the code was found: subject, text or html.
+	Source string `json:"source"`
+	// Context is the text around the code.
+	Context string `json:"context"`
+	// Keyword is set when a word such as "code" or "verification" comes
+	// shortly before the code. Those candidates are much more likely right.
+	Keyword bool `json:"keyword"`
+}
+
+var (
+	// codePattern matches 4-8 digits, two groups of three digits, or 6-10
+	// uppercase letters and digits.
+	codePattern    = regexp.MustCompile(`\b(?:\d{3}[ -]\d{3}|\d{4,8}|[A-Z0-9]{6,10})\b`)
+	keywordPattern = regexp.MustCompile(`(?i)\b(code|otp|pin|passcode|password|verification|verify|one[- ]time|token|security|2fa|mfa|login|sign[- ]in)\b`)
+	yearPattern    = regexp.MustCompile(`^(19|20)\d\d$`)
+)
+
+const (
+	keywordDistance = 60
+	contextRadius   = 40
+)
+
+// Codes returns candidate one-time codes from the subject, text body and
+// HTML body, best first: codes preceded by a keyword, then six digit codes,
+// then the rest in order of appearance.
+func Codes(message store.Message) []Code {
+	var codes []Code
+	seen := map[string]struct{}{}
+	sources := []struct{ name, text string }{
+		{"subject", message.Subject},
+		{"text", message.TextBody},
+		{"html", htmlText(message.HTMLBody)},
+	}
+	for _, source := range sources {
+		for _, code := range findCodes(source.name, source.text) {
+			if _, ok := seen[code.Value]; ok {
+				continue
+			}
+			seen[code.Value] = struct{}{}
+			codes = append(codes, code)
+		}
+	}
+	sort.SliceStable(codes, func(i, j int) bool {
+		if codes[i].Keyword != codes[j].Keyword {
+			return codes[i].Keyword
+		}
+		return isSixDigits(codes[i].Value) && !isSixDigits(codes[j].Value)
+	})
+	return codes
+}
+
+func findCodes(source, text string) []Code {
+	// URLs are full of digits and ids that are not codes.
+	text = urlPattern.ReplaceAllStringFunc(text, func(match string) string {
+		return strings.Repeat(" ", len(match))
+	})
+	var codes []Code
+	for _, loc := range codePattern.FindAllStringIndex(text, -1) {
+		start, end := loc[0], loc[1]
+		match := text[start:end]
+		if partOfNumber(text, start, end) {
+			continue
+		}
+		keyword := keywordPattern.MatchString(text[max(0, start-keywordDistance):start])
+		value := strings.NewReplacer(" ", "", "-", "").Replace(match)
+		digits := strings.IndexFunc(value, func(r rune) bool { return !unicode.IsDigit(r) }) == -1
+		if !digits {
+			// Uppercase words and ids are common, so letters need both a
+			// digit and a keyword to count.
+			if !keyword || !strings.ContainsFunc(value, unicode.IsDigit) || !strings.ContainsFunc(value, unicode.IsLetter) {
+				continue
+			}
+		}
+		if digits && !keyword && yearPattern.MatchString(value) {
+			continue
+		}
+		codes = append(codes, Code{
+			Value:   value,
+			Source:  source,
+			Context: collapseSpace(text[max(0, start-contextRadius):min(len(text), end+contextRadius)]),
+			Keyword: keyword,
+		})
+	}
+	return codes
+}
+
+// partOfNumber rejects matches that are pieces of a larger number, such as
+// a date, time, price, phone number or version. codePattern already matches
+// a grouped code whole, so a digit just past a separator means the match is
+// part of something longer.
+func partOfNumber(text string, start, end int) bool {
+	if start > 0 {
+		if prev, _ := utf8.DecodeLastRuneInString(text[:start]); strings.ContainsRune("$€£#+", prev) {
+			return true
+		}
+		prev := text[start-1]
+		if strings.IndexByte("./:,- ", prev) >= 0 && start > 1 && isDigit(text[start-2]) {
+			return true
+		}
+	}
+	if end < len(text) {
+		next := text[end]
+		if next == '%' {
+			return true
+		}
+		if strings.IndexByte("./:,- ", next) >= 0 && end+1 < len(text) && isDigit(text[end+1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isSixDigits(value string) bool {
+	if len(value) != 6 {
+		return false
+	}
+	for idx := 0; idx < len(value); idx++ {
+		if !isDigit(value[idx]) {
+			return false
+		}
+	}
+	return true
+}
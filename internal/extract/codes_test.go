@@ -0,0 +1,99 @@
+package extract
+
+import (
+	"reflect"
+	"testing"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+func TestCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		message store.Message
+		want    []string
+	}{
+		{
+			name: "verification code",
+			message: store.Message{
+				Subject:  "Verify your email",
+				TextBody: "Hi Alice,\n\nYour verification code is 482913. It expires in 10 minutes.\n",
+			},
+			want: []string{"482913"},
+		},
+		{
+			name: "grouped code in subject",
+			message: store.Message{
+				Subject:  "123 456 is your Example sign-in code",
+				TextBody: "Enter 123 456 to sign in.",
+			},
+			want: []string{"123456"},
+		},
+		{
+			name: "html body",
+			message: store.Message{
+				HTMLBody: `<html><head><style>.code { font-size: 24px; }</style></head><body>
+<p>Use the code below to finish signing in:</p>
+<p class="code"><strong>7 0 4 1 5 2</strong></p>
+<p class="code"><strong>704152</strong></p>
+<p>&copy; 2024 Example Inc.</p>
+</body></html>`,
+			},
+			want: []string{"704152"},
+		},
+		{
+			name: "alphanumeric code",
+			message: store.Message{
+				TextBody: "WELCOME TO EXAMPLE\n\nYour one-time passcode: K7P2QX\n\nORDER ABCDEFG ships soon.",
+			},
+			want: []string{"K7P2QX"},
+		},
+		{
+			name: "numbers that are not codes",
+			message: store.Message{
+				TextBody: "Order total: $1249.00, paid 2024-01-31 at 10:45.\n" +
+					"Call +1 555 0100 or 1-800-555-0199. Version 10.4.2, 25% off.\n" +
+					"Track it at https://example.com/orders/98765432\n" +
+					"Copyright 2024",
+			},
+			want: nil,
+		},
+		{
+			name: "keyword first",
+			message: store.Message{
+				TextBody: "Ticket 5821 was updated.\nReference 902211.\nYour security code is 3390.",
+			},
+			want: []string{"3390", "902211", "5821"},
+		},
+		{
+			name: "year after keyword",
+			message: store.Message{
+				TextBody: "Your PIN: 1987",
+			},
+			want: []string{"1987"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, code := range Codes(tc.message) {
+				got = append(got, code.Value)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Codes() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCodesDetail(t *testing.T) {
+	codes := Codes(store.Message{
+		Subject:  "Your login code",
+		TextBody: "Hello,\n\nEnter 551203 on the sign-in page.\n",
+		HTMLBody: "<p>Enter <b>551203</b> on the sign-in page.</p>",
+	})
+	want := []Code{{Value: "551203", Source: "text", Context: "Hello, Enter 551203 on the sign-in page.", Keyword: false}}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("Codes() = %+v, want %+v", codes, want)
+	}
+}
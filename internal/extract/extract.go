@@ -0,0 +1,270 @@
+// Package extract pulls what tests usually look for out of a message body:
+// the links it contains and candidate one-time codes.
+package extract
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// DefaultMagicLinkPatterns flag links that carry a token or point at a
+// verify, confirm, login or reset page.
+func DefaultMagicLinkPatterns() []string {
+	return []string{
+		`(?i)[?&](token|code|otp|key|sig|signature|ticket|auth)=[^&]+`,
+		`(?i)/(verify|verification|confirm|activate|magic|login|signin|sign-in|reset|invite|auth)[^/]*(/|$|\?)`,
+	}
+}
+
+// Link is one distinct URL found in a message.
+type Link struct {
+	URL string `json:"url"`
+	// Text lists every distinct anchor text the URL appears with.
+	Text  []string `json:"text"`
+	Count int      `json:"count"`
+	// Tracking is set for click-tracking redirects. Destination is the URL
+	// they redirect to, when it can be read from the link itself.
+	Tracking    bool   `json:"tracking"`
+	Destination string `json:"destination,omitempty"`
+	// Magic is set when the URL, or its destination, matches a magic link
+	// pattern.
+	Magic bool `json:"magic"`
+}
+
+// Target is where following the link ends up, as far as can be told.
+func (l Link) Target() string {
+	if l.Destination != "" {
+		return l.Destination
+	}
+	return l.URL
+}
+
+type Extractor struct {
+	magic []*regexp.Regexp
+}
+
+// New compiles the magic link patterns. No patterns means
+// DefaultMagicLinkPatterns.
+func New(patterns []string) (*Extractor, error) {
+	if len(patterns) == 0 {
+		patterns = DefaultMagicLinkPatterns()
+	}
+	extractor := &Extractor{}
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("magic link pattern %q: %w", pattern, err)
+		}
+		extractor.magic = append(extractor.magic, compiled)
+	}
+	return extractor, nil
+}
+
+var (
+	anchorPattern = regexp.MustCompile(`(?is)<a\b([^>]*)>(.*?)</a\s*>`)
+	hrefPattern   = regexp.MustCompile(`(?is)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	urlPattern    = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'\x60]+`)
+)
+
+// Links returns the http and https links in the HTML and text bodies, in
+// order of first appearance. Anchors in the HTML body come first, since only
+// they carry anchor text.
+func (e *Extractor) Links(message store.Message) []Link {
+	var links []Link
+	index := map[string]int{}
+	add := func(raw, text string) {
+		link, ok := normalizeURL(raw)
+		if !ok {
+			return
+		}
+		idx, seen := index[link]
+		if !seen {
+			idx = len(links)
+			index[link] = idx
+			links = append(links, Link{URL: link, Text: []string{}})
+		}
+		entry := &links[idx]
+		entry.Count++
+		if text != "" && !slices.Contains(entry.Text, text) {
+			entry.Text = append(entry.Text, text)
+		}
+	}
+
+	hrefs := map[string]struct{}{}
+	for _, anchor := range anchorPattern.FindAllStringSubmatch(message.HTMLBody, -1) {
+		href := hrefPattern.FindStringSubmatch(anchor[1])
+		if href == nil {
+			continue
+		}
+		target := html.UnescapeString(href[1] + href[2] + href[3])
+		hrefs[strings.TrimSpace(target)] = struct{}{}
+		add(target, collapseSpace(htmlText(anchor[2])))
+	}
+	// Bare URLs in the HTML body that are not an anchor's href, such as a
+	// link printed for clients that cannot follow it.
+	for _, match := range urlPattern.FindAllString(htmlText(message.HTMLBody), -1) {
+		match = trimURL(match)
+		if _, ok := hrefs[match]; !ok {
+			add(match, "")
+		}
+	}
+	for _, match := range urlPattern.FindAllString(message.TextBody, -1) {
+		add(trimURL(match), "")
+	}
+
+	for idx := range links {
+		link := &links[idx]
+		link.Destination, link.Tracking = unwrapRedirect(link.URL)
+		link.Magic = e.matchesMagic(link.URL) || (link.Destination != "" && e.matchesMagic(link.Destination))
+	}
+	return links
+}
+
+func (e *Extractor) matchesMagic(link string) bool {
+	for _, pattern := range e.magic {
+		if pattern.MatchString(link) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeURL(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", false
+	}
+	return raw, true
+}
+
+// trimURL drops punctuation that ends the sentence around a bare URL rather
+// than the URL itself.
+func trimURL(match string) string {
+	for {
+		trimmed := strings.TrimRight(match, ".,;:!?")
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, "(") < strings.Count(trimmed, ")") {
+			trimmed = strings.TrimSuffix(trimmed, ")")
+		}
+		if trimmed == match {
+			return match
+		}
+		match = trimmed
+	}
+}
+
+// redirectParams are query parameters that click trackers put the
+// destination in.
+var redirectParams = []string{"redirect", "redirect_url", "redirect_uri", "dest", "destination", "goto"}
+
+// trackerParams are short or common names that also carry the destination on
+// tracker hosts, but elsewhere are as likely a search query or a share link.
+var trackerParams = []string{"url", "u", "r", "q", "link", "target"}
+
+// trackingHosts are click-tracking domains whose links hide the destination.
+var trackingHosts = []string{"awstrack.me", "ct.sendgrid.net", "list-manage.com", "mandrillapp.com", "mailgun.org", "mjt.lu", "hubspotlinks.com", "mailchimp.com", "sparkpostmail.com", "postmarkapp.com", "cmail19.com", "cmail20.com"}
+
+// trackingPrefixes are subdomains senders point at their tracker, and
+// trackingPaths the click paths those trackers serve.
+var (
+	trackingPrefixes = []string{"click.", "track.", "links."}
+	trackingPaths    = []string{"/ls/click", "/wf/click", "/track/click", "/CL0/", "/c/", "/e3t/"}
+)
+
+// unwrapRedirect reports whether link is a click-tracking redirect and, if
+// the destination is part of the link, returns it.
+func unwrapRedirect(link string) (string, bool) {
+	destination := ""
+	current := link
+	// Trackers sometimes wrap each other, so unwrap a few levels.
+	for range 3 {
+		next, ok := redirectTarget(current)
+		if !ok {
+			break
+		}
+		destination, current = next, next
+	}
+	if destination != "" {
+		return destination, true
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if knownTracker(host) {
+		return "", true
+	}
+	if hasAnyPrefix(host, trackingPrefixes) && hasAnyPrefix(parsed.Path, trackingPaths) {
+		return "", true
+	}
+	return "", false
+}
+
+func redirectTarget(link string) (string, bool) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	params := redirectParams
+	host := strings.ToLower(parsed.Hostname())
+	if knownTracker(host) || hasAnyPrefix(host, trackingPrefixes) {
+		params = append(slices.Clip(params), trackerParams...)
+	}
+	query := parsed.Query()
+	for _, name := range params {
+		for _, value := range query[name] {
+			if target, ok := normalizeURL(value); ok {
+				return target, true
+			}
+		}
+	}
+	return "", false
+}
+
+func knownTracker(host string) bool {
+	for _, tracker := range trackingHosts {
+		if host == tracker || strings.HasSuffix(host, "."+tracker) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	hiddenPattern = regexp.MustCompile(`(?is)<(style|script|head)\b.*?</(style|script|head)\s*>`)
+	breakPattern  = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6]|/td|/th)\b[^>]*>`)
+	tagPattern    = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacePattern  = regexp.MustCompile(`[ \t\r\f\v]+`)
+)
+
+// htmlText renders an HTML body as plain text, closely enough to search
+// it. Block ends become line breaks.
+func htmlText(body string) string {
+	if body == "" {
+		return ""
+	}
+	body = hiddenPattern.ReplaceAllString(body, " ")
+	body = breakPattern.ReplaceAllString(body, "\n")
+	body = tagPattern.ReplaceAllString(body, " ")
+	return spacePattern.ReplaceAllString(html.UnescapeString(body), " ")
+}
+
+func collapseSpace(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
@@ -0,0 +1,135 @@
+package extract
+
+import (
+	"reflect"
+	"testing"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+func TestLinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		message store.Message
+		want    []Link
+	}{
+		{
+			name: "password reset",
+			message: store.Message{
+				HTMLBody: `<html><head><style>a { color: #1a73e8; }</style></head><body>
+<p>Hi Alice,</p>
+<p>We received a request to reset your password.</p>
+<p><a href="https://app.example.com/reset-password?token=3f9a1c&amp;uid=42" style="padding: 12px">
+  Reset   password</a></p>
+<p>Or paste this link into your browser: https://app.example.com/reset-password?token=3f9a1c&amp;uid=42</p>
+<p><a href="mailto:support@example.com">Contact support</a> &middot; <a href="https://example.com/privacy">Privacy</a></p>
+</body></html>`,
+				TextBody: "Hi Alice,\n\nReset your password: https://app.example.com/reset-password?token=3f9a1c&uid=42\n\nQuestions? Read https://example.com/help.\n",
+			},
+			want: []Link{
+				{URL: "https://app.example.com/reset-password?token=3f9a1c&uid=42", Text: []string{"Reset password"}, Count: 2, Magic: true},
+				{URL: "https://example.com/privacy", Text: []string{"Privacy"}, Count: 1},
+				{URL: "https://example.com/help", Text: []string{}, Count: 1},
+			},
+		},
+		{
+			name: "sendgrid click tracking",
+			message: store.Message{
+				HTMLBody: `<a href="https://u1234567.ct.sendgrid.net/ls/click?upn=u001.Hk5Zd2aX-2FyJmQz4&amp;x=Yk9">Confirm your email</a>`,
+			},
+			want: []Link{
+				{URL: "https://u1234567.ct.sendgrid.net/ls/click?upn=u001.Hk5Zd2aX-2FyJmQz4&x=Yk9", Text: []string{"Confirm your email"}, Count: 1, Tracking: true},
+			},
+		},
+		{
+			name: "mailchimp tracking",
+			message: store.Message{
+				HTMLBody: `<a href="https://example.us21.list-manage.com/track/click?u=8f2a7c1e4b&amp;id=0d3e9f&amp;e=5a1b2c">Read the post</a>`,
+			},
+			want: []Link{
+				{URL: "https://example.us21.list-manage.com/track/click?u=8f2a7c1e4b&id=0d3e9f&e=5a1b2c", Text: []string{"Read the post"}, Count: 1, Tracking: true},
+			},
+		},
+		{
+			name: "tracker with destination",
+			message: store.Message{
+				TextBody: "Verify your account:\nhttps://click.mail.example.com/redirect?url=https%3A%2F%2Fapp.example.com%2Fverify%3Ftoken%3Dabc123\n",
+			},
+			want: []Link{
+				{
+					URL:         "https://click.mail.example.com/redirect?url=https%3A%2F%2Fapp.example.com%2Fverify%3Ftoken%3Dabc123",
+					Text:        []string{},
+					Count:       1,
+					Tracking:    true,
+					Destination: "https://app.example.com/verify?token=abc123",
+					Magic:       true,
+				},
+			},
+		},
+		{
+			name: "nested trackers",
+			message: store.Message{
+				TextBody: "https://links.example.com/c/?q=https%3A%2F%2Fexample.com%2Fout%3Fredirect%3Dhttps%253A%252F%252Fshop.example.com%252Fsale\n",
+			},
+			want: []Link{
+				{
+					URL:         "https://links.example.com/c/?q=https%3A%2F%2Fexample.com%2Fout%3Fredirect%3Dhttps%253A%252F%252Fshop.example.com%252Fsale",
+					Text:        []string{},
+					Count:       1,
+					Tracking:    true,
+					Destination: "https://shop.example.com/sale",
+				},
+			},
+		},
+		{
+			name: "search and share links",
+			message: store.Message{
+				TextBody: "Search: https://www.google.com/search?q=https://example.com/docs\n" +
+					"Invite friends: https://example.com/join?r=https://example.com/ref/alice\n" +
+					"Share: https://twitter.com/intent/tweet?url=https%3A%2F%2Fexample.com%2Fpost\n",
+			},
+			want: []Link{
+				{URL: "https://www.google.com/search?q=https://example.com/docs", Text: []string{}, Count: 1},
+				{URL: "https://example.com/join?r=https://example.com/ref/alice", Text: []string{}, Count: 1},
+				{URL: "https://twitter.com/intent/tweet?url=https%3A%2F%2Fexample.com%2Fpost", Text: []string{}, Count: 1},
+			},
+		},
+		{
+			name: "sentence punctuation",
+			message: store.Message{
+				TextBody: "See the docs (https://en.wikipedia.org/wiki/Email_(disambiguation)), or https://example.com/faq, and https://example.com/start!",
+			},
+			want: []Link{
+				{URL: "https://en.wikipedia.org/wiki/Email_(disambiguation)", Text: []string{}, Count: 1},
+				{URL: "https://example.com/faq", Text: []string{}, Count: 1},
+				{URL: "https://example.com/start", Text: []string{}, Count: 1},
+			},
+		},
+		{
+			name: "no links",
+			message: store.Message{
+				TextBody: "Call us at tel:+15550100 or write to support@example.com.",
+				HTMLBody: `<a href="#top">Back to top</a> <a href="javascript:void(0)">Menu</a>`,
+			},
+			want: nil,
+		},
+	}
+	extractor, err := New(nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := extractor.Links(tc.message)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Links() =\n%+v\nwant\n%+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewInvalidPattern(t *testing.T) {
+	if _, err := New([]string{"("}); err == nil {
+		t.Fatal("New accepted an invalid pattern")
+	}
+}
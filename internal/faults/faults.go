@@ -0,0 +1,229 @@
+package faults
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Stage string
+
+const (
+	StageConnect Stage = "connect"
+	StageMail    Stage = "mail"
+	StageRcpt    Stage = "rcpt"
+	StageData    Stage = "data"
+)
+
+// Config is the fault-injection setup. It is loaded from FAULTS_FILE at start
+// and can be replaced at runtime through the admin API.
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// Latency is added before every SMTP reply, which is enough to tarpit
+	// clients without writing per-stage rules.
+	Latency Duration `json:"latency,omitzero"`
+	Rules   []Rule   `json:"rules"`
+}
+
+// Rule describes one fault. The first rule whose stage and patterns match and
+// whose probability fires decides the outcome for a command.
+type Rule struct {
+	Stage Stage `json:"stage"`
+	// Probability is in (0, 1]. Zero means the rule always fires.
+	Probability float64 `json:"probability,omitempty"`
+	// Sender and Recipient are path.Match patterns such as "*@example.com".
+	Sender    string `json:"sender,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	// Code is the 4xx/5xx reply to send. Zero only applies Delay.
+	Code    int      `json:"code,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Delay   Duration `json:"delay,omitzero"`
+	// Drop closes the connection instead of replying. On the data stage the
+	// connection is closed after DropAfterBytes of the message were read.
+	Drop           bool  `json:"drop,omitempty"`
+	DropAfterBytes int64 `json:"dropAfterBytes,omitempty"`
+}
+
+// Action is what the SMTP server should do for a command.
+type Action struct {
+	Delay          time.Duration
+	Code           int
+	Message        string
+	Drop           bool
+	DropAfterBytes int64
+}
+
+func (a Action) Fails() bool {
+	return a.Code != 0 || a.Drop
+}
+
+type Injector struct {
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(cfg Config) (*Injector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Injector{cfg: cfg}, nil
+}
+
+// LoadFile reads a JSON Config. An empty path yields a disabled config.
+func LoadFile(name string) (Config, error) {
+	if strings.TrimSpace(name) == "" {
+		return Config{}, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return Config{}, fmt.Errorf("read faults file: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("parse faults file: %w", err)
+	}
+	return cfg, nil
+}
+
+func (i *Injector) Config() Config {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	cfg := i.cfg
+	cfg.Rules = append([]Rule(nil), i.cfg.Rules...)
+	return cfg
+}
+
+func (i *Injector) SetConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	i.cfg = cfg
+	i.mu.Unlock()
+	return nil
+}
+
+// Evaluate picks the action for a command at stage. recipients holds the
+// address being added on the rcpt stage and every accepted recipient on the
+// data stage.
+func (i *Injector) Evaluate(stage Stage, sender string, recipients []string) Action {
+	if i == nil {
+		return Action{}
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if !i.cfg.Enabled {
+		return Action{}
+	}
+
+	action := Action{Delay: i.cfg.Latency.Duration}
+	for _, rule := range i.cfg.Rules {
+		if rule.Stage != stage || !rule.matches(sender, recipients) {
+			continue
+		}
+		if rule.Probability > 0 && rand.Float64() >= rule.Probability {
+			continue
+		}
+		action.Delay += rule.Delay.Duration
+		action.Code = rule.Code
+		action.Message = rule.message()
+		action.Drop = rule.Drop
+		action.DropAfterBytes = rule.DropAfterBytes
+		break
+	}
+	return action
+}
+
+func (r Rule) matches(sender string, recipients []string) bool {
+	if r.Sender != "" && !matchPattern(r.Sender, sender) {
+		return false
+	}
+	if r.Recipient == "" {
+		return true
+	}
+	for _, recipient := range recipients {
+		if matchPattern(r.Recipient, recipient) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) message() string {
+	if r.Message != "" {
+		return r.Message
+	}
+	if r.Code >= 500 {
+		return "Injected permanent failure"
+	}
+	return "Injected temporary failure"
+}
+
+func matchPattern(pattern, value string) bool {
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && matched
+}
+
+func (c Config) Validate() error {
+	if c.Latency.Duration < 0 {
+		return errors.New("latency must not be negative")
+	}
+	for idx, rule := range c.Rules {
+		switch rule.Stage {
+		case StageConnect:
+			if rule.Sender != "" || rule.Recipient != "" {
+				return fmt.Errorf("rule %d: connect rules cannot match addresses", idx)
+			}
+		case StageMail, StageRcpt, StageData:
+		default:
+			return fmt.Errorf("rule %d: unknown stage %q", idx, rule.Stage)
+		}
+		if rule.Probability < 0 || rule.Probability > 1 {
+			return fmt.Errorf("rule %d: probability must be between 0 and 1", idx)
+		}
+		if rule.Code != 0 && (rule.Code < 400 || rule.Code > 599) {
+			return fmt.Errorf("rule %d: code must be a 4xx or 5xx reply", idx)
+		}
+		if rule.Delay.Duration < 0 || rule.DropAfterBytes < 0 {
+			return fmt.Errorf("rule %d: delay and dropAfterBytes must not be negative", idx)
+		}
+		for _, pattern := range []string{rule.Sender, rule.Recipient} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d: invalid pattern %q", idx, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Duration marshals as a Go duration string such as "250ms".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("duration must be a string such as \"500ms\"")
+	}
+	if value == "" {
+		d.Duration = 0
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
@@ -0,0 +1,155 @@
+package faults
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{name: "rcpt reply", rule: Rule{Stage: StageRcpt, Recipient: "*@bounce.example.com", Code: 550}},
+		{name: "connect drop", rule: Rule{Stage: StageConnect, Drop: true, Probability: 0.5}},
+		{name: "delay only", rule: Rule{Stage: StageData, Delay: Duration{time.Second}}},
+		{name: "unknown stage", rule: Rule{Stage: "helo", Code: 421}, wantErr: true},
+		{name: "connect with sender", rule: Rule{Stage: StageConnect, Sender: "*@example.com", Code: 421}, wantErr: true},
+		{name: "probability above one", rule: Rule{Stage: StageMail, Probability: 1.5, Code: 451}, wantErr: true},
+		{name: "negative probability", rule: Rule{Stage: StageMail, Probability: -0.1, Code: 451}, wantErr: true},
+		{name: "success code", rule: Rule{Stage: StageMail, Code: 250}, wantErr: true},
+		{name: "negative delay", rule: Rule{Stage: StageMail, Delay: Duration{-time.Second}}, wantErr: true},
+		{name: "negative drop offset", rule: Rule{Stage: StageData, Drop: true, DropAfterBytes: -1}, wantErr: true},
+		{name: "bad pattern", rule: Rule{Stage: StageRcpt, Recipient: "[a-", Code: 550}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Config{Enabled: true, Rules: []Rule{tc.rule}}.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+	if err := (Config{Latency: Duration{-time.Millisecond}}).Validate(); err == nil {
+		t.Error("Validate accepted a negative latency")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	injector, err := New(Config{
+		Enabled: true,
+		Latency: Duration{10 * time.Millisecond},
+		Rules: []Rule{
+			{Stage: StageConnect, Code: 421, Message: "Too busy"},
+			{Stage: StageMail, Sender: "*@spammer.example.com", Code: 550},
+			{Stage: StageRcpt, Recipient: "full@example.com", Code: 452, Delay: Duration{time.Second}},
+			{Stage: StageRcpt, Recipient: "*@bounce.example.com", Code: 550, Message: "No such user"},
+			{Stage: StageData, Recipient: "flaky@example.com", Drop: true, DropAfterBytes: 1024},
+			{Stage: StageData, Sender: "slow@example.com", Delay: Duration{2 * time.Second}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	latency := 10 * time.Millisecond
+	tests := []struct {
+		name       string
+		stage      Stage
+		sender     string
+		recipients []string
+		want       Action
+	}{
+		{
+			name:  "connect",
+			stage: StageConnect,
+			want:  Action{Delay: latency, Code: 421, Message: "Too busy"},
+		},
+		{
+			name:   "mail matching sender",
+			stage:  StageMail,
+			sender: "Bot@Spammer.example.com",
+			want:   Action{Delay: latency, Code: 550, Message: "Injected permanent failure"},
+		},
+		{
+			name:   "mail other sender",
+			stage:  StageMail,
+			sender: "alice@example.com",
+			want:   Action{Delay: latency},
+		},
+		{
+			name:       "rcpt first matching rule wins",
+			stage:      StageRcpt,
+			sender:     "alice@example.com",
+			recipients: []string{"full@example.com"},
+			want:       Action{Delay: latency + time.Second, Code: 452, Message: "Injected temporary failure"},
+		},
+		{
+			name:       "rcpt wildcard",
+			stage:      StageRcpt,
+			sender:     "alice@example.com",
+			recipients: []string{"bob@bounce.example.com"},
+			want:       Action{Delay: latency, Code: 550, Message: "No such user"},
+		},
+		{
+			name:       "data any recipient",
+			stage:      StageData,
+			sender:     "alice@example.com",
+			recipients: []string{"bob@example.com", "flaky@example.com"},
+			want:       Action{Delay: latency, Message: "Injected temporary failure", Drop: true, DropAfterBytes: 1024},
+		},
+		{
+			name:       "data delay only",
+			stage:      StageData,
+			sender:     "slow@example.com",
+			recipients: []string{"bob@example.com"},
+			want:       Action{Delay: latency + 2*time.Second, Message: "Injected temporary failure"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := injector.Evaluate(tc.stage, tc.sender, tc.recipients)
+			if got != tc.want {
+				t.Errorf("Evaluate() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateDisabled(t *testing.T) {
+	var nilInjector *Injector
+	if got := nilInjector.Evaluate(StageMail, "a@example.com", nil); got != (Action{}) {
+		t.Errorf("nil injector = %+v", got)
+	}
+	injector, err := New(Config{Rules: []Rule{{Stage: StageMail, Code: 550}}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got := injector.Evaluate(StageMail, "a@example.com", nil); got.Fails() {
+		t.Errorf("disabled injector = %+v", got)
+	}
+	if err := injector.SetConfig(Config{Rules: []Rule{{Stage: "quit"}}}); err == nil {
+		t.Error("SetConfig accepted an invalid rule")
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	var cfg Config
+	data := `{"enabled":true,"latency":"250ms","rules":[{"stage":"rcpt","recipient":"*@example.com","code":451,"delay":"1s"}]}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := Config{
+		Enabled: true,
+		Latency: Duration{250 * time.Millisecond},
+		Rules:   []Rule{{Stage: StageRcpt, Recipient: "*@example.com", Code: 451, Delay: Duration{time.Second}}},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("Unmarshal = %+v, want %+v", cfg, want)
+	}
+	if err := json.Unmarshal([]byte(`{"latency":250}`), &cfg); err == nil {
+		t.Error("Unmarshal accepted a numeric duration")
+	}
+}
@@ -0,0 +1,77 @@
+package faults
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener applies connect-stage rules before the SMTP server sees a
+// connection: rejected connections get the reply and are closed, delayed ones
+// hold back the greeting.
+func (i *Injector) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, injector: i}
+}
+
+// TLSListener is Listener for implicit TLS. Connections are returned as
+// *tls.Conn: rejections are written after the handshake so clients can read
+// them, and delays hold back the handshake and with it the greeting.
+func (i *Injector) TLSListener(l net.Listener, config *tls.Config) net.Listener {
+	return &listener{Listener: l, injector: i, tls: config}
+}
+
+type listener struct {
+	net.Listener
+	injector *Injector
+	tls      *tls.Config
+}
+
+func (l *listener) wrap(conn net.Conn) net.Conn {
+	if l.tls == nil {
+		return conn
+	}
+	return tls.Server(conn, l.tls)
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		action := l.injector.Evaluate(StageConnect, "", nil)
+		if !action.Fails() {
+			if action.Delay > 0 {
+				conn = &delayedConn{Conn: conn, delay: action.Delay}
+			}
+			return l.wrap(conn), nil
+		}
+		go reject(l.wrap(conn), action)
+	}
+}
+
+func reject(conn net.Conn, action Action) {
+	defer conn.Close()
+	if action.Delay > 0 {
+		time.Sleep(action.Delay)
+	}
+	if action.Drop {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, _ = fmt.Fprintf(conn, "%d %s\r\n", action.Code, action.Message)
+}
+
+// delayedConn sleeps before its first write, which is the server greeting.
+type delayedConn struct {
+	net.Conn
+	delay time.Duration
+	once  sync.Once
+}
+
+func (c *delayedConn) Write(p []byte) (int, error) {
+	c.once.Do(func() { time.Sleep(c.delay) })
+	return c.Conn.Write(p)
+}
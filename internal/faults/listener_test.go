@@ -0,0 +1,80 @@
+package faults
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/certs"
+)
+
+func TestListener(t *testing.T) {
+	serverConfig, err := certs.Load("", "", "")
+	if err != nil {
+		t.Fatalf("certs.Load: %v", err)
+	}
+	reject := Config{Enabled: true, Rules: []Rule{{Stage: StageConnect, Code: 421, Message: "Too busy"}}}
+	tests := []struct {
+		name string
+		tls  bool
+		cfg  Config
+	}{
+		{name: "plain reject", cfg: reject},
+		{name: "tls reject", tls: true, cfg: reject},
+		{name: "plain pass", cfg: Config{}},
+		{name: "tls pass", tls: true, cfg: Config{}},
+		{name: "tls delay", tls: true, cfg: Config{Enabled: true, Rules: []Rule{{Stage: StageConnect, Delay: Duration{10 * time.Millisecond}}}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			injector, err := New(tc.cfg)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			raw, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := injector.Listener(raw)
+			if tc.tls {
+				listener = injector.TLSListener(raw, serverConfig)
+			}
+			defer listener.Close()
+			// Passed connections answer with a greeting of their own.
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if _, ok := conn.(*tls.Conn); ok != tc.tls {
+					t.Errorf("accepted %T", conn)
+				}
+				_, _ = conn.Write([]byte("220 ready\r\n"))
+			}()
+
+			conn, err := net.Dial("tcp", raw.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.tls {
+				conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatalf("read greeting: %v", err)
+			}
+			want := "220 ready\r\n"
+			if len(tc.cfg.Rules) > 0 && tc.cfg.Rules[0].Code != 0 {
+				want = "421 Too busy\r\n"
+			}
+			if line != want {
+				t.Errorf("greeting = %q, want %q", line, want)
+			}
+		})
+	}
+}
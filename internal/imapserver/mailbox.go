@@ -0,0 +1,423 @@
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/webhook"
+)
+
+const uidValidity = 1
+
+var supportedFlags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+
+// mailboxState is the message list shared by every connection that has the
+// same user's mailbox selected, so sequence numbers and the EXPUNGE/EXISTS
+// updates sent to those connections agree with each other.
+type mailboxState struct {
+	mu      sync.Mutex
+	loaded  bool
+	entries []store.MailboxEntry
+}
+
+func (b *imapBackend) state(email, box string) *mailboxState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := email + "|" + box
+	if _, ok := b.states[key]; !ok {
+		b.states[key] = &mailboxState{}
+	}
+	return b.states[key]
+}
+
+type mailbox struct {
+	user  *user
+	name  string
+	box   string
+	state *mailboxState
+}
+
+func newMailbox(u *user, name, box string) *mailbox {
+	return &mailbox{user: u, name: name, box: box, state: u.backend.state(u.email, box)}
+}
+
+func (m *mailbox) Name() string {
+	return m.name
+}
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{Delimiter: delimiter, Name: m.name}
+	if m.box == "sent" {
+		info.Attributes = []string{imap.SentAttr}
+	}
+	return info, nil
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	if err := m.refresh(); err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = supportedFlags
+	status.PermanentFlags = supportedFlags
+	for i, entry := range m.state.entries {
+		if !entry.Seen && status.UnseenSeqNum == 0 {
+			status.UnseenSeqNum = uint32(i + 1)
+		}
+	}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.state.entries))
+		case imap.StatusUidNext:
+			next, err := m.user.backend.store.NextUID(context.Background())
+			if err != nil {
+				return nil, err
+			}
+			status.UidNext = next
+		case imap.StatusUidValidity:
+			status.UidValidity = uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			for _, entry := range m.state.entries {
+				if !entry.Seen {
+					status.Unseen++
+				}
+			}
+		}
+	}
+	return status, nil
+}
+
+func (m *mailbox) SetSubscribed(_ bool) error {
+	return nil
+}
+
+func (m *mailbox) Check() error {
+	return m.Poll()
+}
+
+// Poll picks up mail captured or deleted since the mailbox was selected.
+func (m *mailbox) Poll() error {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	return m.refresh()
+}
+
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+
+	ctx := context.Background()
+	for i := range m.state.entries {
+		entry := &m.state.entries[i]
+		seqNum := uint32(i + 1)
+		if !seqSet.Contains(m.id(uid, seqNum, entry)) {
+			continue
+		}
+		fetched, err := m.fetch(ctx, seqNum, entry, items)
+		if err != nil {
+			m.user.backend.logger.Warn("imap fetch", "id", entry.ID, "error", err)
+			continue
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+// SearchMessages answers criteria from mailbox metadata where it can; see
+// searchTarget.
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+
+	ctx := context.Background()
+	var summaries map[string]store.MessageSummary
+	if needsSummaries(criteria) {
+		var err error
+		if summaries, err = m.summaries(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var ids []uint32
+	for i := range m.state.entries {
+		entry := &m.state.entries[i]
+		target := &searchTarget{
+			seqNum: uint32(i + 1),
+			entry:  entry,
+			flags:  m.flags(entry),
+			load:   func() (*message.Entity, error) { return m.parse(ctx, entry) },
+		}
+		if summaries != nil {
+			summary, ok := summaries[entry.ID]
+			if !ok {
+				// Deleted since the mailbox was listed.
+				continue
+			}
+			target.summary = summary
+		}
+		ok, err := target.match(criteria)
+		if err != nil || !ok {
+			continue
+		}
+		ids = append(ids, m.id(uid, target.seqNum, entry))
+	}
+	return ids, nil
+}
+
+func (m *mailbox) CreateMessage(_ []string, _ time.Time, _ imap.Literal) error {
+	return errReadOnly
+}
+
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+
+	ctx := context.Background()
+	for i := range m.state.entries {
+		entry := &m.state.entries[i]
+		seqNum := uint32(i + 1)
+		if !seqSet.Contains(m.id(uid, seqNum, entry)) {
+			continue
+		}
+		updated := backendutil.UpdateFlags(m.flags(entry), op, flags)
+		if err := m.setSeen(ctx, entry, slices.Contains(updated, imap.SeenFlag)); err != nil {
+			return err
+		}
+		extra := slices.DeleteFunc(updated, func(flag string) bool { return flag == imap.SeenFlag })
+		m.user.backend.setFlags(m.user.email, entry.ID, extra)
+
+		fetched := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+		fetched.Flags = m.flags(entry)
+		fetched.Uid = entry.UID
+		m.notify(&backend.MessageUpdate{Update: m.update(), Message: fetched})
+	}
+	return nil
+}
+
+func (m *mailbox) CopyMessages(_ bool, _ *imap.SeqSet, _ string) error {
+	return errReadOnly
+}
+
+// Expunge deletes messages flagged \Deleted through Store.DeleteMessage, the
+// same path as deleting from the web UI.
+func (m *mailbox) Expunge() error {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+
+	ctx := context.Background()
+	for i := len(m.state.entries) - 1; i >= 0; i-- {
+		entry := m.state.entries[i]
+		if !slices.Contains(m.flags(&entry), imap.DeletedFlag) {
+			continue
+		}
+		event, notify := m.user.backend.webhooks.Lookup(ctx, webhook.MessageDeleted, m.user.email, entry.ID)
+		deleted, err := m.user.backend.store.DeleteMessage(ctx, m.user.email, entry.ID)
+		if err != nil {
+			return err
+		}
+		if deleted && notify {
+			m.user.backend.webhooks.Publish(ctx, event)
+		}
+		m.user.backend.setFlags(m.user.email, entry.ID, nil)
+		m.state.entries = slices.Delete(m.state.entries, i, i+1)
+		m.notify(&backend.ExpungeUpdate{Update: m.update(), SeqNum: uint32(i + 1)})
+	}
+	return nil
+}
+
+// refresh syncs the shared state with the store. Callers hold state.mu.
+func (m *mailbox) refresh() error {
+	fresh, err := m.user.backend.store.ListMailbox(context.Background(), m.user.email, m.box)
+	if err != nil {
+		return err
+	}
+	if !m.state.loaded {
+		m.state.entries = fresh
+		m.state.loaded = true
+		return nil
+	}
+
+	current := make(map[uint32]store.MailboxEntry, len(fresh))
+	for _, entry := range fresh {
+		current[entry.UID] = entry
+	}
+	for i := len(m.state.entries) - 1; i >= 0; i-- {
+		entry, ok := current[m.state.entries[i].UID]
+		if !ok {
+			m.state.entries = slices.Delete(m.state.entries, i, i+1)
+			m.notify(&backend.ExpungeUpdate{Update: m.update(), SeqNum: uint32(i + 1)})
+			continue
+		}
+		m.state.entries[i].Seen = entry.Seen
+	}
+
+	lastUID := uint32(0)
+	if len(m.state.entries) > 0 {
+		lastUID = m.state.entries[len(m.state.entries)-1].UID
+	}
+	added := false
+	for _, entry := range fresh {
+		if entry.UID > lastUID {
+			m.state.entries = append(m.state.entries, entry)
+			added = true
+		}
+	}
+	if added {
+		status := imap.NewMailboxStatus(m.name, []imap.StatusItem{imap.StatusMessages})
+		status.Messages = uint32(len(m.state.entries))
+		m.notify(&backend.MailboxUpdate{Update: m.update(), MailboxStatus: status})
+	}
+	return nil
+}
+
+func (m *mailbox) fetch(ctx context.Context, seqNum uint32, entry *store.MailboxEntry, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+	var raw []byte
+	loadRaw := func() ([]byte, error) {
+		if raw != nil {
+			return raw, nil
+		}
+		var err error
+		raw, err = m.raw(ctx, entry)
+		return raw, err
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			data, err := loadRaw()
+			if err != nil {
+				return nil, err
+			}
+			header, _, err := readHeader(data)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			data, err := loadRaw()
+			if err != nil {
+				return nil, err
+			}
+			header, body, err := readHeader(data)
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = m.flags(entry)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = entry.CreatedAt
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(entry.Size)
+		case imap.FetchUid:
+			fetched.Uid = entry.UID
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				continue
+			}
+			data, err := loadRaw()
+			if err != nil {
+				return nil, err
+			}
+			header, body, err := readHeader(data)
+			if err != nil {
+				return nil, err
+			}
+			literal, err := backendutil.FetchBodySection(header, body, section)
+			if err != nil {
+				continue
+			}
+			fetched.Body[section] = literal
+			if !section.Peek && !entry.Seen {
+				if err := m.setSeen(ctx, entry, true); err != nil {
+					return nil, err
+				}
+				if fetched.Flags != nil {
+					fetched.Flags = m.flags(entry)
+				}
+			}
+		}
+	}
+	return fetched, nil
+}
+
+func (m *mailbox) raw(ctx context.Context, entry *store.MailboxEntry) ([]byte, error) {
+	msg, _, _, err := m.user.backend.store.GetMessage(ctx, m.user.email, entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Raw, nil
+}
+
+// setSeen mirrors \Seen into message_reads so the web UI unread counts agree.
+// Sent mail has no read state and always reports \Seen.
+func (m *mailbox) setSeen(ctx context.Context, entry *store.MailboxEntry, seen bool) error {
+	if m.box == "sent" || entry.Seen == seen {
+		return nil
+	}
+	if !seen {
+		if err := m.user.backend.store.MarkMessageUnread(ctx, m.user.email, entry.ID); err != nil {
+			return err
+		}
+		entry.Seen = false
+		return nil
+	}
+	// The web UI or POP3 may have read it since the mailbox was listed.
+	changed, err := m.user.backend.store.MarkMessageRead(ctx, m.user.email, entry.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	entry.Seen = true
+	if changed {
+		m.user.backend.webhooks.Notify(ctx, webhook.MessageRead, m.user.email, entry.ID)
+	}
+	return nil
+}
+
+func (m *mailbox) flags(entry *store.MailboxEntry) []string {
+	flags := m.user.backend.flagsFor(m.user.email, entry.ID)
+	if entry.Seen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	return flags
+}
+
+func (m *mailbox) id(uid bool, seqNum uint32, entry *store.MailboxEntry) uint32 {
+	if uid {
+		return entry.UID
+	}
+	return seqNum
+}
+
+func (m *mailbox) update() backend.Update {
+	return backend.NewUpdate(m.user.email, m.name)
+}
+
+func (m *mailbox) notify(update backend.Update) {
+	m.user.backend.updates <- update
+}
+
+func readHeader(raw []byte) (textproto.Header, *bufio.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(body)
+	return header, body, err
+}
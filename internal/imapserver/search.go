@@ -0,0 +1,225 @@
+package imapserver
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+
+	"github.io/razzkumar/localsmtp/internal/search"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// summaryPageSize is how many summaries SEARCH reads per store query.
+const summaryPageSize = 500
+
+// searchTarget is one message tested against SEARCH criteria. Sequence
+// numbers, UIDs, flags, dates and sizes come from the mailbox entry, and the
+// From, To, Cc, Bcc and Subject headers from the stored summary, matched
+// against addresses rather than display names. The raw message is read at
+// most once, only for body, text, sent date and other header criteria.
+type searchTarget struct {
+	seqNum  uint32
+	entry   *store.MailboxEntry
+	flags   []string
+	summary store.MessageSummary
+	load    func() (*message.Entity, error)
+	parsed  *message.Entity
+}
+
+func (t *searchTarget) match(c *imap.SearchCriteria) (bool, error) {
+	if c.SeqNum != nil && !c.SeqNum.Contains(t.seqNum) {
+		return false, nil
+	}
+	if c.Uid != nil && !c.Uid.Contains(t.entry.UID) {
+		return false, nil
+	}
+	for _, flag := range c.WithFlags {
+		if !hasFlag(t.flags, flag) {
+			return false, nil
+		}
+	}
+	for _, flag := range c.WithoutFlags {
+		if hasFlag(t.flags, flag) {
+			return false, nil
+		}
+	}
+	// RFC 3501 compares dates without time zones.
+	created := t.entry.CreatedAt
+	date := time.Date(created.Year(), created.Month(), created.Day(), 0, 0, 0, 0, time.UTC)
+	if !c.Since.IsZero() && date.Before(c.Since) {
+		return false, nil
+	}
+	if !c.Before.IsZero() && !date.Before(c.Before) {
+		return false, nil
+	}
+	if c.Larger > 0 && t.entry.Size <= int64(c.Larger) {
+		return false, nil
+	}
+	if c.Smaller > 0 && t.entry.Size >= int64(c.Smaller) {
+		return false, nil
+	}
+	for key, wants := range c.Header {
+		values, ok := t.summaryValues(key)
+		if !ok {
+			continue
+		}
+		for _, want := range wants {
+			if !matchAny(values, want) {
+				return false, nil
+			}
+		}
+	}
+
+	for _, not := range c.Not {
+		ok, err := t.match(not)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	for _, or := range c.Or {
+		ok, err := t.match(or[0])
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			if ok, err = t.match(or[1]); err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+
+	rest := rawCriteria(c)
+	if rest == nil {
+		return true, nil
+	}
+	if t.parsed == nil {
+		parsed, err := t.load()
+		if err != nil {
+			return false, err
+		}
+		t.parsed = parsed
+	}
+	return backendutil.Match(t.parsed, t.seqNum, t.entry.UID, t.entry.CreatedAt, t.flags, rest)
+}
+
+// summaryValues returns what the stored summary knows of a header, and false
+// for headers only the raw message has.
+func (t *searchTarget) summaryValues(key string) ([]string, bool) {
+	switch strings.ToLower(key) {
+	case "from":
+		return []string{t.summary.From}, true
+	case "subject":
+		if t.summary.Subject == "" {
+			return nil, true
+		}
+		return []string{t.summary.Subject}, true
+	case "to", "cc", "bcc":
+		return t.summary.RecipientGroups[strings.ToLower(key)], true
+	}
+	return nil, false
+}
+
+// rawCriteria keeps the criteria of c that need the raw message, or returns
+// nil when there are none. Not and Or are left to searchTarget.match.
+func rawCriteria(c *imap.SearchCriteria) *imap.SearchCriteria {
+	rest := &imap.SearchCriteria{SentBefore: c.SentBefore, SentSince: c.SentSince, Body: c.Body, Text: c.Text}
+	for key, values := range c.Header {
+		if summaryHeader(key) {
+			continue
+		}
+		if rest.Header == nil {
+			rest.Header = make(map[string][]string)
+		}
+		rest.Header[key] = values
+	}
+	if rest.SentBefore.IsZero() && rest.SentSince.IsZero() && rest.Header == nil && len(rest.Body) == 0 && len(rest.Text) == 0 {
+		return nil
+	}
+	return rest
+}
+
+// needsSummaries reports whether c or any nested criteria match a header
+// answered from the stored summary.
+func needsSummaries(c *imap.SearchCriteria) bool {
+	for key := range c.Header {
+		if summaryHeader(key) {
+			return true
+		}
+	}
+	for _, not := range c.Not {
+		if needsSummaries(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if needsSummaries(or[0]) || needsSummaries(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func summaryHeader(key string) bool {
+	switch strings.ToLower(key) {
+	case "from", "subject", "to", "cc", "bcc":
+		return true
+	}
+	return false
+}
+
+// matchAny reports whether any value contains want, ignoring case. An empty
+// want only asks for the header to be present.
+func matchAny(values []string, want string) bool {
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), strings.ToLower(want)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// summaries lists the mailbox's summaries by message ID.
+func (m *mailbox) summaries(ctx context.Context) (map[string]store.MessageSummary, error) {
+	summaries := make(map[string]store.MessageSummary)
+	var cursor *store.Cursor
+	for {
+		page, info, err := m.user.backend.store.ListMessages(ctx, m.user.email, m.box, search.Query{}, store.Page{Limit: summaryPageSize, Cursor: cursor})
+		if err != nil {
+			return nil, err
+		}
+		for _, summary := range page {
+			summaries[summary.ID] = summary
+		}
+		if info.Next == nil {
+			return summaries, nil
+		}
+		cursor = info.Next
+	}
+}
+
+// parse reads the raw message for criteria the metadata cannot answer.
+func (m *mailbox) parse(ctx context.Context, entry *store.MailboxEntry) (*message.Entity, error) {
+	raw, err := m.raw(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+	return parsed, nil
+}
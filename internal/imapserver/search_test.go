@@ -0,0 +1,108 @@
+package imapserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+const searchRaw = "From: Shop <noreply@shop.example.com>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Your order has shipped\r\n" +
+	"Date: Fri, 01 Mar 2024 09:00:00 +0000\r\n" +
+	"X-Campaign: spring-sale\r\n" +
+	"\r\n" +
+	"Tracking number 1Z999\r\n"
+
+func TestSearchTarget(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	uids := func(set string) *imap.SeqSet {
+		seqSet, err := imap.ParseSeqSet(set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seqSet
+	}
+	header := func(key, value string) map[string][]string {
+		return map[string][]string{key: {value}}
+	}
+	tests := []struct {
+		name     string
+		criteria *imap.SearchCriteria
+		want     bool
+		wantLoad bool
+	}{
+		{name: "all", criteria: &imap.SearchCriteria{}, want: true},
+		{name: "uid", criteria: &imap.SearchCriteria{Uid: uids("40:50")}, want: true},
+		{name: "other uid", criteria: &imap.SearchCriteria{Uid: uids("1:10")}, want: false},
+		{name: "seen", criteria: &imap.SearchCriteria{WithFlags: []string{imap.SeenFlag}}, want: true},
+		{name: "unflagged", criteria: &imap.SearchCriteria{WithoutFlags: []string{imap.FlaggedFlag}}, want: true},
+		{name: "since the same day", criteria: &imap.SearchCriteria{Since: day(2)}, want: true},
+		{name: "before", criteria: &imap.SearchCriteria{Before: day(2)}, want: false},
+		{name: "larger", criteria: &imap.SearchCriteria{Larger: 100}, want: true},
+		{name: "smaller", criteria: &imap.SearchCriteria{Smaller: 100}, want: false},
+		{name: "from address", criteria: &imap.SearchCriteria{Header: header("From", "SHOP.example")}, want: true},
+		{name: "subject", criteria: &imap.SearchCriteria{Header: header("Subject", "shipped")}, want: true},
+		{name: "bcc from the envelope", criteria: &imap.SearchCriteria{Header: header("Bcc", "audit@")}, want: true},
+		{name: "cc absent", criteria: &imap.SearchCriteria{Header: header("Cc", "")}, want: false},
+		{name: "not seen", criteria: &imap.SearchCriteria{Not: []*imap.SearchCriteria{{WithFlags: []string{imap.SeenFlag}}}}, want: false},
+		{
+			name: "or of metadata",
+			criteria: &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{
+				{Header: header("To", "bob@")},
+				{Header: header("To", "alice@")},
+			}}},
+			want: true,
+		},
+		{
+			name:     "failed metadata skips the body",
+			criteria: &imap.SearchCriteria{Uid: uids("1:10"), Body: []string{"tracking"}},
+			want:     false,
+		},
+		{name: "body", criteria: &imap.SearchCriteria{Body: []string{"tracking"}}, want: true, wantLoad: true},
+		{name: "text in a header", criteria: &imap.SearchCriteria{Text: []string{"spring-sale"}}, want: true, wantLoad: true},
+		{name: "other header", criteria: &imap.SearchCriteria{Header: header("X-Campaign", "spring")}, want: true, wantLoad: true},
+		{name: "sent before", criteria: &imap.SearchCriteria{SentBefore: day(2)}, want: true, wantLoad: true},
+		{
+			name:     "body under not",
+			criteria: &imap.SearchCriteria{Not: []*imap.SearchCriteria{{Body: []string{"refund"}}}},
+			want:     true,
+			wantLoad: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			loads := 0
+			target := &searchTarget{
+				seqNum: 3,
+				entry:  &store.MailboxEntry{UID: 42, ID: "m1", Size: int64(len(searchRaw)), CreatedAt: time.Date(2024, 3, 2, 23, 30, 0, 0, time.UTC), Seen: true},
+				flags:  []string{imap.SeenFlag},
+				summary: store.MessageSummary{
+					ID:              "m1",
+					From:            "noreply@shop.example.com",
+					Subject:         "Your order has shipped",
+					RecipientGroups: map[string][]string{"to": {"alice@example.com"}, "bcc": {"audit@example.com"}},
+				},
+				load: func() (*message.Entity, error) {
+					loads++
+					return message.Read(strings.NewReader(searchRaw))
+				},
+			}
+			got, err := target.match(tc.criteria)
+			if err != nil {
+				t.Fatalf("match: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("match = %v, want %v", got, tc.want)
+			}
+			if (loads > 0) != tc.wantLoad {
+				t.Errorf("loaded the raw message %d times, wantLoad %v", loads, tc.wantLoad)
+			}
+		})
+	}
+}
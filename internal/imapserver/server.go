@@ -0,0 +1,165 @@
+package imapserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/credentials"
+	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/webhook"
+)
+
+const (
+	inboxName = "INBOX"
+	sentName  = "Sent"
+	delimiter = "/"
+)
+
+var errReadOnly = errors.New("mailbox changes are not supported")
+
+type AuthConfig struct {
+	// Enabled requires the password of an SMTP credential that may send as
+	// the mailbox. Any address is accepted as the username either way, as in
+	// the web UI.
+	Enabled     bool
+	Credentials *credentials.Set
+}
+
+type Server struct {
+	imap   *server.Server
+	logger *slog.Logger
+}
+
+func New(store store.Storage, logger *slog.Logger, addr string, authCfg AuthConfig, tlsConfig *tls.Config, webhooks *webhook.Dispatcher) *Server {
+	bkd := &imapBackend{
+		store:    store,
+		webhooks: webhooks,
+		logger:   logger,
+		authCfg:  authCfg,
+		flags:    map[string][]string{},
+		states:   map[string]*mailboxState{},
+		updates:  make(chan backend.Update, 16),
+	}
+	srv := server.New(bkd)
+	srv.Addr = addr
+	// With TLS configured, passwords only travel after STARTTLS.
+	srv.AllowInsecureAuth = tlsConfig == nil
+	srv.TLSConfig = tlsConfig
+	srv.ErrorLog = slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+	return &Server{imap: srv, logger: logger}
+}
+
+func (s *Server) ListenAndServe() error {
+	s.logger.Info("imap server listening", "addr", s.imap.Addr, "starttls", s.imap.TLSConfig != nil)
+	return s.imap.ListenAndServe()
+}
+
+func (s *Server) Close() error {
+	return s.imap.Close()
+}
+
+type imapBackend struct {
+	store    store.Storage
+	webhooks *webhook.Dispatcher
+	logger   *slog.Logger
+	authCfg  AuthConfig
+	updates  chan backend.Update
+
+	// flags keeps IMAP flags other than \Seen, keyed by email and message
+	// ID. They only live as long as the process, like a client's session.
+	mu     sync.Mutex
+	flags  map[string][]string
+	states map[string]*mailboxState
+}
+
+func (b *imapBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	email, err := auth.NormalizeEmail(username)
+	if err != nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+	if b.authCfg.Enabled {
+		if _, err := b.authCfg.Credentials.AuthenticateMailbox(context.Background(), email, password); err != nil {
+			if !errors.Is(err, credentials.ErrInvalid) {
+				b.logger.Error("check imap credentials", "error", err)
+			}
+			return nil, backend.ErrInvalidCredentials
+		}
+	}
+	if err := b.store.UpsertUser(context.Background(), email, time.Now()); err != nil {
+		b.logger.Warn("imap upsert user", "error", err)
+	}
+	return &user{backend: b, email: email}, nil
+}
+
+func (b *imapBackend) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+func (b *imapBackend) flagsFor(email, id string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.flags[email+"|"+id]...)
+}
+
+func (b *imapBackend) setFlags(email, id string, flags []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(flags) == 0 {
+		delete(b.flags, email+"|"+id)
+		return
+	}
+	b.flags[email+"|"+id] = flags
+}
+
+type user struct {
+	backend *imapBackend
+	email   string
+}
+
+func (u *user) Username() string {
+	return u.email
+}
+
+func (u *user) ListMailboxes(_ bool) ([]backend.Mailbox, error) {
+	return []backend.Mailbox{
+		newMailbox(u, inboxName, "inbox"),
+		newMailbox(u, sentName, "sent"),
+	}, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	switch {
+	case strings.EqualFold(name, inboxName):
+		return newMailbox(u, inboxName, "inbox"), nil
+	case name == sentName:
+		return newMailbox(u, sentName, "sent"), nil
+	default:
+		return nil, backend.ErrNoSuchMailbox
+	}
+}
+
+func (u *user) CreateMailbox(_ string) error {
+	return errReadOnly
+}
+
+func (u *user) DeleteMailbox(_ string) error {
+	return errReadOnly
+}
+
+func (u *user) RenameMailbox(_, _ string) error {
+	return errReadOnly
+}
+
+func (u *user) Logout() error {
+	return nil
+}
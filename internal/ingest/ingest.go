@@ -0,0 +1,200 @@
+// Package ingest commits received messages to storage in batches. SQLite has
+// a single writer, so a transaction per message serializes every SMTP client
+// behind one fsync; a batch costs about the same as a single message.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/metrics"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// Backpressure decides what Submit does when the queue is full.
+type Backpressure string
+
+const (
+	// BackpressureBlock waits up to Config.BlockTimeout for space.
+	BackpressureBlock Backpressure = "block"
+	// BackpressureReject fails immediately with ErrBusy.
+	BackpressureReject Backpressure = "reject"
+)
+
+var (
+	ErrBusy   = errors.New("ingest queue full")
+	ErrClosed = errors.New("ingest queue closed")
+)
+
+type Config struct {
+	QueueSize    int
+	MaxBatch     int
+	BatchWait    time.Duration
+	Backpressure Backpressure
+	BlockTimeout time.Duration
+}
+
+// Queue is a group commit in front of a store.Storage. Messages that arrive
+// while a batch is being written are committed together in the next one.
+type Queue struct {
+	store   store.Storage
+	cfg     Config
+	metrics *metrics.Metrics
+	logger  *slog.Logger
+
+	mu      sync.RWMutex
+	closed  bool
+	pending chan *request
+	done    chan struct{}
+}
+
+type request struct {
+	message store.NewMessage
+	result  chan error
+}
+
+func New(storage store.Storage, cfg Config, m *metrics.Metrics, logger *slog.Logger) *Queue {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1000
+	}
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = 100
+	}
+	if cfg.Backpressure == "" {
+		cfg.Backpressure = BackpressureBlock
+	}
+	q := &Queue{
+		store:   storage,
+		cfg:     cfg,
+		metrics: m,
+		logger:  logger,
+		pending: make(chan *request, cfg.QueueSize),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Submit queues message and returns once it is committed, so a nil error
+// means the message is durable. It returns ErrBusy if the queue stays full.
+func (q *Queue) Submit(ctx context.Context, message store.NewMessage) error {
+	req := &request{message: message, result: make(chan error, 1)}
+	if err := q.enqueue(ctx, req); err != nil {
+		return err
+	}
+	return <-req.result
+}
+
+func (q *Queue) enqueue(ctx context.Context, req *request) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrClosed
+	}
+	select {
+	case q.pending <- req:
+		return nil
+	default:
+	}
+	if q.cfg.Backpressure == BackpressureReject {
+		q.metrics.IngestRejected.Inc()
+		return ErrBusy
+	}
+
+	var timeout <-chan time.Time
+	if q.cfg.BlockTimeout > 0 {
+		timer := time.NewTimer(q.cfg.BlockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case q.pending <- req:
+		return nil
+	case <-timeout:
+		q.metrics.IngestRejected.Inc()
+		return ErrBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting messages and returns after the queued ones are
+// committed.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+	for req := range q.pending {
+		q.commit(q.collect(req))
+	}
+}
+
+// collect gathers whatever else is queued behind first, waiting up to
+// BatchWait for more to arrive.
+func (q *Queue) collect(first *request) []*request {
+	batch := []*request{first}
+	var wait <-chan time.Time
+	if q.cfg.BatchWait > 0 {
+		timer := time.NewTimer(q.cfg.BatchWait)
+		defer timer.Stop()
+		wait = timer.C
+	}
+	for len(batch) < q.cfg.MaxBatch {
+		select {
+		case req, ok := <-q.pending:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, req)
+			continue
+		default:
+		}
+		if wait == nil {
+			return batch
+		}
+		select {
+		case req, ok := <-q.pending:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, req)
+		case <-wait:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (q *Queue) commit(batch []*request) {
+	messages := make([]store.NewMessage, len(batch))
+	for i, req := range batch {
+		messages[i] = req.message
+	}
+	ctx := context.Background()
+	start := time.Now()
+	err := q.store.InsertMessages(ctx, messages)
+	q.metrics.StoreInsertDuration.Observe(time.Since(start))
+	q.metrics.IngestBatches.Inc()
+	if err != nil && len(batch) > 1 {
+		// One bad message must not fail the rest, so retry them one by one.
+		q.logger.Warn("ingest batch failed; retrying individually", "messages", len(batch), "error", err)
+		for _, req := range batch {
+			req.result <- q.store.InsertMessages(ctx, []store.NewMessage{req.message})
+		}
+		return
+	}
+	for _, req := range batch {
+		req.result <- err
+	}
+}
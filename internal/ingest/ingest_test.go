@@ -0,0 +1,206 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/metrics"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// fakeStore records each InsertMessages call. While hold is open, calls wait
+// on it after announcing themselves on started, so tests can pile up
+// messages behind a slow commit.
+type fakeStore struct {
+	store.Storage
+	hold    chan struct{}
+	started chan struct{}
+	bad     string
+
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func newFakeStore(bad string) *fakeStore {
+	return &fakeStore{hold: make(chan struct{}), started: make(chan struct{}, 100), bad: bad}
+}
+
+func (f *fakeStore) InsertMessages(ctx context.Context, batch []store.NewMessage) error {
+	f.started <- struct{}{}
+	<-f.hold
+	ids := make([]string, len(batch))
+	for i, message := range batch {
+		ids[i] = message.Message.ID
+	}
+	f.mu.Lock()
+	f.batches = append(f.batches, ids)
+	f.mu.Unlock()
+	for _, id := range ids {
+		if id == f.bad {
+			return errors.New("UNIQUE constraint failed")
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) recorded() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.batches
+}
+
+func newQueue(storage store.Storage, cfg Config) *Queue {
+	return New(storage, cfg, metrics.New(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func message(id string) store.NewMessage {
+	return store.NewMessage{Message: store.Message{ID: id}}
+}
+
+// submit submits id from its own goroutine.
+func submit(q *Queue, id string) chan error {
+	result := make(chan error, 1)
+	go func() { result <- q.Submit(context.Background(), message(id)) }()
+	return result
+}
+
+// submitQueued submits each id while a commit is in progress, waiting for it
+// to be queued before the next so batches keep their order.
+func submitQueued(t *testing.T, q *Queue, ids ...string) map[string]chan error {
+	t.Helper()
+	results := map[string]chan error{}
+	for _, id := range ids {
+		queued := len(q.pending)
+		results[id] = submit(q, id)
+		waitFor(t, func() bool { return len(q.pending) > queued })
+	}
+	return results
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBatch int
+		bad      string
+		want     [][]string
+		failed   string
+	}{
+		{
+			name:     "queued messages share a commit",
+			maxBatch: 10,
+			want:     [][]string{{"m1"}, {"m2", "m3", "m4"}},
+		},
+		{
+			name:     "batches are capped",
+			maxBatch: 2,
+			want:     [][]string{{"m1"}, {"m2", "m3"}, {"m4"}},
+		},
+		{
+			name:     "failed batch is retried one by one",
+			maxBatch: 10,
+			bad:      "m3",
+			want:     [][]string{{"m1"}, {"m2", "m3", "m4"}, {"m2"}, {"m3"}, {"m4"}},
+			failed:   "m3",
+		},
+		{
+			name:     "failed single message is not retried",
+			maxBatch: 10,
+			bad:      "m1",
+			want:     [][]string{{"m1"}, {"m2", "m3", "m4"}},
+			failed:   "m1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := newFakeStore(tc.bad)
+			q := newQueue(storage, Config{QueueSize: 10, MaxBatch: tc.maxBatch})
+			first := submit(q, "m1")
+			<-storage.started
+			results := submitQueued(t, q, "m2", "m3", "m4")
+			results["m1"] = first
+			close(storage.hold)
+
+			for id, result := range results {
+				err := <-result
+				if (err != nil) != (id == tc.failed) {
+					t.Errorf("Submit(%s) = %v", id, err)
+				}
+			}
+			q.Close()
+			if got := storage.recorded(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("batches = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		cancel  bool
+		release bool
+		want    error
+	}{
+		{name: "reject", cfg: Config{Backpressure: BackpressureReject}, want: ErrBusy},
+		{name: "block times out", cfg: Config{Backpressure: BackpressureBlock, BlockTimeout: 20 * time.Millisecond}, want: ErrBusy},
+		{name: "block until cancelled", cfg: Config{Backpressure: BackpressureBlock}, cancel: true, want: context.Canceled},
+		{name: "block until space", cfg: Config{Backpressure: BackpressureBlock, BlockTimeout: 5 * time.Second}, release: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := newFakeStore("")
+			tc.cfg.QueueSize = 1
+			q := newQueue(storage, tc.cfg)
+			defer q.Close()
+			// m1 is being committed and m2 fills the queue.
+			submit(q, "m1")
+			<-storage.started
+			submitQueued(t, q, "m2")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+			if tc.release {
+				time.AfterFunc(20*time.Millisecond, func() { close(storage.hold) })
+			} else {
+				defer close(storage.hold)
+			}
+			if err := q.Submit(ctx, message("m3")); !errors.Is(err, tc.want) {
+				t.Errorf("Submit() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	storage := newFakeStore("")
+	close(storage.hold)
+	q := newQueue(storage, Config{})
+	if err := q.Submit(context.Background(), message("m1")); err != nil {
+		t.Fatalf("Submit() = %v", err)
+	}
+	q.Close()
+	if err := q.Submit(context.Background(), message("m2")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Submit after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,202 @@
+package magic
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Stage string
+
+const (
+	StageRcpt Stage = "rcpt"
+	StageData Stage = "data"
+)
+
+type Action string
+
+const (
+	// ActionReject replies with Code. A captured group overrides the code.
+	ActionReject Action = "reject"
+	// ActionDelay holds the reply for Delay. A captured group such as "5s"
+	// or "500ms" overrides the delay; a bare number is seconds.
+	ActionDelay Action = "delay"
+	// ActionTempFail replies with Code for the first Count attempts per
+	// address, then accepts once and starts over. A captured group
+	// overrides the count.
+	ActionTempFail Action = "tempfail"
+)
+
+// Rule scripts the reply for recipients whose local part matches Pattern.
+type Rule struct {
+	Pattern string `json:"pattern"`
+	Stage   Stage  `json:"stage"`
+	Action  Action `json:"action"`
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Delay   string `json:"delay,omitempty"`
+	Count   int    `json:"count,omitempty"`
+}
+
+// DefaultRules are active unless MAGIC_ADDRESSES_FILE replaces them.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Pattern: `^bounce-(\d{3})$`, Stage: StageRcpt, Action: ActionReject, Code: 550, Message: "Mailbox unavailable"},
+		{Pattern: `^full$`, Stage: StageData, Action: ActionReject, Code: 552, Message: "Mailbox full"},
+		{Pattern: `^slow-(\d+(?:ms|s|m)?)$`, Stage: StageData, Action: ActionDelay},
+		{Pattern: `^tempfail-(\d+)$`, Stage: StageRcpt, Action: ActionTempFail, Code: 451, Message: "Try again later"},
+	}
+}
+
+// LoadFile reads a JSON array of rules. An empty path yields DefaultRules.
+func LoadFile(name string) ([]Rule, error) {
+	if strings.TrimSpace(name) == "" {
+		return DefaultRules(), nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read magic addresses file: %w", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse magic addresses file: %w", err)
+	}
+	return rules, nil
+}
+
+// Reply is the scripted outcome for an address. A zero Code accepts.
+type Reply struct {
+	Delay   time.Duration
+	Code    int
+	Message string
+}
+
+type Responder struct {
+	rules []compiledRule
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+type compiledRule struct {
+	Rule
+	re    *regexp.Regexp
+	delay time.Duration
+}
+
+func New(rules []Rule) (*Responder, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for idx, rule := range rules {
+		re, err := regexp.Compile("(?i)" + rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid pattern: %w", idx, err)
+		}
+		if rule.Stage != StageRcpt && rule.Stage != StageData {
+			return nil, fmt.Errorf("rule %d: unknown stage %q", idx, rule.Stage)
+		}
+		entry := compiledRule{Rule: rule, re: re}
+		switch rule.Action {
+		case ActionReject, ActionTempFail:
+			if re.NumSubexp() == 0 && (rule.Code < 400 || rule.Code > 599) {
+				return nil, fmt.Errorf("rule %d: code must be a 4xx or 5xx reply", idx)
+			}
+		case ActionDelay:
+			if rule.Delay != "" {
+				if entry.delay, err = parseDelay(rule.Delay); err != nil {
+					return nil, fmt.Errorf("rule %d: %w", idx, err)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action %q", idx, rule.Action)
+		}
+		compiled = append(compiled, entry)
+	}
+	return &Responder{rules: compiled, attempts: map[string]int{}}, nil
+}
+
+// Evaluate returns the scripted reply for address at stage. Only the first
+// matching rule applies.
+func (r *Responder) Evaluate(stage Stage, address string) Reply {
+	if r == nil {
+		return Reply{}
+	}
+	local, _, _ := strings.Cut(strings.ToLower(address), "@")
+	for _, rule := range r.rules {
+		if rule.Stage != stage {
+			continue
+		}
+		match := rule.re.FindStringSubmatch(local)
+		if match == nil {
+			continue
+		}
+		param := ""
+		if len(match) > 1 {
+			param = match[1]
+		}
+		return r.apply(rule, param, strings.ToLower(address))
+	}
+	return Reply{}
+}
+
+func (r *Responder) apply(rule compiledRule, param, address string) Reply {
+	switch rule.Action {
+	case ActionReject:
+		code := rule.Code
+		if parsed, err := strconv.Atoi(param); err == nil && parsed >= 400 && parsed <= 599 {
+			code = parsed
+		}
+		if code == 0 {
+			return Reply{}
+		}
+		return Reply{Code: code, Message: rule.message(code)}
+	case ActionDelay:
+		delay := rule.delay
+		if parsed, err := parseDelay(param); err == nil {
+			delay = parsed
+		}
+		return Reply{Delay: delay}
+	case ActionTempFail:
+		count := rule.Count
+		if parsed, err := strconv.Atoi(param); err == nil {
+			count = parsed
+		}
+		code := rule.Code
+		if code == 0 {
+			code = 451
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.attempts[address] < count {
+			r.attempts[address]++
+			return Reply{Code: code, Message: rule.message(code)}
+		}
+		delete(r.attempts, address)
+	}
+	return Reply{}
+}
+
+func (r Rule) message(code int) string {
+	if r.Message != "" {
+		return r.Message
+	}
+	if code >= 500 {
+		return "Rejected by magic address"
+	}
+	return "Temporarily rejected by magic address"
+}
+
+func parseDelay(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid delay %q", value)
+	}
+	return delay, nil
+}
@@ -0,0 +1,89 @@
+package magic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	responder, err := New(DefaultRules())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	tests := []struct {
+		name    string
+		stage   Stage
+		address string
+		want    Reply
+	}{
+		{name: "plain address", stage: StageRcpt, address: "alice@example.com", want: Reply{}},
+		{name: "bounce code", stage: StageRcpt, address: "bounce-553@example.com", want: Reply{Code: 553, Message: "Mailbox unavailable"}},
+		{name: "bounce out of range", stage: StageRcpt, address: "bounce-250@example.com", want: Reply{Code: 550, Message: "Mailbox unavailable"}},
+		{name: "case insensitive", stage: StageRcpt, address: "Bounce-554@Example.com", want: Reply{Code: 554, Message: "Mailbox unavailable"}},
+		{name: "other stage", stage: StageData, address: "bounce-553@example.com", want: Reply{}},
+		{name: "full", stage: StageData, address: "full@example.com", want: Reply{Code: 552, Message: "Mailbox full"}},
+		{name: "slow seconds", stage: StageData, address: "slow-3@example.com", want: Reply{Delay: 3 * time.Second}},
+		{name: "slow milliseconds", stage: StageData, address: "slow-250ms@example.com", want: Reply{Delay: 250 * time.Millisecond}},
+		{name: "slow minutes", stage: StageData, address: "slow-2m@example.com", want: Reply{Delay: 2 * time.Minute}},
+		{name: "slow with a bad unit", stage: StageData, address: "slow-2h@example.com", want: Reply{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := responder.Evaluate(tc.stage, tc.address); got != tc.want {
+				t.Errorf("Evaluate(%s, %s) = %+v, want %+v", tc.stage, tc.address, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTempFail(t *testing.T) {
+	responder, err := New(DefaultRules())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// tempfail-2 fails twice, accepts once, then starts over. Each address
+	// counts on its own.
+	steps := []struct {
+		address string
+		code    int
+	}{
+		{"tempfail-2@example.com", 451},
+		{"tempfail-2@example.com", 451},
+		{"tempfail-2@example.org", 451},
+		{"tempfail-2@example.com", 0},
+		{"tempfail-2@example.com", 451},
+		{"tempfail-2@example.org", 451},
+		{"tempfail-2@example.org", 0},
+		{"tempfail-0@example.com", 0},
+	}
+	for idx, step := range steps {
+		if got := responder.Evaluate(StageRcpt, step.address); got.Code != step.code {
+			t.Errorf("attempt %d for %s: code %d, want %d", idx+1, step.address, got.Code, step.code)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{name: "reject", rule: Rule{Pattern: `^nope$`, Stage: StageRcpt, Action: ActionReject, Code: 550}},
+		{name: "captured code", rule: Rule{Pattern: `^code-(\d+)$`, Stage: StageRcpt, Action: ActionReject}},
+		{name: "fixed delay", rule: Rule{Pattern: `^wait$`, Stage: StageData, Action: ActionDelay, Delay: "5s"}},
+		{name: "bad pattern", rule: Rule{Pattern: `(`, Stage: StageRcpt, Action: ActionReject, Code: 550}, wantErr: true},
+		{name: "unknown stage", rule: Rule{Pattern: `^x$`, Stage: "mail", Action: ActionReject, Code: 550}, wantErr: true},
+		{name: "unknown action", rule: Rule{Pattern: `^x$`, Stage: StageRcpt, Action: "drop"}, wantErr: true},
+		{name: "missing code", rule: Rule{Pattern: `^x$`, Stage: StageRcpt, Action: ActionTempFail}, wantErr: true},
+		{name: "bad delay", rule: Rule{Pattern: `^x$`, Stage: StageData, Action: ActionDelay, Delay: "soon"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New([]Rule{tc.rule})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("New() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are latency buckets in seconds, matching the Prometheus
+// client defaults.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics holds every instrument LocalSMTP exports. Values that can be read
+// from other components at scrape time, such as stored message counts, are
+// written by the caller with WriteGauge instead.
+type Metrics struct {
+	SMTPConnections     *Counter
+	SMTPAuthFailures    *Counter
+	SMTPMessages        *Counter
+	SMTPBytesReceived   *Counter
+	SMTPParseErrors     *Counter
+	StoreInsertDuration *Histogram
+	IngestBatches       *Counter
+	IngestRejected      *Counter
+	HTTPRequests        *Counter
+	HTTPRequestDuration *Histogram
+	RetentionDeleted    *Counter
+	BlobsCollected      *Counter
+	WebhookDeliveries   *Counter
+
+	all []collector
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		SMTPConnections:     newCounter("localsmtp_smtp_connections_total", "SMTP connections accepted."),
+		SMTPAuthFailures:    newCounter("localsmtp_smtp_auth_failures_total", "Failed SMTP AUTH attempts."),
+		SMTPMessages:        newCounter("localsmtp_smtp_messages_total", "SMTP transaction steps by stage and result. stage=\"data\",result=\"accepted\" counts stored messages.", "stage", "result"),
+		SMTPBytesReceived:   newCounter("localsmtp_smtp_received_bytes_total", "Message bytes received over DATA."),
+		SMTPParseErrors:     newCounter("localsmtp_smtp_parse_errors_total", "Messages stored despite a MIME parse error."),
+		StoreInsertDuration: newHistogram("localsmtp_store_insert_duration_seconds", "Time spent committing a batch of messages to the store.", DefaultBuckets),
+		IngestBatches:       newCounter("localsmtp_ingest_batches_total", "Transactions committed by the ingest queue. Divide stored messages by this for the average batch size."),
+		IngestRejected:      newCounter("localsmtp_ingest_rejected_total", "Messages refused with 451 because the ingest queue was full."),
+		HTTPRequests:        newCounter("localsmtp_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code"),
+		HTTPRequestDuration: newHistogram("localsmtp_http_request_duration_seconds", "HTTP request latency by route.", DefaultBuckets, "route"),
+		RetentionDeleted:    newCounter("localsmtp_retention_deleted_total", "Messages removed by the retention janitor by reason.", "reason"),
+		BlobsCollected:      newCounter("localsmtp_blobs_collected_total", "Unreferenced blobs removed from the blob store."),
+		WebhookDeliveries:   newCounter("localsmtp_webhook_deliveries_total", "Webhook delivery attempts by webhook and result (delivered, retry or failed).", "webhook", "result"),
+	}
+	m.all = []collector{
+		m.SMTPConnections,
+		m.SMTPAuthFailures,
+		m.SMTPMessages,
+		m.SMTPBytesReceived,
+		m.SMTPParseErrors,
+		m.StoreInsertDuration,
+		m.IngestBatches,
+		m.IngestRejected,
+		m.HTTPRequests,
+		m.HTTPRequestDuration,
+		m.RetentionDeleted,
+		m.BlobsCollected,
+		m.WebhookDeliveries,
+	}
+	return m
+}
+
+// Write writes all instruments in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) {
+	for _, c := range m.all {
+		c.write(w)
+	}
+}
+
+// WriteGauge writes a single gauge sample with its HELP and TYPE lines.
+// labels alternates names and values.
+func WriteGauge(w io.Writer, name, help string, value float64, labels ...string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatFloat(value))
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *Counter {
+	return &Counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(pairs(c.labels, key)), formatFloat(c.values[key]))
+	}
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+func (h *Histogram) Observe(d time.Duration, labelValues ...string) {
+	seconds := d.Seconds()
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += seconds
+}
+
+func (h *Histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.labels) == 0 && len(h.series) == 0 {
+		h.series[""] = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+	}
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		labels := []string{}
+		if len(h.labels) > 0 {
+			labels = pairs(h.labels, key)
+		}
+		for i, bound := range h.buckets {
+			bucketLabels := append(append([]string(nil), labels...), "le", formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(append(append([]string(nil), labels...), "le", "+Inf")), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(labels), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(labels), series.count)
+	}
+}
+
+func pairs(names []string, key string) []string {
+	values := strings.Split(key, "\xff")
+	out := make([]string, 0, len(names)*2)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		out = append(out, name, value)
+	}
+	return out
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -10,12 +10,15 @@ import (
 )
 
 // Params represents pagination parameters extracted from a request.
-// It contains the page number, limit per page, calculated offset, and sort order.
+// It contains the page number, limit per page, calculated offset, sort order,
+// and an optional cursor that replaces the page number when present.
 type Params struct {
 	Page   int32  // Current page number (1-based)
 	Limit  int32  // Number of items per page
 	Offset int32  // Calculated offset for database queries
 	Sort   string // Sort order: "newest", "oldest", "asc", or "desc"
+	Cursor string // Opaque cursor returned by a previous page, if any
+	Count  bool   // Whether the total number of items was requested
 }
 
 const (
@@ -112,6 +115,9 @@ func GetPaginationParams(q url.Values, opts ...PaginationOption) *Params {
 		params.Sort = sortStr
 	}
 
+	params.Cursor = q.Get("cursor")
+	params.Count, _ = strconv.ParseBool(q.Get("count"))
+
 	return params
 }
 
@@ -0,0 +1,511 @@
+package pop3server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/credentials"
+	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/webhook"
+)
+
+const idleTimeout = 10 * time.Minute
+
+type AuthConfig struct {
+	// Enabled requires, on PASS, the password of an SMTP credential that may
+	// send as the mailbox. Any address is accepted as the username either
+	// way, as in the web UI.
+	Enabled     bool
+	Credentials *credentials.Set
+}
+
+type Server struct {
+	store     store.Storage
+	webhooks  *webhook.Dispatcher
+	logger    *slog.Logger
+	addr      string
+	authCfg   AuthConfig
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func New(store store.Storage, logger *slog.Logger, addr string, authCfg AuthConfig, tlsConfig *tls.Config, webhooks *webhook.Dispatcher) *Server {
+	return &Server{
+		store:     store,
+		webhooks:  webhooks,
+		logger:    logger,
+		addr:      addr,
+		authCfg:   authCfg,
+		tlsConfig: tlsConfig,
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	s.logger.Info("pop3 server listening", "addr", s.addr, "stls", s.tlsConfig != nil)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) track(conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	s.track(conn, true)
+	sess := &session{server: s, conn: conn}
+	defer func() {
+		s.track(sess.conn, false)
+		_ = sess.conn.Close()
+	}()
+	sess.reset()
+	sess.reply(true, "LocalSMTP POP3 server ready")
+
+	for {
+		_ = sess.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := sess.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, args := parseCommand(line)
+		if quit := sess.handle(cmd, args); quit {
+			return
+		}
+	}
+}
+
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	user     string
+	email    string
+	messages []popMessage
+}
+
+type popMessage struct {
+	id      string
+	size    int64
+	deleted bool
+}
+
+func (s *session) reset() {
+	s.reader = bufio.NewReader(s.conn)
+	s.writer = bufio.NewWriter(s.conn)
+}
+
+func (s *session) reply(ok bool, format string, args ...any) {
+	status := "+OK"
+	if !ok {
+		status = "-ERR"
+	}
+	text := fmt.Sprintf(format, args...)
+	if text != "" {
+		status += " " + text
+	}
+	_, _ = s.writer.WriteString(status + "\r\n")
+	_ = s.writer.Flush()
+}
+
+func (s *session) handle(cmd string, args []string) bool {
+	switch cmd {
+	case "QUIT":
+		s.quit()
+		return true
+	case "CAPA":
+		s.capa()
+		return false
+	case "NOOP":
+		s.reply(true, "")
+		return false
+	}
+
+	if s.email == "" {
+		s.handleAuthorization(cmd, args)
+		return false
+	}
+
+	switch cmd {
+	case "STAT":
+		s.stat()
+	case "LIST":
+		s.list(args, false)
+	case "UIDL":
+		s.list(args, true)
+	case "RETR":
+		s.retr(args)
+	case "TOP":
+		s.top(args)
+	case "DELE":
+		s.dele(args)
+	case "RSET":
+		for i := range s.messages {
+			s.messages[i].deleted = false
+		}
+		s.reply(true, "")
+	default:
+		s.reply(false, "unknown command")
+	}
+	return false
+}
+
+func (s *session) capa() {
+	lines := []string{"TOP", "UIDL", "RESP-CODES", "IMPLEMENTATION LocalSMTP"}
+	if s.needsTLS() {
+		lines = append(lines, "STLS")
+	} else {
+		lines = append(lines, "USER")
+	}
+	s.reply(true, "Capability list follows")
+	for _, line := range lines {
+		_, _ = s.writer.WriteString(line + "\r\n")
+	}
+	_, _ = s.writer.WriteString(".\r\n")
+	_ = s.writer.Flush()
+}
+
+func (s *session) handleAuthorization(cmd string, args []string) {
+	switch cmd {
+	case "USER", "PASS":
+		if s.needsTLS() {
+			s.reply(false, "[AUTH] STLS first")
+			return
+		}
+	}
+	switch cmd {
+	case "USER":
+		if len(args) != 1 {
+			s.reply(false, "USER requires an address")
+			return
+		}
+		s.user = args[0]
+		s.reply(true, "")
+	case "PASS":
+		if s.user == "" {
+			s.reply(false, "USER first")
+			return
+		}
+		s.login(strings.Join(args, " "))
+	case "STLS":
+		s.startTLS()
+	default:
+		s.reply(false, "not authenticated")
+	}
+}
+
+func (s *session) login(password string) {
+	ctx := context.Background()
+	email, err := auth.NormalizeEmail(s.user)
+	if err == nil && s.server.authCfg.Enabled {
+		_, err = s.server.authCfg.Credentials.AuthenticateMailbox(ctx, email, password)
+		if err != nil && !errors.Is(err, credentials.ErrInvalid) {
+			s.server.logger.Error("check pop3 credentials", "error", err)
+		}
+	}
+	if err != nil {
+		s.user = ""
+		s.reply(false, "[AUTH] invalid credentials")
+		return
+	}
+
+	entries, err := s.server.store.ListMailbox(ctx, email, "inbox")
+	if err != nil {
+		s.server.logger.Error("pop3 list mailbox", "error", err)
+		s.reply(false, "[SYS/TEMP] unable to open mailbox")
+		return
+	}
+	if err := s.server.store.UpsertUser(ctx, email, time.Now()); err != nil {
+		s.server.logger.Warn("pop3 upsert user", "error", err)
+	}
+	s.email = email
+	s.messages = make([]popMessage, 0, len(entries))
+	for _, entry := range entries {
+		s.messages = append(s.messages, popMessage{id: entry.ID, size: entry.Size})
+	}
+	s.reply(true, "%s has %d messages", email, len(s.messages))
+}
+
+func (s *session) startTLS() {
+	if s.server.tlsConfig == nil || s.isTLS() {
+		s.reply(false, "STLS not available")
+		return
+	}
+	s.reply(true, "Begin TLS negotiation")
+	tlsConn := tls.Server(s.conn, s.server.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = s.conn.Close()
+		return
+	}
+	s.server.track(s.conn, false)
+	s.conn = tlsConn
+	s.server.track(s.conn, true)
+	s.reset()
+}
+
+// needsTLS reports whether the connection must STLS before USER and PASS,
+// so passwords never travel in cleartext once TLS is configured.
+func (s *session) needsTLS() bool {
+	return s.server.tlsConfig != nil && !s.isTLS()
+}
+
+func (s *session) isTLS() bool {
+	_, ok := s.conn.(*tls.Conn)
+	return ok
+}
+
+func (s *session) stat() {
+	count := 0
+	var size int64
+	for _, msg := range s.messages {
+		if msg.deleted {
+			continue
+		}
+		count++
+		size += msg.size
+	}
+	s.reply(true, "%d %d", count, size)
+}
+
+func (s *session) list(args []string, uidl bool) {
+	if len(args) > 0 {
+		idx, msg, err := s.lookup(args[0])
+		if err != nil {
+			s.reply(false, "%s", err.Error())
+			return
+		}
+		if uidl {
+			s.reply(true, "%d %s", idx, msg.id)
+		} else {
+			s.reply(true, "%d %d", idx, msg.size)
+		}
+		return
+	}
+
+	s.reply(true, "")
+	for i, msg := range s.messages {
+		if msg.deleted {
+			continue
+		}
+		if uidl {
+			fmt.Fprintf(s.writer, "%d %s\r\n", i+1, msg.id)
+		} else {
+			fmt.Fprintf(s.writer, "%d %d\r\n", i+1, msg.size)
+		}
+	}
+	_, _ = s.writer.WriteString(".\r\n")
+	_ = s.writer.Flush()
+}
+
+func (s *session) retr(args []string) {
+	if len(args) != 1 {
+		s.reply(false, "RETR requires a message number")
+		return
+	}
+	_, msg, err := s.lookup(args[0])
+	if err != nil {
+		s.reply(false, "%s", err.Error())
+		return
+	}
+	raw, ok := s.load(msg)
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+	if changed, err := s.server.store.MarkMessageRead(ctx, s.email, msg.id, time.Now()); err != nil {
+		s.server.logger.Warn("pop3 mark message read", "error", err)
+	} else if changed {
+		s.server.webhooks.Notify(ctx, webhook.MessageRead, s.email, msg.id)
+	}
+	body := multiline(raw, -1)
+	s.reply(true, "%d octets", len(body))
+	s.writeMultiline(body)
+}
+
+func (s *session) top(args []string) {
+	if len(args) != 2 {
+		s.reply(false, "TOP requires a message number and line count")
+		return
+	}
+	lines, err := strconv.Atoi(args[1])
+	if err != nil || lines < 0 {
+		s.reply(false, "invalid line count")
+		return
+	}
+	_, msg, err := s.lookup(args[0])
+	if err != nil {
+		s.reply(false, "%s", err.Error())
+		return
+	}
+	raw, ok := s.load(msg)
+	if !ok {
+		return
+	}
+	s.reply(true, "")
+	s.writeMultiline(multiline(raw, lines))
+}
+
+func (s *session) dele(args []string) {
+	if len(args) != 1 {
+		s.reply(false, "DELE requires a message number")
+		return
+	}
+	idx, _, err := s.lookup(args[0])
+	if err != nil {
+		s.reply(false, "%s", err.Error())
+		return
+	}
+	s.messages[idx-1].deleted = true
+	s.reply(true, "message %d deleted", idx)
+}
+
+// quit enters the UPDATE state: messages marked with DELE are removed the same
+// way the HTTP API deletes them.
+func (s *session) quit() {
+	if s.email == "" {
+		s.reply(true, "bye")
+		return
+	}
+	ctx := context.Background()
+	failed := 0
+	for _, msg := range s.messages {
+		if !msg.deleted {
+			continue
+		}
+		event, notify := s.server.webhooks.Lookup(ctx, webhook.MessageDeleted, s.email, msg.id)
+		deleted, err := s.server.store.DeleteMessage(ctx, s.email, msg.id)
+		if err != nil {
+			s.server.logger.Error("pop3 delete message", "error", err)
+			failed++
+			continue
+		}
+		if deleted && notify {
+			s.server.webhooks.Publish(ctx, event)
+		}
+	}
+	if failed > 0 {
+		s.reply(false, "[SYS/TEMP] %d messages not deleted", failed)
+		return
+	}
+	s.reply(true, "bye")
+}
+
+func (s *session) lookup(arg string) (int, popMessage, error) {
+	idx, err := strconv.Atoi(arg)
+	if err != nil || idx < 1 || idx > len(s.messages) {
+		return 0, popMessage{}, errors.New("no such message")
+	}
+	msg := s.messages[idx-1]
+	if msg.deleted {
+		return 0, popMessage{}, errors.New("message already deleted")
+	}
+	return idx, msg, nil
+}
+
+func (s *session) load(msg popMessage) ([]byte, bool) {
+	message, _, _, err := s.server.store.GetMessage(context.Background(), s.email, msg.id)
+	if err != nil {
+		s.reply(false, "no such message")
+		return nil, false
+	}
+	return message.Raw, true
+}
+
+// multiline renders raw with CRLF line endings and dot-stuffing, without the
+// terminating line. A non-negative bodyLines limits it to the header and that
+// many body lines, as TOP requires.
+func multiline(raw []byte, bodyLines int) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var out bytes.Buffer
+	out.Grow(len(raw) + len(lines))
+	inBody := false
+	written := 0
+	for _, line := range lines {
+		if inBody && bodyLines >= 0 {
+			if written >= bodyLines {
+				break
+			}
+			written++
+		}
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		out.WriteString(line + "\r\n")
+		if !inBody && line == "" {
+			inBody = true
+		}
+	}
+	return out.Bytes()
+}
+
+// writeMultiline sends a rendered multiline response and its terminator.
+func (s *session) writeMultiline(body []byte) {
+	_, _ = s.writer.Write(body)
+	_, _ = s.writer.WriteString(".\r\n")
+	_ = s.writer.Flush()
+}
+
+func parseCommand(line string) (string, []string) {
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(fields[0]), fields[1:]
+}
@@ -0,0 +1,191 @@
+package retention
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/metrics"
+	"github.io/razzkumar/localsmtp/internal/sse"
+	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/webhook"
+)
+
+// Policy limits what the store keeps. Zero disables a limit. CollectBlobs
+// also removes blob files no message refers to anymore.
+type Policy struct {
+	MaxAge        time.Duration
+	MaxMessages   int
+	MaxPerMailbox int
+	MaxDBBytes    int64
+	Interval      time.Duration
+	BatchSize     int
+	CollectBlobs  bool
+}
+
+// blobGrace keeps fresh blobs whose message row may not be committed yet.
+const blobGrace = time.Hour
+
+func (p Policy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxMessages > 0 || p.MaxPerMailbox > 0 || p.MaxDBBytes > 0 || p.CollectBlobs
+}
+
+// Janitor announces its deletions like an admin purge: a purge event on
+// every open stream and a message.deleted webhook per message.
+type Janitor struct {
+	store    *store.Store
+	hub      *sse.Hub
+	webhooks *webhook.Dispatcher
+	policy   Policy
+	metrics  *metrics.Metrics
+	logger   *slog.Logger
+}
+
+func New(store *store.Store, hub *sse.Hub, webhooks *webhook.Dispatcher, policy Policy, m *metrics.Metrics, logger *slog.Logger) *Janitor {
+	if policy.Interval <= 0 {
+		policy.Interval = 5 * time.Minute
+	}
+	if policy.BatchSize <= 0 {
+		policy.BatchSize = 500
+	}
+	return &Janitor{store: store, hub: hub, webhooks: webhooks, policy: policy, metrics: m, logger: logger}
+}
+
+// Run sweeps once at start and then every Interval until ctx is cancelled.
+func (j *Janitor) Run(ctx context.Context) {
+	j.logger.Info("retention janitor started",
+		"maxAge", j.policy.MaxAge,
+		"maxMessages", j.policy.MaxMessages,
+		"maxPerMailbox", j.policy.MaxPerMailbox,
+		"maxDBBytes", j.policy.MaxDBBytes,
+		"collectBlobs", j.policy.CollectBlobs,
+		"interval", j.policy.Interval)
+	ticker := time.NewTicker(j.policy.Interval)
+	defer ticker.Stop()
+	for {
+		if err := j.Sweep(ctx); err != nil && ctx.Err() == nil {
+			j.logger.Error("retention sweep", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep enforces every configured limit, then returns freed pages to the OS
+// if anything was removed.
+func (j *Janitor) Sweep(ctx context.Context) error {
+	removed := map[string]int64{}
+	var total int64
+	record := func(reason string, count int64) {
+		if count == 0 {
+			return
+		}
+		removed[reason] += count
+		total += count
+		j.metrics.RetentionDeleted.Add(float64(count), reason)
+	}
+
+	if j.policy.MaxAge > 0 {
+		cutoff := time.Now().Add(-j.policy.MaxAge)
+		count, err := j.drain(ctx, func() ([]store.MessageRef, error) {
+			return j.store.ExpiredMessages(ctx, cutoff, j.policy.BatchSize)
+		})
+		record("age", count)
+		if err != nil {
+			return err
+		}
+	}
+	if j.policy.MaxPerMailbox > 0 {
+		count, err := j.drain(ctx, func() ([]store.MessageRef, error) {
+			return j.store.ExcessMailboxMessages(ctx, j.policy.MaxPerMailbox, j.policy.BatchSize)
+		})
+		record("mailbox_count", count)
+		if err != nil {
+			return err
+		}
+	}
+	if j.policy.MaxMessages > 0 {
+		count, err := j.drain(ctx, func() ([]store.MessageRef, error) {
+			return j.store.ExcessMessages(ctx, j.policy.MaxMessages, j.policy.BatchSize)
+		})
+		record("count", count)
+		if err != nil {
+			return err
+		}
+	}
+	if j.policy.MaxDBBytes > 0 {
+		count, err := j.drain(ctx, func() ([]store.MessageRef, error) {
+			size, err := j.store.DatabaseSize(ctx)
+			if err != nil || size <= j.policy.MaxDBBytes {
+				return nil, err
+			}
+			return j.store.OldestMessages(ctx, size-j.policy.MaxDBBytes, j.policy.BatchSize)
+		})
+		record("size", count)
+		if err != nil {
+			return err
+		}
+	}
+
+	if total > 0 {
+		j.hub.BroadcastAll(sse.PurgeEvent("", total))
+		if err := j.store.IncrementalVacuum(ctx); err != nil {
+			return err
+		}
+		j.logger.Info("retention removed messages", "total", total, "byReason", removed)
+	}
+
+	if j.policy.CollectBlobs {
+		count, err := j.store.CollectBlobs(ctx, blobGrace)
+		if count > 0 {
+			j.metrics.BlobsCollected.Add(float64(count))
+			j.logger.Info("retention removed unreferenced blobs", "total", count)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drain deletes the batches pick returns until it finds nothing, yielding
+// between batches so captured mail is not blocked behind a long purge.
+func (j *Janitor) drain(ctx context.Context, pick func() ([]store.MessageRef, error)) (int64, error) {
+	var total int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		refs, err := pick()
+		if err != nil || len(refs) == 0 {
+			return total, err
+		}
+		count, err := j.remove(ctx, refs)
+		total += count
+		if err != nil || count == 0 {
+			return total, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// remove deletes refs and queues a message.deleted webhook for each. The
+// events are loaded first, since the messages are gone afterwards.
+func (j *Janitor) remove(ctx context.Context, refs []store.MessageRef) (int64, error) {
+	events := j.webhooks.LookupDeleted(ctx, "", refs)
+	ids := make([]string, len(refs))
+	for i, ref := range refs {
+		ids[i] = ref.ID
+	}
+	count, err := j.store.DeleteMessages(ctx, ids)
+	if err != nil {
+		return count, err
+	}
+	for _, event := range events {
+		j.webhooks.Publish(ctx, event)
+	}
+	return count, nil
+}
@@ -0,0 +1,123 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+)
+
+// Alias delivers mail for Address to every address in To as well. Address
+// may be a wildcard mailbox such as "*@legacy.example.com".
+type Alias struct {
+	Address string   `json:"address"`
+	To      []string `json:"to"`
+}
+
+// LoadFile reads a JSON array of aliases. An empty path yields none.
+func LoadFile(name string) ([]Alias, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read aliases file: %w", err)
+	}
+	var aliases []Alias
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("parse aliases file: %w", err)
+	}
+	return aliases, nil
+}
+
+// Router adds the mailboxes a message is routed to beyond its recipients. A
+// nil Router routes nothing.
+type Router struct {
+	subaddressing bool
+	aliases       []Alias
+}
+
+// New validates aliases. With subaddressing, mail for "qa+tag@example.com"
+// is also delivered to "qa@example.com".
+func New(subaddressing bool, aliases []Alias) (*Router, error) {
+	router := &Router{subaddressing: subaddressing}
+	for idx, alias := range aliases {
+		address, err := auth.NormalizeEmail(alias.Address)
+		if err != nil {
+			return nil, fmt.Errorf("alias %d: address %q: %w", idx, alias.Address, err)
+		}
+		if len(alias.To) == 0 {
+			return nil, fmt.Errorf("alias %d: %s has no targets", idx, address)
+		}
+		normalized := Alias{Address: address}
+		for _, target := range alias.To {
+			email, err := auth.NormalizeEmail(target)
+			if err != nil {
+				return nil, fmt.Errorf("alias %d: target %q: %w", idx, target, err)
+			}
+			if auth.IsEmailPattern(email) {
+				return nil, fmt.Errorf("alias %d: target %s cannot be a wildcard", idx, email)
+			}
+			normalized.To = append(normalized.To, email)
+		}
+		router.aliases = append(router.aliases, normalized)
+	}
+	return router, nil
+}
+
+// Route returns the extra mailboxes for a recipient: its base address when
+// subaddressing is on, then the targets of any alias matching the recipient
+// or its base. Aliases are not expanded recursively, so they cannot loop.
+func (r *Router) Route(recipient string) []string {
+	if r == nil {
+		return nil
+	}
+	addresses := []string{recipient}
+	if r.subaddressing {
+		if base := Base(recipient); base != recipient {
+			addresses = append(addresses, base)
+		}
+	}
+	routed := addresses[1:]
+	for _, alias := range r.aliases {
+		for _, address := range addresses {
+			if auth.MatchEmail(alias.Address, address) {
+				routed = append(routed, alias.To...)
+				break
+			}
+		}
+	}
+	return routed
+}
+
+// Enabled reports whether r routes anything.
+func (r *Router) Enabled() bool {
+	return r != nil && (r.subaddressing || len(r.aliases) > 0)
+}
+
+// Base strips the "+tag" from an address's local part.
+func Base(address string) string {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return address
+	}
+	if plus := strings.Index(local, "+"); plus > 0 {
+		return local[:plus] + "@" + domain
+	}
+	return address
+}
+
+// Tag returns the "+tag" of an address's local part without the plus, or ""
+// if it has none.
+func Tag(address string) string {
+	local, _, ok := strings.Cut(address, "@")
+	if !ok {
+		return ""
+	}
+	if plus := strings.Index(local, "+"); plus > 0 {
+		return local[plus+1:]
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package routing
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	aliases := []Alias{
+		{Address: "Support@Example.com", To: []string{"alice@example.com", "bob@example.com"}},
+		{Address: "*@legacy.example.com", To: []string{"archive@example.com"}},
+		{Address: "qa@example.com", To: []string{"carol@example.com"}},
+		{Address: "carol@example.com", To: []string{"dave@example.com"}},
+	}
+	tests := []struct {
+		name          string
+		subaddressing bool
+		recipient     string
+		want          []string
+	}{
+		{name: "no match", recipient: "erin@example.com", want: []string{}},
+		{name: "alias", recipient: "support@example.com", want: []string{"alice@example.com", "bob@example.com"}},
+		{name: "wildcard alias", recipient: "old-team@legacy.example.com", want: []string{"archive@example.com"}},
+		{name: "subaddress off", recipient: "qa+signup@example.com", want: []string{}},
+		{name: "subaddress", subaddressing: true, recipient: "erin+news@example.com", want: []string{"erin@example.com"}},
+		{name: "subaddress then alias", subaddressing: true, recipient: "qa+signup@example.com", want: []string{"qa@example.com", "carol@example.com"}},
+		{name: "alias of the full address", subaddressing: true, recipient: "support@example.com", want: []string{"alice@example.com", "bob@example.com"}},
+		{name: "not recursive", recipient: "qa@example.com", want: []string{"carol@example.com"}},
+		{name: "leading plus is not a tag", subaddressing: true, recipient: "+tag@example.com", want: []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			router, err := New(tc.subaddressing, aliases)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if got := router.Route(tc.recipient); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Route(%s) = %q, want %q", tc.recipient, got, tc.want)
+			}
+		})
+	}
+	var router *Router
+	if got := router.Route("qa+signup@example.com"); got != nil {
+		t.Errorf("nil Router routed to %q", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name  string
+		alias Alias
+	}{
+		{name: "bad address", alias: Alias{Address: "not an address", To: []string{"alice@example.com"}}},
+		{name: "no targets", alias: Alias{Address: "support@example.com"}},
+		{name: "bad target", alias: Alias{Address: "support@example.com", To: []string{"alice"}}},
+		{name: "wildcard target", alias: Alias{Address: "support@example.com", To: []string{"*@example.com"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(false, []Alias{tc.alias}); err == nil {
+				t.Error("New accepted an invalid alias")
+			}
+		})
+	}
+}
+
+func TestBaseAndTag(t *testing.T) {
+	tests := []struct {
+		address string
+		base    string
+		tag     string
+	}{
+		{"qa+signup@example.com", "qa@example.com", "signup"},
+		{"qa+a+b@example.com", "qa@example.com", "a+b"},
+		{"qa@example.com", "qa@example.com", ""},
+		{"+tag@example.com", "+tag@example.com", ""},
+		{"no-domain+tag", "no-domain+tag", ""},
+	}
+	for _, tc := range tests {
+		if got := Base(tc.address); got != tc.base {
+			t.Errorf("Base(%s) = %s, want %s", tc.address, got, tc.base)
+		}
+		if got := Tag(tc.address); got != tc.tag {
+			t.Errorf("Tag(%s) = %s, want %s", tc.address, got, tc.tag)
+		}
+	}
+}
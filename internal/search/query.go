@@ -0,0 +1,194 @@
+package search
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Field is the operator a term applies to. Free text has FieldText.
+type Field string
+
+const (
+	FieldText       Field = ""
+	FieldFrom       Field = "from"
+	FieldTo         Field = "to"
+	FieldCc         Field = "cc"
+	FieldSubject    Field = "subject"
+	FieldHas        Field = "has"
+	FieldIs         Field = "is"
+	FieldBefore     Field = "before"
+	FieldAfter      Field = "after"
+	FieldLarger     Field = "larger"
+	FieldSmaller    Field = "smaller"
+	FieldFilename   Field = "filename"
+	FieldTag        Field = "tag"
+	valueAttachment       = "attachment"
+)
+
+var errInvalid = errors.New("invalid search value")
+
+// Term is one condition. Date and size operators carry their parsed value in
+// Time or Size.
+type Term struct {
+	Field   Field
+	Value   string
+	Negated bool
+	Phrase  bool
+	Time    time.Time
+	Size    int64
+}
+
+type Query struct {
+	Terms []Term
+}
+
+func (q Query) Empty() bool {
+	return len(q.Terms) == 0
+}
+
+// Parse reads a Gmail-style query such as
+//
+//	from:alice subject:"weekly report" has:attachment -is:read after:2024-01-31
+//
+// Unknown operators, and operators whose value does not parse (such as the
+// half-typed "is:u" or "before:2024-0"), are searched as plain text.
+func Parse(input string) Query {
+	var query Query
+	for _, token := range tokenize(input) {
+		term := parseTerm(token)
+		if term.Value == "" {
+			continue
+		}
+		query.Terms = append(query.Terms, term)
+	}
+	return query
+}
+
+type token struct {
+	negated bool
+	key     string
+	value   string
+	quoted  bool
+}
+
+// tokenize splits on whitespace outside double quotes. A leading "-" negates
+// a token and "key:" may prefix a quoted value.
+func tokenize(input string) []token {
+	var tokens []token
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		var tok token
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			tok.negated = true
+			i++
+		}
+		start := i
+		for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '"' && runes[i] != ':' {
+			i++
+		}
+		if i < len(runes) && runes[i] == ':' && i > start {
+			tok.key = strings.ToLower(string(runes[start:i]))
+			i++
+			start = i
+		} else {
+			i = start
+		}
+		if i < len(runes) && runes[i] == '"' {
+			i++
+			end := i
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			tok.value = string(runes[i:end])
+			tok.quoted = true
+			i = end + 1
+		} else {
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				i++
+			}
+			tok.value = string(runes[start:i])
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens
+}
+
+func parseTerm(tok token) Term {
+	term := Term{Field: Field(tok.key), Value: strings.TrimSpace(tok.value), Negated: tok.negated, Phrase: tok.quoted}
+	if term.Value == "" {
+		return term
+	}
+	switch term.Field {
+	case FieldText, FieldFrom, FieldTo, FieldCc, FieldSubject, FieldFilename:
+	case FieldTag:
+		term.Value = strings.TrimPrefix(strings.ToLower(term.Value), "+")
+	case FieldHas:
+		term.Value = strings.ToLower(term.Value)
+		if term.Value != valueAttachment {
+			return textTerm(tok)
+		}
+	case FieldIs:
+		term.Value = strings.ToLower(term.Value)
+		if term.Value != "read" && term.Value != "unread" {
+			return textTerm(tok)
+		}
+	case FieldBefore, FieldAfter:
+		parsed, err := parseDate(term.Value)
+		if err != nil {
+			return textTerm(tok)
+		}
+		term.Time = parsed
+	case FieldLarger, FieldSmaller:
+		size, err := parseSize(term.Value)
+		if err != nil {
+			return textTerm(tok)
+		}
+		term.Size = size
+	default:
+		return textTerm(tok)
+	}
+	return term
+}
+
+// textTerm searches tok, operator included, as plain text.
+func textTerm(tok token) Term {
+	return Term{Field: FieldText, Value: tok.key + ":" + strings.TrimSpace(tok.value), Negated: tok.negated, Phrase: tok.quoted}
+}
+
+func parseDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006/01/02", time.RFC3339} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, errInvalid
+}
+
+// parseSize reads sizes such as "500", "10K" or "2M" in bytes.
+func parseSize(value string) (int64, error) {
+	upper := strings.TrimSuffix(strings.ToUpper(value), "B")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(upper, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(upper, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(upper, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		upper = upper[:len(upper)-1]
+	}
+	number, err := strconv.ParseFloat(upper, 64)
+	if err != nil || number < 0 {
+		return 0, errInvalid
+	}
+	return int64(number * float64(multiplier)), nil
+}
@@ -0,0 +1,97 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	day := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		input string
+		want  []Term
+	}{
+		{name: "empty", input: "   ", want: nil},
+		{name: "words", input: "weekly  report", want: []Term{
+			{Field: FieldText, Value: "weekly"},
+			{Field: FieldText, Value: "report"},
+		}},
+		{name: "phrase", input: `"weekly report"`, want: []Term{
+			{Field: FieldText, Value: "weekly report", Phrase: true},
+		}},
+		{name: "unterminated phrase", input: `"weekly report`, want: []Term{
+			{Field: FieldText, Value: "weekly report", Phrase: true},
+		}},
+		{name: "operators", input: `from:alice subject:"weekly report" to:example.com cc:bob filename:invoice`, want: []Term{
+			{Field: FieldFrom, Value: "alice"},
+			{Field: FieldSubject, Value: "weekly report", Phrase: true},
+			{Field: FieldTo, Value: "example.com"},
+			{Field: FieldCc, Value: "bob"},
+			{Field: FieldFilename, Value: "invoice"},
+		}},
+		{name: "operator case", input: "FROM:Alice Has:Attachment IS:Unread", want: []Term{
+			{Field: FieldFrom, Value: "Alice"},
+			{Field: FieldHas, Value: "attachment"},
+			{Field: FieldIs, Value: "unread"},
+		}},
+		{name: "negation", input: "-has:attachment -is:read -spam", want: []Term{
+			{Field: FieldHas, Value: "attachment", Negated: true},
+			{Field: FieldIs, Value: "read", Negated: true},
+			{Field: FieldText, Value: "spam", Negated: true},
+		}},
+		{name: "lone dash", input: "a - b", want: []Term{
+			{Field: FieldText, Value: "a"},
+			{Field: FieldText, Value: "-"},
+			{Field: FieldText, Value: "b"},
+		}},
+		{name: "negated phrase", input: `-subject:"out of office"`, want: []Term{
+			{Field: FieldSubject, Value: "out of office", Negated: true, Phrase: true},
+		}},
+		{name: "dates", input: "after:2024-01-31 before:2024/01/31", want: []Term{
+			{Field: FieldAfter, Value: "2024-01-31", Time: day},
+			{Field: FieldBefore, Value: "2024/01/31", Time: day},
+		}},
+		{name: "sizes", input: "larger:1M smaller:500K larger:2kb smaller:10", want: []Term{
+			{Field: FieldLarger, Value: "1M", Size: 1 << 20},
+			{Field: FieldSmaller, Value: "500K", Size: 500 << 10},
+			{Field: FieldLarger, Value: "2kb", Size: 2 << 10},
+			{Field: FieldSmaller, Value: "10", Size: 10},
+		}},
+		{name: "tag", input: "tag:+SignUp", want: []Term{
+			{Field: FieldTag, Value: "signup"},
+		}},
+		{name: "unknown operator", input: "label:work", want: []Term{
+			{Field: FieldText, Value: "label:work"},
+		}},
+		{name: "url", input: "https://example.com/reset", want: []Term{
+			{Field: FieldText, Value: "https://example.com/reset"},
+		}},
+		{name: "empty operator value", input: "from: is:", want: nil},
+		{name: "half-typed is", input: "is:u", want: []Term{
+			{Field: FieldText, Value: "is:u"},
+		}},
+		{name: "half-typed has", input: "-has:att", want: []Term{
+			{Field: FieldText, Value: "has:att", Negated: true},
+		}},
+		{name: "half-typed date", input: "before:2024-0", want: []Term{
+			{Field: FieldText, Value: "before:2024-0"},
+		}},
+		{name: "bad size", input: "larger:-1M smaller:lots", want: []Term{
+			{Field: FieldText, Value: "larger:-1M"},
+			{Field: FieldText, Value: "smaller:lots"},
+		}},
+		{name: "colon inside value", input: "subject:re:hello", want: []Term{
+			{Field: FieldSubject, Value: "re:hello"},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Parse(tc.input).Terms
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Parse(%q) = %+v, want %+v", tc.input, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package smtpserver
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// mailParams renders MAIL FROM parameters the way the client sent them, keyed
+// by ESMTP keyword.
+func mailParams(opts *smtp.MailOptions) map[string]string {
+	params := map[string]string{}
+	if opts == nil {
+		return params
+	}
+	if opts.Body != "" {
+		params["BODY"] = string(opts.Body)
+	}
+	if opts.Size > 0 {
+		params["SIZE"] = strconv.FormatInt(opts.Size, 10)
+	}
+	if opts.RequireTLS {
+		params["REQUIRETLS"] = ""
+	}
+	if opts.UTF8 {
+		params["SMTPUTF8"] = ""
+	}
+	if opts.Return != "" {
+		params["RET"] = string(opts.Return)
+	}
+	if opts.EnvelopeID != "" {
+		params["ENVID"] = opts.EnvelopeID
+	}
+	if opts.Auth != nil {
+		// go-smtp decodes AUTH=<> to an empty string; any other value is
+		// kept as sent.
+		params["AUTH"] = *opts.Auth
+		if *opts.Auth == "" {
+			params["AUTH"] = "<>"
+		}
+	}
+	return params
+}
+
+func rcptParams(opts *smtp.RcptOptions) map[string]string {
+	params := map[string]string{}
+	if opts == nil {
+		return params
+	}
+	if len(opts.Notify) > 0 {
+		notify := make([]string, 0, len(opts.Notify))
+		for _, value := range opts.Notify {
+			notify = append(notify, string(value))
+		}
+		params["NOTIFY"] = strings.Join(notify, ",")
+	}
+	if opts.OriginalRecipient != "" {
+		params["ORCPT"] = string(opts.OriginalRecipientType) + ";" + opts.OriginalRecipient
+	}
+	if !opts.RequireRecipientValidSince.IsZero() {
+		params["RRVS"] = opts.RequireRecipientValidSince.UTC().Format(time.RFC3339)
+	}
+	if opts.DeliverBy != nil {
+		value := strconv.FormatInt(int64(opts.DeliverBy.Time.Seconds()), 10) + ";" + string(opts.DeliverBy.Mode)
+		if opts.DeliverBy.Trace {
+			value += "T"
+		}
+		params["BY"] = value
+	}
+	if opts.MTPriority != nil {
+		params["MT-PRIORITY"] = strconv.Itoa(*opts.MTPriority)
+	}
+	return params
+}
@@ -0,0 +1,60 @@
+package smtpserver
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.io/razzkumar/localsmtp/internal/faults"
+)
+
+var errConnectionDropped = errors.New("connection dropped by fault injection")
+
+// injectFault runs the fault-injection rules for a stage, sleeping for any
+// configured latency. It returns the SMTP error to reply with, if any.
+func (s *session) injectFault(stage faults.Stage, recipients []string) error {
+	action := s.backend.faults.Evaluate(stage, s.from, recipients)
+	if action.Delay > 0 {
+		time.Sleep(action.Delay)
+	}
+	if !action.Fails() {
+		return nil
+	}
+	s.backend.logger.Info("smtp fault injected", "stage", stage, "code", action.Code, "drop", action.Drop)
+	if action.Drop {
+		_ = s.conn.Close()
+		return errConnectionDropped
+	}
+	return &smtp.SMTPError{
+		Code:         action.Code,
+		EnhancedCode: smtp.EnhancedCodeNotSet,
+		Message:      action.Message,
+	}
+}
+
+// injectDataFault is injectFault for the data stage, where dropping the
+// connection happens part-way through reading the message.
+func (s *session) injectDataFault(r io.Reader) error {
+	action := s.backend.faults.Evaluate(faults.StageData, s.from, s.to)
+	if action.Delay > 0 {
+		time.Sleep(action.Delay)
+	}
+	if !action.Fails() {
+		return nil
+	}
+	s.backend.logger.Info("smtp fault injected", "stage", faults.StageData, "code", action.Code, "drop", action.Drop)
+	if action.Drop {
+		if action.DropAfterBytes > 0 {
+			_, _ = io.CopyN(io.Discard, r, action.DropAfterBytes)
+		}
+		_ = s.conn.Close()
+		return errConnectionDropped
+	}
+	return &smtp.SMTPError{
+		Code:         action.Code,
+		EnhancedCode: smtp.EnhancedCodeNotSet,
+		Message:      action.Message,
+	}
+}
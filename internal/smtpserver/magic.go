@@ -0,0 +1,41 @@
+package smtpserver
+
+import (
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.io/razzkumar/localsmtp/internal/magic"
+)
+
+// scriptedReply applies magic-address rules for recipients at stage.
+func (s *session) scriptedReply(stage magic.Stage, recipients []string) error {
+	delay, reply := scripted(s.backend.magic, stage, recipients)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if reply.Code == 0 {
+		return nil
+	}
+	s.backend.logger.Info("smtp magic address reply", "stage", stage, "code", reply.Code)
+	return &smtp.SMTPError{
+		Code:         reply.Code,
+		EnhancedCode: smtp.EnhancedCodeNotSet,
+		Message:      reply.Message,
+	}
+}
+
+// scripted evaluates every recipient. Delays add up across recipients,
+// capped at readTimeout; the first scripted rejection wins.
+func scripted(responder *magic.Responder, stage magic.Stage, recipients []string) (time.Duration, magic.Reply) {
+	var delay time.Duration
+	var reply magic.Reply
+	for _, recipient := range recipients {
+		result := responder.Evaluate(stage, recipient)
+		delay += result.Delay
+		if result.Code != 0 && reply.Code == 0 {
+			reply = result
+		}
+	}
+	return min(delay, readTimeout), reply
+}
@@ -0,0 +1,36 @@
+package smtpserver
+
+import (
+	"testing"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/magic"
+)
+
+func TestScripted(t *testing.T) {
+	responder, err := magic.New(magic.DefaultRules())
+	if err != nil {
+		t.Fatalf("magic.New: %v", err)
+	}
+	tests := []struct {
+		name       string
+		recipients []string
+		wantDelay  time.Duration
+		wantCode   int
+	}{
+		{name: "plain", recipients: []string{"alice@example.com"}},
+		{name: "slow", recipients: []string{"slow-2s@example.com"}, wantDelay: 2 * time.Second},
+		{name: "delays add up", recipients: []string{"slow-2s@example.com", "slow-500ms@example.com"}, wantDelay: 2500 * time.Millisecond},
+		{name: "capped", recipients: []string{"slow-5m@example.com"}, wantDelay: readTimeout},
+		{name: "sum capped", recipients: []string{"slow-10s@example.com", "slow-10s@example.org"}, wantDelay: readTimeout},
+		{name: "first rejection wins", recipients: []string{"alice@example.com", "full@example.com", "slow-1s@example.com"}, wantDelay: time.Second, wantCode: 552},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			delay, reply := scripted(responder, magic.StageData, tc.recipients)
+			if delay != tc.wantDelay || reply.Code != tc.wantCode {
+				t.Errorf("scripted() = %v, %d; want %v, %d", delay, reply.Code, tc.wantDelay, tc.wantCode)
+			}
+		})
+	}
+}
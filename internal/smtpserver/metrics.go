@@ -0,0 +1,32 @@
+package smtpserver
+
+import (
+	"net"
+
+	"github.io/razzkumar/localsmtp/internal/metrics"
+)
+
+// countingListener counts connections that made it past connect-stage faults.
+type countingListener struct {
+	net.Listener
+	metrics *metrics.Metrics
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.metrics.SMTPConnections.Inc()
+	}
+	return conn, err
+}
+
+// observe records the outcome of a MAIL, RCPT or DATA command and passes err
+// through.
+func (s *session) observe(stage string, err error) error {
+	result := "accepted"
+	if err != nil {
+		result = "rejected"
+	}
+	s.backend.metrics.SMTPMessages.Inc(stage, result)
+	return err
+}
@@ -3,12 +3,15 @@ package smtpserver
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-message/mail"
@@ -16,49 +19,125 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/google/uuid"
 
+	"github.io/razzkumar/localsmtp/internal/blobstore"
+	"github.io/razzkumar/localsmtp/internal/credentials"
+	"github.io/razzkumar/localsmtp/internal/faults"
+	"github.io/razzkumar/localsmtp/internal/ingest"
+	"github.io/razzkumar/localsmtp/internal/magic"
+	"github.io/razzkumar/localsmtp/internal/metrics"
+	"github.io/razzkumar/localsmtp/internal/routing"
 	"github.io/razzkumar/localsmtp/internal/sse"
 	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/webhook"
 )
 
 const (
 	defaultDomain = "localsmtp"
+	// readTimeout is how long the server waits on a client, and so also the
+	// longest a magic address may hold a reply.
+	readTimeout = 15 * time.Second
 )
 
 type AuthConfig struct {
-	Enabled  bool
-	Username string
-	Password string
+	Enabled     bool
+	Credentials *credentials.Set
+}
+
+type TLSConfig struct {
+	// Config enables STARTTLS on the plain listener when set.
+	Config *tls.Config
+	// ImplicitAddr starts an additional implicit-TLS (SMTPS) listener when set.
+	ImplicitAddr string
 }
 
 type Server struct {
-	smtp   *smtp.Server
-	logger *slog.Logger
+	smtp         *smtp.Server
+	logger       *slog.Logger
+	faults       *faults.Injector
+	metrics      *metrics.Metrics
+	implicitAddr string
+
+	// serving and servingTLS are set while the listeners accept connections.
+	serving    atomic.Bool
+	servingTLS atomic.Bool
 }
 
-func New(store *store.Store, hub *sse.Hub, logger *slog.Logger, addr string, authCfg AuthConfig) *Server {
+func New(store store.Storage, queue *ingest.Queue, hub *sse.Hub, logger *slog.Logger, addr string, authCfg AuthConfig, tlsCfg TLSConfig, spoolCfg SpoolConfig, injector *faults.Injector, responder *magic.Responder, router *routing.Router, webhooks *webhook.Dispatcher, m *metrics.Metrics) *Server {
+	if spoolCfg.Threshold <= 0 {
+		spoolCfg.Threshold = 1 << 20
+	}
 	backend := &backend{
-		store:        store,
-		hub:          hub,
-		logger:       logger,
-		authEnabled:  authCfg.Enabled,
-		authUsername: authCfg.Username,
-		authPassword: authCfg.Password,
+		store:       store,
+		ingest:      queue,
+		hub:         hub,
+		logger:      logger,
+		faults:      injector,
+		magic:       responder,
+		router:      router,
+		webhooks:    webhooks,
+		metrics:     m,
+		spool:       spoolCfg,
+		authEnabled: authCfg.Enabled,
+		credentials: authCfg.Credentials,
 	}
 	server := smtp.NewServer(backend)
 	server.Addr = addr
 	server.Domain = defaultDomain
-	server.AllowInsecureAuth = true
-	server.ReadTimeout = 15 * time.Second
+	// With TLS configured, credentials only travel over STARTTLS or SMTPS.
+	server.AllowInsecureAuth = tlsCfg.Config == nil
+	server.ReadTimeout = readTimeout
 	server.WriteTimeout = 15 * time.Second
 	server.MaxRecipients = 100
 	server.MaxMessageBytes = 25 << 20
+	server.TLSConfig = tlsCfg.Config
 
-	return &Server{smtp: server, logger: logger}
+	return &Server{smtp: server, logger: logger, faults: injector, metrics: m, implicitAddr: tlsCfg.ImplicitAddr}
 }
 
 func (s *Server) ListenAndServe() error {
-	s.logger.Info("smtp server listening", "addr", s.smtp.Addr)
-	return s.smtp.ListenAndServe()
+	listener, err := net.Listen("tcp", s.smtp.Addr)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("smtp server listening", "addr", s.smtp.Addr, "starttls", s.smtp.TLSConfig != nil)
+	s.serving.Store(true)
+	defer s.serving.Store(false)
+	return s.smtp.Serve(s.listener(listener))
+}
+
+// ListenAndServeTLS serves implicit TLS on the configured SMTPS address. It
+// shares the backend with the plain listener and returns nil when no SMTPS
+// address is configured.
+func (s *Server) ListenAndServeTLS() error {
+	if s.implicitAddr == "" {
+		return nil
+	}
+	if s.smtp.TLSConfig == nil {
+		return errors.New("smtps listener requires a tls config")
+	}
+	listener, err := net.Listen("tcp", s.implicitAddr)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("smtps server listening", "addr", s.implicitAddr)
+	s.servingTLS.Store(true)
+	defer s.servingTLS.Store(false)
+	return s.smtp.Serve(&countingListener{Listener: s.faults.TLSListener(listener, s.smtp.TLSConfig), metrics: s.metrics})
+}
+
+// Ready reports whether every configured listener is bound and accepting.
+func (s *Server) Ready() error {
+	if !s.serving.Load() {
+		return fmt.Errorf("smtp listener on %s is not accepting connections", s.smtp.Addr)
+	}
+	if s.implicitAddr != "" && !s.servingTLS.Load() {
+		return fmt.Errorf("smtps listener on %s is not accepting connections", s.implicitAddr)
+	}
+	return nil
+}
+
+func (s *Server) listener(l net.Listener) net.Listener {
+	return &countingListener{Listener: s.faults.Listener(l), metrics: s.metrics}
 }
 
 func (s *Server) Close() error {
@@ -66,23 +145,50 @@ func (s *Server) Close() error {
 }
 
 type backend struct {
-	store        *store.Store
-	hub          *sse.Hub
-	logger       *slog.Logger
-	authEnabled  bool
-	authUsername string
-	authPassword string
+	store       store.Storage
+	ingest      *ingest.Queue
+	hub         *sse.Hub
+	logger      *slog.Logger
+	faults      *faults.Injector
+	magic       *magic.Responder
+	router      *routing.Router
+	webhooks    *webhook.Dispatcher
+	metrics     *metrics.Metrics
+	spool       SpoolConfig
+	authEnabled bool
+	credentials *credentials.Set
 }
 
-func (b *backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &session{backend: b}, nil
+// blobBacked is implemented by storage that keeps message content in a blob
+// store the SMTP server can stream into directly.
+type blobBacked interface {
+	Blobs() *blobstore.Store
+}
+
+func (b *backend) blobs() *blobstore.Store {
+	if backed, ok := b.store.(blobBacked); ok {
+		return backed.Blobs()
+	}
+	return nil
+}
+
+func (b *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{backend: b, conn: c}, nil
 }
 
 type session struct {
-	backend       *backend
-	from          string
-	to            []string
-	authenticated bool
+	backend    *backend
+	conn       *smtp.Conn
+	from       string
+	to         []string
+	mailFrom   string
+	mailParams map[string]string
+	rcpts      []store.EnvelopeRecipient
+	// credential is set once AUTH succeeds.
+	credential *store.SMTPCredential
+	// reserved is when MAIL took a slot from the credential's quota. It is
+	// zero when no slot is held.
+	reserved time.Time
 }
 
 func (s *session) AuthMechanisms() []string {
@@ -100,78 +206,224 @@ func (s *session) Auth(mech string) (sasl.Server, error) {
 		return nil, errors.New("unsupported authentication mechanism")
 	}
 	return sasl.NewPlainServer(func(identity, username, password string) error {
-		if username == s.backend.authUsername && password == s.backend.authPassword {
-			s.authenticated = true
-			return nil
+		credential, err := s.backend.credentials.Authenticate(context.Background(), username, password)
+		if err != nil {
+			if !errors.Is(err, credentials.ErrInvalid) {
+				s.backend.logger.Error("check smtp credentials", "error", err)
+			}
+			s.backend.metrics.SMTPAuthFailures.Inc()
+			return errors.New("invalid credentials")
 		}
-		return errors.New("invalid credentials")
+		s.credential = &credential
+		return nil
 	}), nil
 }
 
-func (s *session) Mail(from string, _ *smtp.MailOptions) error {
-	if s.backend.authEnabled && !s.authenticated {
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	return s.observe("mail", s.mail(from, opts))
+}
+
+func (s *session) mail(from string, opts *smtp.MailOptions) error {
+	if s.backend.authEnabled && s.credential == nil {
 		return smtp.ErrAuthRequired
 	}
+	if s.credential != nil {
+		if !credentials.AllowsSender(*s.credential, normalizeEmail(from)) {
+			return errSenderNotAllowed
+		}
+		s.releaseQuota()
+		now := time.Now()
+		if !s.backend.credentials.Reserve(*s.credential, now) {
+			return errQuotaExceeded
+		}
+		s.reserved = now
+	}
 	s.from = normalizeEmail(from)
+	if err := s.injectFault(faults.StageMail, nil); err != nil {
+		s.from = ""
+		s.releaseQuota()
+		return err
+	}
+	s.mailFrom = from
+	s.mailParams = mailParams(opts)
 	return nil
 }
 
-func (s *session) Rcpt(to string, _ *smtp.RcptOptions) error {
-	if s.backend.authEnabled && !s.authenticated {
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return s.observe("rcpt", s.rcpt(to, opts))
+}
+
+func (s *session) rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.backend.authEnabled && s.credential == nil {
 		return smtp.ErrAuthRequired
 	}
+	if err := s.injectFault(faults.StageRcpt, []string{normalizeEmail(to)}); err != nil {
+		return err
+	}
+	if err := s.scriptedReply(magic.StageRcpt, []string{normalizeEmail(to)}); err != nil {
+		return err
+	}
 	s.to = append(s.to, normalizeEmail(to))
+	s.rcpts = append(s.rcpts, store.EnvelopeRecipient{Address: to, Params: rcptParams(opts)})
 	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
-	data, err := io.ReadAll(r)
-	if err != nil {
+	return s.observe("data", s.data(r))
+}
+
+func (s *session) data(r io.Reader) error {
+	if err := s.injectDataFault(r); err != nil {
+		return err
+	}
+	if err := s.scriptedReply(magic.StageData, s.to); err != nil {
+		return err
+	}
+	data := newSpool(s.backend.spool)
+	defer data.Close()
+	if _, err := io.Copy(data, r); err != nil {
 		return err
 	}
+	s.backend.metrics.SMTPBytesReceived.Add(float64(data.Size()))
 
-	message, recipients, attachments, err := parseMessage(s.from, s.to, data)
+	message, recipients, attachments, err := parseMessage(s.from, s.to, data, s.backend.blobs(), s.backend.router)
+	if errors.Is(err, errStoreContent) {
+		s.backend.logger.Error("store smtp message", "error", err)
+		return err
+	}
 	if err != nil {
+		s.backend.metrics.SMTPParseErrors.Inc()
 		s.backend.logger.Warn("parse smtp message", "error", err)
 	}
-
-	ctx := context.Background()
-	if err := s.backend.store.InsertMessage(ctx, message, recipients, attachments); err != nil {
+	if state, ok := s.conn.TLSConnectionState(); ok {
+		message.TLS = true
+		message.TLSVersion = tls.VersionName(state.Version)
+		message.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+	message.Envelope = s.envelope(message.CreatedAt)
+
+	err = s.backend.ingest.Submit(context.Background(), store.NewMessage{Message: message, Recipients: recipients, Attachments: attachments})
+	switch {
+	case errors.Is(err, ingest.ErrBusy):
+		return errServerBusy
+	case errors.Is(err, ingest.ErrClosed):
+		return errShuttingDown
+	case err != nil:
 		s.backend.logger.Error("store smtp message", "error", err)
 		return err
 	}
 
+	// The message counts against the quota; Reset must not give it back.
+	s.reserved = time.Time{}
 	s.backend.hub.Broadcast(messageAudience(message, recipients), buildEvent(message, recipients))
+	s.backend.webhooks.Publish(context.Background(), webhook.Event{Type: webhook.MessageReceived, Message: message, Recipients: recipients})
 	return nil
 }
 
 func (s *session) Reset() {
+	s.releaseQuota()
 	s.from = ""
 	s.to = nil
+	s.mailFrom = ""
+	s.mailParams = nil
+	s.rcpts = nil
+}
+
+func (s *session) envelope(receivedAt time.Time) *store.Envelope {
+	envelope := &store.Envelope{
+		MailFrom:   s.mailFrom,
+		MailParams: s.mailParams,
+		Recipients: append([]store.EnvelopeRecipient(nil), s.rcpts...),
+		Helo:       s.conn.Hostname(),
+		ReceivedAt: receivedAt,
+	}
+	if s.credential != nil {
+		envelope.AuthUsername = s.credential.Username
+		envelope.AuthProject = s.credential.Project
+	}
+	if netConn := s.conn.Conn(); netConn != nil {
+		envelope.RemoteAddr = netConn.RemoteAddr().String()
+	}
+	return envelope
 }
 
 func (s *session) Logout() error {
+	s.releaseQuota()
 	return nil
 }
 
-func parseMessage(envelopeFrom string, envelopeTo []string, raw []byte) (store.Message, []store.Recipient, []store.Attachment, error) {
+// releaseQuota gives back the quota slot MAIL reserved, if the transaction
+// ended without a message being accepted.
+func (s *session) releaseQuota() {
+	if s.reserved.IsZero() || s.credential == nil {
+		return
+	}
+	s.backend.credentials.Release(*s.credential, s.reserved)
+	s.reserved = time.Time{}
+}
+
+var (
+	errSenderNotAllowed = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address not allowed for this credential",
+	}
+	errQuotaExceeded = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Hourly message quota exceeded, try again later",
+	}
+	errServerBusy = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+		Message:      "Server busy, try again later",
+	}
+	errShuttingDown = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Service shutting down, try again later",
+	}
+)
+
+// maxBodyBytes caps each parsed text and HTML body so huge bodies do not
+// have to be held in memory. The raw message always keeps the full text.
+const maxBodyBytes = 2 << 20
+
+// errStoreContent marks failures writing message content to storage, as
+// opposed to malformed MIME, which is captured as far as it parses.
+var errStoreContent = errors.New("store message content")
+
+// parseMessage reads the spooled message in one streaming pass. With a blob
+// store the raw message and attachment bodies are piped straight into it, so
+// memory stays bounded however large the message is; otherwise they are
+// loaded to be stored inline.
+func parseMessage(envelopeFrom string, envelopeTo []string, raw *spool, blobs *blobstore.Store, router *routing.Router) (store.Message, []store.Recipient, []store.Attachment, error) {
 	message := store.Message{
 		ID:        uuid.NewString(),
 		From:      normalizeEmail(envelopeFrom),
 		Subject:   "",
 		TextBody:  "",
 		HTMLBody:  "",
-		Raw:       raw,
-		RawSize:   int64(len(raw)),
+		RawSize:   raw.Size(),
 		CreatedAt: time.Now(),
 	}
 
 	recipients := map[string]map[string]struct{}{}
 	attachments := []store.Attachment{}
 
-	reader, err := mail.CreateReader(bytes.NewReader(raw))
+	var err error
+	if blobs != nil {
+		message.RawKey, _, err = blobs.Put(raw.Reader())
+	} else {
+		message.Raw, err = raw.Bytes()
+	}
+	if err != nil {
+		return message, nil, nil, fmt.Errorf("%w: %w", errStoreContent, err)
+	}
+
+	reader, err := mail.CreateReader(raw.Reader())
 	if err != nil {
-		return message, recipientsFromEnvelope(envelopeTo, recipients), attachments, err
+		return message, recipientsFromEnvelope(envelopeTo, recipients, "to", router), attachments, err
 	}
 
 	if subject, err := reader.Header.Subject(); err == nil {
@@ -204,13 +456,13 @@ func parseMessage(envelopeFrom string, envelopeTo []string, raw []byte) (store.M
 			break
 		}
 		if err != nil {
-			return message, recipientsFromEnvelope(envelopeTo, recipients), attachments, err
+			return message, recipientsFromEnvelope(envelopeTo, recipients, "bcc", router), attachments, err
 		}
 
 		switch header := part.Header.(type) {
 		case *mail.InlineHeader:
 			mediaType, _, _ := header.ContentType()
-			body, err := io.ReadAll(part.Body)
+			body, err := readBody(part.Body)
 			if err != nil {
 				continue
 			}
@@ -234,29 +486,94 @@ func parseMessage(envelopeFrom string, envelopeTo []string, raw []byte) (store.M
 				filename = "attachment"
 			}
 			contentType, _, _ := header.ContentType()
-			body, err := io.ReadAll(part.Body)
-			if err != nil {
-				continue
+			attachment := store.Attachment{Filename: filename, ContentType: contentType}
+			if blobs != nil {
+				body := &partReader{r: part.Body}
+				attachment.BlobKey, attachment.Size, err = blobs.Put(body)
+				if body.err != nil {
+					// Undecodable, like bad base64: skip it as the inline
+					// path does.
+					continue
+				}
+				if err != nil {
+					return message, nil, nil, fmt.Errorf("%w: %w", errStoreContent, err)
+				}
+			} else {
+				attachment.Data, err = io.ReadAll(part.Body)
+				if err != nil {
+					continue
+				}
+				attachment.Size = int64(len(attachment.Data))
 			}
-			attachments = append(attachments, store.Attachment{
-				Filename:    filename,
-				ContentType: contentType,
-				Data:        body,
-				Size:        int64(len(body)),
-			})
+			attachments = append(attachments, attachment)
 		}
 	}
 
-	return message, recipientsFromEnvelope(envelopeTo, recipients), attachments, nil
+	return message, recipientsFromEnvelope(envelopeTo, recipients, "bcc", router), attachments, nil
 }
 
-func recipientsFromEnvelope(envelopeTo []string, base map[string]map[string]struct{}) []store.Recipient {
+// readBody reads a text part up to maxBodyBytes and discards the rest.
+func readBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == maxBodyBytes {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, err
+		}
+		body = bytes.ToValidUTF8(body, nil)
+	}
+	return body, nil
+}
+
+// partReader records errors reading a MIME part, so they can be told apart
+// from errors writing it to the blob store.
+type partReader struct {
+	r   io.Reader
+	err error
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	return n, err
+}
+
+// recipientsFromEnvelope files envelope recipients that are missing from the
+// To/Cc/Bcc headers under rtype. Once headers were parsed those are blind
+// copies; if the headers could not be read there is nothing to compare
+// against, so callers pass "to" instead. Mailboxes the router adds, through
+// sub-addressing or aliases, are filed as "routed".
+func recipientsFromEnvelope(envelopeTo []string, base map[string]map[string]struct{}, rtype string, router *routing.Router) []store.Recipient {
 	for _, addr := range envelopeTo {
-		addRecipient(base, "to", normalizeEmail(addr))
+		email := normalizeEmail(addr)
+		if hasRecipient(base, email) {
+			continue
+		}
+		addRecipient(base, rtype, email)
+	}
+	for _, recipient := range flattenRecipients(base) {
+		for _, email := range router.Route(recipient.Email) {
+			if !hasRecipient(base, email) {
+				addRecipient(base, "routed", email)
+			}
+		}
 	}
 	return flattenRecipients(base)
 }
 
+func hasRecipient(base map[string]map[string]struct{}, email string) bool {
+	for _, emails := range base {
+		if _, ok := emails[email]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func addRecipient(base map[string]map[string]struct{}, rtype, email string) {
 	if email == "" {
 		return
@@ -293,12 +610,15 @@ func buildEvent(message store.Message, recipients []store.Recipient) []byte {
 	toList := []string{}
 	ccList := []string{}
 	bccList := []string{}
+	routedList := []string{}
 	for _, recipient := range recipients {
 		switch recipient.Type {
 		case "cc":
 			ccList = append(ccList, recipient.Email)
 		case "bcc":
 			bccList = append(bccList, recipient.Email)
+		case "routed":
+			routedList = append(routedList, recipient.Email)
 		default:
 			toList = append(toList, recipient.Email)
 		}
@@ -309,6 +629,7 @@ func buildEvent(message store.Message, recipients []store.Recipient) []byte {
 		"to":        toList,
 		"cc":        ccList,
 		"bcc":       bccList,
+		"routed":    routedList,
 		"createdAt": message.CreatedAt.UTC().Format(time.RFC3339),
 	}
 	data, _ := json.Marshal(payload)
@@ -0,0 +1,171 @@
+package smtpserver
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.io/razzkumar/localsmtp/internal/routing"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+func TestParseMessageRecipients(t *testing.T) {
+	router, err := routing.New(true, []routing.Alias{
+		{Address: "support@example.com", To: []string{"alice@example.com", "bob@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("routing.New: %v", err)
+	}
+	tests := []struct {
+		name     string
+		headers  string
+		envelope []string
+		router   *routing.Router
+		want     []store.Recipient
+	}{
+		{
+			name:     "headers",
+			headers:  "To: Alice <Alice@Example.com>, bob@example.com\r\nCc: carol@example.com\r\nBcc: dave@example.com\r\n",
+			envelope: []string{"alice@example.com", "bob@example.com", "carol@example.com", "dave@example.com"},
+			want: []store.Recipient{
+				{Email: "alice@example.com", Type: "to"},
+				{Email: "bob@example.com", Type: "to"},
+				{Email: "carol@example.com", Type: "cc"},
+				{Email: "dave@example.com", Type: "bcc"},
+			},
+		},
+		{
+			name:     "envelope only is bcc",
+			headers:  "To: alice@example.com\r\n",
+			envelope: []string{"alice@example.com", " Erin@Example.com "},
+			want: []store.Recipient{
+				{Email: "alice@example.com", Type: "to"},
+				{Email: "erin@example.com", Type: "bcc"},
+			},
+		},
+		{
+			name:     "header recipients not in the envelope are kept",
+			headers:  "To: alice@example.com\r\nCc: list@example.com\r\n",
+			envelope: []string{"alice@example.com"},
+			want: []store.Recipient{
+				{Email: "alice@example.com", Type: "to"},
+				{Email: "list@example.com", Type: "cc"},
+			},
+		},
+		{
+			name:     "no recipient headers",
+			headers:  "X-Mailer: test\r\n",
+			envelope: []string{"alice@example.com"},
+			want: []store.Recipient{
+				{Email: "alice@example.com", Type: "bcc"},
+			},
+		},
+		{
+			name:     "unreadable headers",
+			headers:  "To: carol@example.com\r\nthis line has no colon\r\n",
+			envelope: []string{"alice@example.com"},
+			want: []store.Recipient{
+				{Email: "alice@example.com", Type: "to"},
+			},
+		},
+		{
+			name:     "subaddress",
+			headers:  "To: qa+signup@example.com\r\n",
+			envelope: []string{"qa+signup@example.com"},
+			router:   router,
+			want: []store.Recipient{
+				{Email: "qa+signup@example.com", Type: "to"},
+				{Email: "qa@example.com", Type: "routed"},
+			},
+		},
+		{
+			name:     "alias of a blind copy",
+			headers:  "To: alice@example.com\r\n",
+			envelope: []string{"alice@example.com", "support@example.com"},
+			router:   router,
+			want: []store.Recipient{
+				{Email: "alice@example.com", Type: "to"},
+				{Email: "bob@example.com", Type: "routed"},
+				{Email: "support@example.com", Type: "bcc"},
+			},
+		},
+		{
+			name:     "routing disabled",
+			headers:  "To: qa+signup@example.com, support@example.com\r\n",
+			envelope: []string{"qa+signup@example.com", "support@example.com"},
+			want: []store.Recipient{
+				{Email: "qa+signup@example.com", Type: "to"},
+				{Email: "support@example.com", Type: "to"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := newSpool(SpoolConfig{Threshold: 1 << 20})
+			defer raw.Close()
+			if _, err := raw.Write([]byte("From: sender@example.com\r\nSubject: hello\r\n" + tc.headers + "\r\nbody\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			_, got, _, _ := parseMessage("sender@example.com", tc.envelope, raw, nil, tc.router)
+			sortRecipients(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("recipients = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseMessageBodies(t *testing.T) {
+	raw := newSpool(SpoolConfig{Threshold: 64})
+	defer raw.Close()
+	body := strings.Join([]string{
+		"From: Sender <sender@example.com>",
+		"To: alice@example.com",
+		"Subject: Your invoice",
+		"Content-Type: multipart/mixed; boundary=b1",
+		"",
+		"--b1",
+		"Content-Type: text/plain",
+		"",
+		"Hi Alice",
+		"--b1",
+		"Content-Type: text/html",
+		"",
+		"<p>Hi Alice</p>",
+		"--b1",
+		"Content-Type: application/pdf",
+		"Content-Disposition: attachment; filename=invoice.pdf",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"JVBERi0xLjQ=",
+		"--b1--",
+		"",
+	}, "\r\n")
+	if _, err := raw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	message, _, attachments, err := parseMessage("", []string{"alice@example.com"}, raw, nil, nil)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if message.From != "sender@example.com" || message.Subject != "Your invoice" {
+		t.Errorf("from, subject = %q, %q", message.From, message.Subject)
+	}
+	if message.TextBody != "Hi Alice" || message.HTMLBody != "<p>Hi Alice</p>" {
+		t.Errorf("bodies = %q, %q", message.TextBody, message.HTMLBody)
+	}
+	if string(message.Raw) != body || message.RawSize != int64(len(body)) {
+		t.Errorf("raw = %d bytes, size %d; want %d", len(message.Raw), message.RawSize, len(body))
+	}
+	want := []store.Attachment{{Filename: "invoice.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4"), Size: 8}}
+	if !reflect.DeepEqual(attachments, want) {
+		t.Errorf("attachments = %+v, want %+v", attachments, want)
+	}
+}
+
+func sortRecipients(recipients []store.Recipient) {
+	slices.SortFunc(recipients, func(a, b store.Recipient) int {
+		return strings.Compare(a.Email, b.Email)
+	})
+}
@@ -0,0 +1,85 @@
+package smtpserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SpoolConfig bounds the memory a DATA command may use. Messages up to
+// Threshold bytes are buffered in memory; larger ones are written to a
+// temporary file in Dir (the system temp directory if empty).
+type SpoolConfig struct {
+	Threshold int64
+	Dir       string
+}
+
+// spool holds one message body so it can be read more than once: to store
+// the raw message and to parse it.
+type spool struct {
+	cfg  SpoolConfig
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func newSpool(cfg SpoolConfig) *spool {
+	return &spool{cfg: cfg}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > s.cfg.Threshold {
+		file, err := os.CreateTemp(s.cfg.Dir, "localsmtp-data-*")
+		if err != nil {
+			return 0, fmt.Errorf("spool message: %w", err)
+		}
+		s.file = file
+		if _, err := file.Write(s.buf.Bytes()); err != nil {
+			return 0, fmt.Errorf("spool message: %w", err)
+		}
+		s.buf = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *spool) Size() int64 {
+	return s.size
+}
+
+// Reader returns a new reader from the start of the message.
+func (s *spool) Reader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.buf.Bytes())
+}
+
+// Bytes returns the whole message, reading it back from disk if needed.
+func (s *spool) Bytes() ([]byte, error) {
+	if s.file == nil {
+		return s.buf.Bytes(), nil
+	}
+	data := make([]byte, s.size)
+	if _, err := io.ReadFull(s.Reader(), data); err != nil {
+		return nil, fmt.Errorf("read spooled message: %w", err)
+	}
+	return data, nil
+}
+
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	s.file.Close()
+	return os.Remove(name)
+}
@@ -1,6 +1,12 @@
 package sse
 
-import "sync"
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+)
 
 type Hub struct {
 	mu   sync.RWMutex
@@ -47,8 +53,26 @@ func (h *Hub) Broadcast(emails []string, payload []byte) {
 
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	for email := range unique {
-		for ch := range h.subs[email] {
+	for subscribed, subscribers := range h.subs {
+		if !matchesAny(subscribed, unique) {
+			continue
+		}
+		for ch := range subscribers {
+			select {
+			case ch <- payload:
+			default:
+			}
+		}
+	}
+}
+
+// BroadcastAll sends payload to every subscriber, for changes such as a
+// purge that can touch any mailbox.
+func (h *Hub) BroadcastAll(payload []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, subscribers := range h.subs {
+		for ch := range subscribers {
 			select {
 			case ch <- payload:
 			default:
@@ -56,3 +80,39 @@ func (h *Hub) Broadcast(emails []string, payload []byte) {
 		}
 	}
 }
+
+// matchesAny reports whether a subscription, which may be a wildcard
+// mailbox, covers one of emails.
+func matchesAny(subscribed string, emails map[string]struct{}) bool {
+	if _, ok := emails[subscribed]; ok {
+		return true
+	}
+	if !auth.IsEmailPattern(subscribed) {
+		return false
+	}
+	for email := range emails {
+		if auth.MatchEmail(subscribed, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribers returns the number of open subscriptions across all emails.
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	total := 0
+	for _, subscribers := range h.subs {
+		total += len(subscribers)
+	}
+	return total
+}
+
+// PurgeEvent tells open sessions to reload after messages were removed in
+// bulk, by an admin purge or by retention. mailbox is the purged mailbox and
+// is empty when any mailbox may have lost mail.
+func PurgeEvent(mailbox string, removed int64) []byte {
+	data, _ := json.Marshal(map[string]any{"mailbox": mailbox, "deleted": removed})
+	return []byte(fmt.Sprintf("event: purge\ndata: %s\n\n", data))
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var errNoBlobStore = errors.New("message data is in the blob store but BLOB_STORE_DIR is not set")
+
+// putBlob returns what to keep inline and the blob key for data. Without a
+// blob store data stays inline. A key the caller already wrote is kept.
+func (s *Store) putBlob(data []byte, key string) ([]byte, string, error) {
+	if key != "" {
+		if s.blobs == nil {
+			return nil, "", errNoBlobStore
+		}
+		return []byte{}, key, nil
+	}
+	if s.blobs == nil || len(data) == 0 {
+		return data, "", nil
+	}
+	key, _, err := s.blobs.Put(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte{}, key, nil
+}
+
+func (s *Store) openBlob(key string, size int64) (io.ReadSeekCloser, error) {
+	if s.blobs == nil {
+		return nil, errNoBlobStore
+	}
+	return s.blobs.Open(key, size)
+}
+
+func (s *Store) readBlob(key string, size int64) ([]byte, error) {
+	if s.blobs == nil {
+		return nil, errNoBlobStore
+	}
+	return s.blobs.ReadAll(key, size)
+}
+
+// CollectBlobs removes blobs no message, attachment or pending webhook
+// delivery refers to. Blobs written or reused within grace are kept, since
+// their rows may not be committed yet.
+func (s *Store) CollectBlobs(ctx context.Context, grace time.Duration) (int64, error) {
+	if s.blobs == nil {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-grace)
+	var removed int64
+	err := s.blobs.Walk(func(key string, modTime time.Time) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if modTime.After(cutoff) {
+			return nil
+		}
+		var referenced bool
+		err := s.read.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM messages WHERE raw_key = ?)
+            OR EXISTS (SELECT 1 FROM attachments WHERE blob_key = ?)
+            OR EXISTS (SELECT 1 FROM webhook_deliveries WHERE raw_key = ? AND status = ?);`,
+			key, key, key, DeliveryPending).Scan(&referenced)
+		if err != nil || referenced {
+			return err
+		}
+		if err := s.blobs.Remove(key); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("collect blobs: %w", err)
+	}
+	return removed, nil
+}
+
+type bytesReader struct {
+	*bytes.Reader
+}
+
+func newBytesReader(data []byte) io.ReadSeekCloser {
+	return bytesReader{bytes.NewReader(data)}
+}
+
+func (bytesReader) Close() error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrCredentialExists is returned when an SMTP credential with the same
+// username exists.
+var ErrCredentialExists = errors.New("smtp credential already exists")
+
+// SMTPCredential is a username that may authenticate to the SMTP server.
+type SMTPCredential struct {
+	ID       int64
+	Username string
+	// PasswordHash is a bcrypt hash.
+	PasswordHash string
+	// AllowedSenders are the MAIL FROM addresses the credential may use,
+	// possibly wildcard mailboxes. Empty allows any sender.
+	AllowedSenders []string
+	// RatePerHour caps the messages accepted per hour. Zero is unlimited.
+	RatePerHour int
+	// Project tags the messages delivered with the credential.
+	Project   string
+	CreatedAt time.Time
+}
+
+// CreateSMTPCredential stores credential and returns it with its ID set.
+func (s *Store) CreateSMTPCredential(ctx context.Context, credential SMTPCredential) (SMTPCredential, error) {
+	result, err := s.db.ExecContext(ctx, `INSERT INTO smtp_credentials
+        (username, password_hash, allowed_senders, rate_per_hour, project, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT DO NOTHING;`,
+		credential.Username, credential.PasswordHash, strings.Join(credential.AllowedSenders, ","),
+		credential.RatePerHour, credential.Project, credential.CreatedAt.Unix())
+	if err != nil {
+		return SMTPCredential{}, fmt.Errorf("create smtp credential: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return SMTPCredential{}, fmt.Errorf("create smtp credential: %w", err)
+	} else if affected == 0 {
+		return SMTPCredential{}, ErrCredentialExists
+	}
+	if credential.ID, err = result.LastInsertId(); err != nil {
+		return SMTPCredential{}, fmt.Errorf("create smtp credential: %w", err)
+	}
+	credential.CreatedAt = time.Unix(credential.CreatedAt.Unix(), 0)
+	return credential, nil
+}
+
+// SMTPCredentialByUsername returns the credential for username.
+func (s *Store) SMTPCredentialByUsername(ctx context.Context, username string) (SMTPCredential, error) {
+	credentials, err := s.querySMTPCredentials(ctx, `WHERE username = ?`, username)
+	if err != nil {
+		return SMTPCredential{}, err
+	}
+	if len(credentials) == 0 {
+		return SMTPCredential{}, ErrNotFound
+	}
+	return credentials[0], nil
+}
+
+// ListSMTPCredentials returns every credential, ordered by username.
+func (s *Store) ListSMTPCredentials(ctx context.Context) ([]SMTPCredential, error) {
+	return s.querySMTPCredentials(ctx, `ORDER BY username`)
+}
+
+// DeleteSMTPCredential removes the credential for username. It reports
+// whether the credential existed.
+func (s *Store) DeleteSMTPCredential(ctx context.Context, username string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM smtp_credentials WHERE username = ?;`, username)
+	if err != nil {
+		return false, fmt.Errorf("delete smtp credential: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete smtp credential: %w", err)
+	}
+	return affected > 0, nil
+}
+
+func (s *Store) querySMTPCredentials(ctx context.Context, clause string, args ...any) ([]SMTPCredential, error) {
+	rows, err := s.read.QueryContext(ctx, `SELECT id, username, password_hash, allowed_senders, rate_per_hour, project, created_at
+        FROM smtp_credentials `+clause+`;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query smtp credentials: %w", err)
+	}
+	defer rows.Close()
+	var credentials []SMTPCredential
+	for rows.Next() {
+		var credential SMTPCredential
+		var senders string
+		var createdAt int64
+		if err := rows.Scan(&credential.ID, &credential.Username, &credential.PasswordHash, &senders,
+			&credential.RatePerHour, &credential.Project, &createdAt); err != nil {
+			return nil, fmt.Errorf("scan smtp credential: %w", err)
+		}
+		if senders != "" {
+			credential.AllowedSenders = strings.Split(senders, ",")
+		}
+		credential.CreatedAt = time.Unix(createdAt, 0)
+		credentials = append(credentials, credential)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query smtp credentials: %w", err)
+	}
+	return credentials, nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// MailboxInfo is one address in the mailbox directory: anyone who logged in
+// or received mail.
+type MailboxInfo struct {
+	Email string
+	// Messages and Unread count the mailbox's inbox.
+	Messages      int32
+	Unread        int32
+	LastMessageAt time.Time
+	// LastLogin is zero for addresses that only received mail.
+	LastLogin time.Time
+}
+
+// purgeBatch bounds each delete so SMTP inserts can interleave with a large
+// purge, like the retention deletes.
+const purgeBatch = 500
+
+// ListMailboxes returns every known mailbox ordered by address.
+func (s *Store) ListMailboxes(ctx context.Context) ([]MailboxInfo, error) {
+	rows, err := s.read.QueryContext(ctx, `WITH mailboxes(email) AS (
+            SELECT email FROM users UNION SELECT email FROM recipients
+        )
+        SELECT mb.email,
+            (SELECT COUNT(DISTINCT r.message_id) FROM recipients r WHERE r.email = mb.email),
+            (SELECT COUNT(DISTINCT r.message_id) FROM recipients r WHERE r.email = mb.email
+                AND NOT EXISTS (SELECT 1 FROM message_reads mr WHERE mr.message_id = r.message_id AND mr.email = mb.email)),
+            (SELECT COALESCE(MAX(m.created_at), 0) FROM recipients r JOIN messages m ON m.id = r.message_id WHERE r.email = mb.email),
+            COALESCE((SELECT u.last_login FROM users u WHERE u.email = mb.email), 0)
+        FROM mailboxes mb
+        ORDER BY mb.email;`)
+	if err != nil {
+		return nil, fmt.Errorf("list mailboxes: %w", err)
+	}
+	defer rows.Close()
+	var mailboxes []MailboxInfo
+	for rows.Next() {
+		var info MailboxInfo
+		var messages, unread, lastMessageAt, lastLogin int64
+		if err := rows.Scan(&info.Email, &messages, &unread, &lastMessageAt, &lastLogin); err != nil {
+			return nil, fmt.Errorf("scan mailbox: %w", err)
+		}
+		info.Messages = clampInt32(messages)
+		info.Unread = clampInt32(unread)
+		if lastMessageAt > 0 {
+			info.LastMessageAt = time.Unix(lastMessageAt, 0)
+		}
+		if lastLogin > 0 {
+			info.LastLogin = time.Unix(lastLogin, 0)
+		}
+		mailboxes = append(mailboxes, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list mailboxes: %w", err)
+	}
+	return mailboxes, nil
+}
+
+// MessageRef identifies a message and the address that sent it, which can
+// always see it.
+type MessageRef struct {
+	ID   string
+	From string
+}
+
+// PurgeTargets lists the messages PurgeMessages would remove for email, so
+// callers can announce each deletion.
+func (s *Store) PurgeTargets(ctx context.Context, email string) ([]MessageRef, error) {
+	query := `SELECT m.id, m.from_email FROM messages m;`
+	var args []any
+	if email != "" {
+		visible, address := visibleTo("m", email)
+		query = `SELECT m.id, m.from_email FROM messages m WHERE ` + visible + `;`
+		args = append(args, address, address)
+	}
+	rows, err := s.read.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list purge targets: %w", err)
+	}
+	defer rows.Close()
+	var refs []MessageRef
+	for rows.Next() {
+		var ref MessageRef
+		if err := rows.Scan(&ref.ID, &ref.From); err != nil {
+			return nil, fmt.Errorf("scan purge target: %w", err)
+		}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list purge targets: %w", err)
+	}
+	return refs, nil
+}
+
+// PurgeMessages deletes every message, or with email set every message the
+// mailbox sent or received, and returns how many were removed.
+func (s *Store) PurgeMessages(ctx context.Context, email string) (int64, error) {
+	var total int64
+	for {
+		var removed int64
+		var err error
+		if email == "" {
+			removed, err = s.deleteBatch(ctx, "purge messages", `DELETE FROM messages WHERE id IN (
+                SELECT id FROM messages LIMIT ?);`, purgeBatch)
+		} else {
+			visible, address := visibleTo("m", email)
+			removed, err = s.deleteBatch(ctx, "purge mailbox", `DELETE FROM messages WHERE id IN (
+                SELECT m.id FROM messages m
+                WHERE `+visible+`
+                LIMIT ?);`, address, address, purgeBatch)
+		}
+		total += removed
+		if err != nil || removed < purgeBatch {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.io/razzkumar/localsmtp/internal/search"
+)
+
+func indexMessage(ctx context.Context, tx *sql.Tx, uid int64, message Message, recipients []Recipient, attachments []Attachment) error {
+	addresses := []string{message.From}
+	for _, recipient := range recipients {
+		addresses = append(addresses, recipient.Email)
+	}
+	filenames := make([]string, 0, len(attachments))
+	for _, attachment := range attachments {
+		filenames = append(filenames, attachment.Filename)
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO messages_fts (rowid, subject, body, html, attachments, addresses)
+        VALUES (?, ?, ?, ?, ?, ?);`,
+		uid,
+		message.Subject,
+		message.TextBody,
+		stripHTML(message.HTMLBody),
+		strings.Join(filenames, " "),
+		strings.Join(addresses, " "),
+	)
+	if err != nil {
+		return fmt.Errorf("index message: %w", err)
+	}
+	return nil
+}
+
+// backfillSearchIndex indexes messages stored before full-text search existed.
+func backfillSearchIndex(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT u.uid, m.id, m.from_email, m.subject, COALESCE(m.text_body, ''), COALESCE(m.html_body, '')
+        FROM message_uids u
+        JOIN messages m ON m.id = u.message_id
+        WHERE NOT EXISTS (SELECT 1 FROM messages_fts f WHERE f.rowid = u.uid);`)
+	if err != nil {
+		return fmt.Errorf("backfill search index: %w", err)
+	}
+	type pending struct {
+		uid     int64
+		message Message
+	}
+	var missing []pending
+	for rows.Next() {
+		var item pending
+		if err := rows.Scan(&item.uid, &item.message.ID, &item.message.From, &item.message.Subject, &item.message.TextBody, &item.message.HTMLBody); err != nil {
+			rows.Close()
+			return fmt.Errorf("backfill search index: %w", err)
+		}
+		missing = append(missing, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("backfill search index: %w", err)
+	}
+
+	for _, item := range missing {
+		recipients, err := queryStrings(ctx, tx, `SELECT email FROM recipients WHERE message_id = ?;`, item.message.ID)
+		if err != nil {
+			return fmt.Errorf("backfill search index: %w", err)
+		}
+		filenames, err := queryStrings(ctx, tx, `SELECT filename FROM attachments WHERE message_id = ?;`, item.message.ID)
+		if err != nil {
+			return fmt.Errorf("backfill search index: %w", err)
+		}
+		var recipientRows []Recipient
+		for _, email := range recipients {
+			recipientRows = append(recipientRows, Recipient{Email: email})
+		}
+		var attachmentRows []Attachment
+		for _, filename := range filenames {
+			attachmentRows = append(attachmentRows, Attachment{Filename: filename})
+		}
+		if err := indexMessage(ctx, tx, item.uid, item.message, recipientRows, attachmentRows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+var (
+	htmlHiddenPattern = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)>`)
+	htmlTagPattern    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+func stripHTML(body string) string {
+	if body == "" {
+		return ""
+	}
+	text := htmlHiddenPattern.ReplaceAllString(body, " ")
+	text = htmlTagPattern.ReplaceAllString(text, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+}
+
+// searchClause turns a parsed query into SQL conditions on messages m. email
+// is the mailbox owner, whose read state is:unread and is:read refer to.
+func searchClause(query search.Query, email string) (string, []any) {
+	var clauses []string
+	var args []any
+	for _, term := range query.Terms {
+		clause, termArgs := termClause(term, email)
+		if clause == "" {
+			continue
+		}
+		if term.Negated {
+			clause = "NOT " + clause
+		}
+		clauses = append(clauses, clause)
+		args = append(args, termArgs...)
+	}
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(clauses, " AND "), args
+}
+
+func termClause(term search.Term, email string) (string, []any) {
+	switch term.Field {
+	case search.FieldText:
+		return ftsClause(ftsPhrase(term))
+	case search.FieldSubject:
+		return ftsClause("subject : " + ftsPhrase(term))
+	case search.FieldFilename:
+		return ftsClause("attachments : " + ftsPhrase(term))
+	case search.FieldFrom:
+		return "(m.from_email LIKE ? ESCAPE '\\')", []any{likePattern(term.Value)}
+	case search.FieldTo, search.FieldCc:
+		return "EXISTS (SELECT 1 FROM recipients rs WHERE rs.message_id = m.id AND rs.type = ? AND rs.email LIKE ? ESCAPE '\\')",
+			[]any{string(term.Field), likePattern(term.Value)}
+	case search.FieldTag:
+		return "EXISTS (SELECT 1 FROM recipients rs WHERE rs.message_id = m.id AND rs.email LIKE ? ESCAPE '\\')",
+			[]any{"%+" + likeEscaper.Replace(term.Value) + "@%"}
+	case search.FieldHas:
+		return "EXISTS (SELECT 1 FROM attachments ah WHERE ah.message_id = m.id)", nil
+	case search.FieldIs:
+		clause := "EXISTS (SELECT 1 FROM message_reads mr WHERE mr.message_id = m.id AND mr.email = ?)"
+		args := []any{email}
+		if email == "" {
+			// Listing every mailbox: read by anyone.
+			clause, args = "EXISTS (SELECT 1 FROM message_reads mr WHERE mr.message_id = m.id)", nil
+		}
+		if term.Value == "unread" {
+			clause = "NOT " + clause
+		}
+		return "(" + clause + ")", args
+	case search.FieldBefore:
+		return "(m.created_at < ?)", []any{term.Time.Unix()}
+	case search.FieldAfter:
+		return "(m.created_at >= ?)", []any{term.Time.Unix()}
+	case search.FieldLarger:
+		return "(m.raw_size > ?)", []any{term.Size}
+	case search.FieldSmaller:
+		return "(m.raw_size < ?)", []any{term.Size}
+	}
+	return "", nil
+}
+
+func ftsClause(match string) (string, []any) {
+	return `(m.id IN (SELECT mu.message_id FROM messages_fts
+        JOIN message_uids mu ON mu.uid = messages_fts.rowid
+        WHERE messages_fts MATCH ?))`, []any{match}
+}
+
+// ftsPhrase quotes a term as an FTS5 string so punctuation in addresses and
+// URLs is tokenized instead of parsed as query syntax. An unquoted trailing
+// "*" is kept as a prefix search.
+func ftsPhrase(term search.Term) string {
+	value := term.Value
+	prefix := false
+	if !term.Phrase && strings.HasSuffix(value, "*") {
+		value = strings.TrimRight(value, "*")
+		prefix = value != ""
+	}
+	quoted := `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+	if prefix {
+		quoted += "*"
+	}
+	return quoted
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func likePattern(value string) string {
+	return "%" + likeEscaper.Replace(strings.ToLower(value)) + "%"
+}
@@ -0,0 +1,657 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/search"
+)
+
+// Memory keeps messages in process instead of SQLite. It holds at most
+// capacity messages; inserting beyond that evicts the oldest, so memory use
+// stays bounded on long CI runs. Nothing survives a restart.
+type Memory struct {
+	mu           sync.RWMutex
+	capacity     int
+	messages     []*memoryMessage
+	byID         map[string]*memoryMessage
+	users        map[string]User
+	tokens       map[string]APIToken
+	credentials  map[string]SMTPCredential
+	lastUID      uint32
+	attachmentID int64
+	tokenID      int64
+	credentialID int64
+}
+
+type memoryMessage struct {
+	uid         uint32
+	message     Message
+	recipients  []Recipient
+	attachments []Attachment
+	reads       map[string]time.Time
+}
+
+func NewMemory(capacity int) *Memory {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &Memory{
+		capacity:    capacity,
+		byID:        map[string]*memoryMessage{},
+		users:       map[string]User{},
+		tokens:      map[string]APIToken{},
+		credentials: map[string]SMTPCredential{},
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (m *Memory) UpsertUser(ctx context.Context, email string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now = time.Unix(now.Unix(), 0)
+	user, ok := m.users[email]
+	if !ok {
+		user = User{Email: email, CreatedAt: now}
+	}
+	user.LastLogin = now
+	m.users[email] = user
+	return nil
+}
+
+func (m *Memory) InsertMessage(ctx context.Context, message Message, recipients []Recipient, attachments []Attachment) error {
+	return m.InsertMessages(ctx, []NewMessage{{Message: message, Recipients: recipients, Attachments: attachments}})
+}
+
+func (m *Memory) InsertMessages(ctx context.Context, batch []NewMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[string]bool, len(batch))
+	for _, item := range batch {
+		if _, ok := m.byID[item.Message.ID]; ok || seen[item.Message.ID] {
+			return fmt.Errorf("insert message: duplicate id %s", item.Message.ID)
+		}
+		seen[item.Message.ID] = true
+	}
+	for _, item := range batch {
+		m.insert(item.Message, item.Recipients, item.Attachments)
+	}
+	return nil
+}
+
+func (m *Memory) insert(message Message, recipients []Recipient, attachments []Attachment) {
+	message.CreatedAt = time.Unix(message.CreatedAt.Unix(), 0)
+	message.Raw = append([]byte(nil), message.Raw...)
+	if message.Envelope != nil {
+		envelope := *message.Envelope
+		envelope.Recipients = append([]EnvelopeRecipient(nil), envelope.Recipients...)
+		message.Envelope = &envelope
+	}
+	stored := &memoryMessage{
+		message:    message,
+		recipients: append([]Recipient(nil), recipients...),
+		reads:      map[string]time.Time{},
+	}
+	for _, attachment := range attachments {
+		m.attachmentID++
+		attachment.ID = m.attachmentID
+		attachment.MessageID = message.ID
+		attachment.Data = append([]byte(nil), attachment.Data...)
+		stored.attachments = append(stored.attachments, attachment)
+	}
+
+	for len(m.messages) >= m.capacity {
+		delete(m.byID, m.messages[0].message.ID)
+		m.messages[0] = nil
+		m.messages = m.messages[1:]
+	}
+	m.lastUID++
+	stored.uid = m.lastUID
+	m.messages = append(m.messages, stored)
+	m.byID[message.ID] = stored
+}
+
+func (m *Memory) MarkMessageRead(ctx context.Context, email, messageID string, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.byID[messageID]
+	if !ok {
+		return false, fmt.Errorf("mark message read: %w", ErrNotFound)
+	}
+	if _, read := stored.reads[email]; read {
+		return false, nil
+	}
+	stored.reads[email] = time.Unix(now.Unix(), 0)
+	return true, nil
+}
+
+func (m *Memory) MarkMessageUnread(ctx context.Context, email, messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stored, ok := m.byID[messageID]; ok {
+		delete(stored.reads, email)
+	}
+	return nil
+}
+
+func (m *Memory) UnreadCounts(ctx context.Context, emails []string) (map[string]UnreadCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	counts := make(map[string]UnreadCount, len(emails))
+	for _, email := range emails {
+		var count UnreadCount
+		for _, stored := range m.messages {
+			if !stored.receivedBy(email) || stored.readBy(email) {
+				continue
+			}
+			count.Total++
+			if !stored.visibleRecipient(email) {
+				count.Bcc++
+			}
+		}
+		counts[email] = count
+	}
+	return counts, nil
+}
+
+func (m *Memory) ListMessages(ctx context.Context, email, box string, query search.Query, page Page) ([]MessageSummary, PageInfo, error) {
+	page = page.normalize()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matched []*memoryMessage
+	for _, stored := range m.messages {
+		if !stored.inBox(email, box) || !stored.matches(query, email) {
+			continue
+		}
+		matched = append(matched, stored)
+	}
+	total := clampInt32(int64(len(matched)))
+
+	// Sort in traversal order, like the SQL query, then skip to the cursor.
+	ascending := page.oldestFirst() != page.backward()
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i].message, matched[j].message
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt) == ascending
+		}
+		return (a.ID < b.ID) == ascending
+	})
+	if page.Cursor != nil {
+		start := sort.Search(len(matched), func(i int) bool {
+			return page.Cursor.follows(matched[i].message.CreatedAt, matched[i].message.ID, page.oldestFirst())
+		})
+		matched = matched[start:]
+	}
+
+	if int(page.Offset) >= len(matched) {
+		matched = nil
+	} else {
+		matched = matched[page.Offset:]
+	}
+	if len(matched) > int(page.Limit)+1 {
+		matched = matched[:page.Limit+1]
+	}
+
+	summaries := make([]MessageSummary, 0, len(matched))
+	for _, stored := range matched {
+		summary := MessageSummary{
+			ID:             stored.message.ID,
+			From:           stored.message.From,
+			Subject:        stored.message.Subject,
+			CreatedAt:      stored.message.CreatedAt,
+			HasAttachments: len(stored.attachments) > 0,
+		}
+		for _, recipient := range stored.recipients {
+			if summary.RecipientGroups == nil {
+				summary.RecipientGroups = map[string][]string{}
+			}
+			summary.RecipientGroups[recipient.Type] = append(summary.RecipientGroups[recipient.Type], recipient.Email)
+		}
+		summaries = append(summaries, summary)
+	}
+	summaries, info := finishPage(page, summaries)
+	if page.Count {
+		info.Total = total
+	}
+	return summaries, info, nil
+}
+
+func (m *Memory) ListMailbox(ctx context.Context, email, box string) ([]MailboxEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var entries []MailboxEntry
+	for _, stored := range m.messages {
+		if !stored.inBox(email, box) {
+			continue
+		}
+		entries = append(entries, MailboxEntry{
+			UID:       stored.uid,
+			ID:        stored.message.ID,
+			Size:      stored.message.RawSize,
+			CreatedAt: stored.message.CreatedAt,
+			Seen:      box == "sent" || stored.readBy(email),
+		})
+	}
+	return entries, nil
+}
+
+func (m *Memory) NextUID(ctx context.Context) (uint32, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastUID + 1, nil
+}
+
+func (m *Memory) Stats(ctx context.Context) (Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var stats Stats
+	for _, stored := range m.messages {
+		stats.Messages++
+		stats.MessageBytes += stored.message.RawSize
+		for _, attachment := range stored.attachments {
+			stats.Attachments++
+			stats.AttachmentBytes += attachment.Size
+		}
+	}
+	return stats, nil
+}
+
+func (m *Memory) CreateAPIToken(ctx context.Context, token APIToken) (APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tokens[token.Name]; ok {
+		return APIToken{}, ErrTokenExists
+	}
+	m.tokenID++
+	token.ID = m.tokenID
+	token.Mailboxes = append([]string(nil), token.Mailboxes...)
+	token.CreatedAt = time.Unix(token.CreatedAt.Unix(), 0)
+	token.LastUsedAt = time.Time{}
+	m.tokens[token.Name] = token
+	return token, nil
+}
+
+func (m *Memory) APITokenByHash(ctx context.Context, hash string) (APIToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, token := range m.tokens {
+		if token.Hash == hash {
+			return token, nil
+		}
+	}
+	return APIToken{}, ErrNotFound
+}
+
+func (m *Memory) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tokens := make([]APIToken, 0, len(m.tokens))
+	for _, token := range m.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens, nil
+}
+
+func (m *Memory) DeleteAPIToken(ctx context.Context, name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tokens[name]; !ok {
+		return false, nil
+	}
+	delete(m.tokens, name)
+	return true, nil
+}
+
+func (m *Memory) CreateSMTPCredential(ctx context.Context, credential SMTPCredential) (SMTPCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.credentials[credential.Username]; ok {
+		return SMTPCredential{}, ErrCredentialExists
+	}
+	m.credentialID++
+	credential.ID = m.credentialID
+	credential.AllowedSenders = append([]string(nil), credential.AllowedSenders...)
+	credential.CreatedAt = time.Unix(credential.CreatedAt.Unix(), 0)
+	m.credentials[credential.Username] = credential
+	return credential, nil
+}
+
+func (m *Memory) SMTPCredentialByUsername(ctx context.Context, username string) (SMTPCredential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	credential, ok := m.credentials[username]
+	if !ok {
+		return SMTPCredential{}, ErrNotFound
+	}
+	return credential, nil
+}
+
+func (m *Memory) ListSMTPCredentials(ctx context.Context) ([]SMTPCredential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	credentials := make([]SMTPCredential, 0, len(m.credentials))
+	for _, credential := range m.credentials {
+		credentials = append(credentials, credential)
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].Username < credentials[j].Username })
+	return credentials, nil
+}
+
+func (m *Memory) DeleteSMTPCredential(ctx context.Context, username string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.credentials[username]; !ok {
+		return false, nil
+	}
+	delete(m.credentials, username)
+	return true, nil
+}
+
+func (m *Memory) TouchAPIToken(ctx context.Context, id int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, token := range m.tokens {
+		if token.ID == id {
+			token.LastUsedAt = time.Unix(at.Unix(), 0)
+			m.tokens[name] = token
+		}
+	}
+	return nil
+}
+
+func (m *Memory) GetMessage(ctx context.Context, email, id string) (Message, []Recipient, []Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored, ok := m.byID[id]
+	if !ok || !stored.visibleTo(email) {
+		return Message{}, nil, nil, ErrNotFound
+	}
+	attachments := make([]Attachment, 0, len(stored.attachments))
+	for _, attachment := range stored.attachments {
+		attachment.Data = nil
+		attachments = append(attachments, attachment)
+	}
+	return stored.message, append([]Recipient(nil), stored.recipients...), attachments, nil
+}
+
+func (m *Memory) DeleteMessage(ctx context.Context, email, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.byID[id]
+	if !ok || !stored.visibleTo(email) {
+		return false, nil
+	}
+	delete(m.byID, id)
+	for i, candidate := range m.messages {
+		if candidate == stored {
+			m.messages = append(m.messages[:i], m.messages[i+1:]...)
+			break
+		}
+	}
+	return true, nil
+}
+
+func (m *Memory) PurgeMessages(ctx context.Context, email string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.messages[:0]
+	var removed int64
+	for _, stored := range m.messages {
+		if email != "" && !stored.visibleTo(email) {
+			kept = append(kept, stored)
+			continue
+		}
+		delete(m.byID, stored.message.ID)
+		removed++
+	}
+	clear(m.messages[len(kept):])
+	m.messages = kept
+	return removed, nil
+}
+
+func (m *Memory) ListMailboxes(ctx context.Context) ([]MailboxInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	byEmail := map[string]*MailboxInfo{}
+	mailbox := func(email string) *MailboxInfo {
+		info, ok := byEmail[email]
+		if !ok {
+			info = &MailboxInfo{Email: email}
+			byEmail[email] = info
+		}
+		return info
+	}
+	for email, user := range m.users {
+		mailbox(email).LastLogin = user.LastLogin
+	}
+	for _, stored := range m.messages {
+		counted := map[string]bool{}
+		for _, recipient := range stored.recipients {
+			if counted[recipient.Email] {
+				continue
+			}
+			counted[recipient.Email] = true
+			info := mailbox(recipient.Email)
+			info.Messages++
+			if !stored.readBy(recipient.Email) {
+				info.Unread++
+			}
+			if stored.message.CreatedAt.After(info.LastMessageAt) {
+				info.LastMessageAt = stored.message.CreatedAt
+			}
+		}
+	}
+	mailboxes := make([]MailboxInfo, 0, len(byEmail))
+	for _, info := range byEmail {
+		mailboxes = append(mailboxes, *info)
+	}
+	sort.Slice(mailboxes, func(i, j int) bool { return mailboxes[i].Email < mailboxes[j].Email })
+	return mailboxes, nil
+}
+
+func (m *Memory) GetAttachment(ctx context.Context, email string, attachmentID int64) (Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, stored := range m.messages {
+		for _, attachment := range stored.attachments {
+			if attachment.ID != attachmentID {
+				continue
+			}
+			if !stored.visibleTo(email) {
+				return Attachment{}, ErrNotFound
+			}
+			return attachment, nil
+		}
+	}
+	return Attachment{}, ErrNotFound
+}
+
+func (m *Memory) OpenAttachment(ctx context.Context, email string, attachmentID int64) (Attachment, io.ReadSeekCloser, error) {
+	attachment, err := m.GetAttachment(ctx, email, attachmentID)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	data := attachment.Data
+	attachment.Data = nil
+	return attachment, newBytesReader(data), nil
+}
+
+func (m *Memory) OpenRaw(ctx context.Context, email, id string) (io.ReadSeekCloser, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored, ok := m.byID[id]
+	if !ok || !stored.visibleTo(email) {
+		return nil, 0, ErrNotFound
+	}
+	return newBytesReader(stored.message.Raw), int64(len(stored.message.Raw)), nil
+}
+
+func (s *memoryMessage) receivedBy(email string) bool {
+	for _, recipient := range s.recipients {
+		if auth.MatchEmail(email, recipient.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleRecipient reports whether email got the message as anything but a
+// blind copy. Routed copies count, since they follow a visible +tag or alias
+// recipient.
+func (s *memoryMessage) visibleRecipient(email string) bool {
+	for _, recipient := range s.recipients {
+		if auth.MatchEmail(email, recipient.Email) && recipient.Type != "bcc" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryMessage) visibleTo(email string) bool {
+	return auth.MatchEmail(email, s.message.From) || s.receivedBy(email)
+}
+
+// readBy reports whether email has read the message. An empty email asks
+// whether anyone has, as in the "all" box.
+func (s *memoryMessage) readBy(email string) bool {
+	if email == "" {
+		return len(s.reads) > 0
+	}
+	_, ok := s.reads[email]
+	return ok
+}
+
+func (s *memoryMessage) inBox(email, box string) bool {
+	switch box {
+	case "sent":
+		return auth.MatchEmail(email, s.message.From)
+	case "all":
+		return true
+	}
+	return s.receivedBy(email)
+}
+
+// matches evaluates a search query the way searchClause does in SQL, with
+// free text matched on word boundaries like the FTS5 tokenizer.
+func (s *memoryMessage) matches(query search.Query, email string) bool {
+	for _, term := range query.Terms {
+		if s.matchTerm(term, email) == term.Negated {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *memoryMessage) matchTerm(term search.Term, email string) bool {
+	switch term.Field {
+	case search.FieldText:
+		addresses := []string{s.message.From}
+		for _, recipient := range s.recipients {
+			addresses = append(addresses, recipient.Email)
+		}
+		return matchWords(term, s.message.Subject) ||
+			matchWords(term, s.message.TextBody) ||
+			matchWords(term, stripHTML(s.message.HTMLBody)) ||
+			matchWords(term, s.filenames()) ||
+			matchWords(term, strings.Join(addresses, " "))
+	case search.FieldSubject:
+		return matchWords(term, s.message.Subject)
+	case search.FieldFilename:
+		return matchWords(term, s.filenames())
+	case search.FieldFrom:
+		return containsFold(s.message.From, term.Value)
+	case search.FieldTo, search.FieldCc:
+		for _, recipient := range s.recipients {
+			if recipient.Type == string(term.Field) && containsFold(recipient.Email, term.Value) {
+				return true
+			}
+		}
+		return false
+	case search.FieldTag:
+		for _, recipient := range s.recipients {
+			if strings.Contains(recipient.Email, "+"+term.Value+"@") {
+				return true
+			}
+		}
+		return false
+	case search.FieldHas:
+		return len(s.attachments) > 0
+	case search.FieldIs:
+		return s.readBy(email) == (term.Value == "read")
+	case search.FieldBefore:
+		return s.message.CreatedAt.Unix() < term.Time.Unix()
+	case search.FieldAfter:
+		return s.message.CreatedAt.Unix() >= term.Time.Unix()
+	case search.FieldLarger:
+		return s.message.RawSize > term.Size
+	case search.FieldSmaller:
+		return s.message.RawSize < term.Size
+	}
+	return true
+}
+
+func (s *memoryMessage) filenames() string {
+	names := make([]string, 0, len(s.attachments))
+	for _, attachment := range s.attachments {
+		names = append(names, attachment.Filename)
+	}
+	return strings.Join(names, " ")
+}
+
+func containsFold(value, substr string) bool {
+	return strings.Contains(strings.ToLower(value), strings.ToLower(substr))
+}
+
+// matchWords reports whether the words of term appear consecutively in text.
+// An unquoted trailing "*" makes the last word a prefix.
+func matchWords(term search.Term, text string) bool {
+	value := term.Value
+	prefix := false
+	if !term.Phrase && strings.HasSuffix(value, "*") {
+		value = strings.TrimRight(value, "*")
+		prefix = value != ""
+	}
+	want := words(value)
+	if len(want) == 0 {
+		return false
+	}
+	have := words(text)
+	for start := 0; start+len(want) <= len(have); start++ {
+		matched := true
+		for i, word := range want {
+			candidate := have[start+i]
+			if candidate == word || (prefix && i == len(want)-1 && strings.HasPrefix(candidate, word)) {
+				continue
+			}
+			matched = false
+			break
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
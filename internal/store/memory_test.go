@@ -0,0 +1,14 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/store/storetest"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		return store.NewMemory(100)
+	})
+}
@@ -0,0 +1,448 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew means the database was migrated by a newer build.
+var ErrSchemaTooNew = errors.New("database schema is newer than this build supports")
+
+// ErrSchemaOutdated means migrations are pending and were not run.
+var ErrSchemaOutdated = errors.New("database schema has pending migrations")
+
+// migration is one schema step. Steps run in order, each in its own
+// transaction together with its schema_version row. Databases created before
+// schema_version existed already have some of these objects, so every step
+// must be safe to apply on top of them.
+type migration struct {
+	version    int
+	name       string
+	statements []string
+	apply      func(ctx context.Context, tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS users (
+                email TEXT PRIMARY KEY,
+                created_at INTEGER NOT NULL,
+                last_login INTEGER NOT NULL
+            );`,
+			`CREATE TABLE IF NOT EXISTS messages (
+                id TEXT PRIMARY KEY,
+                from_email TEXT NOT NULL,
+                subject TEXT NOT NULL,
+                text_body TEXT,
+                html_body TEXT,
+                raw BLOB NOT NULL,
+                raw_size INTEGER NOT NULL,
+                created_at INTEGER NOT NULL
+            );`,
+			`CREATE TABLE IF NOT EXISTS recipients (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                message_id TEXT NOT NULL,
+                email TEXT NOT NULL,
+                type TEXT NOT NULL,
+                FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+            );`,
+			`CREATE TABLE IF NOT EXISTS attachments (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                message_id TEXT NOT NULL,
+                filename TEXT NOT NULL,
+                content_type TEXT NOT NULL,
+                data BLOB NOT NULL,
+                size INTEGER NOT NULL,
+                FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+            );`,
+			`CREATE TABLE IF NOT EXISTS message_reads (
+                message_id TEXT NOT NULL,
+                email TEXT NOT NULL,
+                read_at INTEGER NOT NULL,
+                PRIMARY KEY (message_id, email),
+                FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+            );`,
+			`CREATE INDEX IF NOT EXISTS idx_recipients_email ON recipients(email);`,
+			`CREATE INDEX IF NOT EXISTS idx_recipients_email_message ON recipients(email, message_id);`,
+			`CREATE INDEX IF NOT EXISTS idx_recipients_message ON recipients(message_id);`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_from ON messages(from_email);`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_from_created ON messages(from_email, created_at);`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_created ON messages(created_at);`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_created_id ON messages(created_at, id);`,
+			`CREATE INDEX IF NOT EXISTS idx_message_reads_email ON message_reads(email);`,
+		},
+	},
+	{
+		version: 2,
+		name:    "message tls columns",
+		apply: func(ctx context.Context, tx *sql.Tx) error {
+			columns := []struct {
+				name       string
+				definition string
+			}{
+				{"tls", "INTEGER NOT NULL DEFAULT 0"},
+				{"tls_version", "TEXT NOT NULL DEFAULT ''"},
+				{"tls_cipher", "TEXT NOT NULL DEFAULT ''"},
+			}
+			for _, column := range columns {
+				if err := addColumn(ctx, tx, "messages", column.name, column.definition); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 3,
+		name:    "smtp envelopes",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS envelopes (
+                message_id TEXT PRIMARY KEY,
+                mail_from TEXT NOT NULL,
+                mail_params TEXT NOT NULL,
+                helo TEXT NOT NULL,
+                remote_addr TEXT NOT NULL,
+                auth_username TEXT NOT NULL,
+                received_at INTEGER NOT NULL,
+                FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+            );`,
+			`CREATE TABLE IF NOT EXISTS envelope_recipients (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                message_id TEXT NOT NULL,
+                address TEXT NOT NULL,
+                params TEXT NOT NULL,
+                FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+            );`,
+			`CREATE INDEX IF NOT EXISTS idx_envelope_recipients_message ON envelope_recipients(message_id);`,
+		},
+	},
+	{
+		version: 4,
+		name:    "message uids",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS message_uids (
+                uid INTEGER PRIMARY KEY AUTOINCREMENT,
+                message_id TEXT NOT NULL UNIQUE,
+                FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+            );`,
+			// Messages captured before UIDs existed get them in arrival order.
+			`INSERT INTO message_uids (message_id)
+                SELECT id FROM messages
+                WHERE NOT EXISTS (SELECT 1 FROM message_uids u WHERE u.message_id = messages.id)
+                ORDER BY created_at, id;`,
+		},
+	},
+	{
+		version: 5,
+		name:    "full-text search",
+		statements: []string{
+			`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+                subject, body, html, attachments, addresses,
+                tokenize = 'unicode61 remove_diacritics 2'
+            );`,
+			// messages_fts is keyed by message_uids.uid, so this keeps the
+			// index in step with cascading message deletes.
+			`CREATE TRIGGER IF NOT EXISTS message_uids_fts_delete AFTER DELETE ON message_uids BEGIN
+                DELETE FROM messages_fts WHERE rowid = old.uid;
+            END;`,
+		},
+		apply: backfillSearchIndex,
+	},
+	{
+		version: 6,
+		name:    "blob references",
+		apply: func(ctx context.Context, tx *sql.Tx) error {
+			if err := addColumn(ctx, tx, "messages", "raw_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			if err := addColumn(ctx, tx, "attachments", "blob_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			for _, statement := range []string{
+				`CREATE INDEX IF NOT EXISTS idx_messages_raw_key ON messages(raw_key) WHERE raw_key != '';`,
+				`CREATE INDEX IF NOT EXISTS idx_attachments_blob_key ON attachments(blob_key) WHERE blob_key != '';`,
+			} {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("create blob index: %w", err)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 7,
+		name:    "webhook deliveries",
+		statements: []string{
+			// Deliveries outlive their message, which message.deleted needs,
+			// so message_id is not a foreign key.
+			`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                webhook TEXT NOT NULL,
+                event TEXT NOT NULL,
+                message_id TEXT NOT NULL,
+                url TEXT NOT NULL,
+                payload BLOB NOT NULL,
+                status TEXT NOT NULL,
+                attempts INTEGER NOT NULL DEFAULT 0,
+                next_attempt_at INTEGER NOT NULL,
+                last_attempt_at INTEGER NOT NULL DEFAULT 0,
+                response_code INTEGER NOT NULL DEFAULT 0,
+                last_error TEXT NOT NULL DEFAULT '',
+                created_at INTEGER NOT NULL
+            );`,
+			`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);`,
+			`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook, id);`,
+		},
+	},
+	{
+		version: 8,
+		name:    "api tokens",
+		statements: []string{
+			// mailboxes is a comma-separated list of normalized addresses.
+			`CREATE TABLE IF NOT EXISTS api_tokens (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                name TEXT NOT NULL UNIQUE,
+                token_hash TEXT NOT NULL UNIQUE,
+                prefix TEXT NOT NULL,
+                mailboxes TEXT NOT NULL DEFAULT '',
+                admin INTEGER NOT NULL DEFAULT 0,
+                created_at INTEGER NOT NULL,
+                last_used_at INTEGER NOT NULL DEFAULT 0
+            );`,
+		},
+	},
+	{
+		version: 9,
+		name:    "smtp credentials",
+		statements: []string{
+			// allowed_senders is a comma-separated list of addresses or
+			// wildcard mailboxes.
+			`CREATE TABLE IF NOT EXISTS smtp_credentials (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                username TEXT NOT NULL UNIQUE,
+                password_hash TEXT NOT NULL,
+                allowed_senders TEXT NOT NULL DEFAULT '',
+                rate_per_hour INTEGER NOT NULL DEFAULT 0,
+                project TEXT NOT NULL DEFAULT '',
+                created_at INTEGER NOT NULL
+            );`,
+		},
+		apply: func(ctx context.Context, tx *sql.Tx) error {
+			return addColumn(ctx, tx, "envelopes", "auth_project", "TEXT NOT NULL DEFAULT ''")
+		},
+	},
+	{
+		version: 10,
+		name:    "webhook raw references",
+		apply: func(ctx context.Context, tx *sql.Tx) error {
+			// Deliveries that include the raw message refer to it and read
+			// it when sent, instead of copying it into the payload.
+			columns := []struct {
+				name       string
+				definition string
+			}{
+				{"include_raw", "INTEGER NOT NULL DEFAULT 0"},
+				{"raw_key", "TEXT NOT NULL DEFAULT ''"},
+				{"raw_size", "INTEGER NOT NULL DEFAULT 0"},
+			}
+			for _, column := range columns {
+				if err := addColumn(ctx, tx, "webhook_deliveries", column.name, column.definition); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// LatestSchemaVersion is the version Migrate brings a database to.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+func (m MigrationStatus) Applied() bool {
+	return !m.AppliedAt.IsZero()
+}
+
+// Migrate applies pending migrations and returns how many ran.
+func (s *Store) Migrate(ctx context.Context) (int, error) {
+	if err := s.ensureVersionTable(ctx); err != nil {
+		return 0, err
+	}
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if current > LatestSchemaVersion() {
+		return 0, fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+
+	applied := 0
+	for _, step := range migrations {
+		if step.version <= current {
+			continue
+		}
+		if err := s.runMigration(ctx, step); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// CheckSchema returns an error unless the database is at LatestSchemaVersion.
+func (s *Store) CheckSchema(ctx context.Context) error {
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current > LatestSchemaVersion():
+		return fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	case current < LatestSchemaVersion():
+		return fmt.Errorf("%w: database is at version %d, latest is %d", ErrSchemaOutdated, current, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// SchemaVersion is the highest applied migration, or 0 for a database that
+// has never been migrated.
+func (s *Store) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version;`).Scan(&version)
+	if err != nil {
+		if exists, existsErr := s.tableExists(ctx, "schema_version"); existsErr == nil && !exists {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// MigrationStatus lists every known migration with when it was applied.
+func (s *Store) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	appliedAt := map[int]time.Time{}
+	exists, err := s.tableExists(ctx, "schema_version")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		rows, err := s.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_version;`)
+		if err != nil {
+			return nil, fmt.Errorf("read migration status: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var at int64
+			if err := rows.Scan(&version, &at); err != nil {
+				return nil, fmt.Errorf("read migration status: %w", err)
+			}
+			appliedAt[version] = time.UnixMilli(at)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("read migration status: %w", err)
+		}
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, step := range migrations {
+		status = append(status, MigrationStatus{Version: step.version, Name: step.name, AppliedAt: appliedAt[step.version]})
+	}
+	return status, nil
+}
+
+func (s *Store) ensureVersionTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at INTEGER NOT NULL
+    );`)
+	if err != nil {
+		return fmt.Errorf("create schema_version: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) runMigration(ctx context.Context, step migration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("migration %d: begin tx: %w", step.version, err)
+	}
+	defer tx.Rollback()
+
+	for _, statement := range step.statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", step.version, step.name, err)
+		}
+	}
+	if step.apply != nil {
+		if err := step.apply(ctx, tx); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", step.version, step.name, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?);`,
+		step.version, step.name, time.Now().UnixMilli()); err != nil {
+		return fmt.Errorf("migration %d: record version: %w", step.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %d: commit: %w", step.version, err)
+	}
+	return nil
+}
+
+func (s *Store) tableExists(ctx context.Context, name string) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, name).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("inspect %s: %w", name, err)
+	}
+	return count > 0, nil
+}
+
+// addColumn adds a column unless a pre-migration build already created it.
+func addColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			ctype      string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultVal, &primaryKey); err != nil {
+			return fmt.Errorf("inspect %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("inspect %s: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
@@ -9,14 +9,46 @@ type User struct {
 }
 
 type Message struct {
-	ID        string
-	From      string
-	Subject   string
-	TextBody  string
-	HTMLBody  string
-	Raw       []byte
-	RawSize   int64
-	CreatedAt time.Time
+	ID         string
+	From       string
+	Subject    string
+	TextBody   string
+	HTMLBody   string
+	Raw        []byte
+	RawSize    int64
+	TLS        bool
+	TLSVersion string
+	TLSCipher  string
+	CreatedAt  time.Time
+	Envelope   *Envelope
+	// RawKey refers to Raw already written to the blob store by the caller.
+	RawKey string
+}
+
+// Envelope is the SMTP transaction a message arrived in, as seen on the wire
+// rather than in the message headers.
+type Envelope struct {
+	MailFrom     string
+	MailParams   map[string]string
+	Recipients   []EnvelopeRecipient
+	Helo         string
+	RemoteAddr   string
+	AuthUsername string
+	// AuthProject is the project tag of the credential that authenticated.
+	AuthProject string
+	ReceivedAt  time.Time
+}
+
+// NewMessage is one message for InsertMessages.
+type NewMessage struct {
+	Message     Message
+	Recipients  []Recipient
+	Attachments []Attachment
+}
+
+type EnvelopeRecipient struct {
+	Address string
+	Params  map[string]string
 }
 
 type Recipient struct {
@@ -31,6 +63,8 @@ type Attachment struct {
 	ContentType string
 	Data        []byte
 	Size        int64
+	// BlobKey refers to Data already written to the blob store by the caller.
+	BlobKey string
 }
 
 type MessageSummary struct {
@@ -41,3 +75,26 @@ type MessageSummary struct {
 	HasAttachments  bool
 	RecipientGroups map[string][]string
 }
+
+type UnreadCount struct {
+	Total int32
+	Bcc   int32
+}
+
+// Stats totals what is currently stored, for metrics.
+type Stats struct {
+	Messages        int64
+	MessageBytes    int64
+	Attachments     int64
+	AttachmentBytes int64
+}
+
+// MailboxEntry is a message as seen by mail clients: UID is stable and
+// increases with arrival order across all mailboxes.
+type MailboxEntry struct {
+	UID       uint32
+	ID        string
+	Size      int64
+	CreatedAt time.Time
+	Seen      bool
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned by ParseCursor for tokens it did not issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in a message listing: the message a page continues
+// from. Before selects the messages preceding it in the sort order instead
+// of those following it.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+	Before    bool
+}
+
+// Page selects part of a message listing. With a Cursor, Offset is ignored
+// and the page is found through the (created_at, id) index, so deep pages
+// are cheap and stay stable while new mail arrives.
+type Page struct {
+	Sort   string
+	Offset int32
+	Limit  int32
+	Cursor *Cursor
+	// Count asks for the total number of matching messages, which costs a
+	// scan of all of them.
+	Count bool
+}
+
+// PageInfo locates a page within its listing. Total is -1 unless counting
+// was requested; Next and Prev are nil at either end.
+type PageInfo struct {
+	Total int32
+	Next  *Cursor
+	Prev  *Cursor
+}
+
+func (p Page) normalize() Page {
+	if p.Limit <= 0 {
+		p.Limit = 10
+	}
+	if p.Offset < 0 || p.Cursor != nil {
+		p.Offset = 0
+	}
+	return p
+}
+
+func (p Page) oldestFirst() bool {
+	return p.Sort == "oldest" || p.Sort == "asc"
+}
+
+// backward reports whether the page is read against the sort order.
+func (p Page) backward() bool {
+	return p.Cursor != nil && p.Cursor.Before
+}
+
+// finishPage takes up to Limit+1 messages read in traversal order, trims
+// the probe row and puts them in display order, and works out the cursors
+// to the neighbouring pages.
+func finishPage(page Page, messages []MessageSummary) ([]MessageSummary, PageInfo) {
+	info := PageInfo{Total: -1}
+	more := len(messages) > int(page.Limit)
+	if more {
+		messages = messages[:page.Limit]
+	}
+	if page.backward() {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	if len(messages) == 0 {
+		return messages, info
+	}
+
+	first, last := messages[0], messages[len(messages)-1]
+	hasNext, hasPrev := more, page.Offset > 0 || page.Cursor != nil
+	if page.backward() {
+		hasNext, hasPrev = true, more
+	}
+	if hasNext {
+		info.Next = &Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+	if hasPrev {
+		info.Prev = &Cursor{CreatedAt: first.CreatedAt, ID: first.ID, Before: true}
+	}
+	return messages, info
+}
+
+// follows reports whether a message with the given key comes after c in
+// traversal order: after it in the sort order, or before it when c.Before.
+func (c Cursor) follows(createdAt time.Time, id string, oldestFirst bool) bool {
+	forward := oldestFirst != c.Before
+	if !createdAt.Equal(c.CreatedAt) {
+		return createdAt.After(c.CreatedAt) == forward
+	}
+	if id == c.ID {
+		return false
+	}
+	return (id > c.ID) == forward
+}
+
+// String encodes c as an opaque token for API clients.
+func (c Cursor) String() string {
+	direction := "n"
+	if c.Before {
+		direction = "p"
+	}
+	raw := direction + ":" + strconv.FormatInt(c.CreatedAt.Unix(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a token produced by Cursor.String.
+func ParseCursor(token string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+	var before bool
+	switch parts[0] {
+	case "n":
+	case "p":
+		before = true
+	default:
+		return Cursor{}, ErrInvalidCursor
+	}
+	seconds, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{CreatedAt: time.Unix(seconds, 0), ID: parts[2], Before: before}, nil
+}
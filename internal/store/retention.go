@@ -0,0 +1,175 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The retention queries below pick at most limit whole messages to remove,
+// so callers can announce each one before DeleteMessages removes the batch
+// and SMTP inserts can interleave on the single connection. created_at only
+// has second resolution, so ties are broken by UID, which follows arrival
+// order.
+
+func (s *Store) ExpiredMessages(ctx context.Context, cutoff time.Time, limit int) ([]MessageRef, error) {
+	return s.retentionTargets(ctx, "list expired messages", `SELECT m.id, m.from_email
+        FROM messages m JOIN message_uids u ON u.message_id = m.id
+        WHERE m.created_at < ? ORDER BY m.created_at, u.uid LIMIT ?;`,
+		cutoff.Unix(), limit)
+}
+
+// ExcessMessages picks messages beyond the newest keep overall.
+func (s *Store) ExcessMessages(ctx context.Context, keep, limit int) ([]MessageRef, error) {
+	return s.retentionTargets(ctx, "list excess messages", `SELECT m.id, m.from_email
+        FROM messages m JOIN message_uids u ON u.message_id = m.id
+        ORDER BY m.created_at DESC, u.uid DESC LIMIT ? OFFSET ?;`,
+		limit, keep)
+}
+
+// ExcessMailboxMessages picks messages beyond the newest keep in each
+// recipient's inbox. A message shared by several mailboxes is removed once it
+// falls outside any of them.
+func (s *Store) ExcessMailboxMessages(ctx context.Context, keep, limit int) ([]MessageRef, error) {
+	return s.retentionTargets(ctx, "list excess mailbox messages", `SELECT m.id, m.from_email
+        FROM messages m
+        WHERE m.id IN (
+            SELECT message_id FROM (
+                SELECT r.message_id,
+                    ROW_NUMBER() OVER (PARTITION BY r.email ORDER BY m.created_at DESC, u.uid DESC) AS position
+                FROM recipients r
+                JOIN messages m ON m.id = r.message_id
+                JOIN message_uids u ON u.message_id = m.id
+            )
+            WHERE position > ?
+        )
+        LIMIT ?;`,
+		keep, limit)
+}
+
+// OldestMessages picks the oldest messages until their footprint in the
+// database adds up to at least bytes, so a size limit does not overshoot by a
+// whole batch. The footprint counts parsed bodies plus the raw message and
+// attachments kept inline; data in the blob store takes no database space.
+func (s *Store) OldestMessages(ctx context.Context, bytes int64, limit int) ([]MessageRef, error) {
+	return s.retentionTargets(ctx, "list oldest messages", `SELECT id, from_email FROM (
+            SELECT id, from_email, footprint, SUM(footprint) OVER (ORDER BY created_at, uid) AS running
+            FROM (
+                SELECT m.id, m.from_email, m.created_at, u.uid,
+                    CASE WHEN m.raw_key = '' THEN m.raw_size ELSE 0 END
+                        + COALESCE(LENGTH(m.text_body), 0) + COALESCE(LENGTH(m.html_body), 0)
+                        + (SELECT COALESCE(SUM(a.size), 0) FROM attachments a
+                           WHERE a.message_id = m.id AND a.blob_key = '') AS footprint
+                FROM messages m
+                JOIN message_uids u ON u.message_id = m.id
+            )
+        )
+        WHERE running - footprint < ?
+        LIMIT ?;`,
+		bytes, limit)
+}
+
+// DeleteMessages removes the messages with ids and returns how many existed.
+func (s *Store) DeleteMessages(ctx context.Context, ids []string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return s.deleteBatch(ctx, "delete messages", `DELETE FROM messages WHERE id IN (`+placeholders+`);`, args...)
+}
+
+func (s *Store) retentionTargets(ctx context.Context, op, query string, args ...any) ([]MessageRef, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+	var refs []MessageRef
+	for rows.Next() {
+		var ref MessageRef
+		if err := rows.Scan(&ref.ID, &ref.From); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return refs, nil
+}
+
+func (s *Store) deleteBatch(ctx context.Context, op, query string, args ...any) (int64, error) {
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return rows, nil
+}
+
+// DatabaseSize is the space used by live pages. Free pages left behind by
+// deletes are excluded until IncrementalVacuum returns them to the OS.
+func (s *Store) DatabaseSize(ctx context.Context) (int64, error) {
+	var size int64
+	err := s.db.QueryRowContext(ctx, `SELECT (page_count - freelist_count) * page_size
+        FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size();`).Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("database size: %w", err)
+	}
+	return size, nil
+}
+
+// IncrementalVacuum releases free pages so the database file shrinks. The
+// pragma frees one page per step, so its rows have to be drained.
+func (s *Store) IncrementalVacuum(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, "PRAGMA incremental_vacuum;")
+	if err != nil {
+		return fmt.Errorf("incremental vacuum: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("incremental vacuum: %w", err)
+	}
+	return nil
+}
+
+const autoVacuumIncremental = 2
+
+// IncrementalVacuumEnabled reports whether IncrementalVacuum can return freed
+// pages to the OS. Databases created before it was enabled need
+// EnableIncrementalVacuum first.
+func (s *Store) IncrementalVacuumEnabled(ctx context.Context) (bool, error) {
+	var mode int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA auto_vacuum;").Scan(&mode); err != nil {
+		return false, fmt.Errorf("read auto_vacuum: %w", err)
+	}
+	return mode == autoVacuumIncremental, nil
+}
+
+// EnableIncrementalVacuum switches the database to auto_vacuum=INCREMENTAL.
+// Once tables exist that takes a full VACUUM, which rewrites the whole file
+// and holds the writer meanwhile, so it is an explicit step ("localsmtp
+// migrate vacuum") rather than part of Migrate.
+func (s *Store) EnableIncrementalVacuum(ctx context.Context) error {
+	enabled, err := s.IncrementalVacuumEnabled(ctx)
+	if err != nil || enabled {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL;"); err != nil {
+		return fmt.Errorf("enable incremental vacuum: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "VACUUM;"); err != nil {
+		return fmt.Errorf("enable incremental vacuum: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package store_test
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+func TestRetentionTargets(t *testing.T) {
+	ctx := t.Context()
+	db := openSQLite(t)
+	defer db.Close()
+
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	insert := func(id string, at time.Duration, recipients ...string) {
+		t.Helper()
+		raw := []byte("Subject: " + id + "\r\n\r\n" + strings.Repeat("x", 1000))
+		message := store.Message{ID: id, From: "sender@example.com", Subject: id, TextBody: "body", Raw: raw, RawSize: int64(len(raw)), CreatedAt: base.Add(at)}
+		var rcpts []store.Recipient
+		for _, email := range recipients {
+			rcpts = append(rcpts, store.Recipient{Email: email, Type: "to"})
+		}
+		if err := db.InsertMessage(ctx, message, rcpts, nil); err != nil {
+			t.Fatalf("insert %s: %v", id, err)
+		}
+	}
+	// The oldest message is the only one whose raw is in the blob store.
+	insert("inline-1", time.Minute, "alice@example.com")
+	insert("inline-2", 2*time.Minute, "bob@example.com")
+	insert("inline-3", 3*time.Minute, "alice@example.com")
+	db.SetBlobStore(openBlobs(t))
+	insert("blob", 0, "alice@example.com")
+
+	ids := func(refs []store.MessageRef, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, ref := range refs {
+			ids = append(ids, ref.ID)
+		}
+		return ids
+	}
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{
+			name: "expired",
+			got:  ids(db.ExpiredMessages(ctx, base.Add(90*time.Second), 10)),
+			want: []string{"blob", "inline-1"},
+		},
+		{
+			name: "beyond newest two",
+			got:  ids(db.ExcessMessages(ctx, 2, 10)),
+			want: []string{"inline-1", "blob"},
+		},
+		{
+			// No order is promised across mailboxes.
+			name: "beyond newest per mailbox",
+			got:  slices.Sorted(slices.Values(ids(db.ExcessMailboxMessages(ctx, 1, 10)))),
+			want: []string{"blob", "inline-1"},
+		},
+		{
+			// The blob-backed raw takes no database space, so freeing 1000
+			// bytes takes the next message as well.
+			name: "oldest by inline size",
+			got:  ids(db.OldestMessages(ctx, 1000, 10)),
+			want: []string{"blob", "inline-1"},
+		},
+		{
+			name: "limit",
+			got:  ids(db.OldestMessages(ctx, 1<<20, 3)),
+			want: []string{"blob", "inline-1", "inline-2"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tc.got, tc.want) {
+				t.Errorf("got %q, want %q", tc.got, tc.want)
+			}
+		})
+	}
+
+	removed, err := db.DeleteMessages(ctx, []string{"blob", "inline-2", "missing"})
+	if err != nil || removed != 2 {
+		t.Fatalf("DeleteMessages = %d, %v; want 2", removed, err)
+	}
+	if got := ids(db.ExcessMessages(ctx, 0, 10)); !reflect.DeepEqual(got, []string{"inline-3", "inline-1"}) {
+		t.Errorf("left %q", got)
+	}
+}
+
+func TestIncrementalVacuum(t *testing.T) {
+	db := openSQLite(t)
+	defer db.Close()
+	enabled, err := db.IncrementalVacuumEnabled(t.Context())
+	if err != nil || !enabled {
+		t.Fatalf("new database: incremental vacuum = %v, %v", enabled, err)
+	}
+	if err := db.EnableIncrementalVacuum(t.Context()); err != nil {
+		t.Errorf("EnableIncrementalVacuum on an enabled database: %v", err)
+	}
+}
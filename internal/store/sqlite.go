@@ -3,19 +3,34 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
+
+	"github.io/razzkumar/localsmtp/internal/auth"
+	"github.io/razzkumar/localsmtp/internal/blobstore"
+	"github.io/razzkumar/localsmtp/internal/search"
 )
 
+// Store keeps mail in SQLite. Writes go through db, a single connection, as
+// SQLite allows only one writer. File databases run in WAL mode, where
+// readers do not block the writer, so queries use a separate pool in read.
 type Store struct {
-	db *sql.DB
+	db    *sql.DB
+	read  *sql.DB
+	blobs *blobstore.Store
 }
 
-func Open(ctx context.Context, path string) (*Store, error) {
+// Open opens the database at path with up to readConns connections for
+// queries. In-memory databases exist per connection, so they share the
+// writer instead.
+func Open(ctx context.Context, path string, readConns int) (*Store, error) {
 	trimmed := strings.TrimSpace(path)
 	inMemory := false
 	if trimmed == "" {
@@ -34,72 +49,74 @@ func Open(ctx context.Context, path string) (*Store, error) {
 	if _, err := db.ExecContext(ctx, "PRAGMA foreign_keys = ON;"); err != nil {
 		return nil, fmt.Errorf("enable foreign keys: %w", err)
 	}
-	if !inMemory {
-		if _, err := db.ExecContext(ctx, "PRAGMA journal_mode = WAL;"); err != nil {
-			return nil, fmt.Errorf("enable WAL: %w", err)
-		}
+	// Only a new database picks this up, before its first page is written;
+	// older ones need EnableIncrementalVacuum.
+	if _, err := db.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL;"); err != nil {
+		return nil, fmt.Errorf("enable incremental vacuum: %w", err)
+	}
+	if inMemory {
+		return &Store{db: db, read: db}, nil
+	}
+
+	if _, err := db.ExecContext(ctx, "PRAGMA journal_mode = WAL;"); err != nil {
+		return nil, fmt.Errorf("enable WAL: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "PRAGMA busy_timeout = 5000;"); err != nil {
+		return nil, fmt.Errorf("set busy timeout: %w", err)
+	}
+	if readConns <= 0 {
+		readConns = 4
+	}
+	read, err := sql.Open("sqlite", withPragmas(trimmed, "busy_timeout(5000)", "query_only(1)"))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open sqlite read pool: %w", err)
+	}
+	read.SetMaxOpenConns(readConns)
+	read.SetMaxIdleConns(readConns)
+	return &Store{db: db, read: read}, nil
+}
+
+// withPragmas adds pragmas to a DSN so every pooled connection runs them.
+func withPragmas(dsn string, pragmas ...string) string {
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	for _, pragma := range pragmas {
+		dsn += separator + "_pragma=" + url.QueryEscape(pragma)
+		separator = "&"
 	}
-	return &Store{db: db}, nil
+	return dsn
+}
+
+// SetBlobStore moves raw messages and attachment data captured from now on
+// out of SQLite into blobs. Rows stored inline before stay readable.
+func (s *Store) SetBlobStore(blobs *blobstore.Store) {
+	s.blobs = blobs
+}
+
+// Blobs returns the blob store, or nil if message data is kept in SQLite.
+// Callers may write content there first and pass the keys to InsertMessage.
+func (s *Store) Blobs() *blobstore.Store {
+	return s.blobs
 }
 
 func (s *Store) Close() error {
+	if s.read != s.db {
+		s.read.Close()
+	}
 	return s.db.Close()
 }
 
-func (s *Store) EnsureSchema(ctx context.Context) error {
-	statements := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-            email TEXT PRIMARY KEY,
-            created_at INTEGER NOT NULL,
-            last_login INTEGER NOT NULL
-        );`,
-		`CREATE TABLE IF NOT EXISTS messages (
-            id TEXT PRIMARY KEY,
-            from_email TEXT NOT NULL,
-            subject TEXT NOT NULL,
-            text_body TEXT,
-            html_body TEXT,
-            raw BLOB NOT NULL,
-            raw_size INTEGER NOT NULL,
-            created_at INTEGER NOT NULL
-        );`,
-		`CREATE TABLE IF NOT EXISTS recipients (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            message_id TEXT NOT NULL,
-            email TEXT NOT NULL,
-            type TEXT NOT NULL,
-            FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
-        );`,
-		`CREATE TABLE IF NOT EXISTS attachments (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            message_id TEXT NOT NULL,
-            filename TEXT NOT NULL,
-            content_type TEXT NOT NULL,
-            data BLOB NOT NULL,
-            size INTEGER NOT NULL,
-            FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
-        );`,
-		`CREATE TABLE IF NOT EXISTS message_reads (
-            message_id TEXT NOT NULL,
-            email TEXT NOT NULL,
-            read_at INTEGER NOT NULL,
-            PRIMARY KEY (message_id, email),
-            FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
-        );`,
-		`CREATE INDEX IF NOT EXISTS idx_recipients_email ON recipients(email);`,
-		`CREATE INDEX IF NOT EXISTS idx_recipients_email_message ON recipients(email, message_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_recipients_message ON recipients(message_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_from ON messages(from_email);`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_from_created ON messages(from_email, created_at);`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_created ON messages(created_at);`,
-		`CREATE INDEX IF NOT EXISTS idx_messages_created_id ON messages(created_at, id);`,
-		`CREATE INDEX IF NOT EXISTS idx_message_reads_email ON message_reads(email);`,
-	}
-
-	for _, statement := range statements {
-		if _, err := s.db.ExecContext(ctx, statement); err != nil {
-			return fmt.Errorf("apply schema: %w", err)
-		}
+// Ping checks that the database handle works and the schema is queryable.
+func (s *Store) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping sqlite: %w", err)
+	}
+	var rows int
+	if err := s.read.QueryRowContext(ctx, `SELECT COUNT(*) FROM (SELECT 1 FROM messages LIMIT 1);`).Scan(&rows); err != nil {
+		return fmt.Errorf("query sqlite: %w", err)
 	}
 	return nil
 }
@@ -116,28 +133,105 @@ func (s *Store) UpsertUser(ctx context.Context, email string, now time.Time) err
 }
 
 func (s *Store) InsertMessage(ctx context.Context, message Message, recipients []Recipient, attachments []Attachment) error {
+	return s.InsertMessages(ctx, []NewMessage{{Message: message, Recipients: recipients, Attachments: attachments}})
+}
+
+// InsertMessages stores a batch in a single transaction, which costs about
+// as much as storing one message. Either every message is stored or none.
+func (s *Store) InsertMessages(ctx context.Context, batch []NewMessage) error {
+	// Blobs are written before the transaction so slow disks do not hold the
+	// connection. If the insert fails they are left for CollectBlobs.
+	rows := make([]messageRow, len(batch))
+	for i, item := range batch {
+		row, err := s.prepareMessage(item)
+		if err != nil {
+			return err
+		}
+		rows[i] = row
+	}
+
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("begin tx: %w", err)
 	}
 	defer tx.Rollback()
 
-	_, err = tx.ExecContext(ctx, `INSERT INTO messages
-        (id, from_email, subject, text_body, html_body, raw, raw_size, created_at)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?);`,
+	for _, row := range rows {
+		if err := insertMessage(ctx, tx, row); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit message: %w", err)
+	}
+	return nil
+}
+
+// messageRow is a NewMessage with its content split into what is stored
+// inline and what is in the blob store.
+type messageRow struct {
+	NewMessage
+	raw            []byte
+	rawKey         string
+	attachmentData [][]byte
+	blobKeys       []string
+}
+
+func (s *Store) prepareMessage(item NewMessage) (messageRow, error) {
+	row := messageRow{
+		NewMessage:     item,
+		attachmentData: make([][]byte, len(item.Attachments)),
+		blobKeys:       make([]string, len(item.Attachments)),
+	}
+	var err error
+	row.raw, row.rawKey, err = s.putBlob(item.Message.Raw, item.Message.RawKey)
+	if err != nil {
+		return messageRow{}, fmt.Errorf("insert message: %w", err)
+	}
+	for i, attachment := range item.Attachments {
+		row.attachmentData[i], row.blobKeys[i], err = s.putBlob(attachment.Data, attachment.BlobKey)
+		if err != nil {
+			return messageRow{}, fmt.Errorf("insert attachment: %w", err)
+		}
+	}
+	return row, nil
+}
+
+func insertMessage(ctx context.Context, tx *sql.Tx, row messageRow) error {
+	message, recipients, attachments := row.Message, row.Recipients, row.Attachments
+	_, err := tx.ExecContext(ctx, `INSERT INTO messages
+        (id, from_email, subject, text_body, html_body, raw, raw_key, raw_size, tls, tls_version, tls_cipher, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
 		message.ID,
 		message.From,
 		message.Subject,
 		message.TextBody,
 		message.HTMLBody,
-		message.Raw,
+		row.raw,
+		row.rawKey,
 		message.RawSize,
+		message.TLS,
+		message.TLSVersion,
+		message.TLSCipher,
 		message.CreatedAt.Unix(),
 	)
 	if err != nil {
 		return fmt.Errorf("insert message: %w", err)
 	}
 
+	result, err := tx.ExecContext(ctx, `INSERT INTO message_uids (message_id) VALUES (?);`, message.ID)
+	if err != nil {
+		return fmt.Errorf("insert message uid: %w", err)
+	}
+	uid, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("insert message uid: %w", err)
+	}
+	if err := indexMessage(ctx, tx, uid, message, recipients, attachments); err != nil {
+		return err
+	}
+
 	for _, recipient := range recipients {
 		_, err = tx.ExecContext(ctx, `INSERT INTO recipients (message_id, email, type)
             VALUES (?, ?, ?);`, message.ID, recipient.Email, recipient.Type)
@@ -146,14 +240,15 @@ func (s *Store) InsertMessage(ctx context.Context, message Message, recipients [
 		}
 	}
 
-	for _, attachment := range attachments {
+	for i, attachment := range attachments {
 		_, err = tx.ExecContext(ctx, `INSERT INTO attachments
-            (message_id, filename, content_type, data, size)
-            VALUES (?, ?, ?, ?, ?);`,
+            (message_id, filename, content_type, data, blob_key, size)
+            VALUES (?, ?, ?, ?, ?, ?);`,
 			message.ID,
 			attachment.Filename,
 			attachment.ContentType,
-			attachment.Data,
+			row.attachmentData[i],
+			row.blobKeys[i],
 			attachment.Size,
 		)
 		if err != nil {
@@ -161,54 +256,127 @@ func (s *Store) InsertMessage(ctx context.Context, message Message, recipients [
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("commit message: %w", err)
+	if message.Envelope != nil {
+		if err := insertEnvelope(ctx, tx, message.ID, message.Envelope); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insertEnvelope(ctx context.Context, tx *sql.Tx, messageID string, envelope *Envelope) error {
+	mailParams, err := encodeParams(envelope.MailParams)
+	if err != nil {
+		return fmt.Errorf("insert envelope: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO envelopes
+        (message_id, mail_from, mail_params, helo, remote_addr, auth_username, auth_project, received_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?);`,
+		messageID,
+		envelope.MailFrom,
+		mailParams,
+		envelope.Helo,
+		envelope.RemoteAddr,
+		envelope.AuthUsername,
+		envelope.AuthProject,
+		envelope.ReceivedAt.UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("insert envelope: %w", err)
+	}
+
+	for _, recipient := range envelope.Recipients {
+		params, err := encodeParams(recipient.Params)
+		if err != nil {
+			return fmt.Errorf("insert envelope recipient: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO envelope_recipients (message_id, address, params)
+            VALUES (?, ?, ?);`, messageID, recipient.Address, params)
+		if err != nil {
+			return fmt.Errorf("insert envelope recipient: %w", err)
+		}
 	}
 	return nil
 }
 
-func (s *Store) MarkMessageRead(ctx context.Context, email, messageID string, now time.Time) error {
-	_, err := s.db.ExecContext(ctx, `INSERT INTO message_reads (message_id, email, read_at)
+func (s *Store) MarkMessageRead(ctx context.Context, email, messageID string, now time.Time) (bool, error) {
+	// Rereading keeps the first read time, and inserts no row.
+	result, err := s.db.ExecContext(ctx, `INSERT INTO message_reads (message_id, email, read_at)
         VALUES (?, ?, ?)
-        ON CONFLICT(message_id, email) DO UPDATE SET read_at = excluded.read_at;`,
+        ON CONFLICT(message_id, email) DO NOTHING;`,
 		messageID, email, now.Unix(),
 	)
 	if err != nil {
-		return fmt.Errorf("mark message read: %w", err)
+		return false, fmt.Errorf("mark message read: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("mark message read: %w", err)
+	}
+	return inserted > 0, nil
+}
+
+func (s *Store) MarkMessageUnread(ctx context.Context, email, messageID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM message_reads WHERE message_id = ? AND email = ?;`, messageID, email)
+	if err != nil {
+		return fmt.Errorf("mark message unread: %w", err)
 	}
 	return nil
 }
 
-func (s *Store) UnreadCounts(ctx context.Context, emails []string) (map[string]int32, error) {
-	counts := make(map[string]int32, len(emails))
+func (s *Store) UnreadCounts(ctx context.Context, emails []string) (map[string]UnreadCount, error) {
+	counts := make(map[string]UnreadCount, len(emails))
 	for _, email := range emails {
-		var total int64
-		err := s.db.QueryRowContext(ctx, `SELECT COUNT(1)
+		var total, bcc int64
+		recipient, address := addressMatch("r.email", email)
+		err := s.read.QueryRowContext(ctx, `SELECT COUNT(1),
+                COALESCE(SUM(NOT EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = m.id AND `+recipient+` AND r.type != 'bcc')), 0)
             FROM messages m
-            WHERE EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = m.id AND r.email = ?)
+            WHERE EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = m.id AND `+recipient+`)
               AND NOT EXISTS (SELECT 1 FROM message_reads mr WHERE mr.message_id = m.id AND mr.email = ?);`,
-			email, email).Scan(&total)
+			address, address, email).Scan(&total, &bcc)
 		if err != nil {
 			return nil, fmt.Errorf("count unread: %w", err)
 		}
-		if total < 0 {
-			total = 0
-		}
-		if total > int64(^uint32(0)>>1) {
-			total = int64(^uint32(0) >> 1)
-		}
-		counts[email] = int32(total)
+		counts[email] = UnreadCount{Total: clampInt32(total), Bcc: clampInt32(bcc)}
 	}
 	return counts, nil
 }
 
-func (s *Store) ListMessages(ctx context.Context, email, box, search, sort string, offset, limit int32) ([]MessageSummary, int32, error) {
-	if limit <= 0 {
-		limit = 10
+// globEscaper quotes the GLOB metacharacters other than *, which are valid in
+// addresses.
+var globEscaper = strings.NewReplacer("?", "[?]", "[", "[[]")
+
+// addressMatch returns a condition matching column against a mailbox, which
+// may be a wildcard pattern, and the argument to bind for it.
+func addressMatch(column, email string) (string, string) {
+	if !auth.IsEmailPattern(email) {
+		return column + " = ?", email
 	}
-	if offset < 0 {
-		offset = 0
+	return column + " GLOB ?", globEscaper.Replace(email)
+}
+
+// visibleTo returns a condition for messages in table that email sent or
+// received. Its argument is bound twice.
+func visibleTo(table, email string) (string, string) {
+	sender, address := addressMatch(table+".from_email", email)
+	recipient, _ := addressMatch("r.email", email)
+	return "(" + sender + " OR EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = " + table + ".id AND " + recipient + "))", address
+}
+
+func clampInt32(value int64) int32 {
+	if value < 0 {
+		return 0
+	}
+	if value > int64(^uint32(0)>>1) {
+		return int32(^uint32(0) >> 1)
 	}
+	return int32(value)
+}
+
+func (s *Store) ListMessages(ctx context.Context, email, box string, query search.Query, page Page) ([]MessageSummary, PageInfo, error) {
+	page = page.normalize()
 
 	baseQuery := " FROM messages m"
 	whereQuery := ""
@@ -216,51 +384,60 @@ func (s *Store) ListMessages(ctx context.Context, email, box, search, sort strin
 
 	switch box {
 	case "sent":
-		whereQuery = " WHERE m.from_email = ?"
-		args = append(args, email)
+		sender, address := addressMatch("m.from_email", email)
+		whereQuery = " WHERE " + sender
+		args = append(args, address)
+	case "all":
+		whereQuery = " WHERE 1 = 1"
 	default:
-		whereQuery = " WHERE EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = m.id AND r.email = ?)"
-		args = append(args, email)
+		recipient, address := addressMatch("r.email", email)
+		whereQuery = " WHERE EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = m.id AND " + recipient + ")"
+		args = append(args, address)
 	}
 
-	search = strings.TrimSpace(search)
-	if search != "" {
-		whereQuery += " AND (m.subject LIKE ? OR m.from_email LIKE ? OR EXISTS (SELECT 1 FROM recipients r2 WHERE r2.message_id = m.id AND r2.email LIKE ?))"
-		term := "%" + search + "%"
-		args = append(args, term, term, term)
-	}
+	searchQuery, searchArgs := searchClause(query, email)
+	whereQuery += searchQuery
+	args = append(args, searchArgs...)
 
-	countQuery := "SELECT COUNT(1)" + baseQuery + whereQuery
-	var totalCount int64
-	if err := s.db.QueryRowContext(ctx, countQuery, args...).Scan(&totalCount); err != nil {
-		return nil, 0, fmt.Errorf("count messages: %w", err)
-	}
-	if totalCount < 0 {
-		totalCount = 0
-	}
-	if totalCount > int64(^uint32(0)>>1) {
-		totalCount = int64(^uint32(0) >> 1)
+	totalCount := int64(-1)
+	if page.Count {
+		countQuery := "SELECT COUNT(1)" + baseQuery + whereQuery
+		if err := s.read.QueryRowContext(ctx, countQuery, args...).Scan(&totalCount); err != nil {
+			return nil, PageInfo{}, fmt.Errorf("count messages: %w", err)
+		}
+		if totalCount > int64(^uint32(0)>>1) {
+			totalCount = int64(^uint32(0) >> 1)
+		}
 	}
 
+	// Rows are read in traversal order, which is reversed when paging
+	// backwards from a cursor, and finishPage restores the display order.
+	ascending := page.oldestFirst() != page.backward()
+	listArgs := append([]any{}, args...)
 	orderBy := " ORDER BY m.created_at DESC, m.id DESC"
-	switch sort {
-	case "oldest", "asc":
+	if ascending {
 		orderBy = " ORDER BY m.created_at ASC, m.id ASC"
 	}
+	if page.Cursor != nil {
+		if ascending {
+			whereQuery += " AND (m.created_at, m.id) > (?, ?)"
+		} else {
+			whereQuery += " AND (m.created_at, m.id) < (?, ?)"
+		}
+		listArgs = append(listArgs, page.Cursor.CreatedAt.Unix(), page.Cursor.ID)
+	}
 
 	listQuery := `SELECT m.id, m.from_email, m.subject, m.created_at,
 		EXISTS(SELECT 1 FROM attachments a WHERE a.message_id = m.id) as has_attachments` + baseQuery + whereQuery + orderBy + " LIMIT ? OFFSET ?"
-	listArgs := append([]any{}, args...)
-	listArgs = append(listArgs, limit, offset)
+	listArgs = append(listArgs, page.Limit+1, page.Offset)
 
-	rows, err := s.db.QueryContext(ctx, listQuery, listArgs...)
+	rows, err := s.read.QueryContext(ctx, listQuery, listArgs...)
 	if err != nil {
-		return nil, 0, fmt.Errorf("list messages: %w", err)
+		return nil, PageInfo{}, fmt.Errorf("list messages: %w", err)
 	}
 	defer rows.Close()
 
 	var messages []MessageSummary
-	var ids []string
 	for rows.Next() {
 		var summary MessageSummary
 		var createdAt int64
@@ -271,37 +448,110 @@ func (s *Store) ListMessages(ctx context.Context, email, box, search, sort strin
 			&createdAt,
 			&summary.HasAttachments,
 		); err != nil {
-			return nil, 0, fmt.Errorf("scan message: %w", err)
+			return nil, PageInfo{}, fmt.Errorf("scan message: %w", err)
 		}
 		summary.CreatedAt = time.Unix(createdAt, 0)
 		messages = append(messages, summary)
-		ids = append(ids, summary.ID)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, 0, fmt.Errorf("list messages: %w", err)
+		return nil, PageInfo{}, fmt.Errorf("list messages: %w", err)
 	}
 
-	if len(ids) == 0 {
-		return messages, int32(totalCount), nil
+	messages, info := finishPage(page, messages)
+	info.Total = int32(totalCount)
+	if len(messages) == 0 {
+		return messages, info, nil
 	}
 
+	ids := make([]string, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
 	recipients, err := s.listRecipients(ctx, ids)
 	if err != nil {
-		return nil, 0, err
+		return nil, PageInfo{}, err
 	}
 	for i := range messages {
 		messages[i].RecipientGroups = recipients[messages[i].ID]
 	}
-	return messages, int32(totalCount), nil
+	return messages, info, nil
+}
+
+// ListMailbox returns every message in box for email ordered by UID. Sent
+// messages are always reported as seen.
+func (s *Store) ListMailbox(ctx context.Context, email, box string) ([]MailboxEntry, error) {
+	recipient, address := addressMatch("r.email", email)
+	query := `SELECT u.uid, m.id, m.raw_size, m.created_at,
+            EXISTS(SELECT 1 FROM message_reads mr WHERE mr.message_id = m.id AND mr.email = ?)
+        FROM messages m
+        JOIN message_uids u ON u.message_id = m.id
+        WHERE EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = m.id AND ` + recipient + `)
+        ORDER BY u.uid;`
+	args := []any{email, address}
+	if box == "sent" {
+		sender, address := addressMatch("m.from_email", email)
+		query = `SELECT u.uid, m.id, m.raw_size, m.created_at, 1
+        FROM messages m
+        JOIN message_uids u ON u.message_id = m.id
+        WHERE ` + sender + `
+        ORDER BY u.uid;`
+		args = []any{address}
+	}
+
+	rows, err := s.read.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list mailbox: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []MailboxEntry
+	for rows.Next() {
+		var entry MailboxEntry
+		var createdAt int64
+		if err := rows.Scan(&entry.UID, &entry.ID, &entry.Size, &createdAt, &entry.Seen); err != nil {
+			return nil, fmt.Errorf("list mailbox: %w", err)
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list mailbox: %w", err)
+	}
+	return entries, nil
+}
+
+// NextUID returns the UID the next captured message will get.
+func (s *Store) NextUID(ctx context.Context) (uint32, error) {
+	var next uint32
+	err := s.read.QueryRowContext(ctx, `SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'message_uids'), 0) + 1;`).Scan(&next)
+	if err != nil {
+		return 0, fmt.Errorf("next uid: %w", err)
+	}
+	return next, nil
+}
+
+func (s *Store) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := s.read.QueryRowContext(ctx, `SELECT
+        (SELECT COUNT(*) FROM messages),
+        (SELECT COALESCE(SUM(raw_size), 0) FROM messages),
+        (SELECT COUNT(*) FROM attachments),
+        (SELECT COALESCE(SUM(size), 0) FROM attachments);`).Scan(&stats.Messages, &stats.MessageBytes, &stats.Attachments, &stats.AttachmentBytes)
+	if err != nil {
+		return Stats{}, fmt.Errorf("store stats: %w", err)
+	}
+	return stats, nil
 }
 
 func (s *Store) GetMessage(ctx context.Context, email, id string) (Message, []Recipient, []Attachment, error) {
 	var message Message
+	var rawKey string
 	var createdAt int64
-	row := s.db.QueryRowContext(ctx, `SELECT id, from_email, subject, text_body, html_body, raw, raw_size, created_at
+	visible, address := visibleTo("messages", email)
+	row := s.read.QueryRowContext(ctx, `SELECT id, from_email, subject, text_body, html_body, raw, raw_key, raw_size, tls, tls_version, tls_cipher, created_at
         FROM messages
-        WHERE id = ? AND (from_email = ? OR EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = messages.id AND r.email = ?));`,
-		id, email, email)
+        WHERE id = ? AND `+visible+`;`,
+		id, address, address)
 	if err := row.Scan(
 		&message.ID,
 		&message.From,
@@ -309,15 +559,26 @@ func (s *Store) GetMessage(ctx context.Context, email, id string) (Message, []Re
 		&message.TextBody,
 		&message.HTMLBody,
 		&message.Raw,
+		&rawKey,
 		&message.RawSize,
+		&message.TLS,
+		&message.TLSVersion,
+		&message.TLSCipher,
 		&createdAt,
 	); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return Message{}, nil, nil, sql.ErrNoRows
+			return Message{}, nil, nil, ErrNotFound
 		}
 		return Message{}, nil, nil, fmt.Errorf("get message: %w", err)
 	}
 	message.CreatedAt = time.Unix(createdAt, 0)
+	if rawKey != "" {
+		raw, err := s.readBlob(rawKey, message.RawSize)
+		if err != nil {
+			return Message{}, nil, nil, fmt.Errorf("get message: %w", err)
+		}
+		message.Raw = raw
+	}
 
 	recipients, err := s.getRecipients(ctx, id)
 	if err != nil {
@@ -327,13 +588,19 @@ func (s *Store) GetMessage(ctx context.Context, email, id string) (Message, []Re
 	if err != nil {
 		return Message{}, nil, nil, err
 	}
+	envelope, err := s.getEnvelope(ctx, id)
+	if err != nil {
+		return Message{}, nil, nil, err
+	}
+	message.Envelope = envelope
 	return message, recipients, attachments, nil
 }
 
 func (s *Store) DeleteMessage(ctx context.Context, email, id string) (bool, error) {
+	visible, address := visibleTo("messages", email)
 	result, err := s.db.ExecContext(ctx, `DELETE FROM messages
-        WHERE id = ? AND (from_email = ? OR EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = messages.id AND r.email = ?));`,
-		id, email, email)
+        WHERE id = ? AND `+visible+`;`,
+		id, address, address)
 	if err != nil {
 		return false, fmt.Errorf("delete message: %w", err)
 	}
@@ -345,30 +612,93 @@ func (s *Store) DeleteMessage(ctx context.Context, email, id string) (bool, erro
 }
 
 func (s *Store) GetAttachment(ctx context.Context, email string, attachmentID int64) (Attachment, error) {
+	attachment, blobKey, err := s.findAttachment(ctx, email, attachmentID, "a.data")
+	if err != nil {
+		return Attachment{}, err
+	}
+	if blobKey != "" {
+		if attachment.Data, err = s.readBlob(blobKey, attachment.Size); err != nil {
+			return Attachment{}, fmt.Errorf("get attachment: %w", err)
+		}
+	}
+	return attachment, nil
+}
+
+// OpenAttachment streams an attachment's content. The returned Attachment has
+// no Data.
+func (s *Store) OpenAttachment(ctx context.Context, email string, attachmentID int64) (Attachment, io.ReadSeekCloser, error) {
+	attachment, blobKey, err := s.findAttachment(ctx, email, attachmentID, "CASE WHEN a.blob_key = '' THEN a.data ELSE X'' END")
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	data := attachment.Data
+	attachment.Data = nil
+	if blobKey == "" {
+		return attachment, newBytesReader(data), nil
+	}
+	content, err := s.openBlob(blobKey, attachment.Size)
+	if err != nil {
+		return Attachment{}, nil, fmt.Errorf("open attachment: %w", err)
+	}
+	return attachment, content, nil
+}
+
+// findAttachment loads an attachment visible to email, selecting dataColumn
+// as its inline data.
+func (s *Store) findAttachment(ctx context.Context, email string, attachmentID int64, dataColumn string) (Attachment, string, error) {
 	var attachment Attachment
-	row := s.db.QueryRowContext(ctx, `SELECT a.id, a.message_id, a.filename, a.content_type, a.data, a.size
+	var blobKey string
+	visible, address := visibleTo("m", email)
+	row := s.read.QueryRowContext(ctx, `SELECT a.id, a.message_id, a.filename, a.content_type, `+dataColumn+`, a.blob_key, a.size
         FROM attachments a
         JOIN messages m ON m.id = a.message_id
-        WHERE a.id = ? AND (m.from_email = ? OR EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = m.id AND r.email = ?));`,
-		attachmentID, email, email)
+        WHERE a.id = ? AND `+visible+`;`,
+		attachmentID, address, address)
 	if err := row.Scan(
 		&attachment.ID,
 		&attachment.MessageID,
 		&attachment.Filename,
 		&attachment.ContentType,
 		&attachment.Data,
+		&blobKey,
 		&attachment.Size,
 	); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return Attachment{}, sql.ErrNoRows
+			return Attachment{}, "", ErrNotFound
 		}
-		return Attachment{}, fmt.Errorf("get attachment: %w", err)
+		return Attachment{}, "", fmt.Errorf("get attachment: %w", err)
 	}
-	return attachment, nil
+	return attachment, blobKey, nil
+}
+
+// OpenRaw streams the raw message and returns its size.
+func (s *Store) OpenRaw(ctx context.Context, email, id string) (io.ReadSeekCloser, int64, error) {
+	var raw []byte
+	var rawKey string
+	var size int64
+	visible, address := visibleTo("messages", email)
+	row := s.read.QueryRowContext(ctx, `SELECT CASE WHEN raw_key = '' THEN raw ELSE X'' END, raw_key, raw_size
+        FROM messages
+        WHERE id = ? AND `+visible+`;`,
+		id, address, address)
+	if err := row.Scan(&raw, &rawKey, &size); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, 0, ErrNotFound
+		}
+		return nil, 0, fmt.Errorf("open raw message: %w", err)
+	}
+	if rawKey == "" {
+		return newBytesReader(raw), int64(len(raw)), nil
+	}
+	content, err := s.openBlob(rawKey, size)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open raw message: %w", err)
+	}
+	return content, size, nil
 }
 
 func (s *Store) getRecipients(ctx context.Context, messageID string) ([]Recipient, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT email, type FROM recipients WHERE message_id = ? ORDER BY id;`, messageID)
+	rows, err := s.read.QueryContext(ctx, `SELECT email, type FROM recipients WHERE message_id = ? ORDER BY id;`, messageID)
 	if err != nil {
 		return nil, fmt.Errorf("get recipients: %w", err)
 	}
@@ -389,7 +719,7 @@ func (s *Store) getRecipients(ctx context.Context, messageID string) ([]Recipien
 }
 
 func (s *Store) getAttachments(ctx context.Context, messageID string) ([]Attachment, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id, message_id, filename, content_type, size FROM attachments WHERE message_id = ? ORDER BY id;`, messageID)
+	rows, err := s.read.QueryContext(ctx, `SELECT id, message_id, filename, content_type, size FROM attachments WHERE message_id = ? ORDER BY id;`, messageID)
 	if err != nil {
 		return nil, fmt.Errorf("get attachments: %w", err)
 	}
@@ -409,6 +739,79 @@ func (s *Store) getAttachments(ctx context.Context, messageID string) ([]Attachm
 	return attachments, nil
 }
 
+// getEnvelope returns nil for messages captured before envelopes were stored.
+func (s *Store) getEnvelope(ctx context.Context, messageID string) (*Envelope, error) {
+	var envelope Envelope
+	var mailParams string
+	var receivedAt int64
+	row := s.read.QueryRowContext(ctx, `SELECT mail_from, mail_params, helo, remote_addr, auth_username, auth_project, received_at
+        FROM envelopes WHERE message_id = ?;`, messageID)
+	if err := row.Scan(
+		&envelope.MailFrom,
+		&mailParams,
+		&envelope.Helo,
+		&envelope.RemoteAddr,
+		&envelope.AuthUsername,
+		&envelope.AuthProject,
+		&receivedAt,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get envelope: %w", err)
+	}
+	envelope.ReceivedAt = time.UnixMilli(receivedAt)
+	params, err := decodeParams(mailParams)
+	if err != nil {
+		return nil, fmt.Errorf("get envelope: %w", err)
+	}
+	envelope.MailParams = params
+
+	rows, err := s.read.QueryContext(ctx, `SELECT address, params FROM envelope_recipients WHERE message_id = ? ORDER BY id;`, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("get envelope recipients: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recipient EnvelopeRecipient
+		var encoded string
+		if err := rows.Scan(&recipient.Address, &encoded); err != nil {
+			return nil, fmt.Errorf("get envelope recipients: %w", err)
+		}
+		if recipient.Params, err = decodeParams(encoded); err != nil {
+			return nil, fmt.Errorf("get envelope recipients: %w", err)
+		}
+		envelope.Recipients = append(envelope.Recipients, recipient)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get envelope recipients: %w", err)
+	}
+	return &envelope, nil
+}
+
+func encodeParams(params map[string]string) (string, error) {
+	if len(params) == 0 {
+		return "{}", nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func decodeParams(encoded string) (map[string]string, error) {
+	params := map[string]string{}
+	if encoded == "" {
+		return params, nil
+	}
+	if err := json.Unmarshal([]byte(encoded), &params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
 func (s *Store) listRecipients(ctx context.Context, messageIDs []string) (map[string]map[string][]string, error) {
 	if len(messageIDs) == 0 {
 		return map[string]map[string][]string{}, nil
@@ -421,7 +824,7 @@ func (s *Store) listRecipients(ctx context.Context, messageIDs []string) (map[st
 	for i, id := range messageIDs {
 		args[i] = id
 	}
-	rows, err := s.db.QueryContext(ctx, query, args...)
+	rows, err := s.read.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("list recipients: %w", err)
 	}
@@ -0,0 +1,107 @@
+package store_test
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/blobstore"
+	"github.io/razzkumar/localsmtp/internal/store"
+	"github.io/razzkumar/localsmtp/internal/store/storetest"
+)
+
+func TestSQLite(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		return openSQLite(t)
+	})
+}
+
+// openSQLite returns a migrated database in a fresh temporary directory.
+func openSQLite(t *testing.T) *store.Store {
+	t.Helper()
+	db, err := store.Open(t.Context(), filepath.Join(t.TempDir(), "localsmtp.db"), 2)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := db.Migrate(t.Context()); err != nil {
+		db.Close()
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func TestSQLiteBlobStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		db := openSQLite(t)
+		db.SetBlobStore(openBlobs(t))
+		return db
+	})
+}
+
+func TestCollectBlobs(t *testing.T) {
+	ctx := t.Context()
+	db := openSQLite(t)
+	defer db.Close()
+	blobs := openBlobs(t)
+	db.SetBlobStore(blobs)
+
+	logo := store.Attachment{Filename: "logo.png", ContentType: "image/png", Data: []byte("shared logo"), Size: 11}
+	for _, id := range []string{"kept", "deleted"} {
+		raw := []byte("Subject: " + id + "\r\n\r\nbody\r\n")
+		message := store.Message{ID: id, From: "sender@example.com", Subject: id, Raw: raw, RawSize: int64(len(raw)), CreatedAt: time.Now()}
+		recipients := []store.Recipient{{Email: "alice@example.com", Type: "to"}}
+		if err := db.InsertMessage(ctx, message, recipients, []store.Attachment{logo}); err != nil {
+			t.Fatalf("insert %s: %v", id, err)
+		}
+	}
+	orphan, _, err := blobs.Put(strings.NewReader("nobody refers to this"))
+	if err != nil {
+		t.Fatalf("put orphan: %v", err)
+	}
+	if ok, err := db.DeleteMessage(ctx, "alice@example.com", "deleted"); err != nil || !ok {
+		t.Fatalf("delete = %v, %v", ok, err)
+	}
+
+	if removed, err := db.CollectBlobs(ctx, time.Hour); err != nil || removed != 0 {
+		t.Fatalf("CollectBlobs within grace = %d, %v; want 0", removed, err)
+	}
+	// The deleted message's raw and the orphan go; the logo is still
+	// referenced by the kept message.
+	if removed, err := db.CollectBlobs(ctx, 0); err != nil || removed != 2 {
+		t.Fatalf("CollectBlobs = %d, %v; want 2", removed, err)
+	}
+	if _, err := blobs.ReadAll(orphan, 0); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("orphan blob still readable: %v", err)
+	}
+
+	message, _, attachments, err := db.GetMessage(ctx, "alice@example.com", "kept")
+	if err != nil {
+		t.Fatalf("get kept: %v", err)
+	}
+	if !strings.HasPrefix(string(message.Raw), "Subject: kept") {
+		t.Errorf("kept raw = %q", message.Raw)
+	}
+	if len(attachments) != 1 {
+		t.Fatalf("kept attachments = %d, want 1", len(attachments))
+	}
+	_, r, err := db.OpenAttachment(ctx, "alice@example.com", attachments[0].ID)
+	if err != nil {
+		t.Fatalf("open attachment: %v", err)
+	}
+	defer r.Close()
+	if data, err := io.ReadAll(r); err != nil || string(data) != "shared logo" {
+		t.Errorf("attachment = %q, %v", data, err)
+	}
+}
+
+func openBlobs(t *testing.T) *blobstore.Store {
+	t.Helper()
+	blobs, err := blobstore.Open(t.TempDir(), blobstore.CompressionZstd)
+	if err != nil {
+		t.Fatalf("open blob store: %v", err)
+	}
+	return blobs
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/search"
+)
+
+// ErrNotFound is returned when a message or attachment does not exist or is
+// not visible to the requesting mailbox.
+var ErrNotFound = sql.ErrNoRows
+
+// Storage is what the HTTP, SMTP, IMAP and POP3 servers need from a message
+// store. Store keeps mail in SQLite; Memory keeps a bounded number of
+// messages in process for ephemeral runs.
+type Storage interface {
+	UpsertUser(ctx context.Context, email string, now time.Time) error
+	InsertMessage(ctx context.Context, message Message, recipients []Recipient, attachments []Attachment) error
+	// InsertMessages stores every message in the batch or none of them.
+	InsertMessages(ctx context.Context, batch []NewMessage) error
+	// ListMessages lists box for email. box is "inbox", "sent", or "all",
+	// which lists every message regardless of email.
+	ListMessages(ctx context.Context, email, box string, query search.Query, page Page) ([]MessageSummary, PageInfo, error)
+	ListMailbox(ctx context.Context, email, box string) ([]MailboxEntry, error)
+	NextUID(ctx context.Context) (uint32, error)
+	GetMessage(ctx context.Context, email, id string) (Message, []Recipient, []Attachment, error)
+	DeleteMessage(ctx context.Context, email, id string) (bool, error)
+	// PurgeMessages deletes every message email sent or received, or every
+	// message when email is empty, and returns how many were deleted.
+	PurgeMessages(ctx context.Context, email string) (int64, error)
+	ListMailboxes(ctx context.Context) ([]MailboxInfo, error)
+	GetAttachment(ctx context.Context, email string, attachmentID int64) (Attachment, error)
+	OpenAttachment(ctx context.Context, email string, attachmentID int64) (Attachment, io.ReadSeekCloser, error)
+	OpenRaw(ctx context.Context, email, id string) (io.ReadSeekCloser, int64, error)
+	UnreadCounts(ctx context.Context, emails []string) (map[string]UnreadCount, error)
+	// MarkMessageRead records that email read the message and reports
+	// whether it was unread before.
+	MarkMessageRead(ctx context.Context, email, messageID string, now time.Time) (bool, error)
+	MarkMessageUnread(ctx context.Context, email, messageID string) error
+	CreateAPIToken(ctx context.Context, token APIToken) (APIToken, error)
+	APITokenByHash(ctx context.Context, hash string) (APIToken, error)
+	ListAPITokens(ctx context.Context) ([]APIToken, error)
+	DeleteAPIToken(ctx context.Context, name string) (bool, error)
+	TouchAPIToken(ctx context.Context, id int64, at time.Time) error
+	CreateSMTPCredential(ctx context.Context, credential SMTPCredential) (SMTPCredential, error)
+	SMTPCredentialByUsername(ctx context.Context, username string) (SMTPCredential, error)
+	ListSMTPCredentials(ctx context.Context) ([]SMTPCredential, error)
+	DeleteSMTPCredential(ctx context.Context, username string) (bool, error)
+	Stats(ctx context.Context) (Stats, error)
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var (
+	_ Storage = (*Store)(nil)
+	_ Storage = (*Memory)(nil)
+)
@@ -0,0 +1,1076 @@
+// Package storetest checks that a store.Storage implementation behaves like
+// the SQLite store, so the store package's tests can run the same cases
+// against every backend.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/search"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// Run runs every case as a subtest against a fresh backend from open, which
+// should fail t if the backend cannot be opened.
+func Run(t *testing.T, open func(t *testing.T) store.Storage) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			backend := open(t)
+			if err := c.run(t.Context(), backend); err != nil {
+				t.Error(err)
+			}
+			if err := backend.Close(); err != nil {
+				t.Errorf("close: %v", err)
+			}
+		})
+	}
+}
+
+type testCase struct {
+	name string
+	run  func(ctx context.Context, s store.Storage) error
+}
+
+var cases = []testCase{
+	{"ping", checkPing},
+	{"insert and get", checkInsertGet},
+	{"insert batch", checkInsertBatch},
+	{"visibility", checkVisibility},
+	{"list messages", checkListMessages},
+	{"cursor pagination", checkCursorPagination},
+	{"search", checkSearch},
+	{"read state", checkReadState},
+	{"mailbox", checkMailbox},
+	{"delete", checkDelete},
+	{"attachments", checkAttachments},
+	{"streaming", checkStreaming},
+	{"stats", checkStats},
+	{"upsert user", checkUpsertUser},
+	{"api tokens", checkAPITokens},
+	{"all mail", checkAllMail},
+	{"mailbox directory", checkMailboxDirectory},
+	{"purge", checkPurge},
+	{"wildcard mailboxes", checkWildcardMailboxes},
+	{"tag search", checkTagSearch},
+	{"smtp credentials", checkSMTPCredentials},
+}
+
+var base = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// mail describes a message a case stores. Cases spell out the fields they
+// assert on; the raw message is built from the headers and text unless raw
+// is set.
+type mail struct {
+	id          string
+	from        string
+	subject     string
+	text        string
+	html        string
+	raw         []byte
+	at          time.Duration
+	to, cc, bcc []string
+	routed      []string
+	attachments []store.Attachment
+	envelope    *store.Envelope
+}
+
+func (m mail) message() store.Message {
+	raw := m.raw
+	if raw == nil {
+		raw = []byte("From: " + m.from + "\r\nSubject: " + m.subject + "\r\n\r\n" + m.text + "\r\n")
+	}
+	return store.Message{
+		ID:        m.id,
+		From:      m.from,
+		Subject:   m.subject,
+		TextBody:  m.text,
+		HTMLBody:  m.html,
+		Raw:       raw,
+		RawSize:   int64(len(raw)),
+		CreatedAt: base.Add(m.at),
+		Envelope:  m.envelope,
+	}
+}
+
+func (m mail) recipients() []store.Recipient {
+	var recipients []store.Recipient
+	for _, group := range []struct {
+		kind   string
+		emails []string
+	}{{"to", m.to}, {"cc", m.cc}, {"bcc", m.bcc}, {"routed", m.routed}} {
+		for _, email := range group.emails {
+			recipients = append(recipients, store.Recipient{Email: email, Type: group.kind})
+		}
+	}
+	return recipients
+}
+
+// put stores each message with InsertMessage.
+func put(ctx context.Context, s store.Storage, mails ...mail) error {
+	for _, m := range mails {
+		if err := s.InsertMessage(ctx, m.message(), m.recipients(), m.attachments); err != nil {
+			return fmt.Errorf("insert %s: %w", m.id, err)
+		}
+	}
+	return nil
+}
+
+// list returns the ids on the first page of a mailbox, at most ten.
+func list(ctx context.Context, s store.Storage, email, box, query string) (string, error) {
+	messages, _, err := s.ListMessages(ctx, email, box, search.Parse(query), store.Page{Limit: 10})
+	if err != nil {
+		return "", fmt.Errorf("list %s %s %q: %w", email, box, query, err)
+	}
+	return fmt.Sprint(ids(messages)), nil
+}
+
+func checkPing(ctx context.Context, s store.Storage) error {
+	return s.Ping(ctx)
+}
+
+func checkInsertGet(ctx context.Context, s store.Storage) error {
+	m := mail{
+		id:      "m1",
+		from:    "alice@example.com",
+		subject: "Quarterly report",
+		text:    "Numbers for the quarterly review are attached.",
+		html:    "<p>Numbers for the <b>quarterly</b> review</p>",
+		to:      []string{"bob@example.com"},
+		cc:      []string{"carol@example.com"},
+		bcc:     []string{"dave@example.com"},
+		envelope: &store.Envelope{
+			MailFrom:     "alice@example.com",
+			MailParams:   map[string]string{"SIZE": "100", "BODY": "8BITMIME"},
+			Recipients:   []store.EnvelopeRecipient{{Address: "bob@example.com", Params: map[string]string{"NOTIFY": "FAILURE"}}},
+			Helo:         "client.example.com",
+			RemoteAddr:   "127.0.0.1:5000",
+			AuthUsername: "ci",
+			AuthProject:  "web",
+			ReceivedAt:   base,
+		},
+	}
+	if err := put(ctx, s, m); err != nil {
+		return err
+	}
+	want := m.message()
+	got, recipients, attachments, err := s.GetMessage(ctx, "bob@example.com", "m1")
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if got.ID != want.ID || got.From != want.From || got.Subject != want.Subject ||
+		got.TextBody != want.TextBody || got.HTMLBody != want.HTMLBody ||
+		string(got.Raw) != string(want.Raw) || got.RawSize != want.RawSize {
+		return fmt.Errorf("get: message fields differ: %+v", got)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) {
+		return fmt.Errorf("get: created at %v, want %v", got.CreatedAt, want.CreatedAt)
+	}
+	envelope := got.Envelope
+	if envelope == nil || envelope.MailFrom != "alice@example.com" || envelope.Helo != "client.example.com" ||
+		envelope.RemoteAddr != "127.0.0.1:5000" || envelope.AuthUsername != "ci" || envelope.AuthProject != "web" ||
+		fmt.Sprint(envelope.MailParams) != "map[BODY:8BITMIME SIZE:100]" || !envelope.ReceivedAt.Equal(base) {
+		return fmt.Errorf("get: envelope %+v", envelope)
+	}
+	if len(envelope.Recipients) != 1 || envelope.Recipients[0].Address != "bob@example.com" ||
+		envelope.Recipients[0].Params["NOTIFY"] != "FAILURE" {
+		return fmt.Errorf("get: envelope recipients %+v", envelope.Recipients)
+	}
+	if fmt.Sprint(recipients) != fmt.Sprint(m.recipients()) {
+		return fmt.Errorf("get: recipients %v, want %v", recipients, m.recipients())
+	}
+	if len(attachments) != 0 {
+		return fmt.Errorf("get: %d attachments, want 0", len(attachments))
+	}
+
+	// Mail handed over without SMTP has no envelope.
+	plain := mail{id: "m2", from: "alice@example.com", subject: "Hi", to: []string{"bob@example.com"}}
+	if err := put(ctx, s, plain); err != nil {
+		return err
+	}
+	if got, _, _, err := s.GetMessage(ctx, "bob@example.com", "m2"); err != nil || got.Envelope != nil {
+		return fmt.Errorf("get without envelope: envelope %+v, err %v", got.Envelope, err)
+	}
+
+	if err := s.InsertMessage(ctx, want, m.recipients(), nil); err == nil {
+		return errors.New("insert: duplicate id accepted")
+	}
+	return nil
+}
+
+func checkInsertBatch(ctx context.Context, s store.Storage) error {
+	var batch []store.NewMessage
+	for i, id := range []string{"b1", "b2", "b3"} {
+		m := mail{id: id, from: "alice@example.com", subject: "Batch " + id, at: time.Duration(i) * time.Minute, to: []string{"bob@example.com"}}
+		batch = append(batch, store.NewMessage{Message: m.message(), Recipients: m.recipients()})
+	}
+	if err := s.InsertMessages(ctx, batch); err != nil {
+		return fmt.Errorf("insert batch: %w", err)
+	}
+	if got, err := list(ctx, s, "bob@example.com", "inbox", ""); err != nil || got != "[b3 b2 b1]" {
+		return fmt.Errorf("list after batch: got %s, %v, want [b3 b2 b1]", got, err)
+	}
+
+	// A batch with one bad message must store none of them.
+	fresh := mail{id: "b4", from: "alice@example.com", at: 10 * time.Minute, to: []string{"bob@example.com"}}
+	err := s.InsertMessages(ctx, []store.NewMessage{
+		{Message: fresh.message(), Recipients: fresh.recipients()},
+		batch[0],
+	})
+	if err == nil {
+		return errors.New("insert batch: duplicate id accepted")
+	}
+	if _, _, _, err := s.GetMessage(ctx, "bob@example.com", "b4"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("get b4 after failed batch: %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkVisibility(ctx context.Context, s store.Storage) error {
+	m := mail{
+		id: "m1", from: "alice@example.com", subject: "Hello",
+		to: []string{"bob@example.com"}, cc: []string{"carol@example.com"}, bcc: []string{"dave@example.com"},
+	}
+	if err := put(ctx, s, m); err != nil {
+		return err
+	}
+	// The sender and every kind of recipient can open the message.
+	for _, email := range []string{"alice@example.com", "bob@example.com", "carol@example.com", "dave@example.com"} {
+		if _, _, _, err := s.GetMessage(ctx, email, "m1"); err != nil {
+			return fmt.Errorf("get as %s: %w", email, err)
+		}
+	}
+	if _, _, _, err := s.GetMessage(ctx, "eve@example.com", "m1"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("get as stranger: got %v, want ErrNotFound", err)
+	}
+	if _, _, _, err := s.GetMessage(ctx, "bob@example.com", "missing"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("get missing: got %v, want ErrNotFound", err)
+	}
+	// Each mailbox lists only its own side of the conversation.
+	for _, tc := range []struct {
+		email, box, want string
+	}{
+		{"bob@example.com", "inbox", "[m1]"},
+		{"dave@example.com", "inbox", "[m1]"},
+		{"bob@example.com", "sent", "[]"},
+		{"alice@example.com", "inbox", "[]"},
+		{"alice@example.com", "sent", "[m1]"},
+		{"eve@example.com", "inbox", "[]"},
+	} {
+		if got, err := list(ctx, s, tc.email, tc.box, ""); err != nil || got != tc.want {
+			return fmt.Errorf("list %s %s: got %s, %v, want %s", tc.email, tc.box, got, err, tc.want)
+		}
+	}
+	return nil
+}
+
+func checkListMessages(ctx context.Context, s store.Storage) error {
+	for i, id := range []string{"m1", "m2", "m3"} {
+		m := mail{
+			id: id, from: "alice@example.com", subject: "Report " + id, at: time.Duration(i) * time.Minute,
+			to: []string{"bob@example.com"}, cc: []string{"carol@example.com"}, bcc: []string{"dave@example.com"},
+		}
+		if err := put(ctx, s, m); err != nil {
+			return err
+		}
+	}
+
+	messages, info, err := s.ListMessages(ctx, "bob@example.com", "inbox", search.Query{}, store.Page{Limit: 2, Count: true})
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	if info.Total != 3 || len(messages) != 2 || messages[0].ID != "m3" || messages[1].ID != "m2" {
+		return fmt.Errorf("list newest: total %d, got %v", info.Total, ids(messages))
+	}
+	if messages[0].From != "alice@example.com" || messages[0].Subject != "Report m3" || !messages[0].CreatedAt.Equal(base.Add(2*time.Minute)) {
+		return fmt.Errorf("list: summary %+v", messages[0])
+	}
+	groups := messages[0].RecipientGroups
+	if fmt.Sprint(groups["to"]) != "[bob@example.com]" || fmt.Sprint(groups["cc"]) != "[carol@example.com]" ||
+		fmt.Sprint(groups["bcc"]) != "[dave@example.com]" {
+		return fmt.Errorf("list: recipient groups %v", groups)
+	}
+
+	messages, _, err = s.ListMessages(ctx, "bob@example.com", "inbox", search.Query{}, store.Page{Sort: "oldest", Offset: 1, Limit: 10, Count: true})
+	if err != nil {
+		return fmt.Errorf("list oldest: %w", err)
+	}
+	if len(messages) != 2 || messages[0].ID != "m2" || messages[1].ID != "m3" {
+		return fmt.Errorf("list oldest offset 1: got %v", ids(messages))
+	}
+
+	messages, info, err = s.ListMessages(ctx, "alice@example.com", "sent", search.Query{}, store.Page{Limit: 10, Count: true})
+	if err != nil {
+		return fmt.Errorf("list sent: %w", err)
+	}
+	if info.Total != 3 || len(messages) != 3 {
+		return fmt.Errorf("list sent: total %d, got %v", info.Total, ids(messages))
+	}
+
+	messages, info, err = s.ListMessages(ctx, "alice@example.com", "inbox", search.Query{}, store.Page{Limit: 10, Count: true})
+	if err != nil {
+		return fmt.Errorf("list sender inbox: %w", err)
+	}
+	if info.Total != 0 || len(messages) != 0 {
+		return fmt.Errorf("list sender inbox: total %d, got %v", info.Total, ids(messages))
+	}
+	return nil
+}
+
+func checkCursorPagination(ctx context.Context, s store.Storage) error {
+	// m2 and m3 share a timestamp, so the id breaks the tie.
+	for id, at := range map[string]time.Duration{"m1": 0, "m2": time.Minute, "m3": time.Minute, "m4": 2 * time.Minute} {
+		if err := put(ctx, s, mail{id: id, from: "alice@example.com", at: at, to: []string{"bob@example.com"}}); err != nil {
+			return err
+		}
+	}
+	page := func(page store.Page) ([]store.MessageSummary, store.PageInfo, error) {
+		page.Limit = 2
+		return s.ListMessages(ctx, "bob@example.com", "inbox", search.Query{}, page)
+	}
+	// follow round-trips the cursor through its token, as API clients do.
+	follow := func(cursor *store.Cursor) (*store.Cursor, error) {
+		if cursor == nil {
+			return nil, errors.New("missing cursor")
+		}
+		parsed, err := store.ParseCursor(cursor.String())
+		return &parsed, err
+	}
+
+	messages, info, err := page(store.Page{})
+	if err != nil {
+		return fmt.Errorf("first page: %w", err)
+	}
+	if fmt.Sprint(ids(messages)) != "[m4 m3]" || info.Total != -1 || info.Prev != nil {
+		return fmt.Errorf("first page: got %v, total %d, prev %v", ids(messages), info.Total, info.Prev)
+	}
+	next, err := follow(info.Next)
+	if err != nil {
+		return fmt.Errorf("first page next: %w", err)
+	}
+
+	// Mail arriving between pages must not shift the next one.
+	if err := put(ctx, s, mail{id: "m5", from: "alice@example.com", at: 3 * time.Minute, to: []string{"bob@example.com"}}); err != nil {
+		return err
+	}
+	messages, info, err = page(store.Page{Cursor: next})
+	if err != nil {
+		return fmt.Errorf("second page: %w", err)
+	}
+	if fmt.Sprint(ids(messages)) != "[m2 m1]" || info.Next != nil {
+		return fmt.Errorf("second page: got %v, next %v", ids(messages), info.Next)
+	}
+	prev, err := follow(info.Prev)
+	if err != nil {
+		return fmt.Errorf("second page prev: %w", err)
+	}
+
+	messages, info, err = page(store.Page{Cursor: prev})
+	if err != nil {
+		return fmt.Errorf("back to first page: %w", err)
+	}
+	if fmt.Sprint(ids(messages)) != "[m4 m3]" || info.Next == nil || info.Prev == nil {
+		return fmt.Errorf("back to first page: got %v, next %v, prev %v", ids(messages), info.Next, info.Prev)
+	}
+
+	messages, _, err = page(store.Page{Sort: "oldest", Cursor: &store.Cursor{CreatedAt: base.Add(time.Minute), ID: "m2"}})
+	if err != nil {
+		return fmt.Errorf("oldest after m2: %w", err)
+	}
+	if fmt.Sprint(ids(messages)) != "[m3 m4]" {
+		return fmt.Errorf("oldest after m2: got %v", ids(messages))
+	}
+
+	if _, err := store.ParseCursor("not a cursor"); !errors.Is(err, store.ErrInvalidCursor) {
+		return fmt.Errorf("parse garbage: got %v, want ErrInvalidCursor", err)
+	}
+	return nil
+}
+
+func checkSearch(ctx context.Context, s store.Storage) error {
+	report := mail{
+		id:      "m1",
+		from:    "alice@example.com",
+		subject: "Quarterly report",
+		text:    "Numbers for the quarterly review are attached.",
+		to:      []string{"bob@example.com"},
+		cc:      []string{"carol@example.com"},
+	}
+	invoice := mail{
+		id:          "m2",
+		from:        "mallory@example.org",
+		subject:     "Invoice",
+		text:        "Payment overdue",
+		raw:         make([]byte, 4096),
+		at:          48 * time.Hour,
+		to:          []string{"bob@example.com"},
+		attachments: []store.Attachment{{Filename: "invoice.pdf", ContentType: "application/pdf", Data: []byte("%PDF"), Size: 4}},
+	}
+	if err := put(ctx, s, report, invoice); err != nil {
+		return err
+	}
+	if _, err := s.MarkMessageRead(ctx, "bob@example.com", "m2", base); err != nil {
+		return fmt.Errorf("mark read: %w", err)
+	}
+
+	queries := map[string][]string{
+		"quarterly":               {"m1"},
+		"QUARTERLY":               {"m1"},
+		"quart*":                  {"m1"},
+		"quart":                   {},
+		`"quarterly review"`:      {"m1"},
+		`"review quarterly"`:      {},
+		"subject:invoice":         {"m2"},
+		"subject:overdue":         {},
+		"from:mallory":            {"m2"},
+		"-from:mallory":           {"m1"},
+		"to:bob":                  {"m1", "m2"},
+		"cc:carol":                {"m1"},
+		"to:carol":                {},
+		"has:attachment":          {"m2"},
+		"filename:invoice":        {"m2"},
+		"is:unread":               {"m1"},
+		"is:read":                 {"m2"},
+		"after:2024-03-02":        {"m2"},
+		"before:2024-03-02":       {"m1"},
+		"larger:1K":               {"m2"},
+		"smaller:1K":              {"m1"},
+		"overdue from:mallory":    {"m2"},
+		"overdue -has:attachment": {},
+		// A half-typed operator is searched as text rather than rejected.
+		"is:u": {},
+	}
+	for input, want := range queries {
+		messages, info, err := s.ListMessages(ctx, "bob@example.com", "inbox", search.Parse(input), store.Page{Sort: "oldest", Limit: 10, Count: true})
+		if err != nil {
+			return fmt.Errorf("search %q: %w", input, err)
+		}
+		got := ids(messages)
+		if int(info.Total) != len(want) || fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("search %q: got %v (total %d), want %v", input, got, info.Total, want)
+		}
+	}
+	// Search stays inside the mailbox.
+	if got, err := list(ctx, s, "carol@example.com", "inbox", "from:mallory"); err != nil || got != "[]" {
+		return fmt.Errorf("search another mailbox: got %s, %v, want []", got, err)
+	}
+	return nil
+}
+
+func checkReadState(ctx context.Context, s store.Storage) error {
+	for i, id := range []string{"m1", "m2"} {
+		m := mail{
+			id: id, from: "alice@example.com", at: time.Duration(i) * time.Minute,
+			to: []string{"bob@example.com"}, bcc: []string{"dave@example.com"},
+		}
+		if err := put(ctx, s, m); err != nil {
+			return err
+		}
+	}
+	emails := []string{"bob@example.com", "dave@example.com", "eve@example.com"}
+	counts, err := s.UnreadCounts(ctx, emails)
+	if err != nil {
+		return fmt.Errorf("unread counts: %w", err)
+	}
+	want := map[string]store.UnreadCount{
+		"bob@example.com":  {Total: 2},
+		"dave@example.com": {Total: 2, Bcc: 2},
+		"eve@example.com":  {},
+	}
+	for email, count := range want {
+		if counts[email] != count {
+			return fmt.Errorf("unread counts for %s: %+v, want %+v", email, counts[email], count)
+		}
+	}
+
+	// Read state is per mailbox: bob reading m1 leaves dave's copy unread.
+	// Only the first read changes anything.
+	if changed, err := s.MarkMessageRead(ctx, "bob@example.com", "m1", base); err != nil || !changed {
+		return fmt.Errorf("mark read: changed %v, err %v", changed, err)
+	}
+	if changed, err := s.MarkMessageRead(ctx, "bob@example.com", "m1", base.Add(time.Hour)); err != nil || changed {
+		return fmt.Errorf("mark read again: changed %v, err %v", changed, err)
+	}
+	counts, err = s.UnreadCounts(ctx, emails)
+	if err != nil {
+		return fmt.Errorf("unread counts: %w", err)
+	}
+	if counts["bob@example.com"] != (store.UnreadCount{Total: 1}) || counts["dave@example.com"] != (store.UnreadCount{Total: 2, Bcc: 2}) {
+		return fmt.Errorf("unread counts after read: %+v", counts)
+	}
+	if got, err := list(ctx, s, "bob@example.com", "inbox", "is:unread"); err != nil || got != "[m2]" {
+		return fmt.Errorf("bob unread after read: got %s, %v, want [m2]", got, err)
+	}
+	if got, err := list(ctx, s, "dave@example.com", "inbox", "is:unread"); err != nil || got != "[m2 m1]" {
+		return fmt.Errorf("dave unread after bob read: got %s, %v, want [m2 m1]", got, err)
+	}
+
+	if err := s.MarkMessageUnread(ctx, "bob@example.com", "m1"); err != nil {
+		return fmt.Errorf("mark unread: %w", err)
+	}
+	if err := s.MarkMessageUnread(ctx, "bob@example.com", "m1"); err != nil {
+		return fmt.Errorf("mark unread again: %w", err)
+	}
+	if changed, err := s.MarkMessageRead(ctx, "bob@example.com", "m1", base); err != nil || !changed {
+		return fmt.Errorf("mark read after unread: changed %v, err %v", changed, err)
+	}
+	if err := s.MarkMessageUnread(ctx, "bob@example.com", "m1"); err != nil {
+		return fmt.Errorf("mark unread: %w", err)
+	}
+	counts, err = s.UnreadCounts(ctx, emails)
+	if err != nil {
+		return fmt.Errorf("unread counts: %w", err)
+	}
+	if counts["bob@example.com"] != (store.UnreadCount{Total: 2}) {
+		return fmt.Errorf("unread counts after unread: %+v", counts)
+	}
+	return nil
+}
+
+func checkMailbox(ctx context.Context, s store.Storage) error {
+	first, err := s.NextUID(ctx)
+	if err != nil {
+		return fmt.Errorf("next uid: %w", err)
+	}
+	small := mail{id: "m1", from: "alice@example.com", subject: "Small", to: []string{"bob@example.com"}}
+	large := mail{id: "m2", from: "alice@example.com", raw: make([]byte, 2048), at: time.Minute, to: []string{"bob@example.com"}}
+	if err := put(ctx, s, small, large); err != nil {
+		return err
+	}
+	if _, err := s.MarkMessageRead(ctx, "bob@example.com", "m2", base); err != nil {
+		return fmt.Errorf("mark read: %w", err)
+	}
+
+	entries, err := s.ListMailbox(ctx, "bob@example.com", "inbox")
+	if err != nil {
+		return fmt.Errorf("list mailbox: %w", err)
+	}
+	if len(entries) != 2 || entries[0].ID != "m1" || entries[1].ID != "m2" {
+		return fmt.Errorf("list mailbox: got %+v", entries)
+	}
+	if entries[0].UID != first || entries[1].UID <= entries[0].UID {
+		return fmt.Errorf("list mailbox: uids %d, %d, want %d then increasing", entries[0].UID, entries[1].UID, first)
+	}
+	if entries[0].Seen || !entries[1].Seen {
+		return fmt.Errorf("list mailbox: seen flags %v, %v", entries[0].Seen, entries[1].Seen)
+	}
+	if entries[0].Size != small.message().RawSize || entries[1].Size != 2048 {
+		return fmt.Errorf("list mailbox: sizes %d, %d", entries[0].Size, entries[1].Size)
+	}
+
+	// The sender's own mail is always seen.
+	sent, err := s.ListMailbox(ctx, "alice@example.com", "sent")
+	if err != nil {
+		return fmt.Errorf("list sent mailbox: %w", err)
+	}
+	if len(sent) != 2 || !sent[0].Seen || !sent[1].Seen {
+		return fmt.Errorf("list sent mailbox: got %+v", sent)
+	}
+
+	if _, err := s.DeleteMessage(ctx, "bob@example.com", "m2"); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	next, err := s.NextUID(ctx)
+	if err != nil {
+		return fmt.Errorf("next uid: %w", err)
+	}
+	if next != entries[1].UID+1 {
+		return fmt.Errorf("next uid after delete: %d, want %d (uids are never reused)", next, entries[1].UID+1)
+	}
+	return nil
+}
+
+func checkDelete(ctx context.Context, s store.Storage) error {
+	m := mail{id: "m1", from: "alice@example.com", to: []string{"bob@example.com"}, cc: []string{"carol@example.com"}}
+	other := mail{id: "m2", from: "alice@example.com", at: time.Minute, to: []string{"bob@example.com"}}
+	if err := put(ctx, s, m, other); err != nil {
+		return err
+	}
+	deleted, err := s.DeleteMessage(ctx, "eve@example.com", "m1")
+	if err != nil || deleted {
+		return fmt.Errorf("delete as stranger: deleted %v, err %v", deleted, err)
+	}
+	// Deleting removes the message for every mailbox, not just the caller's.
+	deleted, err = s.DeleteMessage(ctx, "carol@example.com", "m1")
+	if err != nil || !deleted {
+		return fmt.Errorf("delete as recipient: deleted %v, err %v", deleted, err)
+	}
+	if _, _, _, err := s.GetMessage(ctx, "bob@example.com", "m1"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("get after delete: got %v, want ErrNotFound", err)
+	}
+	if got, err := list(ctx, s, "bob@example.com", "inbox", ""); err != nil || got != "[m2]" {
+		return fmt.Errorf("list after delete: got %s, %v, want [m2]", got, err)
+	}
+	deleted, err = s.DeleteMessage(ctx, "bob@example.com", "m1")
+	if err != nil || deleted {
+		return fmt.Errorf("delete twice: deleted %v, err %v", deleted, err)
+	}
+	return nil
+}
+
+func checkAttachments(ctx context.Context, s store.Storage) error {
+	data := []byte("hello, world")
+	m := mail{
+		id: "m1", from: "alice@example.com", to: []string{"bob@example.com"}, bcc: []string{"dave@example.com"},
+		attachments: []store.Attachment{{Filename: "hello.txt", ContentType: "text/plain", Data: data, Size: int64(len(data))}},
+	}
+	plain := mail{id: "m2", from: "alice@example.com", at: time.Minute, to: []string{"bob@example.com"}}
+	if err := put(ctx, s, m, plain); err != nil {
+		return err
+	}
+	_, _, attachments, err := s.GetMessage(ctx, "bob@example.com", "m1")
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if len(attachments) != 1 || attachments[0].ID == 0 || attachments[0].MessageID != "m1" ||
+		attachments[0].Filename != "hello.txt" || attachments[0].Size != int64(len(data)) {
+		return fmt.Errorf("get: attachments %+v", attachments)
+	}
+	id := attachments[0].ID
+
+	attachment, err := s.GetAttachment(ctx, "dave@example.com", id)
+	if err != nil {
+		return fmt.Errorf("get attachment: %w", err)
+	}
+	if string(attachment.Data) != string(data) || attachment.ContentType != "text/plain" {
+		return fmt.Errorf("get attachment: got %+v", attachment)
+	}
+	if _, err := s.GetAttachment(ctx, "eve@example.com", id); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("get attachment as stranger: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetAttachment(ctx, "bob@example.com", id+1000); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("get missing attachment: got %v, want ErrNotFound", err)
+	}
+
+	messages, _, err := s.ListMessages(ctx, "bob@example.com", "inbox", search.Query{}, store.Page{Sort: "oldest", Limit: 10})
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	if len(messages) != 2 || !messages[0].HasAttachments || messages[1].HasAttachments {
+		return fmt.Errorf("list: has attachments misreported: %+v", messages)
+	}
+	return nil
+}
+
+func checkStreaming(ctx context.Context, s store.Storage) error {
+	data := []byte("0123456789abcdefghij")
+	m := mail{
+		id: "m1", from: "alice@example.com", subject: "Stream", text: strings.Repeat("line\r\n", 100),
+		to:          []string{"bob@example.com"},
+		attachments: []store.Attachment{{Filename: "a.txt", ContentType: "text/plain", Data: data, Size: int64(len(data))}},
+	}
+	if err := put(ctx, s, m); err != nil {
+		return err
+	}
+	want := m.message()
+
+	raw, size, err := s.OpenRaw(ctx, "bob@example.com", "m1")
+	if err != nil {
+		return fmt.Errorf("open raw: %w", err)
+	}
+	got, err := io.ReadAll(raw)
+	raw.Close()
+	if err != nil || string(got) != string(want.Raw) || size != want.RawSize {
+		return fmt.Errorf("open raw: got %d bytes (size %d, err %v), want %d", len(got), size, err, want.RawSize)
+	}
+	if _, _, err := s.OpenRaw(ctx, "eve@example.com", "m1"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("open raw as stranger: got %v, want ErrNotFound", err)
+	}
+
+	_, _, attachments, err := s.GetMessage(ctx, "bob@example.com", "m1")
+	if err != nil || len(attachments) != 1 {
+		return fmt.Errorf("get: %d attachments, err %v", len(attachments), err)
+	}
+	attachment, content, err := s.OpenAttachment(ctx, "bob@example.com", attachments[0].ID)
+	if err != nil {
+		return fmt.Errorf("open attachment: %w", err)
+	}
+	defer content.Close()
+	if attachment.Filename != "a.txt" || attachment.Size != int64(len(data)) {
+		return fmt.Errorf("open attachment: got %+v", attachment)
+	}
+	// Read out of order, as HTTP Range requests do.
+	for _, span := range [][2]int64{{10, 5}, {2, 3}, {15, 5}, {0, 20}} {
+		if _, err := content.Seek(span[0], io.SeekStart); err != nil {
+			return fmt.Errorf("seek attachment: %w", err)
+		}
+		buf := make([]byte, span[1])
+		if _, err := io.ReadFull(content, buf); err != nil {
+			return fmt.Errorf("read attachment at %d: %w", span[0], err)
+		}
+		if string(buf) != string(data[span[0]:span[0]+span[1]]) {
+			return fmt.Errorf("read attachment at %d: got %q", span[0], buf)
+		}
+	}
+	if end, err := content.Seek(0, io.SeekEnd); err != nil || end != int64(len(data)) {
+		return fmt.Errorf("seek attachment end: %d, err %v", end, err)
+	}
+	if _, _, err := s.OpenAttachment(ctx, "eve@example.com", attachments[0].ID); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("open attachment as stranger: got %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkStats(ctx context.Context, s store.Storage) error {
+	if stats, err := s.Stats(ctx); err != nil || stats != (store.Stats{}) {
+		return fmt.Errorf("stats when empty: got %+v, %v", stats, err)
+	}
+	data := []byte("0123456789")
+	first := mail{
+		id: "m1", from: "alice@example.com", text: "first", to: []string{"bob@example.com"},
+		attachments: []store.Attachment{{Filename: "a.bin", Data: data, Size: int64(len(data))}},
+	}
+	second := mail{id: "m2", from: "alice@example.com", raw: make([]byte, 300), at: time.Minute, to: []string{"bob@example.com"}}
+	if err := put(ctx, s, first, second); err != nil {
+		return err
+	}
+	stats, err := s.Stats(ctx)
+	if err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	want := store.Stats{Messages: 2, MessageBytes: first.message().RawSize + 300, Attachments: 1, AttachmentBytes: int64(len(data))}
+	if stats != want {
+		return fmt.Errorf("stats: got %+v, want %+v", stats, want)
+	}
+
+	if _, err := s.DeleteMessage(ctx, "bob@example.com", "m1"); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	stats, err = s.Stats(ctx)
+	if err != nil {
+		return fmt.Errorf("stats after delete: %w", err)
+	}
+	if want := (store.Stats{Messages: 1, MessageBytes: 300}); stats != want {
+		return fmt.Errorf("stats after delete: got %+v, want %+v", stats, want)
+	}
+	return nil
+}
+
+func checkUpsertUser(ctx context.Context, s store.Storage) error {
+	if err := s.UpsertUser(ctx, "bob@example.com", base); err != nil {
+		return fmt.Errorf("upsert: %w", err)
+	}
+	if err := s.UpsertUser(ctx, "bob@example.com", base.Add(time.Hour)); err != nil {
+		return fmt.Errorf("upsert again: %w", err)
+	}
+	// The second login updates the one row rather than adding another.
+	mailboxes, err := s.ListMailboxes(ctx)
+	if err != nil {
+		return fmt.Errorf("list mailboxes: %w", err)
+	}
+	if len(mailboxes) != 1 || mailboxes[0].Email != "bob@example.com" || !mailboxes[0].LastLogin.Equal(base.Add(time.Hour)) {
+		return fmt.Errorf("list mailboxes: got %+v", mailboxes)
+	}
+	return nil
+}
+
+func checkAPITokens(ctx context.Context, s store.Storage) error {
+	ci, err := s.CreateAPIToken(ctx, store.APIToken{
+		Name: "ci", Hash: "hash-ci", Prefix: "lsmtp_ab",
+		Mailboxes: []string{"bob@example.com", "carol@example.com"}, CreatedAt: base,
+	})
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if ci.ID == 0 {
+		return errors.New("create: token has no id")
+	}
+	if _, err := s.CreateAPIToken(ctx, store.APIToken{Name: "admin", Hash: "hash-admin", Admin: true, CreatedAt: base}); err != nil {
+		return fmt.Errorf("create admin: %w", err)
+	}
+	if _, err := s.CreateAPIToken(ctx, store.APIToken{Name: "ci", Hash: "hash-other", CreatedAt: base}); !errors.Is(err, store.ErrTokenExists) {
+		return fmt.Errorf("create duplicate: got %v, want ErrTokenExists", err)
+	}
+
+	found, err := s.APITokenByHash(ctx, "hash-ci")
+	if err != nil {
+		return fmt.Errorf("by hash: %w", err)
+	}
+	if found.ID != ci.ID || found.Name != "ci" || found.Prefix != "lsmtp_ab" || found.Admin ||
+		fmt.Sprint(found.Mailboxes) != "[bob@example.com carol@example.com]" ||
+		!found.CreatedAt.Equal(base) || !found.LastUsedAt.IsZero() {
+		return fmt.Errorf("by hash: got %+v", found)
+	}
+	if _, err := s.APITokenByHash(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("by unknown hash: got %v, want ErrNotFound", err)
+	}
+
+	if err := s.TouchAPIToken(ctx, ci.ID, base.Add(time.Hour)); err != nil {
+		return fmt.Errorf("touch: %w", err)
+	}
+	tokens, err := s.ListAPITokens(ctx)
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	if len(tokens) != 2 || tokens[0].Name != "admin" || !tokens[0].Admin || tokens[1].Name != "ci" ||
+		!tokens[1].LastUsedAt.Equal(base.Add(time.Hour)) {
+		return fmt.Errorf("list: got %+v", tokens)
+	}
+
+	if deleted, err := s.DeleteAPIToken(ctx, "ci"); err != nil || !deleted {
+		return fmt.Errorf("delete: got %v, %v", deleted, err)
+	}
+	if deleted, err := s.DeleteAPIToken(ctx, "ci"); err != nil || deleted {
+		return fmt.Errorf("delete again: got %v, %v", deleted, err)
+	}
+	if _, err := s.APITokenByHash(ctx, "hash-ci"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("by hash after delete: got %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkSMTPCredentials(ctx context.Context, s store.Storage) error {
+	ci, err := s.CreateSMTPCredential(ctx, store.SMTPCredential{
+		Username: "ci", PasswordHash: "hash-ci", AllowedSenders: []string{"noreply@example.com", "*@ci.example.com"},
+		RatePerHour: 100, Project: "web", CreatedAt: base,
+	})
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if ci.ID == 0 {
+		return errors.New("create: credential has no id")
+	}
+	if _, err := s.CreateSMTPCredential(ctx, store.SMTPCredential{Username: "app", PasswordHash: "hash-app", CreatedAt: base}); err != nil {
+		return fmt.Errorf("create app: %w", err)
+	}
+	if _, err := s.CreateSMTPCredential(ctx, store.SMTPCredential{Username: "ci", PasswordHash: "other", CreatedAt: base}); !errors.Is(err, store.ErrCredentialExists) {
+		return fmt.Errorf("create duplicate: got %v, want ErrCredentialExists", err)
+	}
+
+	found, err := s.SMTPCredentialByUsername(ctx, "ci")
+	if err != nil {
+		return fmt.Errorf("by username: %w", err)
+	}
+	if found.ID != ci.ID || found.PasswordHash != "hash-ci" || fmt.Sprint(found.AllowedSenders) != "[noreply@example.com *@ci.example.com]" ||
+		found.RatePerHour != 100 || found.Project != "web" || !found.CreatedAt.Equal(base) {
+		return fmt.Errorf("by username: got %+v", found)
+	}
+	if _, err := s.SMTPCredentialByUsername(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("by unknown username: got %v, want ErrNotFound", err)
+	}
+	credentials, err := s.ListSMTPCredentials(ctx)
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	if len(credentials) != 2 || credentials[0].Username != "app" || credentials[0].AllowedSenders != nil || credentials[1].Username != "ci" {
+		return fmt.Errorf("list: got %+v", credentials)
+	}
+
+	if deleted, err := s.DeleteSMTPCredential(ctx, "ci"); err != nil || !deleted {
+		return fmt.Errorf("delete: got %v, %v", deleted, err)
+	}
+	if deleted, err := s.DeleteSMTPCredential(ctx, "ci"); err != nil || deleted {
+		return fmt.Errorf("delete again: got %v, %v", deleted, err)
+	}
+	if _, err := s.SMTPCredentialByUsername(ctx, "ci"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("by username after delete: got %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkAllMail(ctx context.Context, s store.Storage) error {
+	toBob := mail{id: "m1", from: "alice@example.com", to: []string{"bob@example.com"}}
+	toEve := mail{id: "e1", from: "frank@example.com", at: time.Minute, to: []string{"eve@example.com"}}
+	if err := put(ctx, s, toBob, toEve); err != nil {
+		return err
+	}
+	if _, err := s.MarkMessageRead(ctx, "bob@example.com", "m1", base); err != nil {
+		return fmt.Errorf("mark read: %w", err)
+	}
+	for _, tc := range []struct {
+		search string
+		want   string
+	}{
+		{"", "[e1 m1]"},
+		{"is:read", "[m1]"},
+		{"is:unread", "[e1]"},
+		{"from:frank", "[e1]"},
+	} {
+		// The email is ignored for the "all" box.
+		messages, info, err := s.ListMessages(ctx, "bob@example.com", "all", search.Parse(tc.search), store.Page{Limit: 10, Count: true})
+		if err != nil {
+			return fmt.Errorf("list all %q: %w", tc.search, err)
+		}
+		if got := fmt.Sprint(ids(messages)); got != tc.want || int(info.Total) != len(messages) {
+			return fmt.Errorf("list all %q: got %s (total %d), want %s", tc.search, got, info.Total, tc.want)
+		}
+	}
+	return nil
+}
+
+func checkMailboxDirectory(ctx context.Context, s store.Storage) error {
+	if err := s.UpsertUser(ctx, "zoe@example.com", base); err != nil {
+		return fmt.Errorf("upsert: %w", err)
+	}
+	for i, id := range []string{"m1", "m2"} {
+		m := mail{
+			id: id, from: "alice@example.com", at: time.Duration(i) * time.Minute,
+			to: []string{"bob@example.com"}, cc: []string{"carol@example.com"}, bcc: []string{"dave@example.com"},
+		}
+		if err := put(ctx, s, m); err != nil {
+			return err
+		}
+	}
+	if _, err := s.MarkMessageRead(ctx, "bob@example.com", "m1", base); err != nil {
+		return fmt.Errorf("mark read: %w", err)
+	}
+	mailboxes, err := s.ListMailboxes(ctx)
+	if err != nil {
+		return fmt.Errorf("list mailboxes: %w", err)
+	}
+	// Senders who never logged in have no inbox and are not listed.
+	latest := base.Add(time.Minute)
+	want := []store.MailboxInfo{
+		{Email: "bob@example.com", Messages: 2, Unread: 1, LastMessageAt: latest},
+		{Email: "carol@example.com", Messages: 2, Unread: 2, LastMessageAt: latest},
+		{Email: "dave@example.com", Messages: 2, Unread: 2, LastMessageAt: latest},
+		{Email: "zoe@example.com", LastLogin: base},
+	}
+	if len(mailboxes) != len(want) {
+		return fmt.Errorf("list mailboxes: got %+v, want %+v", mailboxes, want)
+	}
+	for i := range want {
+		got := mailboxes[i]
+		if got.Email != want[i].Email || got.Messages != want[i].Messages || got.Unread != want[i].Unread ||
+			!got.LastMessageAt.Equal(want[i].LastMessageAt) || !got.LastLogin.Equal(want[i].LastLogin) {
+			return fmt.Errorf("list mailboxes: entry %d is %+v, want %+v", i, got, want[i])
+		}
+	}
+	return nil
+}
+
+func checkPurge(ctx context.Context, s store.Storage) error {
+	shared := mail{id: "m1", from: "alice@example.com", to: []string{"bob@example.com"}, cc: []string{"carol@example.com"}}
+	fromCarol := mail{id: "m2", from: "carol@example.com", at: time.Minute, to: []string{"bob@example.com"}}
+	unrelated := mail{id: "e1", from: "frank@example.com", at: 2 * time.Minute, to: []string{"eve@example.com"}}
+	if err := put(ctx, s, shared, fromCarol, unrelated); err != nil {
+		return err
+	}
+	// Purging a mailbox removes what it sent and received, for everyone,
+	// like a delete.
+	if removed, err := s.PurgeMessages(ctx, "carol@example.com"); err != nil || removed != 2 {
+		return fmt.Errorf("purge mailbox: got %d, %v, want 2", removed, err)
+	}
+	if got, err := list(ctx, s, "bob@example.com", "inbox", ""); err != nil || got != "[]" {
+		return fmt.Errorf("list after purge: got %s, %v, want []", got, err)
+	}
+	if _, _, _, err := s.GetMessage(ctx, "eve@example.com", "e1"); err != nil {
+		return fmt.Errorf("get unrelated after purge: %w", err)
+	}
+	if removed, err := s.PurgeMessages(ctx, "nobody@example.com"); err != nil || removed != 0 {
+		return fmt.Errorf("purge empty mailbox: got %d, %v, want 0", removed, err)
+	}
+	if removed, err := s.PurgeMessages(ctx, ""); err != nil || removed != 1 {
+		return fmt.Errorf("purge all: got %d, %v, want 1", removed, err)
+	}
+	if got, err := list(ctx, s, "", "all", ""); err != nil || got != "[]" {
+		return fmt.Errorf("list all after purge: got %s, %v, want []", got, err)
+	}
+	return nil
+}
+
+func checkWildcardMailboxes(ctx context.Context, s store.Storage) error {
+	mails := []mail{{
+		id: "m1", from: "alice@example.com",
+		to: []string{"bob@example.com"}, cc: []string{"carol@example.com"}, bcc: []string{"dave@example.com"},
+	}}
+	for i, to := range []string{"qa+signup@example.com", "a?b@example.com", "axb@example.com"} {
+		mails = append(mails, mail{id: fmt.Sprintf("q%d", i+1), from: "alice@example.com", at: time.Duration(i+1) * time.Minute, to: []string{to}})
+	}
+	if err := put(ctx, s, mails...); err != nil {
+		return err
+	}
+	for _, tc := range []struct {
+		email, box, want string
+	}{
+		{"*@example.com", "inbox", "[q3 q2 q1 m1]"},
+		{"qa+*@example.com", "inbox", "[q1]"},
+		{"b*@example.com", "inbox", "[m1]"},
+		// ? is a literal character in addresses, not a wildcard.
+		{"a?*@example.com", "inbox", "[q2]"},
+		{"al*@example.com", "sent", "[q3 q2 q1 m1]"},
+		{"*@other.example", "inbox", "[]"},
+	} {
+		if got, err := list(ctx, s, tc.email, tc.box, ""); err != nil || got != tc.want {
+			return fmt.Errorf("list %s %s: got %s, %v, want %s", tc.email, tc.box, got, err, tc.want)
+		}
+	}
+
+	// A wildcard mailbox has its own read state.
+	if _, err := s.MarkMessageRead(ctx, "*@example.com", "q1", base); err != nil {
+		return fmt.Errorf("mark read: %w", err)
+	}
+	counts, err := s.UnreadCounts(ctx, []string{"*@example.com", "d*@example.com", "qa+*@example.com"})
+	if err != nil {
+		return fmt.Errorf("unread counts: %w", err)
+	}
+	if got := counts["*@example.com"]; got.Total != 3 || got.Bcc != 0 {
+		return fmt.Errorf("unread *@example.com: got %+v, want 3 total", got)
+	}
+	if got := counts["d*@example.com"]; got.Total != 1 || got.Bcc != 1 {
+		return fmt.Errorf("unread d*@example.com: got %+v, want 1 bcc", got)
+	}
+	if got := counts["qa+*@example.com"]; got.Total != 1 {
+		return fmt.Errorf("unread qa+*@example.com: got %+v, want 1", got)
+	}
+
+	if _, _, _, err := s.GetMessage(ctx, "qa+*@example.com", "q1"); err != nil {
+		return fmt.Errorf("get as wildcard: %w", err)
+	}
+	if _, _, _, err := s.GetMessage(ctx, "qa+*@example.com", "m1"); !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("get outside wildcard: got %v, want ErrNotFound", err)
+	}
+	entries, err := s.ListMailbox(ctx, "*@example.com", "inbox")
+	if err != nil {
+		return fmt.Errorf("list mailbox: %w", err)
+	}
+	if len(entries) != 4 || entries[0].ID != "m1" || !entries[1].Seen || entries[2].Seen {
+		return fmt.Errorf("list mailbox: got %+v", entries)
+	}
+	return nil
+}
+
+func checkTagSearch(ctx context.Context, s store.Storage) error {
+	// A sub-addressed message as routed at ingest: the base mailbox gets a
+	// routed copy, which is not a blind copy.
+	plain := mail{id: "m1", from: "alice@example.com", to: []string{"bob@example.com"}}
+	tagged := mail{id: "t1", from: "alice@example.com", at: time.Minute, to: []string{"qa+signup@example.com"}, routed: []string{"qa@example.com"}}
+	if err := put(ctx, s, plain, tagged); err != nil {
+		return err
+	}
+	counts, err := s.UnreadCounts(ctx, []string{"qa@example.com"})
+	if err != nil {
+		return fmt.Errorf("unread counts: %w", err)
+	}
+	if counts["qa@example.com"] != (store.UnreadCount{Total: 1}) {
+		return fmt.Errorf("routed unread count: %+v, want {Total:1}", counts["qa@example.com"])
+	}
+	for _, tc := range []struct {
+		email, search, want string
+	}{
+		{"qa@example.com", "", "[t1]"},
+		{"qa@example.com", "tag:signup", "[t1]"},
+		{"qa@example.com", "tag:+SIGNUP", "[t1]"},
+		{"qa@example.com", "tag:sign", "[]"},
+		{"qa@example.com", "-tag:signup", "[]"},
+		{"bob@example.com", "tag:signup", "[]"},
+	} {
+		if got, err := list(ctx, s, tc.email, "inbox", tc.search); err != nil || got != tc.want {
+			return fmt.Errorf("list %s %q: got %s, %v, want %s", tc.email, tc.search, got, err, tc.want)
+		}
+	}
+	return nil
+}
+
+func ids(messages []store.MessageSummary) []string {
+	result := make([]string, 0, len(messages))
+	for _, message := range messages {
+		result = append(result, message.ID)
+	}
+	return result
+}
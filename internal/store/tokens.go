@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrTokenExists is returned when an API token with the same name exists.
+var ErrTokenExists = errors.New("api token already exists")
+
+// APIToken is a named bearer token. Only the SHA-256 hash of the secret is
+// kept, so a lost token has to be replaced.
+type APIToken struct {
+	ID   int64
+	Name string
+	Hash string
+	// Prefix is the start of the secret, enough to tell tokens apart.
+	Prefix string
+	// Mailboxes the token may act as. Admin tokens may act as any mailbox.
+	Mailboxes  []string
+	Admin      bool
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// CreateAPIToken stores token and returns it with its ID set.
+func (s *Store) CreateAPIToken(ctx context.Context, token APIToken) (APIToken, error) {
+	result, err := s.db.ExecContext(ctx, `INSERT INTO api_tokens
+        (name, token_hash, prefix, mailboxes, admin, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT DO NOTHING;`,
+		token.Name, token.Hash, token.Prefix, strings.Join(token.Mailboxes, ","), token.Admin, token.CreatedAt.Unix())
+	if err != nil {
+		return APIToken{}, fmt.Errorf("create api token: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return APIToken{}, fmt.Errorf("create api token: %w", err)
+	} else if affected == 0 {
+		return APIToken{}, ErrTokenExists
+	}
+	if token.ID, err = result.LastInsertId(); err != nil {
+		return APIToken{}, fmt.Errorf("create api token: %w", err)
+	}
+	token.CreatedAt = time.Unix(token.CreatedAt.Unix(), 0)
+	return token, nil
+}
+
+// APITokenByHash returns the token whose secret hashes to hash.
+func (s *Store) APITokenByHash(ctx context.Context, hash string) (APIToken, error) {
+	tokens, err := s.queryAPITokens(ctx, `WHERE token_hash = ?`, hash)
+	if err != nil {
+		return APIToken{}, err
+	}
+	if len(tokens) == 0 {
+		return APIToken{}, ErrNotFound
+	}
+	return tokens[0], nil
+}
+
+// ListAPITokens returns every token, ordered by name.
+func (s *Store) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	return s.queryAPITokens(ctx, `ORDER BY name`)
+}
+
+// DeleteAPIToken revokes the token called name. It reports whether the
+// token existed.
+func (s *Store) DeleteAPIToken(ctx context.Context, name string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM api_tokens WHERE name = ?;`, name)
+	if err != nil {
+		return false, fmt.Errorf("delete api token: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete api token: %w", err)
+	}
+	return affected > 0, nil
+}
+
+// TouchAPIToken records that token id was used at.
+func (s *Store) TouchAPIToken(ctx context.Context, id int64, at time.Time) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE api_tokens SET last_used_at = ? WHERE id = ?;`, at.Unix(), id); err != nil {
+		return fmt.Errorf("touch api token: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) queryAPITokens(ctx context.Context, clause string, args ...any) ([]APIToken, error) {
+	rows, err := s.read.QueryContext(ctx, `SELECT id, name, token_hash, prefix, mailboxes, admin, created_at, last_used_at
+        FROM api_tokens `+clause+`;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query api tokens: %w", err)
+	}
+	defer rows.Close()
+	var tokens []APIToken
+	for rows.Next() {
+		var token APIToken
+		var mailboxes string
+		var createdAt, lastUsedAt int64
+		if err := rows.Scan(&token.ID, &token.Name, &token.Hash, &token.Prefix, &mailboxes, &token.Admin, &createdAt, &lastUsedAt); err != nil {
+			return nil, fmt.Errorf("scan api token: %w", err)
+		}
+		if mailboxes != "" {
+			token.Mailboxes = strings.Split(mailboxes, ",")
+		}
+		token.CreatedAt = time.Unix(createdAt, 0)
+		if lastUsedAt > 0 {
+			token.LastUsedAt = time.Unix(lastUsedAt, 0)
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query api tokens: %w", err)
+	}
+	return tokens, nil
+}
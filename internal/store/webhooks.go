@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Webhook delivery states. A delivery stays pending until it succeeds or
+// runs out of attempts.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event queued for one webhook. The payload is fixed
+// when the event happens, so every retry sends the same body. With
+// IncludeRaw the raw message is not copied into it; it is read when the
+// delivery is sent, from the blob RawKey or else from the message row.
+type WebhookDelivery struct {
+	ID            int64
+	Webhook       string
+	Event         string
+	MessageID     string
+	URL           string
+	Payload       []byte
+	IncludeRaw    bool
+	RawKey        string
+	RawSize       int64
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastAttemptAt time.Time
+	ResponseCode  int
+	LastError     string
+	CreatedAt     time.Time
+}
+
+// DeliveryFilter narrows ListWebhookDeliveries. Empty fields match anything.
+type DeliveryFilter struct {
+	Webhook string
+	Status  string
+	Limit   int
+}
+
+// EnqueueWebhookDeliveries stores pending deliveries, due immediately.
+func (s *Store) EnqueueWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("enqueue webhook deliveries: begin tx: %w", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO webhook_deliveries
+        (webhook, event, message_id, url, payload, include_raw, raw_key, raw_size, status, next_attempt_at, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		return fmt.Errorf("enqueue webhook deliveries: %w", err)
+	}
+	defer stmt.Close()
+	for _, delivery := range deliveries {
+		if _, err := stmt.ExecContext(ctx, delivery.Webhook, delivery.Event, delivery.MessageID, delivery.URL,
+			delivery.Payload, delivery.IncludeRaw, delivery.RawKey, delivery.RawSize, DeliveryPending, delivery.CreatedAt.UnixMilli(), delivery.CreatedAt.UnixMilli()); err != nil {
+			return fmt.Errorf("enqueue webhook delivery: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("enqueue webhook deliveries: commit: %w", err)
+	}
+	return nil
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries whose next
+// attempt is at or before now, oldest first.
+func (s *Store) DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	return s.queryWebhookDeliveries(ctx, `WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?`,
+		DeliveryPending, now.UnixMilli(), limit)
+}
+
+// NextWebhookDelivery reports when the earliest pending delivery is due. ok
+// is false when nothing is pending.
+func (s *Store) NextWebhookDelivery(ctx context.Context) (due time.Time, ok bool, err error) {
+	var at *int64
+	err = s.read.QueryRowContext(ctx, `SELECT MIN(next_attempt_at) FROM webhook_deliveries WHERE status = ?;`,
+		DeliveryPending).Scan(&at)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("next webhook delivery: %w", err)
+	}
+	if at == nil {
+		return time.Time{}, false, nil
+	}
+	return time.UnixMilli(*at), true, nil
+}
+
+// RecordWebhookAttempt stores the outcome of sending delivery. Status,
+// NextAttemptAt, ResponseCode and LastError are taken from delivery, and
+// Attempts is incremented.
+func (s *Store) RecordWebhookAttempt(ctx context.Context, delivery WebhookDelivery, attemptedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE webhook_deliveries
+        SET status = ?, attempts = attempts + 1, next_attempt_at = ?, last_attempt_at = ?,
+            response_code = ?, last_error = ?
+        WHERE id = ?;`,
+		delivery.Status, delivery.NextAttemptAt.UnixMilli(), attemptedAt.UnixMilli(),
+		delivery.ResponseCode, delivery.LastError, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("record webhook attempt: %w", err)
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns the delivery log, newest first.
+func (s *Store) ListWebhookDeliveries(ctx context.Context, filter DeliveryFilter) ([]WebhookDelivery, error) {
+	var where []string
+	var args []any
+	if filter.Webhook != "" {
+		where = append(where, "webhook = ?")
+		args = append(args, filter.Webhook)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = "WHERE " + strings.Join(where, " AND ")
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = 50
+	}
+	args = append(args, filter.Limit)
+	return s.queryWebhookDeliveries(ctx, clause+" ORDER BY id DESC LIMIT ?", args...)
+}
+
+// ReadDeliveryRaw returns the raw message for a delivery with IncludeRaw.
+// CollectBlobs keeps RawKey while the delivery is pending; without a key the
+// message is read by ID, and ErrNotFound means it has since been deleted.
+func (s *Store) ReadDeliveryRaw(ctx context.Context, delivery WebhookDelivery) ([]byte, error) {
+	if delivery.RawKey != "" {
+		raw, err := s.readBlob(delivery.RawKey, delivery.RawSize)
+		if err != nil {
+			return nil, fmt.Errorf("read webhook raw message: %w", err)
+		}
+		return raw, nil
+	}
+	var raw []byte
+	var rawKey string
+	var size int64
+	row := s.read.QueryRowContext(ctx, `SELECT CASE WHEN raw_key = '' THEN raw ELSE X'' END, raw_key, raw_size
+        FROM messages WHERE id = ?;`, delivery.MessageID)
+	if err := row.Scan(&raw, &rawKey, &size); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("read webhook raw message: %w", err)
+	}
+	if rawKey == "" {
+		return raw, nil
+	}
+	raw, err := s.readBlob(rawKey, size)
+	if err != nil {
+		return nil, fmt.Errorf("read webhook raw message: %w", err)
+	}
+	return raw, nil
+}
+
+// DeleteWebhookDeliveriesBefore prunes finished deliveries created before
+// cutoff from the log. Pending ones are kept however old they are.
+func (s *Store) DeleteWebhookDeliveriesBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	return s.deleteBatch(ctx, "delete webhook deliveries",
+		`DELETE FROM webhook_deliveries WHERE status != ? AND created_at < ?;`,
+		DeliveryPending, cutoff.UnixMilli())
+}
+
+func (s *Store) queryWebhookDeliveries(ctx context.Context, clause string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := s.read.QueryContext(ctx, `SELECT id, webhook, event, message_id, url, payload, include_raw, raw_key, raw_size, status, attempts,
+        next_attempt_at, last_attempt_at, response_code, last_error, created_at
+        FROM webhook_deliveries `+clause+`;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var nextAttemptAt, lastAttemptAt, createdAt int64
+		if err := rows.Scan(&delivery.ID, &delivery.Webhook, &delivery.Event, &delivery.MessageID, &delivery.URL,
+			&delivery.Payload, &delivery.IncludeRaw, &delivery.RawKey, &delivery.RawSize, &delivery.Status, &delivery.Attempts, &nextAttemptAt, &lastAttemptAt,
+			&delivery.ResponseCode, &delivery.LastError, &createdAt); err != nil {
+			return nil, fmt.Errorf("scan webhook delivery: %w", err)
+		}
+		delivery.NextAttemptAt = time.UnixMilli(nextAttemptAt)
+		if lastAttemptAt > 0 {
+			delivery.LastAttemptAt = time.UnixMilli(lastAttemptAt)
+		}
+		delivery.CreatedAt = time.UnixMilli(createdAt)
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,389 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/metrics"
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+// Request headers sent with every delivery. The signature is the hex
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the hook's secret.
+const (
+	HeaderEvent     = "X-LocalSMTP-Event"
+	HeaderDelivery  = "X-LocalSMTP-Delivery"
+	HeaderTimestamp = "X-LocalSMTP-Timestamp"
+	HeaderSignature = "X-LocalSMTP-Signature"
+)
+
+const (
+	initialBackoff = 5 * time.Second
+	maxBackoff     = time.Hour
+	// pollInterval bounds how long the dispatcher sleeps when nothing is
+	// due, so deliveries queued by another process are still picked up.
+	pollInterval = time.Minute
+	batchSize    = 20
+)
+
+type Config struct {
+	MaxAttempts int
+	Timeout     time.Duration
+	// LogRetention is how long finished deliveries stay in the log.
+	LogRetention time.Duration
+}
+
+// Dispatcher queues events for matching hooks and delivers them in the
+// background. A nil Dispatcher ignores every event.
+type Dispatcher struct {
+	store   *store.Store
+	hooks   []compiledHook
+	cfg     Config
+	client  *http.Client
+	metrics *metrics.Metrics
+	logger  *slog.Logger
+	wake    chan struct{}
+}
+
+func New(db *store.Store, hooks []Hook, cfg Config, m *metrics.Metrics, logger *slog.Logger) (*Dispatcher, error) {
+	compiled, err := compile(hooks)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 8
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.LogRetention <= 0 {
+		cfg.LogRetention = 7 * 24 * time.Hour
+	}
+	return &Dispatcher{
+		store:   db,
+		hooks:   compiled,
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		metrics: m,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// Enabled reports whether any hook is configured, so callers can skip
+// loading what an event needs.
+func (d *Dispatcher) Enabled() bool {
+	return d != nil && len(d.hooks) > 0
+}
+
+// Hooks returns the configured hooks without their secrets.
+func (d *Dispatcher) Hooks() []Hook {
+	if d == nil {
+		return nil
+	}
+	hooks := make([]Hook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		hook.Secret = ""
+		hooks = append(hooks, hook.Hook)
+	}
+	return hooks
+}
+
+// Deliveries returns the delivery log, newest first.
+func (d *Dispatcher) Deliveries(ctx context.Context, filter store.DeliveryFilter) ([]store.WebhookDelivery, error) {
+	if d == nil {
+		return nil, nil
+	}
+	return d.store.ListWebhookDeliveries(ctx, filter)
+}
+
+// Lookup loads message id as visible to email for an event of type
+// eventType. Deletes must look the message up before removing it.
+func (d *Dispatcher) Lookup(ctx context.Context, eventType EventType, email, id string) (Event, bool) {
+	if !d.Enabled() {
+		return Event{}, false
+	}
+	message, recipients, _, err := d.store.GetMessage(ctx, email, id)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			d.logger.Warn("webhook load message", "id", id, "error", err)
+		}
+		return Event{}, false
+	}
+	return Event{Type: eventType, Mailbox: email, Message: message, Recipients: recipients}, true
+}
+
+// LookupPurge loads a message.deleted event for each message a purge of
+// email, or of every message when email is empty, is about to remove.
+func (d *Dispatcher) LookupPurge(ctx context.Context, email string) []Event {
+	if !d.Enabled() {
+		return nil
+	}
+	refs, err := d.store.PurgeTargets(ctx, email)
+	if err != nil {
+		d.logger.Warn("webhook load purge targets", "mailbox", email, "error", err)
+		return nil
+	}
+	return d.LookupDeleted(ctx, email, refs)
+}
+
+// LookupDeleted loads a message.deleted event for each message in refs,
+// which mailbox is about to remove. mailbox is empty for removals that are
+// not made by a mailbox, such as retention.
+func (d *Dispatcher) LookupDeleted(ctx context.Context, mailbox string, refs []store.MessageRef) []Event {
+	if !d.Enabled() {
+		return nil
+	}
+	var events []Event
+	for _, ref := range refs {
+		if event, ok := d.Lookup(ctx, MessageDeleted, ref.From, ref.ID); ok {
+			event.Mailbox = mailbox
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Notify publishes an event for message id as visible to email.
+func (d *Dispatcher) Notify(ctx context.Context, eventType EventType, email, id string) {
+	if event, ok := d.Lookup(ctx, eventType, email, id); ok {
+		d.Publish(ctx, event)
+	}
+}
+
+// Publish queues event for every hook it matches. Failures are logged rather
+// than returned, since the action that caused the event already happened.
+func (d *Dispatcher) Publish(ctx context.Context, event Event) {
+	if !d.Enabled() {
+		return
+	}
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	var deliveries []store.WebhookDelivery
+	body, err := buildPayload(event)
+	if err != nil {
+		d.logger.Error("build webhook payload", "event", event.Type, "id", event.Message.ID, "error", err)
+		return
+	}
+	for _, hook := range d.hooks {
+		if !hook.matches(event) {
+			continue
+		}
+		deliveries = append(deliveries, store.WebhookDelivery{
+			Webhook:    hook.Name,
+			Event:      string(event.Type),
+			MessageID:  event.Message.ID,
+			URL:        hook.URL,
+			Payload:    body,
+			IncludeRaw: hook.IncludeRaw,
+			RawKey:     event.Message.RawKey,
+			RawSize:    event.Message.RawSize,
+			CreatedAt:  event.At,
+		})
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	if err := d.store.EnqueueWebhookDeliveries(ctx, deliveries); err != nil {
+		d.logger.Error("queue webhook deliveries", "event", event.Type, "id", event.Message.ID, "error", err)
+		return
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued events until ctx is cancelled, waking early when
+// Publish queues new ones.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.logger.Info("webhook dispatcher started", "webhooks", len(d.hooks), "maxAttempts", d.cfg.MaxAttempts)
+	d.prune(ctx)
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	for {
+		d.deliverDue(ctx)
+		timer := time.NewTimer(d.untilNext(ctx))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.wake:
+		case <-timer.C:
+		case <-prune.C:
+			d.prune(ctx)
+		}
+		timer.Stop()
+	}
+}
+
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		due, err := d.store.DueWebhookDeliveries(ctx, time.Now(), batchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				d.logger.Error("load webhook deliveries", "error", err)
+			}
+			return
+		}
+		for _, delivery := range due {
+			d.attempt(ctx, delivery)
+		}
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) untilNext(ctx context.Context) time.Duration {
+	due, ok, err := d.store.NextWebhookDelivery(ctx)
+	if err != nil || !ok {
+		return pollInterval
+	}
+	return min(max(time.Until(due), 0), pollInterval)
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, delivery store.WebhookDelivery) {
+	now := time.Now()
+	code, err := d.send(ctx, delivery)
+	if ctx.Err() != nil {
+		// Shutting down; the delivery stays due and is retried on restart.
+		return
+	}
+	delivery.ResponseCode = code
+	delivery.LastError = ""
+	switch {
+	case err == nil:
+		delivery.Status = store.DeliveryDelivered
+		d.metrics.WebhookDeliveries.Inc(delivery.Webhook, "delivered")
+	case delivery.Attempts+1 >= d.cfg.MaxAttempts:
+		delivery.Status = store.DeliveryFailed
+		delivery.LastError = err.Error()
+		d.metrics.WebhookDeliveries.Inc(delivery.Webhook, "failed")
+		d.logger.Warn("webhook delivery failed", "webhook", delivery.Webhook, "delivery", delivery.ID, "attempts", delivery.Attempts+1, "error", err)
+	default:
+		delivery.Status = store.DeliveryPending
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(backoff(delivery.Attempts + 1))
+		d.metrics.WebhookDeliveries.Inc(delivery.Webhook, "retry")
+	}
+	if err := d.store.RecordWebhookAttempt(context.WithoutCancel(ctx), delivery, now); err != nil {
+		d.logger.Error("record webhook attempt", "delivery", delivery.ID, "error", err)
+	}
+}
+
+// send posts the delivery and returns the response status. Any status
+// outside 2xx is an error.
+func (d *Dispatcher) send(ctx context.Context, delivery store.WebhookDelivery) (int, error) {
+	hook, ok := d.hook(delivery.Webhook)
+	if !ok {
+		return 0, errors.New("webhook is no longer configured")
+	}
+	body := delivery.Payload
+	if delivery.IncludeRaw {
+		var err error
+		if body, err = d.withRaw(ctx, delivery); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "LocalSMTP-Webhook")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if hook.Secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(hook.Secret, timestamp, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// withRaw adds the raw message to the delivery's payload. A message deleted
+// before the delivery was sent is posted without it.
+func (d *Dispatcher) withRaw(ctx context.Context, delivery store.WebhookDelivery) ([]byte, error) {
+	raw, err := d.store.ReadDeliveryRaw(ctx, delivery)
+	if errors.Is(err, store.ErrNotFound) {
+		d.logger.Warn("webhook raw message is gone", "delivery", delivery.ID, "id", delivery.MessageID)
+		return delivery.Payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var body payload
+	if err := json.Unmarshal(delivery.Payload, &body); err != nil {
+		return nil, fmt.Errorf("decode webhook payload: %w", err)
+	}
+	body.Raw = raw
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("encode webhook payload: %w", err)
+	}
+	return data, nil
+}
+
+func (d *Dispatcher) hook(name string) (compiledHook, bool) {
+	for _, hook := range d.hooks {
+		if hook.Name == name {
+			return hook, true
+		}
+	}
+	return compiledHook{}, false
+}
+
+func (d *Dispatcher) prune(ctx context.Context) {
+	removed, err := d.store.DeleteWebhookDeliveriesBefore(ctx, time.Now().Add(-d.cfg.LogRetention))
+	if err != nil {
+		if ctx.Err() == nil {
+			d.logger.Error("prune webhook deliveries", "error", err)
+		}
+		return
+	}
+	if removed > 0 {
+		d.logger.Info("pruned webhook delivery log", "removed", removed)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>", which receivers
+// compare against the signature header.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff is the wait before retrying after attempts failed attempts.
+func backoff(attempts int) time.Duration {
+	delay := initialBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"message.received"}`)
+	// Computed independently with Python's hmac module.
+	want := "5618156c98e72a18fa973b562ff44de2eca640beaa2b8e040aab1e5e062859e8"
+	if got := Sign("whsec_test", "1700000000", body); got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+	if Sign("whsec_test", "1700000001", body) == want {
+		t.Error("signature does not cover the timestamp")
+	}
+	if Sign("other", "1700000000", body) == want {
+		t.Error("signature does not depend on the secret")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{6, 160 * time.Second},
+		{10, 2560 * time.Second},
+		{11, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tc := range tests {
+		if got := backoff(tc.attempts); got != tc.want {
+			t.Errorf("backoff(%d) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
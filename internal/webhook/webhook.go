@@ -0,0 +1,205 @@
+// Package webhook posts message events to configured URLs. Deliveries are
+// queued in SQLite and retried with exponential backoff, so a receiver that
+// is down for a while still gets every event once it comes back.
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+type EventType string
+
+const (
+	MessageReceived EventType = "message.received"
+	MessageDeleted  EventType = "message.deleted"
+	MessageRead     EventType = "message.read"
+)
+
+// Event is something that happened to a message. Mailbox is the address that
+// read or deleted it and is empty for received messages.
+type Event struct {
+	Type       EventType
+	Mailbox    string
+	Message    store.Message
+	Recipients []store.Recipient
+	At         time.Time
+}
+
+// Hook is one webhook endpoint and the events it wants.
+type Hook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret signs every request with HMAC-SHA256. Empty sends no signature.
+	Secret string `json:"secret,omitempty"`
+	// Events lists the event types to send. Empty sends all of them.
+	Events []EventType `json:"events,omitempty"`
+	// IncludeRaw adds the raw MIME message, base64 encoded, to the payload.
+	IncludeRaw bool `json:"includeRaw,omitempty"`
+	// Recipient and Sender are path.Match patterns such as "*@example.com".
+	// Subject is a regular expression.
+	Recipient string `json:"recipient,omitempty"`
+	Sender    string `json:"sender,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+}
+
+// LoadFile reads a JSON array of hooks. An empty path yields no hooks.
+func LoadFile(name string) ([]Hook, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read webhooks file: %w", err)
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("parse webhooks file: %w", err)
+	}
+	return hooks, nil
+}
+
+type compiledHook struct {
+	Hook
+	subject *regexp.Regexp
+}
+
+func compile(hooks []Hook) ([]compiledHook, error) {
+	compiled := make([]compiledHook, 0, len(hooks))
+	names := map[string]struct{}{}
+	for idx, hook := range hooks {
+		if hook.Name == "" {
+			return nil, fmt.Errorf("webhook %d: name is required", idx)
+		}
+		if _, ok := names[hook.Name]; ok {
+			return nil, fmt.Errorf("webhook %q: duplicate name", hook.Name)
+		}
+		names[hook.Name] = struct{}{}
+		target, err := url.Parse(hook.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("webhook %q: url must be an absolute http or https URL", hook.Name)
+		}
+		for _, event := range hook.Events {
+			switch event {
+			case MessageReceived, MessageDeleted, MessageRead:
+			default:
+				return nil, fmt.Errorf("webhook %q: unknown event %q", hook.Name, event)
+			}
+		}
+		for _, pattern := range []string{hook.Recipient, hook.Sender} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("webhook %q: invalid pattern %q", hook.Name, pattern)
+			}
+		}
+		entry := compiledHook{Hook: hook}
+		if hook.Subject != "" {
+			if entry.subject, err = regexp.Compile(hook.Subject); err != nil {
+				return nil, fmt.Errorf("webhook %q: subject: %w", hook.Name, err)
+			}
+		}
+		compiled = append(compiled, entry)
+	}
+	return compiled, nil
+}
+
+func (h compiledHook) matches(event Event) bool {
+	if len(h.Events) > 0 && !containsEvent(h.Events, event.Type) {
+		return false
+	}
+	if h.Sender != "" && !matchPattern(h.Sender, event.Message.From) {
+		return false
+	}
+	if h.subject != nil && !h.subject.MatchString(event.Message.Subject) {
+		return false
+	}
+	if h.Recipient == "" {
+		return true
+	}
+	for _, recipient := range event.Recipients {
+		if matchPattern(h.Recipient, recipient.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsEvent(events []EventType, event EventType) bool {
+	for _, candidate := range events {
+		if candidate == event {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern, value string) bool {
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && matched
+}
+
+// payload is the JSON body posted for an event.
+type payload struct {
+	Event     EventType      `json:"event"`
+	Timestamp string         `json:"timestamp"`
+	Mailbox   string         `json:"mailbox,omitempty"`
+	Message   messagePayload `json:"message"`
+	// Raw is the base64 encoded MIME message when the hook asks for it. It is
+	// added when the delivery is sent.
+	Raw []byte `json:"raw,omitempty"`
+}
+
+type messagePayload struct {
+	ID        string   `json:"id"`
+	From      string   `json:"from"`
+	To        []string `json:"to"`
+	Cc        []string `json:"cc"`
+	Bcc       []string `json:"bcc"`
+	Routed    []string `json:"routed"`
+	Subject   string   `json:"subject"`
+	Size      int64    `json:"size"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+func buildPayload(event Event) ([]byte, error) {
+	body := payload{
+		Event:     event.Type,
+		Timestamp: event.At.UTC().Format(time.RFC3339Nano),
+		Mailbox:   event.Mailbox,
+		Message: messagePayload{
+			ID:        event.Message.ID,
+			From:      event.Message.From,
+			To:        []string{},
+			Cc:        []string{},
+			Bcc:       []string{},
+			Routed:    []string{},
+			Subject:   event.Message.Subject,
+			Size:      event.Message.RawSize,
+			CreatedAt: event.Message.CreatedAt.UTC().Format(time.RFC3339),
+		},
+	}
+	for _, recipient := range event.Recipients {
+		switch recipient.Type {
+		case "cc":
+			body.Message.Cc = append(body.Message.Cc, recipient.Email)
+		case "bcc":
+			body.Message.Bcc = append(body.Message.Bcc, recipient.Email)
+		case "routed":
+			body.Message.Routed = append(body.Message.Routed, recipient.Email)
+		default:
+			body.Message.To = append(body.Message.To, recipient.Email)
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("encode webhook payload: %w", err)
+	}
+	return data, nil
+}
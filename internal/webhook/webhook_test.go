@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.io/razzkumar/localsmtp/internal/store"
+)
+
+func TestMatches(t *testing.T) {
+	message := store.Message{From: "noreply@shop.example.com", Subject: "Your order #1234 has shipped"}
+	recipients := []store.Recipient{
+		{Email: "alice@example.com", Type: "to"},
+		{Email: "audit@corp.example.com", Type: "bcc"},
+	}
+	tests := []struct {
+		name  string
+		hook  Hook
+		event EventType
+		want  bool
+	}{
+		{name: "no filters", hook: Hook{}, event: MessageRead, want: true},
+		{name: "listed event", hook: Hook{Events: []EventType{MessageReceived, MessageDeleted}}, event: MessageDeleted, want: true},
+		{name: "unlisted event", hook: Hook{Events: []EventType{MessageReceived}}, event: MessageRead, want: false},
+		{name: "sender pattern", hook: Hook{Sender: "*@SHOP.example.com"}, event: MessageReceived, want: true},
+		{name: "other sender", hook: Hook{Sender: "*@bank.example.com"}, event: MessageReceived, want: false},
+		{name: "subject regexp", hook: Hook{Subject: `order #\d+`}, event: MessageReceived, want: true},
+		{name: "subject mismatch", hook: Hook{Subject: `^Reset`}, event: MessageReceived, want: false},
+		{name: "any recipient", hook: Hook{Recipient: "*@corp.example.com"}, event: MessageReceived, want: true},
+		{name: "no matching recipient", hook: Hook{Recipient: "bob@example.com"}, event: MessageReceived, want: false},
+		{
+			name:  "all filters",
+			hook:  Hook{Events: []EventType{MessageReceived}, Sender: "noreply@*", Subject: "shipped", Recipient: "alice@*"},
+			event: MessageReceived,
+			want:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.hook.Name = "test"
+			tc.hook.URL = "http://localhost:9000/hook"
+			hooks, err := compile([]Hook{tc.hook})
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			event := Event{Type: tc.event, Message: message, Recipients: recipients}
+			if got := hooks[0].matches(event); got != tc.want {
+				t.Errorf("matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		hooks []Hook
+	}{
+		{name: "missing name", hooks: []Hook{{URL: "http://localhost/hook"}}},
+		{name: "duplicate name", hooks: []Hook{{Name: "ci", URL: "http://localhost/a"}, {Name: "ci", URL: "http://localhost/b"}}},
+		{name: "relative url", hooks: []Hook{{Name: "ci", URL: "/hook"}}},
+		{name: "other scheme", hooks: []Hook{{Name: "ci", URL: "ftp://localhost/hook"}}},
+		{name: "unknown event", hooks: []Hook{{Name: "ci", URL: "http://localhost/hook", Events: []EventType{"message.sent"}}}},
+		{name: "bad pattern", hooks: []Hook{{Name: "ci", URL: "http://localhost/hook", Recipient: "[a-"}}},
+		{name: "bad subject", hooks: []Hook{{Name: "ci", URL: "http://localhost/hook", Subject: "("}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := compile(tc.hooks); err == nil {
+				t.Error("compile accepted invalid hooks")
+			}
+		})
+	}
+}
+
+func TestBuildPayload(t *testing.T) {
+	data, err := buildPayload(Event{
+		Type:    MessageDeleted,
+		Mailbox: "alice@example.com",
+		Message: store.Message{ID: "m1", From: "sender@example.com", Subject: "Hi", RawSize: 42, CreatedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		Recipients: []store.Recipient{
+			{Email: "alice@example.com", Type: "to"},
+			{Email: "bob@example.com", Type: "cc"},
+			{Email: "carol@example.com", Type: "bcc"},
+			{Email: "qa@example.com", Type: "routed"},
+		},
+		At: time.Date(2024, 3, 2, 8, 30, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("buildPayload: %v", err)
+	}
+	var got payload
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := payload{
+		Event:     MessageDeleted,
+		Timestamp: "2024-03-02T08:30:00Z",
+		Mailbox:   "alice@example.com",
+		Message: messagePayload{
+			ID:        "m1",
+			From:      "sender@example.com",
+			To:        []string{"alice@example.com"},
+			Cc:        []string{"bob@example.com"},
+			Bcc:       []string{"carol@example.com"},
+			Routed:    []string{"qa@example.com"},
+			Subject:   "Hi",
+			Size:      42,
+			CreatedAt: "2024-03-01T12:00:00Z",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("payload = %+v, want %+v", got, want)
+	}
+}
@@ -12,7 +12,7 @@ import {
 } from "./api";
 import type { AccountSummary, MessageDetail, MessageSummary, User } from "./types";
 
-type Box = "inbox" | "sent";
+type Box = "inbox" | "sent" | "all";
 type ViewMode = "html" | "text" | "raw";
 
 const dateFormatter = new Intl.DateTimeFormat("en-US", {
@@ -37,6 +37,7 @@ const emptyMessage: MessageDetail = {
   to: [],
   cc: [],
   bcc: [],
+  routed: [],
   subject: "",
   text: "",
   html: "",
@@ -54,6 +55,7 @@ export default function App() {
   const [activeEmail, setActiveEmail] = useState<string>("");
   const [box, setBox] = useState<Box>("inbox");
   const [messages, setMessages] = useState<MessageSummary[]>([]);
+  const [selectedMailbox, setSelectedMailbox] = useState("");
   const [selectedId, setSelectedId] = useState<string | null>(null);
   const [selectedMessage, setSelectedMessage] = useState<MessageDetail>(emptyMessage);
   const [detailTab, setDetailTab] = useState<ViewMode>("html");
@@ -65,7 +67,7 @@ export default function App() {
   const [error, setError] = useState<string | null>(null);
   const [detailError, setDetailError] = useState<string | null>(null);
   const [hasMore, setHasMore] = useState(true);
-  const pageRef = useRef(1);
+  const cursorRef = useRef<string | null>(null);
   const scrollRef = useRef<HTMLDivElement | null>(null);
   const shouldScrollRef = useRef(false);
   const [composeOpen, setComposeOpen] = useState(false);
@@ -78,16 +80,16 @@ export default function App() {
     setLoading(true);
     setError(null);
     setHasMore(true);
-    pageRef.current = 1;
+    cursorRef.current = null;
     shouldScrollRef.current = false;
     try {
-      const response = await listMessages(activeEmail, box, search, 1, pageSize);
+      const response = await listMessages(activeEmail, box, search, null, pageSize);
       setMessages(response.messages);
       setSelectedId((selected) =>
         selected && response.messages.some((item) => item.id === selected) ? selected : null
       );
       setHasMore(response.hasMore);
-      pageRef.current = response.page;
+      cursorRef.current = response.nextCursor ?? null;
     } catch (err) {
       setError(err instanceof Error ? err.message : "Unable to load messages");
     } finally {
@@ -101,11 +103,10 @@ export default function App() {
     }
     setLoadingMore(true);
     try {
-      const targetPage = pageRef.current + 1;
-      const response = await listMessages(activeEmail, box, search, targetPage, pageSize);
+      const response = await listMessages(activeEmail, box, search, cursorRef.current, pageSize);
       setMessages((current) => [...current, ...response.messages]);
       setHasMore(response.hasMore);
-      pageRef.current = response.page;
+      cursorRef.current = response.nextCursor ?? null;
       shouldScrollRef.current = true;
     } catch (err) {
       setError(err instanceof Error ? err.message : "Unable to load messages");
@@ -167,15 +168,18 @@ export default function App() {
     scrollRef.current?.scrollBy({ top: smoothScrollOffset, behavior: "smooth" });
   }, [messages.length]);
 
+  // In the admin "all" box, messages are opened as the mailbox that has them.
+  const messageEmail = box === "all" && selectedMailbox ? selectedMailbox : activeEmail;
+
   useEffect(() => {
-    if (!selectedId || !user || !activeEmail) {
+    if (!selectedId || !user || !messageEmail) {
       setSelectedMessage(emptyMessage);
       setDetailError(null);
       return;
     }
     setSelectedMessage(emptyMessage);
     setDetailError(null);
-    getMessage(activeEmail, selectedId)
+    getMessage(messageEmail, selectedId)
       .then((message) => {
         setSelectedMessage(message);
         setDetailTab(defaultTab(message));
@@ -188,31 +192,33 @@ export default function App() {
         setDetailError(err instanceof Error ? err.message : "Unable to load message");
         setSelectedMessage(emptyMessage);
       });
-  }, [activeEmail, box, refreshAccounts, selectedId, user]);
+  }, [box, messageEmail, refreshAccounts, selectedId, user]);
 
   useEffect(() => {
-    if (!selectedId || detailTab !== "raw" || !activeEmail) {
+    if (!selectedId || detailTab !== "raw" || !messageEmail) {
       return;
     }
-    getRawMessage(activeEmail, selectedId)
+    getRawMessage(messageEmail, selectedId)
       .then(setRawContent)
       .catch((err) => setRawContent(err instanceof Error ? err.message : ""));
-  }, [activeEmail, detailTab, selectedId]);
+  }, [detailTab, messageEmail, selectedId]);
 
   useEffect(() => {
     if (!user) {
       return undefined;
     }
     const source = new EventSource("/api/stream", { withCredentials: true });
-    source.addEventListener("message", () => {
+    const reload = () => {
       resetMessages();
       refreshAccounts();
-    });
+    };
+    source.addEventListener("message", reload);
+    source.addEventListener("purge", reload);
     return () => source.close();
   }, [refreshAccounts, resetMessages, user]);
 
-  const handleLogin = async (email: string) => {
-    const nextUser = await login(email);
+  const handleLogin = async (email: string, adminSecret = "") => {
+    const nextUser = await login(email, adminSecret);
     setUser(nextUser);
     setActiveEmail(nextUser.email);
     setAccounts(nextUser.emails.map((item) => ({ email: item, unread: 0 })));
@@ -221,7 +227,7 @@ export default function App() {
     setSelectedId(null);
     setSearchInput("");
     setHasMore(true);
-    pageRef.current = 1;
+    cursorRef.current = null;
     shouldScrollRef.current = false;
     setError(null);
     refreshAccounts();
@@ -240,15 +246,15 @@ export default function App() {
     setMessages([]);
     setSelectedId(null);
     setHasMore(true);
-    pageRef.current = 1;
+    cursorRef.current = null;
     setError(null);
   };
 
   const handleDelete = async () => {
-    if (!selectedId || !activeEmail) {
+    if (!selectedId || !messageEmail) {
       return;
     }
-    await deleteMessage(activeEmail, selectedId);
+    await deleteMessage(messageEmail, selectedId);
     setSelectedId(null);
     resetMessages();
     refreshAccounts();
@@ -358,7 +364,7 @@ export default function App() {
                           setSelectedId(null);
                           setMessages([]);
                           setHasMore(true);
-                          pageRef.current = 1;
+                          cursorRef.current = null;
                           shouldScrollRef.current = false;
                         }}
                       >
@@ -391,10 +397,18 @@ export default function App() {
                 >
                   Sent
                 </button>
+                {user.admin && (
+                  <button
+                    className={`tab ${box === "all" ? "active" : ""}`}
+                    onClick={() => setBox("all")}
+                  >
+                    All mail
+                  </button>
+                )}
               </div>
               <input
                 className="search"
-                placeholder="Search subject or address"
+                placeholder="Search, e.g. from:alice has:attachment"
                 value={searchInput}
                 onChange={(event) => setSearchInput(event.target.value)}
               />
@@ -414,16 +428,21 @@ export default function App() {
                   <ul className="message-list">
                     {messages.map((message, index) => {
                       const label =
-                        box === "inbox" ? message.from : message.to.join(", ") || "No recipients";
+                        box === "sent" ? message.to.join(", ") || "No recipients" : message.from;
                       return (
                         <li key={message.id}>
                           <button
                             className={`message-item ${selectedId === message.id ? "selected" : ""}`}
-                            onClick={() => setSelectedId(message.id)}
+                            onClick={() => {
+                              setSelectedId(message.id);
+                              setSelectedMailbox(message.mailbox ?? "");
+                            }}
                             style={{ animationDelay: `${index * 40}ms` }}
                           >
                             <div className="message-title">
                               <span>{label}</span>
+                              {message.tag && <span className="tag">+{message.tag}</span>}
+                              {message.deliveredAs === "bcc" && <span className="tag">Bcc</span>}
                               {message.hasAttachments && <span className="tag">Attachments</span>}
                             </div>
                             <div className="message-subject">{message.subject || "(No subject)"}</div>
@@ -494,6 +513,16 @@ export default function App() {
                         <span>Bcc</span> {selectedMessage.bcc.join(", ")}
                       </p>
                     )}
+                    {selectedMessage.deliveredAs === "bcc" && (
+                      <p className="detail-meta">
+                        <span>Delivered</span> as a blind copy
+                      </p>
+                    )}
+                    {selectedMessage.deliveredAs === "routed" && (
+                      <p className="detail-meta">
+                        <span>Delivered</span> through sub-addressing or an alias
+                      </p>
+                    )}
                     <p className="detail-meta">
                       <span>Received</span>
                       {selectedMessage.createdAt ? formatLongDate(selectedMessage.createdAt) : ""}
@@ -557,7 +586,7 @@ export default function App() {
                           key={attachment.id}
                           className="attachment"
                           href={`/api/messages/${selectedMessage.id}/attachments/${attachment.id}?email=${encodeURIComponent(
-                            activeEmail || user.email
+                            messageEmail || user.email
                           )}`}
                         >
                           <div>
@@ -640,8 +669,9 @@ function arraysEqual(a: string[], b: string[]): boolean {
   return true;
 }
 
-function LoginScreen({ onLogin }: { onLogin: (email: string) => Promise<void> }) {
+function LoginScreen({ onLogin }: { onLogin: (email: string, adminSecret: string) => Promise<void> }) {
   const [email, setEmail] = useState("");
+  const [adminSecret, setAdminSecret] = useState("");
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState<string | null>(null);
 
@@ -650,7 +680,7 @@ function LoginScreen({ onLogin }: { onLogin: (email: string) => Promise<void> })
     setLoading(true);
     setError(null);
     try {
-      await onLogin(email);
+      await onLogin(email, adminSecret);
     } catch (err) {
       setError(err instanceof Error ? err.message : "Unable to login");
     } finally {
@@ -675,6 +705,13 @@ function LoginScreen({ onLogin }: { onLogin: (email: string) => Promise<void> })
             onChange={(event) => setEmail(event.target.value)}
             required
           />
+          <input
+            type="password"
+            placeholder="Admin secret (optional)"
+            autoComplete="off"
+            value={adminSecret}
+            onChange={(event) => setAdminSecret(event.target.value)}
+          />
           <button className="button primary" type="submit" disabled={loading}>
             {loading ? "Signing in..." : "Enter inbox"}
           </button>
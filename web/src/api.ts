@@ -4,9 +4,11 @@ type MessageListResponse = {
   messages: MessageSummary[];
   page: number;
   limit: number;
-  total: number;
+  total?: number;
   hasMore: boolean;
   nextPage: number;
+  nextCursor?: string;
+  prevCursor?: string;
 };
 
 const headers = {
@@ -37,10 +39,10 @@ export async function getMe(): Promise<User> {
   return request<User>("/api/me");
 }
 
-export async function login(email: string): Promise<User> {
+export async function login(email: string, adminSecret = ""): Promise<User> {
   return request<User>("/api/login", {
     method: "POST",
-    body: JSON.stringify({ email }),
+    body: JSON.stringify(adminSecret ? { email, adminSecret } : { email }),
   });
 }
 
@@ -56,7 +58,7 @@ export async function listMessages(
   email: string,
   box: string,
   search: string,
-  page: number,
+  cursor: string | null,
   limit: number
 ): Promise<MessageListResponse> {
   const params = new URLSearchParams();
@@ -65,7 +67,9 @@ export async function listMessages(
   if (search) {
     params.set("search", search);
   }
-  params.set("page", String(page));
+  if (cursor) {
+    params.set("cursor", cursor);
+  }
   params.set("limit", String(limit));
   return request<MessageListResponse>(`/api/messages?${params.toString()}`);
 }
@@ -1,11 +1,13 @@
 export type User = {
   email: string;
   emails: string[];
+  admin?: boolean;
 };
 
 export type AccountSummary = {
   email: string;
   unread: number;
+  unreadBcc?: number;
 };
 
 export type MessageSummary = {
@@ -15,6 +17,10 @@ export type MessageSummary = {
   subject: string;
   createdAt: string;
   hasAttachments: boolean;
+  deliveredAs?: "to" | "cc" | "bcc" | "routed";
+  tag?: string;
+  // mailbox is set in the admin "all" box: the address to open the message as.
+  mailbox?: string;
 };
 
 export type Attachment = {
@@ -30,10 +36,34 @@ export type MessageDetail = {
   to: string[];
   cc: string[];
   bcc: string[];
+  routed: string[];
+  deliveredAs?: "to" | "cc" | "bcc" | "routed";
   subject: string;
   text: string;
   html: string;
   createdAt: string;
   rawSize: number;
+  tls?: {
+    enabled: boolean;
+    version?: string;
+    cipher?: string;
+  };
+  envelope?: Envelope;
   attachments: Attachment[];
 };
+
+export type Envelope = {
+  mailFrom: string;
+  mailParams: Record<string, string>;
+  rcptTo: { address: string; params: Record<string, string> }[];
+  helo: string;
+  remoteAddr: string;
+  authUsername?: string;
+  authProject?: string;
+  tls: {
+    enabled: boolean;
+    version?: string;
+    cipher?: string;
+  };
+  receivedAt: string;
+};